@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+import (
+	"geo"
+	"geotag"
+	"options"
+	_ "readers"
+	"trackfilter"
+	"types"
+)
+
+var GitCommit = "local"
+var GitTag = "0.0.0"
+
+func getVersion() string {
+	return fmt.Sprintf("%s %s commit:%s", filepath.Base(os.Args[0]), GitTag, GitCommit)
+}
+
+func photo_files(dir string) []string {
+	var fns []string
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		log.Fatalf("fl2geotag: %+v\n", err)
+	}
+	for _, e := range ents {
+		if e.Type().IsRegular() {
+			switch strings.ToLower(filepath.Ext(e.Name())) {
+			case ".jpg", ".jpeg":
+				fns = append(fns, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	sort.Strings(fns)
+	return fns
+}
+
+func main() {
+	files, _ := options.ParseCLI(getVersion)
+	if len(files) == 0 || options.Config.PhotoDir == "" {
+		options.Usage()
+		os.Exit(1)
+	}
+
+	geo.Frobnicate_init()
+	fspec, err := trackfilter.ParseSpec(options.Config.Filter)
+	if err != nil {
+		log.Fatalf("fl2geotag: %+v\n", err)
+	}
+	options.Config.Tmpdir, err = os.MkdirTemp("", ".fl2x")
+	if err != nil {
+		log.Fatalf("fl2geotag: %+v\n", err)
+	}
+	defer os.RemoveAll(options.Config.Tmpdir)
+
+	var trk geotag.Track
+	for _, fn := range types.ExpandLogs(files) {
+		lfr, err := types.NewFlightLog(fn)
+		if err != nil {
+			log.Fatalf("fl2geotag: %+v\n", err)
+		}
+		metas, err := lfr.GetMetas()
+		if err != nil {
+			log.Printf("fl2geotag: %s %+v\n", fn, err)
+			continue
+		}
+		for _, b := range metas {
+			if (options.Config.Idx == 0 || options.Config.Idx == b.Index) && b.Flags&types.Is_Valid != 0 {
+				ls, res := lfr.Reader(b, nil)
+				if res {
+					ls, _ = trackfilter.Apply(ls, fspec)
+					trk.AddSegment(ls, b)
+				}
+			}
+		}
+	}
+	if trk.Len() == 0 {
+		log.Fatalln("fl2geotag: no positions in the log(s)")
+	}
+	t0, t1 := trk.Span()
+	fmt.Printf("Track    : %s to %s (%d points)\n", t0.Format(time.RFC3339), t1.Format(time.RFC3339), trk.Len())
+
+	offset := time.Duration(options.Config.PhotoOffset * float64(time.Second))
+	tagged := 0
+	nlocal := 0
+	photos := photo_files(options.Config.PhotoDir)
+	for _, fn := range photos {
+		name := filepath.Base(fn)
+		ts, utc, err := geotag.PhotoTime(fn)
+		if err != nil {
+			fmt.Printf("%s : %v\n", name, err)
+			continue
+		}
+		// Without a time zone, the photo time is the camera's clock,
+		// which is only UTC if the camera is so set
+		if !utc && options.Config.PhotoOffset == 0 {
+			if nlocal == 0 {
+				fmt.Fprintf(os.Stderr, "*** %s (and maybe others) has no time zone; the camera time is taken as UTC, set -photo-offset if the camera is on local time\n", name)
+			}
+			nlocal++
+		}
+		ts = ts.Add(offset)
+		f, ok := trk.Locate(ts)
+		if !ok {
+			fmt.Printf("%s : %s not in the log(s)\n", name, ts.Format(time.RFC3339))
+			continue
+		}
+		hdg := ""
+		if f.HasHdg {
+			hdg = fmt.Sprintf(" %.0f°", f.Hdg)
+		}
+		fmt.Printf("%s : %s %s %.1fm%s", name, ts.Format("15:04:05.00"),
+			geo.PositionFormat(f.Lat, f.Lon, options.Config.Dms), f.Alt, hdg)
+		if !options.Config.DryRun {
+			if options.Config.Xmp {
+				err = geotag.WriteXmp(fn, f, getVersion())
+			} else {
+				err = geotag.WriteExif(fn, f)
+			}
+		}
+		if err != nil {
+			fmt.Printf(" : %v\n", err)
+			continue
+		}
+		fmt.Println()
+		tagged++
+	}
+	fmt.Printf("Tagged   : %d of %d photos\n", tagged, len(photos))
+	if nlocal > 0 {
+		fmt.Printf("Warning  : %d photos without a time zone, camera time taken as UTC\n", nlocal)
+	}
+}
@@ -9,15 +9,12 @@ import (
 )
 
 import (
-	"aplog"
-	"bbl"
-	"bltlog"
 	"bltmqtt"
 	"geo"
 	"ltmgen"
-	"mwpjson"
 	"options"
-	"otx"
+	_ "readers"
+	"trackfilter"
 	"types"
 )
 
@@ -37,28 +34,22 @@ func main() {
 	}
 
 	geo.Frobnicate_init()
+	fspec, err := trackfilter.ParseSpec(options.Config.Filter)
+	if err != nil {
+		log.Fatalf("fl2mqtt: %+v\n", err)
+	}
+	options.Config.Tmpdir, err = os.MkdirTemp("", ".fl2x")
+	if err != nil {
+		log.Fatalf("fl2mqtt: %+v\n", err)
+	}
+	defer os.RemoveAll(options.Config.Tmpdir)
 
 	var lfr types.FlightLog
-	for _, fn := range files {
-		ftype := types.EvinceFileType(fn)
-		switch ftype {
-		case types.IS_OTX:
-			l := otx.NewOTXReader(fn)
-			lfr = &l
-		case types.IS_BBL:
-			l := bbl.NewBBLReader(fn)
-			lfr = &l
-		case types.IS_BLT:
-			l := bltlog.NewBLTReader(fn)
-			lfr = &l
-		case types.IS_AP:
-			l := aplog.NewAPReader(fn)
-			lfr = &l
-		case types.IS_MWP:
-			l := mwpjson.NewMWPJSONReader(fn)
-			lfr = &l
-		default:
-			log.Fatal("Unknown log format")
+	for _, fn := range types.ExpandLogs(files) {
+		var err error
+		lfr, err = types.NewFlightLog(fn)
+		if err != nil {
+			log.Fatalf("fl2x: %+v\n", err)
 		}
 		metas, err := lfr.GetMetas()
 		if err == nil {
@@ -86,6 +77,7 @@ func main() {
 						case strings.HasPrefix(app, "fl2mqtt"):
 							ls, res := lfr.Reader(metas[options.Config.Idx-1], nil)
 							if res {
+								ls, _ = trackfilter.Apply(ls, fspec)
 								bltmqtt.MQTTGen(ls, metas[options.Config.Idx-1])
 							}
 						case strings.HasPrefix(app, "fl2ltm"):
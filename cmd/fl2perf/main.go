@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+import (
+	"geo"
+	"options"
+	"perf"
+	_ "readers"
+	"trackfilter"
+	"types"
+	"wind"
+)
+
+var GitCommit = "local"
+var GitTag = "0.0.0"
+
+func getVersion() string {
+	return fmt.Sprintf("%s %s commit:%s", filepath.Base(os.Args[0]), GitTag, GitCommit)
+}
+
+func show_curve(title string, c *perf.Curve) {
+	bins := c.Bins()
+	if len(bins) == 0 {
+		return
+	}
+	fmt.Printf("  %-7s  %7s  %9s  %7s\n", title, "Samples", "Power (W)", "Wh/km")
+	for _, b := range bins {
+		fmt.Printf("  %5.0f    %7d  %9.1f  %7.2f\n", b.Speed, b.N, b.Power, b.Whkm())
+	}
+	se, sr := c.Best()
+	f := c.Fit()
+	if f.Ok {
+		fmt.Printf("  Fit            : P = %.1f + %.5f.v³ + %.1f/v\n", f.C, f.A, f.B)
+		fmt.Printf("  Best endurance : %.1f m/s (%.1f W), bins %.0f m/s\n", f.Endurance, f.Power(f.Endurance), se)
+		fmt.Printf("  Best range     : %.1f m/s (%.2f Wh/km), bins %.0f m/s\n", f.Range, f.Power(f.Range)/f.Range/3.6, sr)
+	} else if se > 0 {
+		fmt.Printf("  Fit            : none (too few bins or no minimum)\n")
+		fmt.Printf("  Best endurance : bins %.0f m/s\n", se)
+		fmt.Printf("  Best range     : bins %.0f m/s\n", sr)
+	}
+	fmt.Println()
+}
+
+func write_csv(fn string, crafts []*perf.Craft) error {
+	fh, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	fmt.Fprintln(fh, "craft,speed_type,speed,samples,power,whkm")
+	for _, c := range crafts {
+		for _, k := range []struct {
+			name string
+			c    *perf.Curve
+		}{{"ground", &c.Ground}, {"air", &c.Air}} {
+			for _, b := range k.c.Bins() {
+				fmt.Fprintf(fh, "%q,%s,%.1f,%d,%.2f,%.3f\n", c.Name, k.name, b.Speed, b.N, b.Power, b.Whkm())
+			}
+		}
+	}
+	return nil
+}
+
+func main() {
+	files, _ := options.ParseCLI(getVersion)
+	if len(files) == 0 {
+		options.Usage()
+		os.Exit(1)
+	}
+
+	geo.Frobnicate_init()
+	fspec, err := trackfilter.ParseSpec(options.Config.Filter)
+	if err != nil {
+		log.Fatalf("fl2perf: %+v\n", err)
+	}
+	options.Config.Tmpdir, err = os.MkdirTemp("", ".fl2x")
+	if err != nil {
+		log.Fatalf("fl2perf: %+v\n", err)
+	}
+	defer os.RemoveAll(options.Config.Tmpdir)
+
+	pf := perf.NewPerf()
+	for _, fn := range types.ExpandLogs(files) {
+		lfr, err := types.NewFlightLog(fn)
+		if err != nil {
+			log.Fatalf("fl2perf: %+v\n", err)
+		}
+		metas, err := lfr.GetMetas()
+		if err != nil {
+			log.Printf("fl2perf: %s %+v\n", fn, err)
+			continue
+		}
+		for _, b := range metas {
+			if (options.Config.Idx == 0 || options.Config.Idx == b.Index) && b.Flags&types.Is_Valid != 0 {
+				ls, res := lfr.Reader(b, nil)
+				if res {
+					ls, _ = trackfilter.Apply(ls, fspec)
+					wind.Estimate(&ls.L)
+					n := pf.Add(ls, b)
+					fmt.Printf("%-8.8s : %s (%d cruise samples)\n", "Log", b.LogName(), n)
+				}
+			}
+		}
+	}
+	fmt.Println()
+
+	crafts := pf.Crafts()
+	if len(crafts) == 0 {
+		log.Fatalln("fl2perf: no cruise samples with voltage and current")
+	}
+	for _, c := range crafts {
+		fmt.Printf("%-8.8s : %s (%d flights, %d samples)\n\n", "Craft", c.Name, c.Flights, c.Samples)
+		show_curve("Ground", &c.Ground)
+		show_curve("Air", &c.Air)
+	}
+	if options.Config.PerfCsv != "" {
+		if err := write_csv(options.Config.PerfCsv, crafts); err != nil {
+			log.Fatalf("fl2perf: %+v\n", err)
+		}
+	}
+}
@@ -9,9 +9,9 @@ import (
 )
 
 import (
-	"bbl"
 	"geo"
 	"options"
+	_ "readers"
 	"sitlgen"
 	"types"
 )
@@ -35,20 +35,23 @@ func main() {
 		}
 	}
 	geo.Frobnicate_init()
+	tmpdir, err := os.MkdirTemp("", ".fl2x")
+	if err != nil {
+		log.Fatalf("fl2x: %+v\n", err)
+	}
+	options.Config.Tmpdir = tmpdir
+	defer os.RemoveAll(tmpdir)
 	var lfr types.FlightLog
-	for _, fn := range files {
-		ftype := types.EvinceFileType(fn)
-		switch ftype {
-		case types.IS_BBL:
-			l := bbl.NewBBLReader(fn)
-			lfr = &l
-		default:
-			log.Fatal("Unknown log format")
+	for _, fn := range types.ExpandLogs(files) {
+		var err error
+		lfr, err = types.NewFlightLog(fn)
+		if err != nil {
+			log.Fatalf("fl2x: %+v\n", err)
 		}
 
 		metas, err := lfr.GetMetas()
 		if err == nil {
-			if metas[0].Acc1G == 0 {
+			if lfr.LogType() == types.LOGBBL && metas[0].Acc1G == 0 {
 				// Old file, refresh the cache
 				currentTime := time.Now().Local()
 				err = os.Chtimes(fn, currentTime, currentTime)
@@ -3,25 +3,25 @@ package main
 import (
 	"fmt"
 	"github.com/yookoala/realpath"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
 import (
-	"aplog"
-	"bbl"
-	"bltlog"
+	"battery"
 	"flsql"
 	"geo"
 	"kmlgen"
-	"mwpjson"
+	"logmerge"
 	"options"
-	"otx"
-	"sqlreader"
+	_ "readers"
+	"trackfilter"
+	"trkgen"
 	"types"
+	"wind"
 )
 
 var GitCommit = "local"
@@ -35,14 +35,44 @@ func main() {
 	dump_log := os.Getenv("DUMP_LOG") != ""
 	files, _ := options.ParseCLI(GetVersion)
 	geo.Frobnicate_init()
+	fspec, err := trackfilter.ParseSpec(options.Config.Filter)
+	if err != nil {
+		log.Fatalf("fl2x: %+v\n", err)
+	}
+	if _, err := kmlgen.ParseTour(options.Config.Tour); err != nil {
+		log.Fatalf("fl2x: %+v\n", err)
+	}
+	switch options.Config.Format {
+	case "", "kml", "geojson", "czml", "gpx", "igc", "html", "srt", "ass":
+	default:
+		log.Fatalf("fl2x: unknown output format \"%s\"\n", options.Config.Format)
+	}
 	if len(files) == 0 {
+		switch options.Config.Format {
+		case "gpx", "igc", "html", "srt", "ass":
+			log.Fatalf("fl2x: %s output requires a log\n", options.Config.Format)
+		}
 		if len(options.Config.Mission) > 0 {
 			outms := kmlgen.GenKmlName(options.Config.Mission, options.Config.MissionIndex)
-			kmlgen.GenerateMissionOnly(outms, GetVersion)
+			switch options.Config.Format {
+			case "geojson":
+				kmlgen.GeneratePlanGeoJSON(outms, GetVersion)
+			case "czml":
+				kmlgen.GeneratePlanCZML(outms, GetVersion)
+			default:
+				kmlgen.GenerateMissionOnly(outms, GetVersion)
+			}
 			show_output(outms)
 		} else if len(options.Config.Cli) > 0 {
 			outms := kmlgen.GenKmlName(options.Config.Cli, 0)
-			kmlgen.GenerateCliOnly(outms, GetVersion)
+			switch options.Config.Format {
+			case "geojson":
+				kmlgen.GeneratePlanGeoJSON(outms, GetVersion)
+			case "czml":
+				kmlgen.GeneratePlanCZML(outms, GetVersion)
+			default:
+				kmlgen.GenerateCliOnly(outms, GetVersion)
+			}
 			show_output(outms)
 		} else {
 			options.Usage()
@@ -50,30 +80,33 @@ func main() {
 		os.Exit(1)
 	}
 
+	options.Config.Tmpdir, err = os.MkdirTemp("", ".fl2x")
+	if err != nil {
+		log.Fatalf("fl2x: %+v\n", err)
+	}
+	defer os.RemoveAll(options.Config.Tmpdir)
+
+	var msegs []types.LogSegment
+	if options.Config.Merge != "" {
+		msegs = read_merge_log(options.Config.Merge)
+	}
+
+	// One database for all the logs (and archive members); the flights of
+	// each log are numbered on from those of the previous
+	var db flsql.DBL
+	use_db := false
+	if options.Config.Sql != "" {
+		db = flsql.NewSQLliteDB(options.Config.Sql)
+		use_db = true
+		defer db.Close()
+	}
+	dbidx := 0
+
 	var lfr types.FlightLog
-	for _, fn := range files {
-		ftype := types.EvinceFileType(fn)
-		switch ftype {
-		case types.IS_OTX:
-			l := otx.NewOTXReader(fn)
-			lfr = &l
-		case types.IS_BBL:
-			l := bbl.NewBBLReader(fn)
-			lfr = &l
-		case types.IS_BLT:
-			l := bltlog.NewBLTReader(fn)
-			lfr = &l
-		case types.IS_AP:
-			l := aplog.NewAPReader(fn)
-			lfr = &l
-		case types.IS_MWP:
-			l := mwpjson.NewMWPJSONReader(fn)
-			lfr = &l
-		case types.IS_SQL:
-			l := sqlreader.NewSQLReader(fn)
-			lfr = &l
-		default:
-			log.Fatalf("%s: unknown log format\n", fn)
+	for _, fn := range types.ExpandLogs(files) {
+		lfr, err = types.NewFlightLog(fn)
+		if err != nil {
+			log.Fatalf("fl2x: %+v\n", err)
 		}
 
 		metas, err := lfr.GetMetas()
@@ -83,20 +116,8 @@ func main() {
 				lfr.Dump()
 				os.Exit(0)
 			}
-			options.Config.Tmpdir, err = ioutil.TempDir("", ".fl2x")
-			if err != nil {
-				log.Fatalf("fl2x: %+v\n", err)
-			}
-			defer os.RemoveAll(options.Config.Tmpdir)
-
-			var db flsql.DBL
-			use_db := false
-			if options.Config.Sql != "" {
-				db = flsql.NewSQLliteDB(options.Config.Sql)
-				use_db = true
-				defer db.Close()
-			}
 
+			dbnext := dbidx
 			for _, b := range metas {
 				outfn := ""
 				if (options.Config.Idx == 0 || options.Config.Idx == b.Index) && b.Flags&types.Is_Valid != 0 {
@@ -106,12 +127,35 @@ func main() {
 						}
 					}
 					ls, res := lfr.Reader(b, nil)
+					if res && len(msegs) > 0 {
+						ls = merge_log(ls, msegs)
+					}
+					var bres battery.Result
+					hasbat := false
+					if res {
+						ls, _ = trackfilter.Apply(ls, fspec)
+						if ls.M == nil {
+							ls.M = make(types.MapRec)
+						}
+						if wind.Estimate(&ls.L) {
+							ls.M["Wind"] = wind.Summary(ls.L) + " (estimated)"
+						}
+						if bres, hasbat = battery.Analyse(ls.L, options.Config.CellVolts); hasbat {
+							for k, v := range bres.Summary() {
+								ls.M[k] = v
+							}
+						}
+					}
 					if res {
 						if dump_log {
 							for _, bi := range ls.L.Items {
 								fmt.Fprintf(os.Stderr, "%+v\n", bi)
 							}
 						} else if use_db {
+							b.Index += dbidx
+							if b.Index > dbnext {
+								dbnext = b.Index
+							}
 							db.Reset()
 							n := len(ls.L.Items)
 							ns := uint64(0)
@@ -140,6 +184,13 @@ func main() {
 							}
 
 							db.Writemeta(b)
+							db.WriteEvents(b.Index, ls.E)
+							if hasbat {
+								db.WriteText(b.Index, "battery", bres.Text())
+								if len(bres.Remain) > 0 {
+									db.WriteText(b.Index, "battery-remain", bres.RemainCSV())
+								}
+							}
 
 							fmt.Printf("%d\t%s\t%.1f\t%d", b.Index, b.Date, b.Duration.Seconds(), nx)
 							if ls.S != "" {
@@ -151,7 +202,24 @@ func main() {
 
 						} else if options.Config.Summary == false {
 							outfn = kmlgen.GenKmlName(b.Logname, b.Index)
-							kmlgen.GenerateKML(ls.H, ls.L, outfn, b, ls.M, GetVersion)
+							switch options.Config.Format {
+							case "geojson":
+								kmlgen.GenerateGeoJSON(ls.H, ls.L, outfn, b, ls.M, ls.E, GetVersion)
+							case "czml":
+								kmlgen.GenerateCZML(ls.H, ls.L, outfn, b, ls.M, ls.E, GetVersion)
+							case "html":
+								kmlgen.GenerateReport(ls.H, ls.L, outfn, b, ls.M, ls.E, GetVersion)
+							case "gpx":
+								trkgen.GenerateGPX(ls, outfn, b, GetVersion)
+							case "igc":
+								trkgen.GenerateIGC(ls, outfn, b, GetVersion)
+							case "srt":
+								trkgen.GenerateSRT(ls, outfn, b, GetVersion)
+							case "ass":
+								trkgen.GenerateASS(ls, outfn, b, GetVersion)
+							default:
+								kmlgen.GenerateKML(ls.H, ls.L, outfn, b, ls.M, ls.E, GetVersion)
+							}
 						}
 					}
 					if !use_db {
@@ -161,21 +229,124 @@ func main() {
 						if s, ok := b.ShowDisarm(); ok {
 							fmt.Printf("%-8.8s : %s\n", "Disarm", s)
 						}
+						if len(ls.E) > 0 {
+							fmt.Printf("%-8.8s : %d\n", "Events", len(ls.E))
+						}
 						if !res {
 							fmt.Fprintf(os.Stderr, "*** skipping KML/Z for log  with no valid geospatial data\n")
 						} else {
 							show_output(outfn)
 						}
+						if options.Config.Series != "" {
+							write_series(lfr, b)
+						}
 						fmt.Println()
 					}
 				}
 			}
+			dbidx = dbnext
 		} else {
 			log.Fatalf("fl2x: %+v\n", err)
 		}
 	}
 }
 
+// Writes the fields selected by -series, a CSV file per table
+func write_series(lfr types.FlightLog, b types.FlightMeta) {
+	s, err := lfr.Series(b, strings.Split(options.Config.Series, ","))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "*** series: %v\n", err)
+		return
+	}
+	if s.Len() == 0 {
+		fmt.Fprintf(os.Stderr, "*** series: no fields selected\n")
+		return
+	}
+	base := kmlgen.GenKmlName(b.Logname, b.Index)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	for _, t := range s.Tables {
+		fn := fmt.Sprintf("%s.%s.csv", base, t.Name)
+		fh, err := os.Create(fn)
+		if err == nil {
+			err = t.WriteCSV(fh)
+			fh.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "*** series: %v\n", err)
+			continue
+		}
+		fmt.Printf("%-8.8s : %s (%d rows)\n", "Series", fn, t.Len())
+	}
+}
+
+// Reads every valid flight from the log to be merged
+func read_merge_log(fn string) []types.LogSegment {
+	var segs []types.LogSegment
+	// A reader may set the mission (BulletGCSS), which is the primary log's
+	mission := options.Config.Mission
+	defer func() {
+		options.Config.Mission = mission
+	}()
+	mfr, err := types.NewFlightLog(fn)
+	if err != nil {
+		log.Fatalf("fl2x: %+v\n", err)
+	}
+	metas, err := mfr.GetMetas()
+	if err != nil {
+		log.Fatalf("fl2x: %+v\n", err)
+	}
+	for _, m := range metas {
+		if m.Flags&types.Is_Valid != 0 {
+			if ls, ok := mfr.Reader(m, nil); ok {
+				ls.M = types.MapRec{"Log": m.LogName()}
+				segs = append(segs, ls)
+			}
+		}
+	}
+	return segs
+}
+
+// Whether merge result r is better than b; a merge whose tracks correlate
+// beats one aligned by time alone, then the more items matched, then the
+// smaller track error
+func better_merge(r, b logmerge.Result) bool {
+	if b.Matched == 0 {
+		return r.Matched > 0
+	}
+	if rc, bc := r.Error >= 0, b.Error >= 0; rc != bc {
+		return rc
+	}
+	if r.Matched != b.Matched {
+		return r.Matched > b.Matched
+	}
+	return r.Error < b.Error
+}
+
+// Merges the best matching flight from the merge log
+func merge_log(ls types.LogSegment, segs []types.LogSegment) types.LogSegment {
+	var best types.LogSegment
+	var bres logmerge.Result
+	var name string
+	for _, s := range segs {
+		ms, res, err := logmerge.Merge(ls, s)
+		if err == nil && better_merge(res, bres) {
+			best = ms
+			bres = res
+			name = s.M["Log"]
+		}
+	}
+	if bres.Matched == 0 {
+		fmt.Fprintf(os.Stderr, "*** No overlapping flight in merge log\n")
+		return ls
+	}
+	if bres.Relative {
+		best.M["Merged"] = fmt.Sprintf("%s, aligned by track", name)
+	} else {
+		best.M["Merged"] = fmt.Sprintf("%s, offset %.1fs", name, bres.Offset.Seconds())
+	}
+	return best
+}
+
 func show_output(outfn string) {
 	if outfn != "" {
 		rp, err := realpath.Realpath(outfn)
@@ -30,6 +30,7 @@ var (
 	homepos string
 	idx     int
 	outfile string
+	format  string
 )
 
 func GetVersion() string {
@@ -84,6 +85,7 @@ Examples:
 	flag.StringVar(&homepos, "home", homepos, "Use home location")
 	flag.StringVar(&outfile, "out", outfile, "Output file")
 	flag.IntVar(&idx, "mission-index", 0, "Mission Index")
+	flag.StringVar(&format, "format", "kml", "Output format [kml, geojson]")
 	flag.Parse()
 	files := flag.Args()
 	if len(files) == 0 {
@@ -133,7 +135,15 @@ Examples:
 		}
 	}
 
-	err := generateKML(mfile, idx, dms, home, cfile)
+	var err error
+	switch format {
+	case "kml":
+		err = generateKML(mfile, idx, dms, home, cfile)
+	case "geojson":
+		err = generateGeoJSON(mfile, idx, home, cfile)
+	default:
+		err = fmt.Errorf("unknown format \"%s\"", format)
+	}
 	if err != nil {
 		log.Fatalf("mission2kmk: %+v\n", err)
 	}
@@ -210,3 +220,51 @@ func generateKML(mfile string, idx int, dms bool, homep []float64, clifile strin
 	k.WriteIndent(w, "", "  ")
 	return err
 }
+
+func generateGeoJSON(mfile string, idx int, homep []float64, clifile string) error {
+	var feats []kmlgen.GeoFeature
+	kname := ""
+	if mfile != "" {
+		kname = filepath.Base(mfile)
+		_, mm, err := mission.Read_Mission_File(mfile)
+		if err != nil {
+			return err
+		}
+		for nm, _ := range mm.Segment {
+			nmx := nm + 1
+			if idx == 0 || nmx == idx {
+				ms := mm.To_mission(nmx)
+				var hpos types.HomeRec
+				if len(homep) >= 2 {
+					hpos.HomeLat = homep[0]
+					hpos.HomeLon = homep[1]
+					hpos.Flags = types.HOME_ARM
+				} else if ms.Metadata.Homey != 0 && ms.Metadata.Homex != 0 {
+					hpos.HomeLat = ms.Metadata.Homey
+					hpos.HomeLon = ms.Metadata.Homex
+					hpos.Flags = types.HOME_ARM
+				}
+				feats = append(feats, kmlgen.Mission_geojson(ms, hpos, nmx)...)
+			}
+		}
+	}
+	if clifile != "" {
+		if mfile == "" {
+			kname = filepath.Base(clifile)
+		}
+		feats = append(feats, kmlgen.Cli_geojson(clifile, nil)...)
+	}
+
+	var err error
+	var w io.WriteCloser
+	if outfile == "-" || outfile == "" {
+		w = os.Stdout
+	} else {
+		w, err = os.Create(outfile)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	return kmlgen.Write_geojson(w, kname, feats)
+}
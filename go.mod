@@ -5,28 +5,41 @@ go 1.24.0
 toolchain go1.24.5
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/mazznoer/colorgrad v0.10.0
 	github.com/twpayne/go-kml v1.5.2
+	github.com/ulikunitz/xz v0.5.15
 	github.com/yookoala/realpath v1.0.0
 )
 
 require (
 	aplog v1.0.0
+	battery v1.0.0
 	bbl v1.0.0
 	bltlog v1.0.0
 	bltmqtt v1.0.0
+	csvlog v1.0.0
 	flsql v1.0.0
 	geo v1.0.0
+	geotag v1.0.0
 	kmlgen v1.0.0
 	log2mission v1.0.0
+	logmerge v1.0.0
 	ltmgen v1.0.0
 	mission v1.0.0
 	mwpjson v1.0.0
 	options v1.0.0
+	perf v1.0.0
 	otx v1.0.0
+	readers v1.0.0
 	sitlgen v1.0.0
 	sqlreader v1.0.0
+	tlog v1.0.0
+	trackfilter v1.0.0
+	trkgen v1.0.0
 	types v1.0.0
+	wind v1.0.0
+	ulog v1.0.0
 )
 
 require (
@@ -93,3 +106,25 @@ replace flsql v1.0.0 => ./pkg/flsql
 replace mwpjson v1.0.0 => ./pkg/mwpjson/
 
 replace sqlreader v1.0.0 => ./pkg/readsql/
+
+replace tlog v1.0.0 => ./pkg/tlog
+
+replace ulog v1.0.0 => ./pkg/ulog
+
+replace readers v1.0.0 => ./pkg/readers
+
+replace csvlog v1.0.0 => ./pkg/csvlog
+
+replace logmerge v1.0.0 => ./pkg/logmerge
+
+replace trackfilter v1.0.0 => ./pkg/trackfilter
+
+replace trkgen v1.0.0 => ./pkg/trkgen
+
+replace geotag v1.0.0 => ./pkg/geotag
+
+replace battery v1.0.0 => ./pkg/battery
+
+replace perf v1.0.0 => ./pkg/perf
+
+replace wind v1.0.0 => ./pkg/wind
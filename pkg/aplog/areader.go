@@ -1,14 +1,13 @@
 package aplog
 
 import (
-	"bufio"
-	"encoding/json"
+	"bytes"
+	"errors"
 	"fmt"
 	"math"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"regexp"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -18,16 +17,6 @@ import (
 	"types"
 )
 
-type MavMeta struct {
-	Type      string  `json:"type"`
-	Timestamp float64 `json:"timestamp"`
-}
-
-type MavLog struct {
-	Meta MavMeta         `json:"meta"`
-	Data json.RawMessage `json:"data"`
-}
-
 type MavAtt struct {
 	DesPitch int64   `json:"DesPitch"`
 	DesRoll  int64   `json:"DesRoll"`
@@ -135,6 +124,38 @@ type MavErr struct {
 	TimeUS int64 `json:"TimeUS"`
 }
 
+// ERR subsystems and EV identifiers, for the event list
+var err_subsys = map[int64]string{
+	2: "Radio", 3: "Compass", 5: "Radio failsafe", 6: "Battery failsafe", 8: "GCS failsafe",
+	9: "Fence failsafe", 10: "Flight mode", 11: "GPS", 12: "Crash check", 16: "EKF check",
+	17: "EKF failsafe", 18: "Barometer", 19: "CPU", 20: "ADSB failsafe", 21: "Terrain",
+	22: "Navigation", 23: "Terrain failsafe", 24: "EKF primary", 25: "Thrust loss",
+	26: "Sensor failsafe", 28: "Pilot input", 29: "Vibration failsafe",
+}
+
+var ev_names = map[int64]string{
+	15: "Auto armed", 17: "Land complete maybe", 18: "Land complete", 19: "Lost GPS",
+	25: "Set home", 28: "Not landed", 41: "Fence floor enabled", 42: "Fence floor disabled",
+	56: "EKF yaw reset", 57: "Avoidance ADSB enabled", 62: "EKF alt reset",
+	63: "Land cancelled by pilot", 71: "Surfaced", 80: "Motor interlock enabled",
+}
+
+type apevent struct {
+	stamp uint64
+	text  string
+}
+
+func err_text(e MavErr) string {
+	name, ok := err_subsys[e.Subsys]
+	if !ok {
+		name = fmt.Sprintf("Subsystem %d", e.Subsys)
+	}
+	if e.Ecode == 0 {
+		return name + " cleared"
+	}
+	return fmt.Sprintf("%s error %d", name, e.Ecode)
+}
+
 type APLOG struct {
 	name string
 	meta []types.FlightMeta
@@ -147,6 +168,18 @@ func NewAPReader(fn string) APLOG {
 	return l
 }
 
+func init() {
+	types.RegisterLogFormat(types.LogFormat{Name: "ArduPilot", Type: types.IS_AP, Probe: probe_log,
+		Reader: func(fn string) types.FlightLog { l := NewAPReader(fn); return &l }})
+}
+
+func probe_log(sig []byte) int {
+	if bytes.HasPrefix(sig, []byte{0xa3, 0x95, 0x80, 0x80, 0x59, 0x46, 0x4d, 0x54}) {
+		return types.PROBE_MAGIC
+	}
+	return types.PROBE_NONE
+}
+
 func (o *APLOG) LogType() byte {
 	return types.LOGARP
 }
@@ -165,45 +198,67 @@ func (o *APLOG) GetDurations() {
 }
 
 func (o *APLOG) Dump() {
+	data, err := types.ReadLog(o.name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "log file %s\n", err)
+		os.Exit(1)
+	}
+	d := new_dfreader(data)
+	for {
+		if _, ok := d.next(); !ok {
+			break
+		}
+	}
+	var a []int
+	for k := range d.fmts {
+		a = append(a, int(k))
+	}
+	sort.Ints(a)
+	for _, k := range a {
+		f := d.fmts[uint8(k)]
+		cols := make([]string, len(f.columns))
+		for j, c := range f.columns {
+			cols[j] = c
+			if j < len(f.units) && f.units[j] != "" {
+				cols[j] = fmt.Sprintf("%s (%s)", c, f.units[j])
+			}
+		}
+		fmt.Printf("%s, %d, %s\n", f.name, f.typ, strings.Join(cols, ", "))
+	}
 }
 
 func metas(logfile string) ([]types.FlightMeta, error) {
 	var metas []types.FlightMeta
-	fi, err := os.Stat(logfile)
+	data, err := types.ReadLog(logfile)
 	if err != nil {
 		return nil, err
 	}
-	size := fi.Size()
-	cmd := exec.Command("mavlogdump.py", "--format", "json", logfile)
-	types.SetSilentProcess(cmd)
-	out, err := cmd.StdoutPipe()
-	defer cmd.Wait()
-	defer out.Close()
-	err = cmd.Start()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start err=%v", err)
-		os.Exit(1)
-	}
+	size := int64(len(data))
 
-	mt := types.FlightMeta{Logname: filepath.Base(logfile), Size: size, Start: 0}
+	mt := types.FlightMeta{Logname: types.LogBase(logfile), Size: size, Start: 0}
 
 	var st time.Time
-	var mlog MavLog
 	nl := 0
-	scanner := bufio.NewScanner(out)
-	scanner.Split(bufio.ScanLines)
-	for scanner.Scan() {
-		text := scanner.Text()
-		if err := json.Unmarshal([]byte(text), &mlog); err == nil {
-			st = time_from_log_stamp(mlog.Meta.Timestamp)
-			if mt.Date.IsZero() {
-				mt.Date = st
-			}
-			if mlog.Meta.Type == "GPS" {
-				nl += 1
-			}
+	d := new_dfreader(data)
+	for {
+		m, ok := d.next()
+		if !ok {
+			break
+		}
+		if m.stamp.IsZero() {
+			continue
+		}
+		st = m.stamp
+		if mt.Date.IsZero() {
+			mt.Date = st
+		}
+		if m.name == "GPS" {
+			nl += 1
 		}
 	}
+	if nl == 0 {
+		err = errors.New("No GPS records in log")
+	}
 
 	mt.Duration = st.Sub(mt.Date)
 	mt.End = nl
@@ -305,15 +360,39 @@ func apmode_normalise(mnum int64) uint8 {
 	return md
 }
 
+// Series reads every time stamped message of the log, as a table per
+// message type, named as the message (e.g. "ATT", "IMU") with its columns.
+// String columns are stored as zero.
+func (lg *APLOG) Series(m types.FlightMeta, sel []string) (*types.Series, error) {
+	data, err := types.ReadLog(lg.name)
+	if err != nil {
+		return nil, err
+	}
+	s := types.NewSeries(sel)
+	tbls := make(map[*dfformat]*types.Table)
+	d := new_dfreader(data)
+	for {
+		mlog, ok := d.next()
+		if !ok {
+			break
+		}
+		if mlog.timeus == 0 {
+			continue
+		}
+		t, ok := tbls[mlog.fmt]
+		if !ok {
+			t = s.AddTable(mlog.name, mlog.fmt.columns)
+			tbls[mlog.fmt] = t
+		}
+		t.Append(mlog.timeus, mlog.vals)
+	}
+	return s, nil
+}
+
 func (lg *APLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegment, bool) {
-	cmd := exec.Command("mavlogdump.py", "--format", "json", lg.name)
-	types.SetSilentProcess(cmd)
-	out, err := cmd.StdoutPipe()
-	defer cmd.Wait()
-	defer out.Close()
-	err = cmd.Start()
+	data, err := types.ReadLog(lg.name)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start err=%v", err)
+		fmt.Fprintf(os.Stderr, "log file %s\n", err)
 		os.Exit(1)
 	}
 
@@ -325,45 +404,60 @@ func (lg *APLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegme
 
 	stats := types.LogStats{}
 	var mrec MavRec
-	var mlog MavLog
 	have_origin := false
 	var llat, llon float64
 	var dt, st, lt uint64
+	// Fields logged, as their messages are seen; see types.FieldMask
+	fields := types.F_STAMP | types.F_UTC | types.F_STATUS | types.F_POS | types.F_GALT |
+		types.F_SPD | types.F_COG | types.F_NUMSAT | types.F_HDOP | types.F_FIX
 
+	var evs types.EventDetector
+	var pending []apevent
 	leffic := 0.0
 	lwhkm := 0.0
 	whacc := 0.0
 
-	re := regexp.MustCompile(": NaN,")
-
-	scanner := bufio.NewScanner(out)
-	scanner.Split(bufio.ScanLines)
-	for scanner.Scan() {
-		text := scanner.Text()
-		t := re.ReplaceAllString(text, ": null,")
-		if err := json.Unmarshal([]byte(t), &mlog); err != nil {
-			continue
+	d := new_dfreader(data)
+	for {
+		mlog, ok := d.next()
+		if !ok {
+			break
 		}
-		switch mlog.Meta.Type {
+		switch mlog.name {
 		case "ATT":
-			json.Unmarshal(mlog.Data, &mrec.a)
+			mlog.unmarshal(&mrec.a)
+			fields |= types.F_ATTITUDE | types.F_CSE
 		case "ORGN":
-			json.Unmarshal(mlog.Data, &mrec.o)
+			mlog.unmarshal(&mrec.o)
 		case "BAT":
-			json.Unmarshal(mlog.Data, &mrec.b)
+			mlog.unmarshal(&mrec.b)
+			fields |= types.F_VOLTS | types.F_AMPS | types.F_ENERGY
 		case "MODE":
-			json.Unmarshal(mlog.Data, &mrec.m)
+			mlog.unmarshal(&mrec.m)
+			fields |= types.F_FMODE
 		case "CTUN":
-			json.Unmarshal(mlog.Data, &mrec.c)
+			mlog.unmarshal(&mrec.c)
+			fields |= types.F_ALT | types.F_THROTTLE
 		case "ERR":
-			json.Unmarshal(mlog.Data, &mrec.err)
+			mlog.unmarshal(&mrec.err)
+			fields |= types.F_HWFAIL
+			pending = append(pending, apevent{mlog.timeus, err_text(mrec.err)})
 		case "EV":
-			json.Unmarshal(mlog.Data, &mrec.ev)
+			mlog.unmarshal(&mrec.ev)
+			// arm / disarm are derived from the status
+			if mrec.ev.ID != 10 && mrec.ev.ID != 11 {
+				name, ok := ev_names[mrec.ev.ID]
+				if !ok {
+					name = fmt.Sprintf("Event %d", mrec.ev.ID)
+				}
+				pending = append(pending, apevent{mlog.timeus, name})
+			}
 		case "RAD":
-			json.Unmarshal(mlog.Data, &mrec.r)
+			mlog.unmarshal(&mrec.r)
+			fields |= types.F_RSSI
 		case "GPS":
-			json.Unmarshal(mlog.Data, &mrec.g)
-			mrec.stamp = time_from_log_stamp(mlog.Meta.Timestamp)
+			mlog.unmarshal(&mrec.g)
+			mrec.stamp = mlog.stamp
 			b, xhave_origin := create_record(mrec, have_origin)
 			if xhave_origin && have_origin == false {
 				homes.HomeLat = b.Hlat
@@ -383,6 +477,13 @@ func (lg *APLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegme
 				b.Vrange = d * 1852.0
 				us := b.Stamp
 				if us > st {
+					// Events are detected on every fix, the items decimated
+					b.SetValid(fields, homes)
+					evs.Check(&b)
+					for _, e := range pending {
+						evs.AddAt(&b, e.stamp, types.EV_LOG, e.text)
+					}
+					pending = nil
 					// Do the plot every 100ms
 					if (us - dt) >= ndelay {
 						c, d = geo.Csedist(homes.HomeLat, homes.HomeLon, b.Lat, b.Lon)
@@ -437,6 +538,7 @@ func (lg *APLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegme
 							ch <- b
 						} else {
 							rec.Items = append(rec.Items, b)
+							rec.Valid |= b.Valid
 						}
 						dt = us
 					}
@@ -462,6 +564,11 @@ func (lg *APLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegme
 
 		}
 	}
+	if n := len(rec.Items); n > 0 {
+		for _, e := range pending {
+			evs.AddAt(&rec.Items[n-1], e.stamp, types.EV_LOG, e.text)
+		}
+	}
 	srec := stats.Summary(lt - st)
 	ls := types.LogSegment{}
 	if ch != nil {
@@ -473,6 +580,7 @@ func (lg *APLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegme
 			ls.L = rec
 			ls.H = homes
 			ls.M = srec
+			ls.E = evs.Events
 		}
 		return ls, ok
 	}
@@ -0,0 +1,325 @@
+package aplog
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// DataFlash (ArduPilot .bin) binary log decoder.
+// Each message is HEAD1 HEAD2 msgid payload, payload layout given by FMT messages
+
+const (
+	df_HEAD1   = 0xa3
+	df_HEAD2   = 0x95
+	df_FMT_ID  = 0x80
+	df_FMT_LEN = 89
+)
+
+// Seconds from Unix to GPS epoch, less the (current) GPS leap seconds
+const df_GPS_EPOCH = 315964800 - 18
+
+type dfformat struct {
+	typ     uint8
+	length  int
+	name    string
+	format  string
+	columns []string
+	units   []string
+	mults   []float64
+}
+
+type dfmsg struct {
+	name   string
+	timeus uint64
+	stamp  time.Time
+	fmt    *dfformat
+	vals   []float64
+	strs   map[string]string
+}
+
+type dfreader struct {
+	data     []byte
+	pos      int
+	fmts     map[uint8]*dfformat
+	fmtus    map[uint8][2]string
+	units    map[byte]string
+	mults    map[byte]float64
+	timebase float64
+	nbad     int
+}
+
+func df_size(c byte) int {
+	switch c {
+	case 'b', 'B', 'M':
+		return 1
+	case 'h', 'H', 'c', 'C', 'g':
+		return 2
+	case 'i', 'I', 'f', 'e', 'E', 'L', 'n':
+		return 4
+	case 'd', 'q', 'Q':
+		return 8
+	case 'N':
+		return 16
+	case 'a', 'Z':
+		return 64
+	default:
+		return -1
+	}
+}
+
+func df_string(b []byte) string {
+	if n := strings.IndexByte(string(b), 0); n != -1 {
+		b = b[:n]
+	}
+	return string(b)
+}
+
+func half_float(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1.0
+	}
+	exp := int((h >> 10) & 0x1f)
+	mant := float64(h & 0x3ff)
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(mant, -24)
+	case 0x1f:
+		return 0
+	default:
+		return sign * math.Ldexp(mant+1024, exp-25)
+	}
+}
+
+func new_dfreader(data []byte) *dfreader {
+	d := &dfreader{data: data}
+	d.fmts = make(map[uint8]*dfformat)
+	d.fmtus = make(map[uint8][2]string)
+	d.units = make(map[byte]string)
+	d.mults = make(map[byte]float64)
+	d.fmts[df_FMT_ID] = &dfformat{typ: df_FMT_ID, length: df_FMT_LEN, name: "FMT",
+		format: "BBnNZ", columns: []string{"Type", "Length", "Name", "Format", "Columns"}}
+	d.find_time_base()
+	return d
+}
+
+// As pymavlink, the time base is established from the first GPS message
+// with a valid week number; messages are then stamped from their TimeUS
+func (d *dfreader) find_time_base() {
+	for {
+		m, ok := d.next()
+		if !ok {
+			break
+		}
+		if m.name == "GPS" {
+			var g MavGPS
+			m.unmarshal(&g)
+			if g.GWk != 0 {
+				t := float64(df_GPS_EPOCH) + float64(g.GWk)*604800 + float64(g.Gms)*0.001
+				d.timebase = t - float64(g.TimeUS)*1e-6
+				break
+			}
+		}
+	}
+	d.pos = 0
+	d.nbad = 0
+}
+
+func (d *dfreader) resync() {
+	d.nbad++
+	d.pos++
+	for d.pos < len(d.data)-2 {
+		if d.data[d.pos] == df_HEAD1 && d.data[d.pos+1] == df_HEAD2 {
+			if _, ok := d.fmts[d.data[d.pos+2]]; ok {
+				return
+			}
+		}
+		d.pos++
+	}
+	d.pos = len(d.data)
+}
+
+func (d *dfreader) next() (*dfmsg, bool) {
+	for d.pos < len(d.data)-3 {
+		if d.data[d.pos] != df_HEAD1 || d.data[d.pos+1] != df_HEAD2 {
+			d.resync()
+			continue
+		}
+		f, ok := d.fmts[d.data[d.pos+2]]
+		if !ok {
+			d.resync()
+			continue
+		}
+		if d.pos+f.length > len(d.data) {
+			d.pos = len(d.data)
+			break
+		}
+		m, ok := d.decode(f, d.data[d.pos+3:d.pos+f.length])
+		if !ok {
+			d.resync()
+			continue
+		}
+		d.pos += f.length
+		switch m.name {
+		case "FMT":
+			d.add_format(m)
+		case "FMTU":
+			typ := uint8(m.value("FmtType"))
+			d.fmtus[typ] = [2]string{m.strs["UnitIds"], m.strs["MultIds"]}
+			if f, ok := d.fmts[typ]; ok {
+				d.apply_units(f)
+			}
+		case "UNIT":
+			d.units[byte(m.value("Id"))] = m.strs["Label"]
+		case "MULT":
+			d.mults[byte(m.value("Id"))] = m.value("Mult")
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+func (d *dfreader) add_format(m *dfmsg) {
+	f := &dfformat{}
+	f.typ = uint8(m.value("Type"))
+	f.length = int(m.value("Length"))
+	f.name = m.strs["Name"]
+	f.format = m.strs["Format"]
+	f.columns = strings.Split(m.strs["Columns"], ",")
+	size := 3
+	for j := 0; j < len(f.format); j++ {
+		n := df_size(f.format[j])
+		if n == -1 {
+			return
+		}
+		size += n
+	}
+	if size != f.length || len(f.columns) != len(f.format) {
+		return
+	}
+	d.fmts[f.typ] = f
+	d.apply_units(f)
+}
+
+func (d *dfreader) apply_units(f *dfformat) {
+	fu, ok := d.fmtus[f.typ]
+	if !ok {
+		return
+	}
+	f.units = make([]string, len(f.columns))
+	f.mults = make([]float64, len(f.columns))
+	for j := range f.columns {
+		if j < len(fu[0]) {
+			f.units[j] = d.units[fu[0][j]]
+		}
+		f.mults[j] = 1.0
+		if j < len(fu[1]) {
+			if v, ok := d.mults[fu[1][j]]; ok && v != 0 {
+				f.mults[j] = v
+			}
+		}
+	}
+}
+
+func (d *dfreader) decode(f *dfformat, b []byte) (*dfmsg, bool) {
+	m := &dfmsg{name: f.name, fmt: f}
+	m.vals = make([]float64, len(f.format))
+	off := 0
+	for j := 0; j < len(f.format); j++ {
+		c := f.format[j]
+		n := df_size(c)
+		if n == -1 || off+n > len(b) {
+			return nil, false
+		}
+		p := b[off : off+n]
+		var v float64
+		switch c {
+		case 'b':
+			v = float64(int8(p[0]))
+		case 'B', 'M':
+			v = float64(p[0])
+		case 'h':
+			v = float64(int16(binary.LittleEndian.Uint16(p)))
+		case 'H':
+			v = float64(binary.LittleEndian.Uint16(p))
+		case 'c':
+			v = float64(int16(binary.LittleEndian.Uint16(p))) / 100.0
+		case 'C':
+			v = float64(binary.LittleEndian.Uint16(p)) / 100.0
+		case 'g':
+			v = half_float(binary.LittleEndian.Uint16(p))
+		case 'i':
+			v = float64(int32(binary.LittleEndian.Uint32(p)))
+		case 'I':
+			v = float64(binary.LittleEndian.Uint32(p))
+		case 'e':
+			v = float64(int32(binary.LittleEndian.Uint32(p))) / 100.0
+		case 'E':
+			v = float64(binary.LittleEndian.Uint32(p)) / 100.0
+		case 'L':
+			v = float64(int32(binary.LittleEndian.Uint32(p))) / 1e7
+		case 'f':
+			v = float64(math.Float32frombits(binary.LittleEndian.Uint32(p)))
+		case 'd':
+			v = math.Float64frombits(binary.LittleEndian.Uint64(p))
+		case 'q':
+			v = float64(int64(binary.LittleEndian.Uint64(p)))
+		case 'Q':
+			u := binary.LittleEndian.Uint64(p)
+			v = float64(u)
+			if j < len(f.columns) && f.columns[j] == "TimeUS" {
+				m.timeus = u
+			}
+		case 'n', 'N', 'Z':
+			if m.strs == nil {
+				m.strs = make(map[string]string)
+			}
+			if j < len(f.columns) {
+				m.strs[f.columns[j]] = df_string(p)
+			}
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			v = 0
+		}
+		m.vals[j] = v
+		off += n
+	}
+	if m.timeus != 0 {
+		m.stamp = time_from_log_stamp(d.timebase + float64(m.timeus)*1e-6)
+	}
+	return m, true
+}
+
+func (m *dfmsg) value(name string) float64 {
+	for j, c := range m.fmt.columns {
+		if c == name {
+			return m.vals[j]
+		}
+	}
+	return 0
+}
+
+// Fills the Mav* structure from the message, matching field json tags to
+// column names as encoding/json did for the mavlogdump output.
+func (m *dfmsg) unmarshal(v interface{}) {
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		tag := rt.Field(i).Tag.Get("json")
+		for j, c := range m.fmt.columns {
+			if strings.EqualFold(tag, c) {
+				fv := rv.Field(i)
+				switch fv.Kind() {
+				case reflect.Float64:
+					fv.SetFloat(m.vals[j])
+				case reflect.Int64:
+					fv.SetInt(int64(m.vals[j]))
+				}
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package battery
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+import (
+	"types"
+)
+
+// Battery analysis of a flight's voltage and current:
+//   - the cell count, from the voltage at the start of the log
+//   - the pack internal resistance, by regression of voltage against current
+//     within short windows (so the discharge trend does not bias it)
+//   - the cell voltage sag at the maximum current
+//   - the usable capacity to a given rest cell voltage, where the rest
+//     voltage is the loaded voltage plus the IR drop; if the flight did not
+//     reach it, it is extrapolated from the second half of the flight
+//   - the remaining flight time, predicted over the flight from the recent
+//     discharge rate
+
+const (
+	rest_time   = 10 * 1000000 // µs at the start for the rest voltage
+	ir_window   = 20 * 1000000 // µs, regression window
+	rate_window = 60 * 1000000 // µs, discharge rate window
+	remain_step = 10 * 1000000 // µs between remaining time predictions
+	min_samples = 5            // per regression window
+	min_amps_sd = 0.5          // A, current variation needed for the IR
+	min_drop    = 0.05         // V/cell, rest voltage fall needed to extrapolate
+)
+
+type Remain struct {
+	Stamp uint64  // µs from the first item
+	Secs  float64 // predicted remaining flight time
+}
+
+type Result struct {
+	Cells     int
+	Vstart    float64 // pack voltage at the start
+	Vmin      float64 // minimum (loaded) cell voltage
+	HasAmps   bool
+	Imax      float64
+	IR        float64 // pack internal resistance (Ω), 0 if not determined
+	R2        float64 // coefficient of determination of the IR regression
+	Sag       float64 // cell voltage sag at Imax (from the IR)
+	Used      float64 // mAh
+	Wh        float64 // Wh used
+	Duration  float64 // s
+	Vcell     float64 // rest cell voltage defining the usable capacity
+	Usable    float64 // mAh to Vcell, 0 if not estimated
+	UsableWh  float64
+	Reached   bool    // Vcell was reached in the flight (vice extrapolated)
+	Endurance float64 // s, at the flight's mean discharge rate
+	Remain    []Remain
+}
+
+type sample struct {
+	t   uint64
+	v   float64
+	i   float64
+	mah float64
+	wh  float64
+}
+
+func samples(rec types.LogRec) []sample {
+	var ss []sample
+	use_energy := rec.Cap&types.CAP_ENERGY != 0 && rec.Cap&types.CAP_ENERGYC == 0
+	has_amps := rec.Cap&types.CAP_AMPS != 0
+	var mah, wh float64
+	var st, lt uint64
+	for _, b := range rec.Items {
+		if !b.Logged(types.F_VOLTS) || b.Volts <= 0 {
+			continue
+		}
+		if len(ss) == 0 {
+			st = b.Stamp
+			lt = b.Stamp
+		}
+		s := sample{t: b.Stamp - st, v: b.Volts}
+		if has_amps && b.Logged(types.F_AMPS) {
+			s.i = b.Amps
+			dt := float64(b.Stamp-lt) / 1e6
+			mah += b.Amps * dt / 3.6
+			wh += b.Amps * b.Volts * dt / 3600
+		}
+		if use_energy && b.Logged(types.F_ENERGY) && b.Energy > 0 {
+			mah = b.Energy
+		}
+		s.mah = mah
+		s.wh = wh
+		lt = b.Stamp
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+// Pooled within window regression of V against I; returns the resistance
+// and R²
+func internal_resistance(ss []sample) (float64, float64) {
+	var sxx, sxy, syy float64
+	n := 0
+	for j := 0; j < len(ss); {
+		k := j
+		w := ss[j].t / ir_window
+		for k < len(ss) && ss[k].t/ir_window == w {
+			k++
+		}
+		if k-j >= min_samples {
+			var mi, mv float64
+			for _, s := range ss[j:k] {
+				mi += s.i
+				mv += s.v
+			}
+			mi /= float64(k - j)
+			mv /= float64(k - j)
+			for _, s := range ss[j:k] {
+				sxx += (s.i - mi) * (s.i - mi)
+				sxy += (s.i - mi) * (s.v - mv)
+				syy += (s.v - mv) * (s.v - mv)
+			}
+			n += k - j
+		}
+		j = k
+	}
+	if n == 0 || sxx/float64(n) < min_amps_sd*min_amps_sd || sxy >= 0 || syy == 0 {
+		return 0, 0
+	}
+	return -sxy / sxx, sxy * sxy / (sxx * syy)
+}
+
+// Linear fit y = a + bx
+func linfit(xs, ys []float64) (float64, float64, bool) {
+	n := float64(len(xs))
+	var sx, sy, sxx, sxy float64
+	for j := range xs {
+		sx += xs[j]
+		sy += ys[j]
+		sxx += xs[j] * xs[j]
+		sxy += xs[j] * ys[j]
+	}
+	d := n*sxx - sx*sx
+	if n < 2 || d == 0 {
+		return 0, 0, false
+	}
+	b := (n*sxy - sx*sy) / d
+	return (sy - b*sx) / n, b, true
+}
+
+func (r *Result) usable(ss []sample) {
+	vt := r.Vcell * float64(r.Cells)
+	rest := make([]float64, len(ss))
+	for j, s := range ss {
+		rest[j] = s.v + r.IR*s.i
+	}
+	// first crossing of the window averaged rest voltage
+	var sum float64
+	j0 := 0
+	for j, s := range ss {
+		sum += rest[j]
+		for ss[j0].t+ir_window < s.t {
+			sum -= rest[j0]
+			j0++
+		}
+		if s.t >= ir_window && sum/float64(j-j0+1) <= vt {
+			r.Usable, r.UsableWh, r.Reached = s.mah, s.wh, true
+			return
+		}
+	}
+	var xs, ys []float64
+	for j, s := range ss {
+		if s.mah >= r.Used/2 {
+			xs = append(xs, s.mah)
+			ys = append(ys, rest[j])
+		}
+	}
+	// a (near) flat discharge gives no useful extrapolation
+	a, b, ok := linfit(xs, ys)
+	if !ok || -b*(xs[len(xs)-1]-xs[0]) < min_drop*float64(r.Cells) {
+		return
+	}
+	vend := a + b*r.Used
+	r.Usable = r.Used
+	r.UsableWh = r.Wh
+	if vend > vt {
+		r.Usable += (vend - vt) / -b
+		r.UsableWh += (r.Usable - r.Used) / 1000 * (vend + vt) / 2
+	}
+}
+
+func (r *Result) remaining(ss []sample) {
+	j0 := 0
+	next := uint64(0)
+	for _, s := range ss {
+		for ss[j0].t+rate_window < s.t {
+			j0++
+		}
+		if s.t < next || s.t < rate_window {
+			continue
+		}
+		next = s.t + remain_step
+		if rate := (s.mah - ss[j0].mah) / float64(s.t-ss[j0].t); rate > 0 {
+			secs := math.Max(0, (r.Usable-s.mah)/rate/1e6)
+			r.Remain = append(r.Remain, Remain{s.t, secs})
+		}
+	}
+}
+
+// Analyse the flight's battery use; false if the volts were not logged (or
+// the cell count could not be determined). vcell is the rest cell voltage
+// defining the usable capacity.
+func Analyse(rec types.LogRec, vcell float64) (Result, bool) {
+	r := Result{Vcell: vcell}
+	if rec.Cap&types.CAP_VOLTS == 0 {
+		return r, false
+	}
+	ss := samples(rec)
+	if len(ss) < min_samples {
+		return r, false
+	}
+	for _, s := range ss {
+		if s.t < rest_time && s.v > r.Vstart {
+			r.Vstart = s.v
+		}
+	}
+	if r.Cells = types.CellCount(r.Vstart); r.Cells == 0 {
+		return r, false
+	}
+	r.Vmin = r.Vstart
+	for _, s := range ss {
+		r.Vmin = math.Min(r.Vmin, s.v)
+		r.Imax = math.Max(r.Imax, s.i)
+	}
+	r.Vmin /= float64(r.Cells)
+	last := ss[len(ss)-1]
+	r.Duration = float64(last.t) / 1e6
+	r.Used = last.mah
+	r.Wh = last.wh
+	r.HasAmps = rec.Cap&types.CAP_AMPS != 0 && r.Imax > 0
+	if !r.HasAmps {
+		return r, true
+	}
+	r.IR, r.R2 = internal_resistance(ss)
+	r.Sag = r.IR * r.Imax / float64(r.Cells)
+	r.usable(ss)
+	if r.Usable > 0 && r.Used > 0 {
+		r.Endurance = r.Usable * r.Duration / r.Used
+		r.remaining(ss)
+	}
+	return r, true
+}
+
+func show_secs(secs float64) string {
+	s := int(secs + 0.5)
+	return fmt.Sprintf("%02d:%02d", s/60, s%60)
+}
+
+// Summary returns the results as a summary (LogStats.Summary) map
+func (r Result) Summary() types.MapRec {
+	m := make(types.MapRec)
+	m["Battery"] = fmt.Sprintf("%dS, %.2f V at start, min %.2f V/cell", r.Cells, r.Vstart, r.Vmin)
+	if !r.HasAmps {
+		return m
+	}
+	if r.IR > 0 {
+		m["IR"] = fmt.Sprintf("%.1f mΩ (%.1f mΩ/cell, R² %.2f)", r.IR*1000, r.IR*1000/float64(r.Cells), r.R2)
+		m["Sag"] = fmt.Sprintf("%.2f V/cell at %.1f A", r.Sag, r.Imax)
+	}
+	if r.Usable > 0 {
+		how := "extrapolated"
+		if r.Reached {
+			how = "reached"
+		}
+		m["Usable"] = fmt.Sprintf("%.0f mAh, %.1f Wh to %.2f V/cell (%s)", r.Usable, r.UsableWh, r.Vcell, how)
+		m["Remain"] = fmt.Sprintf("%s at end, endurance %s at %.1f A mean", show_secs(math.Max(0, r.Endurance-r.Duration)),
+			show_secs(r.Endurance), r.Used*3.6/r.Duration)
+	}
+	return m
+}
+
+// Text returns the results as "name: value" lines (for the SQL misc table)
+func (r Result) Text() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "cells: %d\nvstart: %.2f\nvmin_cell: %.3f\n", r.Cells, r.Vstart, r.Vmin)
+	if r.HasAmps {
+		fmt.Fprintf(&sb, "imax: %.1f\nused_mah: %.0f\nused_wh: %.2f\n", r.Imax, r.Used, r.Wh)
+		if r.IR > 0 {
+			fmt.Fprintf(&sb, "ir_ohm: %.4f\nir_r2: %.3f\nsag_cell: %.3f\n", r.IR, r.R2, r.Sag)
+		}
+		if r.Usable > 0 {
+			fmt.Fprintf(&sb, "vcell: %.2f\nusable_mah: %.0f\nusable_wh: %.2f\nreached: %v\nendurance_s: %.0f\n",
+				r.Vcell, r.Usable, r.UsableWh, r.Reached, r.Endurance)
+		}
+	}
+	return sb.String()
+}
+
+// RemainCSV returns the remaining time predictions as "secs,remaining" lines
+func (r Result) RemainCSV() string {
+	var sb strings.Builder
+	sb.WriteString("secs,remaining\n")
+	for _, p := range r.Remain {
+		fmt.Fprintf(&sb, "%.0f,%.0f\n", float64(p.Stamp)/1e6, p.Secs)
+	}
+	return sb.String()
+}
@@ -0,0 +1,3 @@
+module battery
+
+go 1.19
@@ -0,0 +1,895 @@
+package bbl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"types"
+)
+
+const (
+	pred_ZERO = iota
+	pred_PREVIOUS
+	pred_STRAIGHT_LINE
+	pred_AVERAGE_2
+	pred_MINTHROTTLE
+	pred_MOTOR_0
+	pred_INC
+	pred_HOME_COORD
+	pred_1500
+	pred_VBATREF
+	pred_LAST_MAIN_FRAME_TIME
+	pred_MINMOTOR
+)
+
+const (
+	enc_SIGNED_VB       = 0
+	enc_UNSIGNED_VB     = 1
+	enc_NEG_14BIT       = 3
+	enc_TAG8_8SVB       = 6
+	enc_TAG2_3S32       = 7
+	enc_TAG8_4S16       = 8
+	enc_NULL            = 9
+	enc_TAG2_3SVARIABLE = 10
+)
+
+const (
+	ev_SYNC_BEEP           = 0
+	ev_INFLIGHT_ADJUSTMENT = 13
+	ev_LOGGING_RESUME      = 14
+	ev_FLIGHT_MODE         = 30
+	ev_LOG_END             = 255
+)
+
+// INAV flightModeFlags bits
+const (
+	fmf_ANGLE       = (1 << 0)
+	fmf_HORIZON     = (1 << 1)
+	fmf_HEADING     = (1 << 2)
+	fmf_NAV_ALTHOLD = (1 << 3)
+	fmf_NAV_RTH     = (1 << 4)
+	fmf_NAV_POSHOLD = (1 << 5)
+	fmf_HEADFREE    = (1 << 6)
+	fmf_NAV_LAUNCH  = (1 << 7)
+	fmf_MANUAL      = (1 << 8)
+	fmf_FAILSAFE    = (1 << 9)
+	fmf_AUTO_TUNE   = (1 << 10)
+	fmf_NAV_WP      = (1 << 11)
+	fmf_NAV_CRUISE  = (1 << 12)
+)
+
+var bbl_marker = []byte("H Product:Blackbox flight data recorder")
+
+type bbfield struct {
+	name      string
+	signed    bool
+	predictor int
+	encoding  int
+}
+
+type bbsysconf struct {
+	fwrevision  string
+	startdt     time.Time
+	iinterval   int64
+	pnum        int64
+	pdenom      int64
+	minthrottle int64
+	minmotor    int64
+	vbatref     int64
+	vbatscale   int64
+	curroffset  int64
+	currscale   int64
+	datavers    int
+	legacy      bool
+}
+
+// A merged main / slow / GPS / home frame, as blackbox_decode --merge-gps
+type bbframe struct {
+	vals   []int64
+	stamp  int64
+	volts  float64
+	amps   float64
+	energy float64
+	utc    time.Time
+}
+
+type bbdecoder struct {
+	data     []byte
+	pos      int
+	end      int
+	sys      bbsysconf
+	fdefs    map[byte][]bbfield
+	mhist    [2][]int64
+	mvalid   bool
+	slow     []int64
+	gps      []int64
+	home     []int64
+	hashome  bool
+	lastiter int64
+	lasttime int64
+	tbase    int64
+	ltraw    int64
+	stamp0   int64
+	lstamp   int64
+	energy   float64
+	idx      bbindex
+	eof      bool
+	corrupt  bool
+	ended    bool
+	nerrs    int
+	errs     strings.Builder
+	frame    bbframe
+	onframe  func(byte, int64, []int64) // if set, called with each S, G, H frame
+	events   []bbevent
+}
+
+// An 'E' frame or decoding error, for the reader's event list
+type bbevent struct {
+	stamp int64
+	kind  types.EventKind
+	text  string
+}
+
+type bbindex struct {
+	iter    int
+	time    int
+	motor0  int
+	vbat    int
+	amps    int
+	coord   [2]int
+	soff    int
+	goff    int
+	hoff    int
+	nfields int
+}
+
+// Returns the byte offsets of each log in a (possibly multi-log) BBL file
+func log_segments(data []byte) [][2]int {
+	var segs [][2]int
+	off := 0
+	for {
+		n := bytes.Index(data[off:], bbl_marker)
+		if n == -1 {
+			break
+		}
+		if len(segs) > 0 {
+			segs[len(segs)-1][1] = off + n
+		}
+		segs = append(segs, [2]int{off + n, len(data)})
+		off += n + len(bbl_marker)
+	}
+	return segs
+}
+
+func new_decoder(data []byte, idx int) (*bbdecoder, error) {
+	segs := log_segments(data)
+	if idx < 1 || idx > len(segs) {
+		return nil, fmt.Errorf("No BBL log for index %d", idx)
+	}
+	d := &bbdecoder{data: data, pos: segs[idx-1][0], end: segs[idx-1][1]}
+	d.fdefs = make(map[byte][]bbfield)
+	d.lastiter = -1
+	err := d.parse_headers()
+	return d, err
+}
+
+func (d *bbdecoder) parse_headers() error {
+	names := make(map[byte][]string)
+	attrs := make(map[string][]int)
+
+	d.sys.iinterval = 1
+	d.sys.pnum = 1
+	d.sys.pdenom = 1
+	d.sys.datavers = 2
+
+	for d.pos < d.end-1 && d.data[d.pos] == 'H' && d.data[d.pos+1] == ' ' {
+		n := bytes.IndexByte(d.data[d.pos:d.end], '\n')
+		if n == -1 {
+			n = d.end - d.pos
+		}
+		line := string(d.data[d.pos+2 : d.pos+n])
+		d.pos += n + 1
+		k := strings.Index(line, ":")
+		if k == -1 {
+			continue
+		}
+		key := line[:k]
+		val := line[k+1:]
+		switch {
+		case strings.HasPrefix(key, "Field "):
+			parts := strings.Fields(key)
+			if len(parts) != 3 || len(parts[1]) != 1 {
+				continue
+			}
+			ft := parts[1][0]
+			if parts[2] == "name" {
+				names[ft] = strings.Split(val, ",")
+			} else {
+				var iv []int
+				for _, s := range strings.Split(val, ",") {
+					v, _ := strconv.Atoi(s)
+					iv = append(iv, v)
+				}
+				attrs[string(ft)+parts[2]] = iv
+			}
+		case key == "I interval":
+			d.sys.iinterval, _ = strconv.ParseInt(val, 10, 64)
+		case key == "P interval":
+			if parts := strings.Split(val, "/"); len(parts) == 2 {
+				d.sys.pnum, _ = strconv.ParseInt(parts[0], 10, 64)
+				d.sys.pdenom, _ = strconv.ParseInt(parts[1], 10, 64)
+			}
+		case key == "P ratio":
+			d.sys.pnum = 1
+			d.sys.pdenom, _ = strconv.ParseInt(val, 10, 64)
+		case key == "Data version":
+			d.sys.datavers, _ = strconv.Atoi(val)
+		case key == "minthrottle":
+			d.sys.minthrottle, _ = strconv.ParseInt(val, 10, 64)
+		case key == "motorOutput":
+			parts := strings.Split(val, ",")
+			d.sys.minmotor, _ = strconv.ParseInt(parts[0], 10, 64)
+		case key == "vbatref":
+			d.sys.vbatref, _ = strconv.ParseInt(val, 10, 64)
+		case key == "vbatscale":
+			d.sys.vbatscale, _ = strconv.ParseInt(val, 10, 64)
+		case key == "currentMeter", key == "currentSensor":
+			if parts := strings.Split(val, ","); len(parts) == 2 {
+				d.sys.curroffset, _ = strconv.ParseInt(parts[0], 10, 64)
+				d.sys.currscale, _ = strconv.ParseInt(parts[1], 10, 64)
+			}
+		case key == "Firmware revision":
+			d.sys.fwrevision = val
+		case key == "Log start datetime":
+			d.sys.startdt, _ = time.Parse(time.RFC3339, val)
+			if d.sys.startdt.Year() < 2000 {
+				d.sys.startdt = time.Time{}
+			}
+		}
+	}
+
+	for _, ft := range []byte{'I', 'G', 'H', 'S'} {
+		nl := names[ft]
+		fl := make([]bbfield, len(nl))
+		for j, s := range nl {
+			fl[j].name = s
+		}
+		d.fdefs[ft] = fl
+	}
+	d.fdefs['P'] = make([]bbfield, len(names['I']))
+	copy(d.fdefs['P'], d.fdefs['I'])
+
+	for _, ft := range []byte{'I', 'P', 'G', 'H', 'S'} {
+		fl := d.fdefs[ft]
+		for j := range fl {
+			if v := attrs[string(ft)+"signed"]; j < len(v) {
+				fl[j].signed = v[j] != 0
+			} else if v := attrs["Isigned"]; ft == 'P' && j < len(v) {
+				fl[j].signed = v[j] != 0
+			}
+			if v := attrs[string(ft)+"predictor"]; j < len(v) {
+				fl[j].predictor = v[j]
+			}
+			if v := attrs[string(ft)+"encoding"]; j < len(v) {
+				fl[j].encoding = v[j]
+			} else {
+				fl[j].encoding = enc_NULL
+			}
+		}
+	}
+
+	if len(d.fdefs['I']) == 0 {
+		return errors.New("No I frame definition in BBL header")
+	}
+
+	if d.sys.iinterval < 1 {
+		d.sys.iinterval = 1
+	}
+	if d.sys.pnum < 1 || d.sys.pdenom < 1 {
+		d.sys.pnum = 1
+		d.sys.pdenom = 1
+	}
+
+	fw := strings.Fields(d.sys.fwrevision)
+	if len(fw) > 1 && fw[0] == "INAV" {
+		maj, _ := strconv.Atoi(strings.Split(fw[1], ".")[0])
+		d.sys.legacy = (maj < 2)
+	} else {
+		d.sys.legacy = true
+	}
+
+	d.build_index()
+	return nil
+}
+
+func (d *bbdecoder) build_index() {
+	d.idx = bbindex{iter: -1, time: -1, motor0: -1, vbat: -1, amps: -1, coord: [2]int{-1, -1}}
+	hdrs = make(map[string]int)
+	n := 0
+	for j, f := range d.fdefs['I'] {
+		switch f.name {
+		case "loopIteration":
+			d.idx.iter = j
+		case "time":
+			d.idx.time = j
+		case "motor[0]":
+			d.idx.motor0 = j
+		case "vbat", "vbatLatest":
+			d.idx.vbat = j
+		case "amperage", "amperageLatest":
+			d.idx.amps = j
+		}
+		hdrs[f.name] = n
+		n++
+	}
+	d.idx.soff = n
+	for _, f := range d.fdefs['S'] {
+		if _, ok := hdrs[f.name]; !ok {
+			hdrs[f.name] = n
+		}
+		n++
+	}
+	d.idx.goff = n
+	for j, f := range d.fdefs['G'] {
+		switch f.name {
+		case "time":
+			hdrs["GPS_time"] = n
+		case "GPS_coord[0]":
+			d.idx.coord[0] = j
+			hdrs[f.name] = n
+		case "GPS_coord[1]":
+			d.idx.coord[1] = j
+			hdrs[f.name] = n
+		default:
+			hdrs[f.name] = n
+		}
+		n++
+	}
+	d.idx.hoff = n
+	for _, f := range d.fdefs['H'] {
+		hdrs[f.name] = n
+		n++
+	}
+	d.idx.nfields = n
+	d.frame.vals = make([]int64, n)
+}
+
+func (d *bbdecoder) read_byte() byte {
+	if d.pos >= d.end {
+		d.eof = true
+		return 0
+	}
+	c := d.data[d.pos]
+	d.pos++
+	return c
+}
+
+func (d *bbdecoder) read_uvb() int64 {
+	var res uint32
+	for shift := uint(0); shift < 35; shift += 7 {
+		c := d.read_byte()
+		res |= uint32(c&0x7f) << shift
+		if c < 0x80 {
+			return int64(res)
+		}
+	}
+	d.corrupt = true
+	return 0
+}
+
+func (d *bbdecoder) read_svb() int64 {
+	u := uint32(d.read_uvb())
+	return int64(int32(u>>1) ^ -int32(u&1))
+}
+
+func sign_extend(v uint32, bits uint) int64 {
+	shift := 32 - bits
+	return int64(int32(v<<shift) >> shift)
+}
+
+func (d *bbdecoder) read_tag2_3s32(vals []int64) {
+	lead := d.read_byte()
+	switch lead >> 6 {
+	case 0:
+		vals[0] = sign_extend(uint32(lead>>4)&3, 2)
+		vals[1] = sign_extend(uint32(lead>>2)&3, 2)
+		vals[2] = sign_extend(uint32(lead)&3, 2)
+	case 1:
+		vals[0] = sign_extend(uint32(lead)&0x0f, 4)
+		lead = d.read_byte()
+		vals[1] = sign_extend(uint32(lead>>4), 4)
+		vals[2] = sign_extend(uint32(lead)&0x0f, 4)
+	case 2:
+		vals[0] = sign_extend(uint32(lead)&0x3f, 6)
+		lead = d.read_byte()
+		vals[1] = sign_extend(uint32(lead)&0x3f, 6)
+		lead = d.read_byte()
+		vals[2] = sign_extend(uint32(lead)&0x3f, 6)
+	case 3:
+		d.read_variable3(lead, vals)
+	}
+}
+
+func (d *bbdecoder) read_variable3(lead byte, vals []int64) {
+	for i := 0; i < 3; i++ {
+		switch lead & 3 {
+		case 0:
+			vals[i] = sign_extend(uint32(d.read_byte()), 8)
+		case 1:
+			b1 := uint32(d.read_byte())
+			b2 := uint32(d.read_byte())
+			vals[i] = sign_extend(b1|(b2<<8), 16)
+		case 2:
+			b1 := uint32(d.read_byte())
+			b2 := uint32(d.read_byte())
+			b3 := uint32(d.read_byte())
+			vals[i] = sign_extend(b1|(b2<<8)|(b3<<16), 24)
+		case 3:
+			b1 := uint32(d.read_byte())
+			b2 := uint32(d.read_byte())
+			b3 := uint32(d.read_byte())
+			b4 := uint32(d.read_byte())
+			vals[i] = int64(int32(b1 | (b2 << 8) | (b3 << 16) | (b4 << 24)))
+		}
+		lead >>= 2
+	}
+}
+
+func (d *bbdecoder) read_tag2_3svariable(vals []int64) {
+	lead := d.read_byte()
+	switch lead >> 6 {
+	case 0:
+		vals[0] = sign_extend(uint32(lead>>4)&3, 2)
+		vals[1] = sign_extend(uint32(lead>>2)&3, 2)
+		vals[2] = sign_extend(uint32(lead)&3, 2)
+	case 1:
+		b1 := uint32(d.read_byte())
+		vals[0] = sign_extend((uint32(lead)&0x3e)>>1, 5)
+		vals[1] = sign_extend(((uint32(lead)&1)<<4)|((b1&0xf0)>>4), 5)
+		vals[2] = sign_extend(b1&0x0f, 4)
+	case 2:
+		b1 := uint32(d.read_byte())
+		b2 := uint32(d.read_byte())
+		vals[0] = sign_extend(((uint32(lead)&0x3f)<<2)|((b1&0xc0)>>6), 8)
+		vals[1] = sign_extend(((b1&0x3f)<<1)|((b2&0x80)>>7), 7)
+		vals[2] = sign_extend(b2&0x7f, 7)
+	case 3:
+		d.read_variable3(lead, vals)
+	}
+}
+
+func (d *bbdecoder) read_tag8_4s16(vals []int64) {
+	if d.sys.datavers < 2 {
+		sel := d.read_byte()
+		for i := 0; i < 4; i++ {
+			switch sel & 3 {
+			case 0:
+				vals[i] = 0
+			case 1:
+				c := uint32(d.read_byte())
+				vals[i] = sign_extend(c&0x0f, 4)
+				if i < 3 {
+					i++
+					vals[i] = sign_extend(c>>4, 4)
+					sel >>= 2
+				}
+			case 2:
+				vals[i] = sign_extend(uint32(d.read_byte()), 8)
+			case 3:
+				b1 := uint32(d.read_byte())
+				b2 := uint32(d.read_byte())
+				vals[i] = sign_extend(b1|(b2<<8), 16)
+			}
+			sel >>= 2
+		}
+		return
+	}
+
+	sel := d.read_byte()
+	nibble := false
+	var buf uint32
+	for i := 0; i < 4; i++ {
+		switch sel & 3 {
+		case 0:
+			vals[i] = 0
+		case 1:
+			if !nibble {
+				buf = uint32(d.read_byte())
+				vals[i] = sign_extend(buf>>4, 4)
+			} else {
+				vals[i] = sign_extend(buf&0x0f, 4)
+			}
+			nibble = !nibble
+		case 2:
+			if !nibble {
+				vals[i] = sign_extend(uint32(d.read_byte()), 8)
+			} else {
+				c1 := (buf << 4) & 0xff
+				buf = uint32(d.read_byte())
+				c1 |= buf >> 4
+				vals[i] = sign_extend(c1, 8)
+			}
+		case 3:
+			if !nibble {
+				c1 := uint32(d.read_byte())
+				c2 := uint32(d.read_byte())
+				vals[i] = sign_extend((c1<<8)|c2, 16)
+			} else {
+				c1 := uint32(d.read_byte())
+				c2 := uint32(d.read_byte())
+				vals[i] = sign_extend(((buf&0x0f)<<12)|(c1<<4)|(c2>>4), 16)
+				buf = c2
+			}
+		}
+		sel >>= 2
+	}
+}
+
+func (d *bbdecoder) read_tag8_8svb(vals []int64, n int) {
+	if n == 1 {
+		vals[0] = d.read_svb()
+		return
+	}
+	hdr := d.read_byte()
+	for i := 0; i < n; i++ {
+		if hdr&1 != 0 {
+			vals[i] = d.read_svb()
+		} else {
+			vals[i] = 0
+		}
+		hdr >>= 1
+	}
+}
+
+func (d *bbdecoder) predict(ft byte, j int, f bbfield, v int64, cur, prev, prev2 []int64, skipped int64) int64 {
+	switch f.predictor {
+	case pred_PREVIOUS:
+		if prev != nil {
+			v += prev[j]
+		}
+	case pred_STRAIGHT_LINE:
+		if prev != nil {
+			v += 2*prev[j] - prev2[j]
+		}
+	case pred_AVERAGE_2:
+		if prev != nil {
+			v += (prev[j] + prev2[j]) / 2
+		}
+	case pred_MINTHROTTLE:
+		v += d.sys.minthrottle
+	case pred_MINMOTOR:
+		v += d.sys.minmotor
+	case pred_MOTOR_0:
+		if d.idx.motor0 >= 0 && d.idx.motor0 < j {
+			v += cur[d.idx.motor0]
+		}
+	case pred_INC:
+		v = skipped + 1
+		if prev != nil {
+			v += prev[j]
+		}
+	case pred_HOME_COORD:
+		if d.hashome && len(d.home) > 1 {
+			if ft == 'G' && j == d.idx.coord[1] {
+				v += d.home[1]
+			} else {
+				v += d.home[0]
+			}
+		}
+	case pred_1500:
+		v += 1500
+	case pred_VBATREF:
+		v += d.sys.vbatref
+	case pred_LAST_MAIN_FRAME_TIME:
+		if d.mhist[0] != nil {
+			v += d.lasttime
+		}
+	}
+	if f.signed {
+		return int64(int32(v))
+	}
+	return int64(uint32(v))
+}
+
+func (d *bbdecoder) parse_frame(ft byte, prev, prev2 []int64, skipped int64) []int64 {
+	fl := d.fdefs[ft]
+	cur := make([]int64, len(fl))
+	var vals [8]int64
+	for j := 0; j < len(fl); {
+		f := fl[j]
+		n := 1
+		switch f.encoding {
+		case enc_SIGNED_VB:
+			vals[0] = d.read_svb()
+		case enc_UNSIGNED_VB:
+			vals[0] = d.read_uvb()
+		case enc_NEG_14BIT:
+			vals[0] = -sign_extend(uint32(d.read_uvb()), 14)
+		case enc_NULL:
+			vals[0] = 0
+		case enc_TAG8_4S16:
+			d.read_tag8_4s16(vals[:4])
+			n = 4
+		case enc_TAG2_3S32:
+			d.read_tag2_3s32(vals[:3])
+			n = 3
+		case enc_TAG2_3SVARIABLE:
+			d.read_tag2_3svariable(vals[:3])
+			n = 3
+		case enc_TAG8_8SVB:
+			for n = 1; j+n < len(fl) && n < 8; n++ {
+				if fl[j+n].encoding != enc_TAG8_8SVB {
+					break
+				}
+			}
+			d.read_tag8_8svb(vals[:n], n)
+		default:
+			d.corrupt = true
+			return cur
+		}
+		for k := 0; k < n && j < len(fl); k++ {
+			cur[j] = d.predict(ft, j, fl[j], vals[k], cur, prev, prev2, skipped)
+			j++
+		}
+	}
+	return cur
+}
+
+func (d *bbdecoder) should_have_frame(n int64) bool {
+	return (n%d.sys.iinterval+d.sys.pnum-1)%d.sys.pdenom < d.sys.pnum
+}
+
+func (d *bbdecoder) count_skipped() int64 {
+	if d.lastiter == -1 {
+		return 0
+	}
+	var n int64
+	for j := d.lastiter + 1; !d.should_have_frame(j) && n < d.sys.iinterval; j++ {
+		n++
+	}
+	return n
+}
+
+func (d *bbdecoder) add_event(kind types.EventKind, text string) {
+	d.events = append(d.events, bbevent{d.tbase + d.lasttime, kind, text})
+}
+
+// Returns (and clears) the events decoded since the last call
+func (d *bbdecoder) take_events() []bbevent {
+	evs := d.events
+	d.events = nil
+	return evs
+}
+
+func (d *bbdecoder) parse_event() {
+	ev := d.read_byte()
+	switch ev {
+	case ev_SYNC_BEEP:
+		d.read_uvb()
+		d.add_event(types.EV_LOG, "Sync beep")
+	case ev_INFLIGHT_ADJUSTMENT:
+		fn := d.read_byte()
+		if fn&0x80 != 0 {
+			if d.pos+4 <= d.end {
+				v := math.Float32frombits(binary.LittleEndian.Uint32(d.data[d.pos:]))
+				d.add_event(types.EV_LOG, fmt.Sprintf("In-flight adjustment %d = %g", fn&0x7f, v))
+			}
+			d.pos += 4
+		} else {
+			v := d.read_svb()
+			d.add_event(types.EV_LOG, fmt.Sprintf("In-flight adjustment %d = %d", fn, v))
+		}
+	case ev_LOGGING_RESUME:
+		d.lastiter = d.read_uvb()
+		d.lasttime = d.read_uvb()
+		d.mvalid = false
+		d.add_event(types.EV_LOG, "Logging resumed")
+	case ev_FLIGHT_MODE:
+		d.read_uvb()
+		d.read_uvb()
+	case ev_LOG_END:
+		if bytes.HasPrefix(d.data[d.pos:d.end], []byte("End of log\x00")) {
+			d.pos += 11
+			d.ended = true
+			d.add_event(types.EV_LOG, "End of log")
+		} else {
+			d.corrupt = true
+		}
+	default:
+		d.corrupt = true
+	}
+}
+
+func is_frame_marker(c byte) bool {
+	switch c {
+	case 'I', 'P', 'G', 'H', 'S', 'E':
+		return true
+	}
+	return false
+}
+
+func (d *bbdecoder) warn(format string, args ...interface{}) {
+	d.nerrs++
+	if d.nerrs <= 32 {
+		fmt.Fprintf(&d.errs, "Warning: "+format+"\n", args...)
+		d.add_event(types.EV_LOGERR, fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *bbdecoder) volts(v int64) float64 {
+	if d.sys.legacy {
+		return float64(v) * 3.3 * float64(d.sys.vbatscale) / (10 * 4095)
+	}
+	return float64(v) / 100.0
+}
+
+func (d *bbdecoder) amperes(v int64) float64 {
+	if d.sys.legacy {
+		if d.sys.currscale == 0 {
+			return 0
+		}
+		mv := (v*3300)/4096 - d.sys.curroffset
+		return float64(mv*10000/d.sys.currscale) / 1000.0
+	}
+	return float64(v) / 100.0
+}
+
+// Iterates over the frames of the log, calling fn with each merged main
+// frame. Iteration ends at the end of the log or if fn returns false.
+func (d *bbdecoder) decode(fn func(*bbframe) bool) {
+	for !d.ended && d.pos < d.end {
+		start := d.pos
+		ft := d.read_byte()
+		d.corrupt = false
+		d.eof = false
+		var cur []int64
+		switch ft {
+		case 'I':
+			cur = d.parse_frame('I', nil, nil, 0)
+		case 'P':
+			cur = d.parse_frame('P', d.mhist[0], d.mhist[1], d.count_skipped())
+		case 'G', 'H', 'S':
+			cur = d.parse_frame(ft, nil, nil, 0)
+		case 'E':
+			d.parse_event()
+		default:
+			if d.mvalid {
+				d.warn("Unexpected frame type 0x%02x at offset %d", ft, start)
+			}
+			d.mvalid = false
+			continue
+		}
+
+		if d.eof {
+			break
+		}
+		if !d.corrupt && !d.ended && d.pos < d.end && !is_frame_marker(d.data[d.pos]) {
+			d.corrupt = true
+		}
+		if d.corrupt {
+			if d.mvalid {
+				d.warn("Corrupt '%c' frame at offset %d", ft, start)
+			}
+			d.mvalid = false
+			d.pos = start + 1
+			continue
+		}
+
+		switch ft {
+		case 'I':
+			d.mhist[1] = cur
+			d.mhist[0] = cur
+			d.mvalid = true
+			d.main_done(cur)
+			if !d.emit(fn) {
+				return
+			}
+		case 'P':
+			if d.mvalid {
+				d.mhist[1] = d.mhist[0]
+				d.mhist[0] = cur
+				d.main_done(cur)
+				if !d.emit(fn) {
+					return
+				}
+			}
+		case 'G':
+			d.gps = cur
+		case 'H':
+			d.home = cur
+			d.hashome = true
+		case 'S':
+			d.slow = cur
+		}
+		if d.onframe != nil && (ft == 'G' || ft == 'H' || ft == 'S') {
+			d.onframe(ft, d.tbase+d.lasttime, cur)
+		}
+	}
+}
+
+// Names of the fields of a frame type
+func (d *bbdecoder) field_names(ft byte) []string {
+	var names []string
+	for _, f := range d.fdefs[ft] {
+		names = append(names, f.name)
+	}
+	return names
+}
+
+func (d *bbdecoder) main_done(cur []int64) {
+	if d.idx.iter != -1 {
+		d.lastiter = cur[d.idx.iter]
+	}
+	if d.idx.time != -1 {
+		d.lasttime = cur[d.idx.time]
+	}
+}
+
+func (d *bbdecoder) emit(fn func(*bbframe) bool) bool {
+	f := &d.frame
+	copy(f.vals, d.mhist[0])
+	for j := d.idx.soff; j < d.idx.nfields; j++ {
+		f.vals[j] = 0
+	}
+	copy(f.vals[d.idx.soff:d.idx.goff], d.slow)
+	copy(f.vals[d.idx.goff:d.idx.hoff], d.gps)
+	copy(f.vals[d.idx.hoff:], d.home)
+
+	// 32bit microsecond timer wraps after ~71 minutes
+	if d.lasttime < d.ltraw && d.ltraw-d.lasttime > math.MaxInt32 {
+		d.tbase += (1 << 32)
+	}
+	d.ltraw = d.lasttime
+	f.stamp = d.tbase + d.lasttime
+	if d.stamp0 == 0 {
+		d.stamp0 = f.stamp
+		d.lstamp = f.stamp
+	}
+
+	f.volts = 0
+	f.amps = 0
+	if d.idx.vbat != -1 {
+		f.volts = d.volts(d.mhist[0][d.idx.vbat])
+	}
+	if d.idx.amps != -1 {
+		f.amps = d.amperes(d.mhist[0][d.idx.amps])
+		d.energy += f.amps * float64(f.stamp-d.lstamp) / 3600000.0
+	}
+	f.energy = d.energy
+	d.lstamp = f.stamp
+
+	if !d.sys.startdt.IsZero() {
+		f.utc = d.sys.startdt.Add(time.Duration(f.stamp-d.stamp0) * time.Microsecond)
+	} else {
+		f.utc = time.Time{}
+	}
+	return fn(f)
+}
+
+// Time span of the main frames in the log
+func (d *bbdecoder) duration() time.Duration {
+	var st, et int64
+	d.decode(func(f *bbframe) bool {
+		if st == 0 {
+			st = f.stamp
+		}
+		et = f.stamp
+		return true
+	})
+	return time.Duration(et-st) * time.Microsecond
+}
+
+func (d *bbdecoder) warnings() string {
+	if d.nerrs > 32 {
+		fmt.Fprintf(&d.errs, "Warning: %d further frame errors\n", d.nerrs-32)
+	}
+	return d.errs.String()
+}
@@ -0,0 +1,96 @@
+package bbl
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testdata/golden.TXT is a small INAV log exercising the main frame
+// encodings (unsigned / signed VB, TAG2_3S32 2 and 4 bit, TAG8_4S16 with
+// nibble packing, TAG8_8SVB, TAG2_3SVARIABLE 5/5/4 and variable width) and
+// predictors (INC, STRAIGHT_LINE, PREVIOUS, AVERAGE_2, MINMOTOR, MOTOR_0).
+// testdata/golden.csv is the main frames as blackbox_decode --raw writes
+// them; it may be regenerated with
+//
+//	blackbox_decode --raw --stdout testdata/golden.TXT > testdata/golden.csv
+
+func read_golden(t *testing.T, fn string) ([]string, [][]int64) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var rows [][]int64
+	for j, l := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		parts := strings.Split(l, ",")
+		if j == 0 {
+			for _, p := range parts {
+				// "time (us)" etc.
+				names = append(names, strings.Fields(p)[0])
+			}
+			continue
+		}
+		var row []int64
+		for _, p := range parts {
+			v, err := strconv.ParseInt(strings.TrimSpace(p), 10, 64)
+			if err != nil {
+				t.Fatalf("%s:%d: %v", fn, j+1, err)
+			}
+			row = append(row, v)
+		}
+		rows = append(rows, row)
+	}
+	return names, rows
+}
+
+func TestDecodeGolden(t *testing.T) {
+	data, err := os.ReadFile("testdata/golden.TXT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, want := read_golden(t, "testdata/golden.csv")
+
+	d, err := new_decoder(data, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// blackbox_decode may add computed columns; the decoded fields are
+	// compared by name
+	fields := d.field_names('I')
+	cols := make([]int, len(fields))
+	for k, f := range fields {
+		cols[k] = -1
+		for c, n := range names {
+			if n == f {
+				cols[k] = c
+			}
+		}
+		if cols[k] == -1 {
+			t.Fatalf("field %s not in golden.csv", f)
+		}
+	}
+
+	var got [][]int64
+	d.decode(func(f *bbframe) bool {
+		got = append(got, append([]int64{}, f.vals[:len(fields)]...))
+		return true
+	})
+	if w := d.warnings(); w != "" {
+		t.Errorf("warnings: %s", w)
+	}
+	if !d.ended {
+		t.Errorf("log end not seen")
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%d frames, want %d", len(got), len(want))
+	}
+	for j := range want {
+		for k, c := range cols {
+			if got[j][k] != want[j][c] {
+				t.Errorf("frame %d %s = %d, want %d", j, fields[k], got[j][k], want[j][c])
+			}
+		}
+	}
+}
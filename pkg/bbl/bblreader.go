@@ -2,14 +2,11 @@ package bbl
 
 import (
 	"bufio"
-	"encoding/csv"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -39,6 +36,18 @@ func NewBBLReader(fn string) BBLOG {
 	return l
 }
 
+func init() {
+	types.RegisterLogFormat(types.LogFormat{Name: "Blackbox", Type: types.IS_BBL, Probe: probe_log,
+		Reader: func(fn string) types.FlightLog { l := NewBBLReader(fn); return &l }})
+}
+
+func probe_log(sig []byte) int {
+	if bytes.Contains(sig, []byte("H Product:Blackbox")) {
+		return types.PROBE_MAGIC
+	}
+	return types.PROBE_NONE
+}
+
 func (o *BBLOG) GetMetas() ([]types.FlightMeta, error) {
 	m, err := types.ReadMetaCache(o.name)
 	if err != nil || options.Config.Nocache {
@@ -63,31 +72,14 @@ func (o *BBLOG) Dump() {
 }
 
 func get_headers(fn string) {
-	cmd := exec.Command(options.Config.Blackbox_decode,
-		"--datetime", "--merge-gps", "--stdout", "--index", "1", fn)
-	types.SetSilentProcess(cmd)
-	out, err := cmd.StdoutPipe()
-
-	defer cmd.Wait()
-	defer out.Close()
-	r := csv.NewReader(out)
-	r.TrimLeadingSpace = true
-	err = cmd.Start()
+	data, err := types.ReadLog(fn)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start err=%v", err)
+		fmt.Fprintf(os.Stderr, "log file %s\n", err)
 		os.Exit(1)
 	}
-	record, err := r.Read()
-	build_headers(record)
-}
-
-func build_headers(record []string) {
-	hdrs = make(map[string]int)
-	for i, s := range record {
-		hdrs[s] = i
-	}
-	if _, ok := hdrs["dateTime"]; !ok {
-		fmt.Fprintln(os.Stderr, "No \"datetime\" header, probably blackbox_decode too old or broken")
+	if _, err = new_decoder(data, 1); err != nil {
+		fmt.Fprintf(os.Stderr, "bbl: %s\n", err)
+		os.Exit(1)
 	}
 }
 
@@ -110,8 +102,7 @@ func dump_headers() {
 
 func metas(fn string) ([]types.FlightMeta, error) {
 	var bes []types.FlightMeta
-	get_headers(fn)
-	r, err := os.Open(fn)
+	r, err := types.OpenLog(fn)
 	if err == nil {
 		var nbes int
 		var loffset int64
@@ -119,7 +110,7 @@ func metas(fn string) ([]types.FlightMeta, error) {
 		var has_vbat bool
 		var has_intp bool
 
-		base := filepath.Base(fn)
+		base := types.LogBase(fn)
 		scanner := bufio.NewScanner(r)
 
 		zero_or_nl := func(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -316,79 +307,39 @@ func metas(fn string) ([]types.FlightMeta, error) {
 }
 
 func get_durations(fn string, meta []types.FlightMeta) {
-	for i := 0; i < len(meta); i++ {
-		meta[i].Duration = get_bb_duration(fn, fmt.Sprintf("%d", i+1))
+	data, err := types.ReadLog(fn)
+	if err != nil {
+		return
 	}
-}
-
-func get_bb_duration(bbfile string, idx string) time.Duration {
-	cmd := exec.Command(options.Config.Blackbox_decode, "--stdout", "--index", idx, bbfile)
-	out, err := cmd.StdoutPipe()
-	defer cmd.Wait()
-	defer out.Close()
-	err = cmd.Start()
-	scanner := bufio.NewScanner(out)
-	i := 0
-	var ssec string
-	var lsec string
-	var line string
-	for scanner.Scan() {
-		line = scanner.Text()
-		if i == 1 {
-			parts := strings.SplitN(line, ",", 3)
-			if len(parts) > 2 {
-				lsec = strings.TrimLeft(parts[1], " ")
-				ssec = lsec
-			}
+	for i := 0; i < len(meta); i++ {
+		if d, err := new_decoder(data, i+1); err == nil {
+			meta[i].Duration = d.duration()
 		}
-		i += 1
-	}
-	parts := strings.SplitN(line, ",", 3)
-	if len(parts) > 2 {
-		lsec = strings.TrimLeft(parts[1], " ")
 	}
-
-	ilsec, _ := strconv.ParseInt(lsec, 10, 64)
-	issec, _ := strconv.ParseInt(ssec, 10, 64)
-	sdiff := ilsec - issec
-	diff := time.Duration(sdiff) * time.Microsecond
-	if err = scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, "reading standard input:", err)
-	}
-	return diff
 }
 
-func get_rec_value(r []string, key string) (string, bool) {
-	var s string
+func get_rec_value(r *bbframe, key string) (int64, bool) {
 	i, ok := hdrs[key]
-	if ok {
-		if i < len(r) {
-			s = r[i]
-		} else {
-			return "", false
-		}
+	if ok && i < len(r.vals) {
+		return r.vals[i], true
 	}
-	return s, ok
+	return 0, false
 }
 
 func dataCapability() uint16 {
 	var ret uint16 = 0
-	if _, ok := hdrs["amperage (A)"]; ok {
-		ret |= types.CAP_AMPS
-	} else if _, ok := hdrs["amperageLatest (A)"]; ok {
-		ret |= types.CAP_AMPS
+	if _, ok := hdrs["amperage"]; ok {
+		ret |= (types.CAP_AMPS | types.CAP_ENERGY)
+	} else if _, ok := hdrs["amperageLatest"]; ok {
+		ret |= (types.CAP_AMPS | types.CAP_ENERGY)
 	}
-	if _, ok := hdrs["vbat (V)"]; ok {
+	if _, ok := hdrs["vbat"]; ok {
 		ret |= types.CAP_VOLTS
-	} else if _, ok = hdrs["vbatLatest (V)"]; ok {
+	} else if _, ok = hdrs["vbatLatest"]; ok {
 		ret |= types.CAP_VOLTS
 	}
 
-	if _, ok := hdrs["energyCumulative (mAh)"]; ok {
-		ret |= types.CAP_ENERGY
-	}
-
-	if _, ok := hdrs["GPS_speed (m/s)"]; ok {
+	if _, ok := hdrs["GPS_speed"]; ok {
 		ret |= types.CAP_SPEED
 	}
 
@@ -405,38 +356,69 @@ func dataCapability() uint16 {
 	return ret
 }
 
-func get_bbl_line(r []string, have_origin bool) types.LogItem {
+// Fields logged, from the headers; see types.FieldMask
+func dataFields() types.FieldMask {
+	ret := types.F_STAMP | types.F_UTC | types.F_FMODE | types.F_STATUS
+	for _, f := range []struct {
+		keys []string
+		mask types.FieldMask
+	}{
+		{[]string{"GPS_coord[0]"}, types.F_POS},
+		{[]string{"GPS_numSat"}, types.F_NUMSAT | types.F_FIX},
+		{[]string{"GPS_fixType"}, types.F_FIX},
+		{[]string{"GPS_hdop"}, types.F_HDOP},
+		{[]string{"GPS_altitude"}, types.F_GALT},
+		{[]string{"GPS_speed"}, types.F_SPD},
+		{[]string{"GPS_ground_course"}, types.F_COG},
+		{[]string{"GPS_home[0]"}, types.F_HOME},
+		{[]string{"navPos[2]", "BaroAlt"}, types.F_ALT},
+		{[]string{"vbat", "vbatLatest"}, types.F_VOLTS},
+		{[]string{"amperage", "amperageLatest"}, types.F_AMPS | types.F_ENERGY},
+		{[]string{"activeWpNumber"}, types.F_WPNO},
+		{[]string{"navState", "navMode"}, types.F_NAVMODE},
+		{[]string{"rcData[0]", "rcCommand[0]"}, types.F_STICKS},
+		{[]string{"rcData[3]"}, types.F_THROTTLE},
+		{[]string{"attitude[0]"}, types.F_ATTITUDE},
+		{[]string{"attitude[2]", "navHeading"}, types.F_CSE},
+		{[]string{"rssi"}, types.F_RSSI},
+		{[]string{"gyroADC[0]"}, types.F_GYRO},
+		{[]string{"accSmooth[0]"}, types.F_ACC},
+		{[]string{"hwHealthStatus"}, types.F_HWFAIL},
+		{[]string{"wind[0]"}, types.F_WIND},
+	} {
+		for _, k := range f.keys {
+			if _, ok := hdrs[k]; ok {
+				ret |= f.mask
+				break
+			}
+		}
+	}
+	return ret
+}
+
+func get_bbl_line(r *bbframe, have_origin bool) types.LogItem {
 	status := types.Is_ARMED
 	b := types.LogItem{}
 
-	s, ok := get_rec_value(r, "GPS_numSat")
+	v, ok := get_rec_value(r, "GPS_numSat")
 	if ok {
-		i64, _ := strconv.Atoi(s)
-		b.Numsat = uint8(i64)
+		b.Numsat = uint8(v)
 	}
 
-	if s, ok = get_rec_value(r, "GPS_hdop"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Hdop = uint16(i64)
+	if v, ok = get_rec_value(r, "GPS_hdop"); ok {
+		b.Hdop = uint16(v)
 	}
 
-	if s, ok = get_rec_value(r, "vbat (V)"); ok {
-		b.Volts, _ = strconv.ParseFloat(s, 64)
-	} else if s, ok = get_rec_value(r, "vbatLatest (V)"); ok {
-		b.Volts, _ = strconv.ParseFloat(s, 64)
-	}
+	b.Volts = r.volts
 
-	if s, ok = get_rec_value(r, "navPos[2]"); ok {
-		b.Alt, _ = strconv.ParseFloat(s, 64)
-		b.Alt = b.Alt / 100.0
-	} else if s, ok = get_rec_value(r, "BaroAlt (cm)"); ok {
-		b.Alt, _ = strconv.ParseFloat(s, 64)
-		b.Alt = b.Alt / 100.0
+	if v, ok = get_rec_value(r, "navPos[2]"); ok {
+		b.Alt = float64(v) / 100.0
+	} else if v, ok = get_rec_value(r, "BaroAlt"); ok {
+		b.Alt = float64(v) / 100.0
 	}
 
-	if s, ok = get_rec_value(r, "GPS_fixType"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Fix = uint8(i64)
+	if v, ok = get_rec_value(r, "GPS_fixType"); ok {
+		b.Fix = uint8(v)
 	} else {
 		if b.Numsat > 5 {
 			b.Fix = 2
@@ -447,70 +429,65 @@ func get_bbl_line(r []string, have_origin bool) types.LogItem {
 		}
 	}
 
-	if s, ok = get_rec_value(r, "GPS_coord[0]"); ok {
-		b.Lat, _ = strconv.ParseFloat(s, 64)
+	if v, ok = get_rec_value(r, "GPS_coord[0]"); ok {
+		b.Lat = float64(v) / 1e7
 	}
 
-	if s, ok = get_rec_value(r, "GPS_coord[1]"); ok {
-		b.Lon, _ = strconv.ParseFloat(s, 64)
+	if v, ok = get_rec_value(r, "GPS_coord[1]"); ok {
+		b.Lon = float64(v) / 1e7
 	}
 
-	if s, ok = get_rec_value(r, "GPS_altitude"); ok {
-		b.GAlt, _ = strconv.ParseFloat(s, 64)
+	if v, ok = get_rec_value(r, "GPS_altitude"); ok {
+		b.GAlt = float64(v)
 	}
 
-	if s, ok = get_rec_value(r, "GPS_speed (m/s)"); ok {
-		b.Spd, _ = strconv.ParseFloat(s, 64)
+	if v, ok = get_rec_value(r, "GPS_speed"); ok {
+		b.Spd = float64(v) / 100.0
 	}
 
-	if s, ok = get_rec_value(r, "time (us)"); ok {
-		i64, _ := strconv.ParseInt(s, 10, 64)
-		b.Stamp = uint64(i64)
-	}
+	b.Stamp = uint64(r.stamp)
 
-	if s, ok = get_rec_value(r, "activeWpNumber"); ok {
-		i64, _ := strconv.ParseInt(s, 10, 64)
-		b.ActiveWP = uint8(i64)
+	if v, ok = get_rec_value(r, "activeWpNumber"); ok {
+		b.ActiveWP = uint8(v)
 	}
 
 	md := uint8(0)
-	s0, sok := get_rec_value(r, "flightModeFlags (flags)")
-	if s, ok = get_rec_value(r, "navState"); ok {
-		i64, _ := strconv.ParseInt(s, 10, 64)
-		if inav.IsCruise3d(inav_vers, int(i64)) {
+	fmf, fok := get_rec_value(r, "flightModeFlags")
+	if v, ok = get_rec_value(r, "navState"); ok {
+		nvs := int(v)
+		if inav.IsCruise3d(inav_vers, nvs) {
 			md = types.FM_CRUISE3D
-		} else if inav.IsCruise2d(inav_vers, int(i64)) {
+		} else if inav.IsCruise2d(inav_vers, nvs) {
 			md = types.FM_CRUISE2D
-		} else if inav.IsRTH(inav_vers, int(i64)) {
+		} else if inav.IsRTH(inav_vers, nvs) {
 			md = types.FM_RTH
-		} else if inav.IsWP(inav_vers, int(i64)) {
+		} else if inav.IsWP(inav_vers, nvs) {
 			md = types.FM_WP
-		} else if inav.IsLand(inav_vers, int(i64)) {
+		} else if inav.IsLand(inav_vers, nvs) {
 			md = types.FM_LAND
-		} else if inav.IsLaunch(inav_vers, int(i64)) {
+		} else if inav.IsLaunch(inav_vers, nvs) {
 			md = types.FM_LAUNCH
-		} else if inav.IsPH(inav_vers, int(i64)) {
+		} else if inav.IsPH(inav_vers, nvs) {
 			md = types.FM_PH
-		} else if inav.IsAH(inav_vers, int(i64)) {
+		} else if inav.IsAH(inav_vers, nvs) {
 			md = types.FM_AH
-		} else if inav.IsEmerg(inav_vers, int(i64)) {
+		} else if inav.IsEmerg(inav_vers, nvs) {
 			md = types.FM_EMERG
 		} else {
-			if strings.Contains(s0, "MANUAL") {
+			if fmf&fmf_MANUAL != 0 {
 				md = types.FM_MANUAL
-			} else if strings.Contains(s0, "ANGLE") {
+			} else if fmf&fmf_ANGLE != 0 {
 				md = types.FM_ANGLE
-			} else if strings.Contains(s0, "HORIZON") {
+			} else if fmf&fmf_HORIZON != 0 {
 				md = types.FM_HORIZON
 			}
 		}
-		b.Navmode = inav.Navmode(inav_vers, int(i64))
+		b.Navmode = inav.Navmode(inav_vers, nvs)
 	}
 
 	// Ancient INAV (pre 1.very-early)
-	if s, ok = get_rec_value(r, "navMode"); ok {
-		i64, _ := strconv.ParseInt(s, 10, 64)
-		switch i64 {
+	if v, ok = get_rec_value(r, "navMode"); ok {
+		switch v {
 		case 3:
 			md = types.FM_PH
 			b.Navmode = 1
@@ -521,170 +498,119 @@ func get_bbl_line(r []string, have_origin bool) types.LogItem {
 	}
 
 	// fallback for old inav bug
-	if sok && strings.Contains(s0, "NAVRTH") {
+	if fok && fmf&fmf_NAV_RTH != 0 {
 		md = types.FM_RTH
 	}
 
 	b.Fmode = md
 	b.Fmtext = types.Mnames[md]
 
-	if s, ok = get_rec_value(r, "failsafePhase (flags)"); ok {
-		if !strings.Contains(s, "IDLE") {
+	if v, ok = get_rec_value(r, "failsafePhase"); ok {
+		if v != 0 {
 			status |= types.Is_FAIL
 		}
 	}
 
 	b.Status = uint8(status)
 
+	hlat, hok := get_rec_value(r, "GPS_home[0]")
+	hlon, _ := get_rec_value(r, "GPS_home[1]")
+	if hok {
+		b.Hlat = float64(hlat) / 1e7
+		b.Hlon = float64(hlon) / 1e7
+	}
 	if !have_origin {
-		b.Hlat = 0
-		b.Hlon = 0
 		b.Vrange = -1
 		b.Bearing = -1
-		if s, ok = get_rec_value(r, "GPS_home_lat"); ok {
-			b.Hlat, _ = strconv.ParseFloat(s, 64)
-		}
-		if s, ok = get_rec_value(r, "GPS_home_lon"); ok {
-			b.Hlon, _ = strconv.ParseFloat(s, 64)
+		// The home direction / distance were computed by blackbox_decode
+		// from GPS_home, so without it, there is no safehome
+		if hok {
 			b.Bearing = -2
-		} else {
-			if s, ok = get_rec_value(r, "homeDirection"); ok {
-				i64, _ := strconv.Atoi(s)
-				b.Bearing = int32(i64)
-			} else {
-				if s, ok = get_rec_value(r, "Azimuth"); ok {
-					i64, _ := strconv.Atoi(s)
-					b.Bearing = int32((i64 + 180) % 360)
-				}
-			}
-
-			if b.Bearing != -1 {
-				if s, ok = get_rec_value(r, "Distance (m)"); ok {
-					b.Vrange, _ = strconv.ParseFloat(s, 64)
-				}
-			}
-		}
-	} else {
-		if s, ok = get_rec_value(r, "GPS_home_lat"); ok {
-			b.Hlat, _ = strconv.ParseFloat(s, 64)
-		}
-		if s, ok = get_rec_value(r, "GPS_home_lon"); ok {
-			b.Hlon, _ = strconv.ParseFloat(s, 64)
 		}
 	}
 
-	if s, ok = get_rec_value(r, "rcData[0]"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Ail = int16(i64)
-		if s, ok = get_rec_value(r, "rcData[1]"); ok {
-			i64, _ := strconv.Atoi(s)
-			b.Ele = int16(i64)
+	if v, ok = get_rec_value(r, "rcData[0]"); ok {
+		b.Ail = int16(v)
+		if v, ok = get_rec_value(r, "rcData[1]"); ok {
+			b.Ele = int16(v)
 		}
-		if s, ok = get_rec_value(r, "rcData[2]"); ok {
-			i64, _ := strconv.Atoi(s)
-			b.Rud = int16(i64)
+		if v, ok = get_rec_value(r, "rcData[2]"); ok {
+			b.Rud = int16(v)
 		}
-		if s, ok = get_rec_value(r, "rcData[3]"); ok {
-			i64, _ := strconv.Atoi(s)
-			b.Thr = int16(i64)
+		if v, ok = get_rec_value(r, "rcData[3]"); ok {
+			b.Thr = int16(v)
 		}
-	} else if s, ok = get_rec_value(r, "rcCommand[0]"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Ail = int16(i64) + 1500
-		if s, ok = get_rec_value(r, "rcCommand[1]"); ok {
-			i64, _ := strconv.Atoi(s)
-			b.Ele = int16(i64) + 1500
+	} else if v, ok = get_rec_value(r, "rcCommand[0]"); ok {
+		b.Ail = int16(v) + 1500
+		if v, ok = get_rec_value(r, "rcCommand[1]"); ok {
+			b.Ele = int16(v) + 1500
 		}
-		if s, ok = get_rec_value(r, "rcCommand[2]"); ok {
-			i64, _ := strconv.Atoi(s)
-			b.Rud = -1*int16(i64) + 1500
+		if v, ok = get_rec_value(r, "rcCommand[2]"); ok {
+			b.Rud = -1*int16(v) + 1500
 		}
-		if s, ok = get_rec_value(r, "rcCommand[3]"); ok {
-			i64, _ := strconv.Atoi(s)
-			b.Thr = int16(i64)
+		if v, ok = get_rec_value(r, "rcCommand[3]"); ok {
+			b.Thr = int16(v)
 		}
 	}
 
-	if s, ok = get_rec_value(r, "attitude[0]"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Roll = int16(i64 / 10)
+	if v, ok = get_rec_value(r, "attitude[0]"); ok {
+		b.Roll = int16(v / 10)
 	}
 
-	if s, ok = get_rec_value(r, "attitude[1]"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Pitch = int16(i64 / 10)
+	if v, ok = get_rec_value(r, "attitude[1]"); ok {
+		b.Pitch = int16(v / 10)
 	}
 
-	if s, ok = get_rec_value(r, "attitude[2]"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Cse = uint32(i64 / 10)
-	} else if s, ok = get_rec_value(r, "navHeading"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Cse = uint32(i64 / 100)
+	if v, ok = get_rec_value(r, "attitude[2]"); ok {
+		b.Cse = uint32(v / 10)
+	} else if v, ok = get_rec_value(r, "navHeading"); ok {
+		b.Cse = uint32(v / 100)
 	}
 
-	if s, ok = get_rec_value(r, "GPS_ground_course"); ok {
-		v, _ := strconv.ParseFloat(s, 64)
-		b.Cog = uint32(v)
+	if v, ok = get_rec_value(r, "GPS_ground_course"); ok {
+		b.Cog = uint32(v / 10)
 	}
 
-	if s, ok = get_rec_value(r, "rssi"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Rssi = uint8(i64 * 100 / 1023)
+	if v, ok = get_rec_value(r, "rssi"); ok {
+		b.Rssi = uint8(v * 100 / 1023)
 	}
 
-	if s, ok = get_rec_value(r, "dateTime"); ok {
-		b.Utc, _ = time.Parse(time.RFC3339Nano, s)
-	}
-
-	if s, ok = get_rec_value(r, "amperage (A)"); ok {
-		b.Amps, _ = strconv.ParseFloat(s, 64)
-	} else if s, ok = get_rec_value(r, "amperageLatest (A)"); ok {
-		b.Amps, _ = strconv.ParseFloat(s, 64)
-	}
+	b.Utc = r.utc
 
-	if s, ok = get_rec_value(r, "energyCumulative (mAh)"); ok {
-		b.Energy, _ = strconv.ParseFloat(s, 64)
-		if b.Energy < 0 {
-			b.Energy = 0
-		}
+	b.Amps = r.amps
+	b.Energy = r.energy
+	if b.Energy < 0 {
+		b.Energy = 0
 	}
 
-	if s, ok = get_rec_value(r, "rcData[3]"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Throttle = int(i64)
+	if v, ok = get_rec_value(r, "rcData[3]"); ok {
+		b.Throttle = int(v)
 		b.Throttle = (b.Throttle - 1000) / 10
 	}
 
-	if s, ok = get_rec_value(r, "gyroADC[0]"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Gyro_x = int16(i64)
+	if v, ok = get_rec_value(r, "gyroADC[0]"); ok {
+		b.Gyro_x = int16(v)
 	}
-	if s, ok = get_rec_value(r, "gyroADC[1]"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Gyro_y = int16(i64)
+	if v, ok = get_rec_value(r, "gyroADC[1]"); ok {
+		b.Gyro_y = int16(v)
 	}
-	if s, ok = get_rec_value(r, "gyroADC[2]"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Gyro_z = int16(i64)
+	if v, ok = get_rec_value(r, "gyroADC[2]"); ok {
+		b.Gyro_z = int16(v)
 	}
 
-	if s, ok = get_rec_value(r, "accSmooth[0]"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Acc_x = int16(i64)
+	if v, ok = get_rec_value(r, "accSmooth[0]"); ok {
+		b.Acc_x = int16(v)
 	}
-	if s, ok = get_rec_value(r, "accSmooth[1]"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Acc_y = int16(i64)
+	if v, ok = get_rec_value(r, "accSmooth[1]"); ok {
+		b.Acc_y = int16(v)
 	}
-	if s, ok = get_rec_value(r, "accSmooth[2]"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Acc_z = int16(i64)
+	if v, ok = get_rec_value(r, "accSmooth[2]"); ok {
+		b.Acc_z = int16(v)
 	}
 
-	if s, ok = get_rec_value(r, "hwHealthStatus"); ok {
+	if v, ok = get_rec_value(r, "hwHealthStatus"); ok {
 		b.HWfail = false
-		val, _ := strconv.Atoi(s)
+		val := int(v)
 		for n := 0; n < 7; n++ {
 			sv := val & 3
 			if sv > 1 || ((n < 2 || n == 4) && sv != 1) {
@@ -695,37 +621,16 @@ func get_bbl_line(r []string, have_origin bool) types.LogItem {
 		}
 	}
 
-	if s, ok = get_rec_value(r, "wind[0]"); ok {
-		i64, _ := strconv.Atoi(s)
-		b.Wind[0] = int16(i64)
-		if s, ok = get_rec_value(r, "wind[1]"); ok {
-			i64, _ = strconv.Atoi(s)
-			b.Wind[1] = int16(i64)
-			if s, ok = get_rec_value(r, "wind[2]"); ok {
-				i64, _ = strconv.Atoi(s)
-				b.Wind[2] = int16(i64)
+	if v, ok = get_rec_value(r, "wind[0]"); ok {
+		b.Wind[0] = int16(v)
+		if v, ok = get_rec_value(r, "wind[1]"); ok {
+			b.Wind[1] = int16(v)
+			if v, ok = get_rec_value(r, "wind[2]"); ok {
+				b.Wind[2] = int16(v)
 			}
 		}
-	} /*
-		else {
-			b.Wind[0] = -32768
-			b.Wind[1] = -32768
-			b.Wind[2] = -32768
-		}
-	*/
-	return b
-}
-
-func proc_start(w1 *os.File, args ...string) (p *os.Process, err error) {
-	if args[0], err = exec.LookPath(args[0]); err == nil {
-		var procAttr os.ProcAttr
-		procAttr.Files = []*os.File{nil, w1, nil}
-		p, err := os.StartProcess(args[0], args, &procAttr)
-		if err == nil {
-			return p, nil
-		}
 	}
-	return nil, err
+	return b
 }
 
 func read_mission(fb *geo.Frob) *mission.Mission {
@@ -758,16 +663,60 @@ func read_mission(fb *geo.Frob) *mission.Mission {
 	return ms
 }
 
+// Series reads the flight's frames at the logged rate, as the tables "main"
+// (I and P frames), "slow", "gps" and "home", with the logged (unscaled)
+// values
+func (lg *BBLOG) Series(meta types.FlightMeta, sel []string) (*types.Series, error) {
+	data, err := types.ReadLog(lg.name)
+	if err != nil {
+		return nil, err
+	}
+	d, err := new_decoder(data, meta.Index)
+	if err != nil {
+		return nil, err
+	}
+	s := types.NewSeries(sel)
+	tbls := make(map[byte]*types.Table)
+	for _, t := range []struct {
+		ft   byte
+		name string
+	}{{'I', "main"}, {'S', "slow"}, {'G', "gps"}, {'H', "home"}} {
+		tbls[t.ft] = s.AddTable(t.name, d.field_names(t.ft))
+	}
+	var vals []float64
+	to_float := func(iv []int64) []float64 {
+		vals = vals[:0]
+		for _, v := range iv {
+			vals = append(vals, float64(v))
+		}
+		return vals
+	}
+	d.onframe = func(ft byte, stamp int64, iv []int64) {
+		if t := tbls[ft]; t != nil {
+			t.Append(uint64(stamp), to_float(iv))
+		}
+	}
+	d.decode(func(r *bbframe) bool {
+		if t := tbls['I']; t != nil {
+			t.Append(uint64(r.stamp), to_float(r.vals[:d.idx.soff]))
+		}
+		return true
+	})
+	return s, nil
+}
+
 func (lg *BBLOG) Reader(meta types.FlightMeta, ch chan interface{}) (types.LogSegment, bool) {
-	cmd := exec.Command(options.Config.Blackbox_decode,
-		"--datetime", "--merge-gps", "--stdout", "--index",
-		strconv.Itoa(meta.Index), lg.name)
-	types.SetSilentProcess(cmd)
-	out, _ := cmd.StdoutPipe()
-	serr, _ := cmd.StderrPipe()
+	data, err := types.ReadLog(lg.name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "log file %s\n", err)
+		os.Exit(1)
+	}
 
-	defer cmd.Wait()
-	defer out.Close()
+	d, err := new_decoder(data, meta.Index)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bbl: %s\n", err)
+		os.Exit(1)
+	}
 
 	var homes types.HomeRec
 	var rec types.LogRec
@@ -777,15 +726,6 @@ func (lg *BBLOG) Reader(meta types.FlightMeta, ch chan interface{}) (types.LogSe
 
 	ms := read_mission(fb)
 
-	r := csv.NewReader(out)
-	r.TrimLeadingSpace = true
-
-	err := cmd.Start()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start err=%v", err)
-		os.Exit(1)
-	}
-
 	stats := types.LogStats{}
 
 	var llat, llon float64
@@ -810,6 +750,7 @@ func (lg *BBLOG) Reader(meta types.FlightMeta, ch chan interface{}) (types.LogSe
 	ndelay := 1000 * uint64(options.Config.Intvl)
 	tgt := 0
 	laststat := uint8(255)
+	var evs types.EventDetector
 	leffic := 0.0
 	lwhkm := 0.0
 	whacc := 0.0
@@ -819,21 +760,15 @@ func (lg *BBLOG) Reader(meta types.FlightMeta, ch chan interface{}) (types.LogSe
 		skiptime = uint64(options.Config.SkipTime) * 1000
 	}
 
-	for i := 0; ; i++ {
-		record, err := r.Read()
-		if err == io.EOF {
-			break
-		}
-		if i == 0 {
-			build_headers(record)
-			rec.Cap = dataCapability()
-			if ch != nil {
-				ch <- rec.Cap
-			}
-			continue
-		}
+	rec.Cap = dataCapability()
+	fields := dataFields()
+	if ch != nil {
+		ch <- rec.Cap
+	}
 
-		b := get_bbl_line(record, have_origin)
+	take_events := d.take_events // d is shadowed below
+	d.decode(func(r *bbframe) bool {
+		b := get_bbl_line(r, have_origin)
 
 		if !have_origin {
 			if b.Fix > 1 && b.Numsat > 5 {
@@ -861,11 +796,6 @@ func (lg *BBLOG) Reader(meta types.FlightMeta, ch chan interface{}) (types.LogSe
 							homes.Flags |= types.HOME_SAFE
 						}
 					}
-				} else if b.Bearing > -1 {
-					hlat, hlon := geo.Posit(b.Lat, b.Lon, float64(b.Bearing), b.Vrange/1852.0)
-					homes.SafeLat = hlat
-					homes.SafeLon = hlon
-					homes.Flags |= types.HOME_SAFE
 				}
 				if fb != nil && (homes.Flags&types.HOME_SAFE != 0) {
 					homes.SafeLat, homes.SafeLon, _ = fb.Relocate(homes.SafeLat, homes.SafeLon, b.GAlt)
@@ -881,22 +811,32 @@ func (lg *BBLOG) Reader(meta types.FlightMeta, ch chan interface{}) (types.LogSe
 			us := b.Stamp
 			var deltat = us - st
 			if skiptime > 0 && deltat < skiptime {
-				continue
+				return true
 			}
 
 			if us > st {
 				var d float64
 				var c float64
+				if !basetime.IsZero() {
+					b.Utc = basetime.Add(time.Duration(us) * time.Microsecond)
+				}
+				if fb != nil {
+					b.Utc = b.Utc.Add(froboff)
+					b.Lat, b.Lon, _ = fb.Relocate(b.Lat, b.Lon, 0)
+				}
+				// Events are detected on every frame, the items decimated; a
+				// derived WP number holds until the next item
+				b.SetValid(fields, homes)
+				eb := b
+				if eb.Fmode == types.FM_WP && eb.ActiveWP == 0 && ms != nil && eb.Fmode == laststat {
+					eb.ActiveWP = uint8(tgt)
+				}
+				evs.Check(&eb)
+				for _, e := range take_events() {
+					evs.AddAt(&eb, uint64(e.stamp), e.kind, e.text)
+				}
 				// Do the plot every 100ms
 				if (us - dt) >= ndelay {
-					if !basetime.IsZero() {
-						b.Utc = basetime.Add(time.Duration(us) * time.Microsecond)
-					}
-					if fb != nil {
-						b.Utc = b.Utc.Add(froboff)
-						b.Lat, b.Lon, _ = fb.Relocate(b.Lat, b.Lon, 0)
-					}
-
 					c, d = geo.Csedist(homes.HomeLat, homes.HomeLon, b.Lat, b.Lon)
 					b.Bearing = int32(c)
 					b.Vrange = d * 1852.0
@@ -946,11 +886,13 @@ func (lg *BBLOG) Reader(meta types.FlightMeta, ch chan interface{}) (types.LogSe
 					if b.Rssi > 0 {
 						rec.Cap |= types.CAP_RSSI_VALID
 					}
+					b.SetValid(fields, homes)
 
 					if ch != nil {
 						ch <- b
 					} else {
 						rec.Items = append(rec.Items, b)
+						rec.Valid |= b.Valid
 					}
 					dt = us
 				}
@@ -972,20 +914,17 @@ func (lg *BBLOG) Reader(meta types.FlightMeta, ch chan interface{}) (types.LogSe
 				lt = us
 			}
 		}
-		if err != nil {
-			log.Printf("bblreader: %+v\n", err)
-			break
+		return true
+	})
+
+	if n := len(rec.Items); n > 0 {
+		for _, e := range d.take_events() {
+			evs.AddAt(&rec.Items[n-1], uint64(e.stamp), e.kind, e.text)
 		}
 	}
-
-	sbytes, err := io.ReadAll(serr)
-	serr.Close()
-
-	logerrs := parse_errors(string(sbytes))
-
 	srec := stats.Summary(lt - st)
 	ls := types.LogSegment{}
-	ls.S = logerrs
+	ls.S = d.warnings()
 
 	if ch != nil {
 		ch <- srec
@@ -996,18 +935,8 @@ func (lg *BBLOG) Reader(meta types.FlightMeta, ch chan interface{}) (types.LogSe
 			ls.L = rec
 			ls.H = homes
 			ls.M = srec
+			ls.E = evs.Events
 		}
 		return ls, ok
 	}
 }
-
-func parse_errors(s string) string {
-	var sb strings.Builder
-	parts := strings.Split(s, "\n")
-	for _, p := range parts {
-		if strings.HasPrefix(p, "\tWarning: ") || strings.HasPrefix(p, "\tError: ") {
-			fmt.Fprintf(&sb, "%s\n", p[1:])
-		}
-	}
-	return sb.String()
-}
@@ -172,121 +172,153 @@ func make_bullet_msg(b types.LogItem, homeamsl float64, elapsed int, ncells int,
 	sb.WriteString(strconv.Itoa(elapsed))
 	sb.WriteByte(',')
 
-	sb.WriteString("ran:")
-	sb.WriteString(strconv.Itoa(int(b.Roll * 10)))
-	sb.WriteByte(',')
+	if b.Logged(types.F_ATTITUDE) {
+		sb.WriteString("ran:")
+		sb.WriteString(strconv.Itoa(int(b.Roll * 10)))
+		sb.WriteByte(',')
 
-	sb.WriteString("pan:")
-	sb.WriteString(strconv.Itoa(int(b.Pitch * 10)))
-	sb.WriteByte(',')
+		sb.WriteString("pan:")
+		sb.WriteString(strconv.Itoa(int(b.Pitch * 10)))
+		sb.WriteByte(',')
+	}
 
-	sb.WriteString("hea:")
-	sb.WriteString(strconv.Itoa(int(b.Cse)))
-	sb.WriteByte(',')
+	if b.Logged(types.F_CSE) {
+		sb.WriteString("hea:")
+		sb.WriteString(strconv.Itoa(int(b.Cse)))
+		sb.WriteByte(',')
+	}
 
-	sb.WriteString("ggc:")
-	sb.WriteString(strconv.Itoa(int(b.Cog)))
-	sb.WriteByte(',')
+	if b.Logged(types.F_COG) {
+		sb.WriteString("ggc:")
+		sb.WriteString(strconv.Itoa(int(b.Cog)))
+		sb.WriteByte(',')
+	}
 
-	sb.WriteString("alt:")
-	sb.WriteString(strconv.Itoa(int(b.Alt * 100)))
-	sb.WriteByte(',')
+	if b.Logged(types.F_ALT) {
+		sb.WriteString("alt:")
+		sb.WriteString(strconv.Itoa(int(b.Alt * 100)))
+		sb.WriteByte(',')
+	}
 
-	sb.WriteString("asl:")
-	sb.WriteString(strconv.Itoa(int(b.GAlt)))
-	sb.WriteByte(',')
+	if b.Logged(types.F_GALT) {
+		sb.WriteString("asl:")
+		sb.WriteString(strconv.Itoa(int(b.GAlt)))
+		sb.WriteByte(',')
+	}
 
-	sb.WriteString("gsp:")
-	sb.WriteString(strconv.Itoa(int(b.Spd * 100)))
-	sb.WriteByte(',')
+	if b.Logged(types.F_SPD) {
+		sb.WriteString("gsp:")
+		sb.WriteString(strconv.Itoa(int(b.Spd * 100)))
+		sb.WriteByte(',')
+	}
 
-	sb.WriteString("bpv:")
-	if options.Config.Bulletvers == 2 {
-		sb.WriteString(strconv.Itoa(int(b.Volts * 100)))
-	} else {
-		sb.WriteString(fmt.Sprintf("%.2f", float64(b.Volts)))
+	if b.Logged(types.F_VOLTS) {
+		sb.WriteString("bpv:")
+		if options.Config.Bulletvers == 2 {
+			sb.WriteString(strconv.Itoa(int(b.Volts * 100)))
+		} else {
+			sb.WriteString(fmt.Sprintf("%.2f", float64(b.Volts)))
+		}
+		sb.WriteByte(',')
+
+		avc := b.Volts / float64(ncells)
+		sb.WriteString("acv:")
+		if options.Config.Bulletvers == 2 {
+			sb.WriteString(strconv.Itoa(int(avc * 100)))
+		} else {
+			sb.WriteString(fmt.Sprintf("%.2f", avc))
+		}
+		sb.WriteByte(',')
 	}
-	sb.WriteByte(',')
 
-	avc := b.Volts / float64(ncells)
-	sb.WriteString("acv:")
-	if options.Config.Bulletvers == 2 {
-		sb.WriteString(strconv.Itoa(int(avc * 100)))
-	} else {
-		sb.WriteString(fmt.Sprintf("%.2f", avc))
+	if b.Logged(types.F_ENERGY) {
+		sb.WriteString("cad:")
+		if options.Config.Bulletvers == 2 {
+			sb.WriteString(strconv.Itoa(int(b.Energy)))
+		} else {
+			sb.WriteString(fmt.Sprintf("%.0f", b.Energy))
+		}
+		sb.WriteByte(',')
 	}
-	sb.WriteByte(',')
 
-	sb.WriteString("cad:")
-	if options.Config.Bulletvers == 2 {
-		sb.WriteString(strconv.Itoa(int(b.Energy)))
-	} else {
-		sb.WriteString(fmt.Sprintf("%.0f", b.Energy))
+	if b.Logged(types.F_AMPS) {
+		sb.WriteString("cud:")
+		if options.Config.Bulletvers == 2 {
+			sb.WriteString(strconv.Itoa(int(b.Amps * 100)))
+		} else {
+			sb.WriteString(fmt.Sprintf("%.2f", b.Amps))
+		}
+		sb.WriteByte(',')
 	}
-	sb.WriteByte(',')
 
-	sb.WriteString("cud:")
-	if options.Config.Bulletvers == 2 {
-		sb.WriteString(strconv.Itoa(int(b.Amps * 100)))
-	} else {
-		sb.WriteString(fmt.Sprintf("%.2f", b.Amps))
+	if b.Logged(types.F_RSSI) {
+		//	rssi := 100 * int(b.Rssi) / 255
+		sb.WriteString("rsi:")
+		sb.WriteString(strconv.Itoa(int(b.Rssi)))
+		sb.WriteByte(',')
 	}
-	sb.WriteByte(',')
 
-	//	rssi := 100 * int(b.Rssi) / 255
-	sb.WriteString("rsi:")
-	sb.WriteString(strconv.Itoa(int(b.Rssi)))
-	sb.WriteByte(',')
+	if b.Logged(types.F_POS) {
+		sb.WriteString("gla:")
+		if options.Config.Bulletvers == 2 {
+			sb.WriteString(strconv.Itoa(int(b.Lat * 10000000)))
+		} else {
+			sb.WriteString(fmt.Sprintf("%.8f", b.Lat))
+		}
+		sb.WriteByte(',')
 
-	sb.WriteString("gla:")
-	if options.Config.Bulletvers == 2 {
-		sb.WriteString(strconv.Itoa(int(b.Lat * 10000000)))
-	} else {
-		sb.WriteString(fmt.Sprintf("%.8f", b.Lat))
+		sb.WriteString("glo:")
+		if options.Config.Bulletvers == 2 {
+			sb.WriteString(strconv.Itoa(int(b.Lon * 10000000)))
+		} else {
+			sb.WriteString(fmt.Sprintf("%.8f", b.Lon))
+		}
+		sb.WriteByte(',')
 	}
-	sb.WriteByte(',')
 
-	sb.WriteString("glo:")
-	if options.Config.Bulletvers == 2 {
-		sb.WriteString(strconv.Itoa(int(b.Lon * 10000000)))
-	} else {
-		sb.WriteString(fmt.Sprintf("%.8f", b.Lon))
+	if b.Logged(types.F_NUMSAT) {
+		sb.WriteString("gsc:")
+		sb.WriteString(strconv.Itoa(int(b.Numsat)))
+		sb.WriteByte(',')
 	}
-	sb.WriteByte(',')
-
-	sb.WriteString("gsc:")
-	sb.WriteString(strconv.Itoa(int(b.Numsat)))
-	sb.WriteByte(',')
 
-	sb.WriteString("ghp:")
-	if options.Config.Bulletvers == 2 {
-		sb.WriteString(strconv.Itoa(int(b.Hdop)))
-	} else {
-		hdop := float64(b.Hdop) / 100.0
-		sb.WriteString(fmt.Sprintf("%.1f", hdop))
+	if b.Logged(types.F_HDOP) {
+		sb.WriteString("ghp:")
+		if options.Config.Bulletvers == 2 {
+			sb.WriteString(strconv.Itoa(int(b.Hdop)))
+		} else {
+			hdop := float64(b.Hdop) / 100.0
+			sb.WriteString(fmt.Sprintf("%.1f", hdop))
+		}
+		sb.WriteByte(',')
 	}
-	sb.WriteByte(',')
 
-	sb.WriteString("3df:")
-	if b.Fix != 0 {
-		sb.WriteString("1")
-	} else {
-		sb.WriteString("0")
+	if b.Logged(types.F_FIX) {
+		sb.WriteString("3df:")
+		if b.Fix != 0 {
+			sb.WriteString("1")
+		} else {
+			sb.WriteString("0")
+		}
+		sb.WriteByte(',')
 	}
-	sb.WriteByte(',')
 
-	sb.WriteString("hds:")
-	sb.WriteString(strconv.Itoa(int(b.Vrange)))
-	sb.WriteByte(',')
+	if b.Logged(types.F_RANGE) {
+		sb.WriteString("hds:")
+		sb.WriteString(strconv.Itoa(int(b.Vrange)))
+		sb.WriteByte(',')
 
-	bearing := (b.Bearing + 180) % 360
-	sb.WriteString("hdr:")
-	sb.WriteString(strconv.Itoa(int(bearing)))
-	sb.WriteByte(',')
+		bearing := (b.Bearing + 180) % 360
+		sb.WriteString("hdr:")
+		sb.WriteString(strconv.Itoa(int(bearing)))
+		sb.WriteByte(',')
+	}
 
-	sb.WriteString("trp:")
-	sb.WriteString(strconv.Itoa(b.Throttle))
-	sb.WriteByte(',')
+	if b.Logged(types.F_THROTTLE) {
+		sb.WriteString("trp:")
+		sb.WriteString(strconv.Itoa(b.Throttle))
+		sb.WriteByte(',')
+	}
 
 	fs := (b.Status & 2) >> 1
 	sb.WriteString("fs:")
@@ -348,19 +380,6 @@ func make_bullet_mode(mode string, ncells int, hwfail bool) string {
 	return sb.String()
 }
 
-func get_cells(vbat float64) int {
-	ncell := 0
-	for i := 1; i < 10; i++ {
-		vmin := 3.0 * float64(i)
-		vmax := 4.22 * float64(i)
-		if vbat < vmax && vbat > vmin {
-			ncell = i
-			break
-		}
-	}
-	return ncell
-}
-
 func output_message(c *MQTTClient, wfh *os.File, msg string, et time.Time) {
 	if c != nil {
 		c.publish(msg)
@@ -460,7 +479,7 @@ func MQTTGen(s types.LogSegment, meta types.FlightMeta) {
 		stat := b.Status >> 2
 
 		if ncells == 0 {
-			ncells = get_cells(b.Volts)
+			ncells = types.CellCount(b.Volts)
 		}
 
 		if b.Fmode != laststat {
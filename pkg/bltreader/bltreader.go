@@ -1,6 +1,7 @@
 package bltlog
 
 import (
+	"bytes"
 	"fmt"
 	//"io"
 	//"math"
@@ -41,6 +42,18 @@ func NewBLTReader(fn string) BLTLOG {
 	return l
 }
 
+func init() {
+	types.RegisterLogFormat(types.LogFormat{Name: "BulletGCSS", Type: types.IS_BLT, Probe: probe_log,
+		Reader: func(fn string) types.FlightLog { l := NewBLTReader(fn); return &l }})
+}
+
+func probe_log(sig []byte) int {
+	if bytes.Contains(sig, []byte("|Connected to")) {
+		return types.PROBE_STRONG
+	}
+	return types.PROBE_NONE
+}
+
 func (o *BLTLOG) LogType() byte {
 	return types.LOGBLT
 }
@@ -63,14 +76,14 @@ func (o *BLTLOG) Dump() {
 func metas(logfile string) ([]types.FlightMeta, error) {
 	var metas []types.FlightMeta
 
-	fh, err := os.Open(logfile)
+	fh, err := types.OpenLog(logfile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "log file %s\n", err)
 		return metas, err
 	}
 	defer fh.Close()
 
-	basefile := filepath.Base(logfile)
+	basefile := types.LogBase(logfile)
 
 	scanner := bufio.NewScanner(fh)
 	idx := 0
@@ -121,8 +134,19 @@ func metas(logfile string) ([]types.FlightMeta, error) {
 	return metas, err
 }
 
-func parse_bullet(line string, b *types.LogItem) uint16 {
+// Fields logged by each Bullet key; see types.FieldMask
+var bullet_fields = map[string]types.FieldMask{
+	"ran": types.F_ATTITUDE, "pan": types.F_ATTITUDE, "hea": types.F_CSE | types.F_COG,
+	"alt": types.F_ALT, "asl": types.F_GALT, "gsp": types.F_SPD, "bpv": types.F_VOLTS,
+	"cad": types.F_ENERGY, "cud": types.F_AMPS, "rsi": types.F_RSSI, "ghp": types.F_HDOP,
+	"fs": types.F_STATUS, "arm": types.F_STATUS, "ftm": types.F_FMODE, "hdr": types.F_RANGE,
+	"hds": types.F_RANGE, "gla": types.F_POS, "glo": types.F_POS, "gsc": types.F_NUMSAT,
+	"3df": types.F_FIX, "trp": types.F_THROTTLE, "nvs": types.F_NAVMODE,
+}
+
+func parse_bullet(line string, b *types.LogItem) (uint16, types.FieldMask) {
 	cap := uint16(0)
+	fields := types.F_STAMP | types.F_UTC
 	if parts := strings.Split(line, "|"); len(parts) == 2 {
 		lasttm, _ := strconv.ParseInt(parts[0], 10, 64)
 		b.Utc = time.Unix(lasttm/1000, 1000*1000*(lasttm%1000))
@@ -131,6 +155,7 @@ func parse_bullet(line string, b *types.LogItem) uint16 {
 			kv := strings.Split(kvs, ":")
 			if len(kv) == 2 {
 				tmp, _ := strconv.Atoi(kv[1])
+				fields |= bullet_fields[kv[0]]
 				switch kv[0] {
 				case "ran":
 					b.Roll = int16(tmp / 10)
@@ -170,7 +195,7 @@ func parse_bullet(line string, b *types.LogItem) uint16 {
 				case "hdr":
 					b.Bearing = int32(tmp)
 				case "hds":
-					b.Vrange = float64(tmp) / 1852.0
+					b.Vrange = float64(tmp)
 				case "gla":
 					b.Lat = float64(tmp) / 1e7
 				case "glo":
@@ -232,7 +257,7 @@ func parse_bullet(line string, b *types.LogItem) uint16 {
 	if b.Lat == 0.0 && b.Lon == 0 {
 		b.Fix = 0
 	}
-	return cap
+	return cap, fields
 }
 
 func parse_mission(vals []string) {
@@ -281,12 +306,54 @@ func parse_flight_mode(fmode uint8) uint8 {
 	}
 }
 
+// Series reads every message of the flight as the table "bullet", the
+// columns being the (numeric) Bullet keys, as logged (unscaled)
+func (lg *BLTLOG) Series(m types.FlightMeta, sel []string) (*types.Series, error) {
+	fh, err := types.OpenLog(lg.name)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	s := types.NewSeries(sel)
+	scanner := bufio.NewScanner(fh)
+	var st int64
+	for i := 1; scanner.Scan(); i++ {
+		if i < m.Start || i > m.End {
+			continue
+		}
+		parts := strings.Split(scanner.Text(), "|")
+		if len(parts) != 2 {
+			continue
+		}
+		tm, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if st == 0 {
+			st = tm
+		}
+		vals := make(map[string]float64)
+		for _, kvs := range strings.Split(parts[1], ",") {
+			if k, v, ok := strings.Cut(kvs, ":"); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					vals[k] = f
+				}
+			}
+		}
+		if tm >= st {
+			s.AppendMap("bullet", uint64(tm-st)*1000, vals)
+		}
+	}
+	return s, scanner.Err()
+}
+
 func (lg *BLTLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegment, bool) {
 	var stats types.LogStats
 	ls := types.LogSegment{}
 	var lt, st time.Time
 
-	fh, err := os.Open(lg.name)
+	fh, err := types.OpenLog(lg.name)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "log file %s\n", err)
 		return ls, false
@@ -298,14 +365,17 @@ func (lg *BLTLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegm
 	rec := types.LogRec{}
 	b := types.LogItem{}
 	hseen := false
+	var fields types.FieldMask
+	var evs types.EventDetector
 	leffic := 0.0
 	lwhkm := 0.0
 	whacc := 0.0
 	for scanner.Scan() {
 		line := scanner.Text()
 		if i >= m.Start && i <= m.End {
-			cap := parse_bullet(line, &b)
+			cap, fl := parse_bullet(line, &b)
 			rec.Cap |= cap
+			fields |= fl
 			if ch != nil {
 				if !hseen && (homes.Flags&types.HOME_ARM) != 0 {
 					hseen = true
@@ -325,8 +395,8 @@ func (lg *BLTLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegm
 						}
 					}
 
-					if b.Vrange > stats.Max_range {
-						stats.Max_range = b.Vrange
+					if b.Vrange/1852.0 > stats.Max_range {
+						stats.Max_range = b.Vrange / 1852.0
 						stats.Max_range_time = uint64(b.Utc.Sub(st).Nanoseconds() / 1000)
 					}
 
@@ -365,12 +435,23 @@ func (lg *BLTLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegm
 					}
 
 					lt = b.Utc
+					b.SetValid(fields, homes)
+					evs.Check(&b)
 					if ch != nil {
 						ch <- b
 					} else {
 						rec.Items = append(rec.Items, b)
+						rec.Valid |= b.Valid
 					}
 					stats.Distance = b.Tdist / 1852.0
+				} else if !st.IsZero() {
+					// Events are detected on every line, the items decimated
+					e := b
+					if mdiff := e.Utc.Sub(st).Microseconds(); mdiff > 0 {
+						e.Stamp = uint64(mdiff)
+					}
+					e.SetValid(fields, homes)
+					evs.Check(&e)
 				}
 			}
 		}
@@ -392,6 +473,7 @@ func (lg *BLTLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegm
 			ls.L = rec
 			ls.H = homes
 			ls.M = srec
+			ls.E = evs.Events
 		}
 		return ls, ok
 	}
@@ -0,0 +1,831 @@
+package csvlog
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"geo"
+	"options"
+	"types"
+)
+
+type CSVLOG struct {
+	name string
+	meta []types.FlightMeta
+	prof *csvprofile
+}
+
+func NewCSVReader(fn string) CSVLOG {
+	var l CSVLOG
+	l.name = fn
+	l.meta = nil
+	if fh, err := types.OpenLog(fn); err == nil {
+		sig := make([]byte, types.PROBE_SIZE)
+		n, _ := io.ReadFull(fh, sig)
+		fh.Close()
+		l.prof, _ = find_profile(sig[:n])
+	}
+	return l
+}
+
+func init() {
+	types.RegisterLogFormat(types.LogFormat{Name: "CSV", Type: types.IS_CSV, Probe: probe_log,
+		Reader: func(fn string) types.FlightLog { l := NewCSVReader(fn); return &l }})
+}
+
+func probe_log(sig []byte) int {
+	_, conf := find_profile(sig)
+	return conf
+}
+
+func (o *CSVLOG) LogType() byte {
+	return types.LOGCSV
+}
+
+func (o *CSVLOG) GetMetas() ([]types.FlightMeta, error) {
+	if o.prof == nil {
+		return nil, errors.New("No CSV profile for log")
+	}
+	m, err := types.ReadMetaCache(o.name)
+	if err != nil || options.Config.Nocache {
+		m, err = o.metas()
+		types.WriteMetaCache(o.name, m)
+	}
+	o.meta = m
+	return m, err
+}
+
+func (o *CSVLOG) GetDurations() {
+}
+
+func (o *CSVLOG) Dump() {
+	if o.prof == nil {
+		return
+	}
+	r, fh, err := o.open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "log file %s\n", err)
+		return
+	}
+	defer fh.Close()
+	record, _ := r.Read()
+	c := new_csvreader(o.prof, record)
+	fmt.Printf("Profile: %s (%s) %s\n", o.prof.Name, o.prof.file, o.prof.Desc)
+	fmt.Printf("time: %s [%s]\n", strings.Join(o.prof.Time.Columns, " "), o.prof.Time.Format)
+	keys := make([]string, 0, len(o.prof.Fields))
+	for k := range o.prof.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f := o.prof.Fields[k]
+		if h, ok := c.hdrs[f.Column]; ok {
+			u := f.Unit
+			if u == "" {
+				u = h.u
+			}
+			fmt.Printf("%3d: %-8s <= %s units=(%s)\n", h.i, k, f.Column, u)
+		} else {
+			fmt.Printf("  -: %-8s <= %s (missing)\n", k, f.Column)
+		}
+	}
+}
+
+func (o *CSVLOG) open() (*csv.Reader, io.Closer, error) {
+	fh, err := types.OpenLog(o.name)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := csv.NewReader(fh)
+	r.Comma = []rune(o.prof.Separator)[0]
+	r.TrimLeadingSpace = true
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1
+	return r, fh, nil
+}
+
+// Per-log state for applying a profile to records
+type csvreader struct {
+	p    *csvprofile
+	hdrs map[string]hdrrec
+	base time.Time
+}
+
+func new_csvreader(p *csvprofile, hdr []string) *csvreader {
+	return &csvreader{p: p, hdrs: read_headers(hdr)}
+}
+
+func (c *csvreader) has(key string) bool {
+	f, ok := c.p.Fields[key]
+	if ok {
+		_, ok = c.hdrs[f.Column]
+	}
+	return ok
+}
+
+func (c *csvreader) text(r []string, f csvfield) (string, string, bool) {
+	h, ok := c.hdrs[f.Column]
+	if !ok || h.i >= len(r) {
+		return "", "", false
+	}
+	s := strings.TrimSpace(r[h.i])
+	if f.Part > 0 {
+		sep := f.Split
+		if sep == "" {
+			sep = " "
+		}
+		parts := strings.Fields(strings.ReplaceAll(s, sep, " "))
+		if f.Part > len(parts) {
+			return "", "", false
+		}
+		s = parts[f.Part-1]
+	}
+	u := f.Unit
+	if u == "" {
+		u = h.u
+	}
+	return s, u, s != ""
+}
+
+func (c *csvreader) number(r []string, f csvfield) (float64, string, bool) {
+	s, u, ok := c.text(r, f)
+	if !ok {
+		return 0, u, false
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, u, false
+	}
+	if f.Scale != 0 {
+		v *= f.Scale
+	}
+	v += f.Offset
+	return normalise_units(v, u), u, true
+}
+
+func (c *csvreader) value(r []string, key string) (float64, bool) {
+	f, ok := c.p.Fields[key]
+	if !ok {
+		return 0, false
+	}
+	v, _, ok := c.number(r, f)
+	return v, ok
+}
+
+// Converts to the units used by LogItem (m, m/s, A, V, mAh, degrees)
+func normalise_units(v float64, u string) float64 {
+	switch strings.ToLower(u) {
+	case "ft", "feet":
+		v *= 0.3048
+	case "km":
+		v *= 1000
+	case "cm":
+		v /= 100
+	case "mm":
+		v /= 1000
+	case "kmh", "km/h", "kph":
+		v /= 3.6
+	case "mph":
+		v *= 0.44704
+	case "kts", "knots", "kn":
+		v *= 0.51444444
+	case "cm/s":
+		v /= 100
+	case "mm/s":
+		v /= 1000
+	case "ma", "mv":
+		v /= 1000
+	case "ah":
+		v *= 1000
+	case "rad":
+		v = v * 180.0 / math.Pi
+	}
+	return v
+}
+
+func elapsed_secs(v float64, u string) float64 {
+	switch strings.ToLower(u) {
+	case "ms", "millisecond", "milliseconds":
+		v /= 1000
+	case "us", "microsecond", "microseconds":
+		v /= 1e6
+	}
+	return v
+}
+
+func (c *csvreader) get_time(r []string) (time.Time, bool) {
+	var parts []string
+	for _, col := range c.p.Time.Columns {
+		s, _, ok := c.text(r, csvfield{Column: col})
+		if !ok {
+			return time.Time{}, false
+		}
+		parts = append(parts, s)
+	}
+	s := strings.Join(parts, " ")
+	var t time.Time
+	var err error
+	switch strings.ToLower(c.p.Time.Format) {
+	case "rfc3339", "iso8601":
+		t, err = time.Parse(time.RFC3339Nano, s)
+	case "unix", "unix-ms", "unix-us", "elapsed", "elapsed-ms":
+		var v float64
+		if v, err = strconv.ParseFloat(s, 64); err == nil {
+			switch strings.ToLower(c.p.Time.Format) {
+			case "unix-ms", "elapsed-ms":
+				v /= 1000
+			case "unix-us":
+				v /= 1e6
+			}
+			t = time.Unix(0, int64(v*1e9)).UTC()
+		}
+	default:
+		t, err = time.Parse(c.p.Time.Format, s)
+	}
+	if err != nil {
+		return t, false
+	}
+	if c.p.Time.Elapsed.Column != "" {
+		if v, u, ok := c.number(r, c.p.Time.Elapsed); ok {
+			et := time.Duration(elapsed_secs(v, u) * 1e9)
+			if c.base.IsZero() {
+				c.base = t.Add(-et)
+			}
+			t = c.base.Add(et)
+		}
+	}
+	return t, true
+}
+
+func (c *csvreader) is_armed(r []string) bool {
+	a := c.p.Armed
+	if a.Column == "" {
+		return true
+	}
+	s, _, _ := c.text(r, csvfield{Column: a.Column})
+	if len(a.Values) > 0 {
+		for _, v := range a.Values {
+			if s == v {
+				return true
+			}
+		}
+		return false
+	}
+	for _, v := range a.Disarmed {
+		if s == v {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *csvreader) capability() uint16 {
+	var ret uint16 = 0
+	if c.has("amps") {
+		ret |= types.CAP_AMPS
+	}
+	if c.has("volts") {
+		ret |= types.CAP_VOLTS
+	}
+	if c.has("energy") {
+		ret |= types.CAP_ENERGY
+	} else if ret&(types.CAP_VOLTS|types.CAP_AMPS) == types.CAP_VOLTS|types.CAP_AMPS {
+		ret |= (types.CAP_ENERGY | types.CAP_ENERGYC)
+	}
+	if c.has("spd") {
+		ret |= types.CAP_SPEED
+	}
+	if c.has("alt") || c.has("galt") {
+		ret |= types.CAP_ALTITUDE
+	}
+	return ret
+}
+
+// Fields logged, from the profile's mapping; see types.FieldMask
+func (c *csvreader) fields() types.FieldMask {
+	ret := types.F_STAMP | types.F_UTC | types.F_SPD
+	for _, f := range []struct {
+		keys []string
+		mask types.FieldMask
+	}{
+		{[]string{"lat"}, types.F_POS},
+		{[]string{"alt", "galt"}, types.F_ALT},
+		{[]string{"galt"}, types.F_GALT},
+		{[]string{"cse", "cog"}, types.F_CSE},
+		{[]string{"cog"}, types.F_COG},
+		{[]string{"pitch", "roll"}, types.F_ATTITUDE},
+		{[]string{"numsat"}, types.F_NUMSAT | types.F_FIX | types.F_HDOP},
+		{[]string{"fix"}, types.F_FIX},
+		{[]string{"hdop"}, types.F_HDOP},
+		{[]string{"volts"}, types.F_VOLTS},
+		{[]string{"amps"}, types.F_AMPS},
+		{[]string{"rssi"}, types.F_RSSI},
+		{[]string{"throttle"}, types.F_THROTTLE},
+		{[]string{"fmode"}, types.F_FMODE},
+	} {
+		for _, k := range f.keys {
+			if c.has(k) {
+				ret |= f.mask
+				break
+			}
+		}
+	}
+	if c.capability()&types.CAP_ENERGY != 0 {
+		ret |= types.F_ENERGY
+	}
+	if _, ok := c.hdrs[c.p.Armed.Column]; ok {
+		ret |= types.F_STATUS
+	}
+	return ret
+}
+
+func (c *csvreader) get_line(r []string) types.LogItem {
+	b := types.LogItem{}
+	status := uint8(0)
+
+	b.Utc, _ = c.get_time(r)
+	b.Lat, _ = c.value(r, "lat")
+	b.Lon, _ = c.value(r, "lon")
+	b.Alt, _ = c.value(r, "alt")
+	if v, ok := c.value(r, "galt"); ok {
+		b.GAlt = v
+	} else {
+		b.GAlt = -999999.9
+	}
+
+	if v, ok := c.value(r, "spd"); ok {
+		if v > 255 || v < 0 {
+			v = 0
+		}
+		b.Spd = v
+	}
+
+	if v, ok := c.value(r, "cse"); ok {
+		if v < 0 {
+			v += 360.0
+		}
+		b.Cse = uint32(v)
+		b.Cog = b.Cse
+	}
+	if v, ok := c.value(r, "cog"); ok {
+		if v < 0 {
+			v += 360.0
+		}
+		b.Cog = uint32(v)
+		if !c.has("cse") {
+			b.Cse = b.Cog
+		}
+	}
+	if v, ok := c.value(r, "pitch"); ok {
+		b.Pitch = int16(v)
+	}
+	if v, ok := c.value(r, "roll"); ok {
+		b.Roll = int16(v)
+	}
+
+	ns, hasns := c.value(r, "numsat")
+	fix, hasfix := c.value(r, "fix")
+	if hasns {
+		b.Numsat = uint8(ns)
+	}
+	if hasfix {
+		b.Fix = uint8(fix)
+	}
+	switch {
+	case hasns:
+		if !hasfix {
+			if ns > 5 {
+				b.Fix = 2
+			} else if ns > 0 {
+				b.Fix = 1
+			}
+		}
+		if ns > 5 {
+			b.Hdop = uint16((3.3 - ns/12.0) * 100)
+			if b.Hdop < 50 {
+				b.Hdop = 50
+			}
+		} else if ns > 0 {
+			b.Hdop = 800
+		} else {
+			b.Hdop = 999
+		}
+	case b.Lat != 0 || b.Lon != 0:
+		// no satellite count, assume a good fix
+		if !hasfix {
+			b.Fix = 2
+		}
+		b.Numsat = 13
+		b.Hdop = 100
+	}
+	if v, ok := c.value(r, "hdop"); ok {
+		b.Hdop = uint16(v * 100)
+	}
+	if b.Lat == 0 && b.Lon == 0 {
+		b.Fix = 0
+	}
+
+	if v, ok := c.value(r, "throttle"); ok {
+		b.Throttle = int(v)
+	}
+	if v, ok := c.value(r, "rssi"); ok && v > 0 {
+		b.Rssi = uint8(v)
+	}
+	b.Volts, _ = c.value(r, "volts")
+	b.Amps, _ = c.value(r, "amps")
+	if f, ok := c.p.Fields["energy"]; ok {
+		if v, u, ok := c.number(r, f); ok {
+			switch strings.ToLower(u) {
+			case "mwh", "wh":
+				if b.Volts > 0 {
+					if strings.ToLower(u) == "wh" {
+						v *= 1000
+					}
+					b.Energy = v / b.Volts
+				}
+			case "pct", "%":
+			default:
+				b.Energy = v
+			}
+		}
+	}
+
+	md := uint8(0)
+	if f, ok := c.p.Fields["fmode"]; ok {
+		if s, _, ok := c.text(r, f); ok {
+			m, ok := c.p.Modes[s]
+			if !ok {
+				for k, v := range c.p.Modes {
+					if strings.EqualFold(k, s) {
+						m = v
+						break
+					}
+				}
+			}
+			md = mode_names[strings.ToLower(m)]
+			if md == types.FM_FS {
+				status |= types.Is_FAIL
+			}
+		}
+	}
+	if c.is_armed(r) {
+		status |= types.Is_ARMED
+	}
+	b.Fmode = md
+	b.Fmtext = types.Mnames[md]
+	b.Status = status
+	return b
+}
+
+func (o *CSVLOG) metas() ([]types.FlightMeta, error) {
+	var metas []types.FlightMeta
+
+	r, fh, err := o.open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "log file %s\n", err)
+		return metas, err
+	}
+	defer fh.Close()
+
+	basefile := types.LogBase(o.name)
+	var c *csvreader
+	var lasttm time.Time
+
+	idx := 0
+	for i := 1; ; i++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			if idx > 0 {
+				metas[idx-1].End = (i - 1)
+				metas[idx-1].Duration = lasttm.Sub(metas[idx-1].Date)
+			}
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reader %s\n", err)
+			return metas, err
+		}
+		if i == 1 {
+			c = new_csvreader(o.prof, record)
+			continue
+		}
+		t_utc, ok := c.get_time(record)
+		if !ok {
+			continue
+		}
+		if idx == 0 || (options.Config.SplitTime > 0 && t_utc.Sub(lasttm) > time.Duration(options.Config.SplitTime)*time.Second) {
+			if idx > 0 {
+				metas[idx-1].End = i - 1
+				metas[idx-1].Duration = lasttm.Sub(metas[idx-1].Date)
+			}
+			idx += 1
+			mt := types.FlightMeta{Logname: basefile, Date: t_utc, Index: idx, Start: i}
+			metas = append(metas, mt)
+		}
+		lasttm = t_utc
+	}
+
+	for j, mx := range metas {
+		if mx.End-mx.Start > 64 {
+			metas[j].Flags = types.Has_Start | types.Is_Valid
+		}
+	}
+	if len(metas) == 0 {
+		err = errors.New("No records in CSV file")
+	}
+	return metas, err
+}
+
+func calc_speed(b types.LogItem, tdiff time.Duration, llat, llon float64) float64 {
+	spd := 0.0
+	if tdiff > 0 && llat != 0 && llon != 0 {
+		_, d := geo.Csedist(llat, llon, b.Lat, b.Lon)
+		spd = d * 1852.0 / tdiff.Seconds()
+	}
+	return spd
+}
+
+// Series reads every record of the flight as the table "log", columns being
+// named by the log's header. Non-numeric values are stored as NaN.
+func (lg *CSVLOG) Series(m types.FlightMeta, sel []string) (*types.Series, error) {
+	r, fh, err := lg.open()
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	s := types.NewSeries(sel)
+	var c *csvreader
+	var t *types.Table
+	var ncols int
+	var vals []float64
+	var st time.Time
+	for i := 1; ; i++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return s, err
+		}
+		if i == 1 {
+			c = new_csvreader(lg.prof, record)
+			ncols = len(record)
+			if t = s.AddTable("log", record); t == nil {
+				break
+			}
+			continue
+		}
+		if i < m.Start || i > m.End {
+			continue
+		}
+		ts, ok := c.get_time(record)
+		if !ok {
+			continue
+		}
+		if st.IsZero() {
+			st = ts
+		}
+		vals = vals[:0]
+		for j := 0; j < ncols; j++ {
+			v := math.NaN()
+			if j < len(record) {
+				if f, err := strconv.ParseFloat(record[j], 64); err == nil {
+					v = f
+				}
+			}
+			vals = append(vals, v)
+		}
+		t.Append(uint64(ts.Sub(st).Microseconds()), vals)
+	}
+	return s, nil
+}
+
+func (lg *CSVLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegment, bool) {
+	var stats types.LogStats
+
+	llat := 0.0
+	llon := 0.0
+
+	var homes types.HomeRec
+	rec := types.LogRec{}
+	var froboff time.Duration
+
+	fb := geo.Getfrobnication()
+
+	r, fh, err := lg.open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "log file %s\n", err)
+		os.Exit(-1)
+	}
+	defer fh.Close()
+
+	var c *csvreader
+	var lt, st time.Time
+	var fields types.FieldMask
+	havegalt := false
+
+	var evs types.EventDetector
+	leffic := 0.0
+	lwhkm := 0.0
+	whacc := 0.0
+	accEnergy := 0.0
+	for i := 1; ; i++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reader %s\n", err)
+			os.Exit(-1)
+		}
+		if i == 1 {
+			c = new_csvreader(lg.prof, record)
+			rec.Cap = c.capability()
+			fields = c.fields()
+			havegalt = !c.has("alt") && c.has("galt")
+			continue
+		}
+		if i < m.Start || i > m.End {
+			continue
+		}
+		b := c.get_line(record)
+		if b.Utc.IsZero() {
+			continue
+		}
+		if (b.Status&types.Is_ARMED) == 0 && b.Alt < 10 && b.Spd < 7 {
+			continue
+		}
+
+		tdiff := b.Utc.Sub(lt)
+		if tdiff.Nanoseconds()/(1000*1000) < int64(options.Config.Intvl) {
+			// Events are detected on every line, the items decimated
+			if !st.IsZero() && homes.Flags != 0 {
+				b.Stamp = uint64(b.Utc.Sub(st).Microseconds())
+				if fb != nil {
+					b.Utc = b.Utc.Add(froboff)
+					b.Lat, b.Lon, _ = fb.Relocate(b.Lat, b.Lon, 0)
+				}
+				if havegalt && b.GAlt > -999999 && homes.Flags&types.HOME_ALT != 0 {
+					b.Alt = b.GAlt - homes.HomeAlt
+				}
+				b.Hlat = homes.HomeLat
+				b.Hlon = homes.HomeLon
+				b.SetValid(fields, homes)
+				evs.Check(&b)
+			}
+			continue
+		}
+		ut := b.Utc // b.Utc may be frobnicated
+		if st.IsZero() {
+			st = ut
+			lt = st
+		} else {
+			b.Stamp = uint64(ut.Sub(st).Microseconds())
+		}
+
+		if homes.Flags == 0 {
+			if b.Fix > 1 && b.Numsat > 5 {
+				homes.HomeLat = b.Lat
+				homes.HomeLon = b.Lon
+				homes.Flags = types.HOME_ARM
+				if options.Config.HomeAlt != -999999 {
+					homes.HomeAlt = float64(options.Config.HomeAlt)
+					homes.Flags |= types.HOME_ALT
+				} else if b.GAlt > -999999 {
+					homes.HomeAlt = b.GAlt
+					homes.Flags |= types.HOME_ALT
+				}
+				if fb != nil {
+					fb.Set_origin(homes.HomeLat, homes.HomeLon, b.GAlt)
+					homes.HomeLat, homes.HomeLon, homes.HomeAlt = fb.Relocate(homes.HomeLat, homes.HomeLon, homes.HomeAlt)
+					ttmp := time.Now().Add(time.Hour * 24 * 42)
+					froboff = ttmp.Sub(b.Utc)
+					b.Utc = ttmp
+				}
+				llat = b.Lat
+				llon = b.Lon
+				if ch != nil {
+					ch <- homes
+				}
+			}
+		} else {
+			if fb != nil {
+				b.Utc = b.Utc.Add(froboff)
+				b.Lat, b.Lon, _ = fb.Relocate(b.Lat, b.Lon, 0)
+			}
+		}
+
+		// Only an AMSL altitude, make it relative to home
+		if havegalt && b.GAlt > -999999 && homes.Flags&types.HOME_ALT != 0 {
+			b.Alt = b.GAlt - homes.HomeAlt
+		}
+
+		b.Hlat = homes.HomeLat
+		b.Hlon = homes.HomeLon
+
+		if (rec.Cap & types.CAP_SPEED) == 0 {
+			b.Spd = calc_speed(b, tdiff, llat, llon)
+		}
+
+		if b.Spd > 200 {
+			continue // sanity check, 200m/s == 720kph, 388 knots
+		}
+
+		var d float64
+		if homes.Flags != 0 {
+			var cse float64
+			cse, d = geo.Csedist(homes.HomeLat, homes.HomeLon, b.Lat, b.Lon)
+
+			b.Bearing = int32(cse)
+			b.Vrange = d * 1852.0
+
+			if d > stats.Max_range {
+				stats.Max_range = d
+				stats.Max_range_time = uint64(ut.Sub(st).Nanoseconds() / 1000)
+			}
+
+			if b.Alt > stats.Max_alt {
+				stats.Max_alt = b.Alt
+				stats.Max_alt_time = uint64(ut.Sub(st).Nanoseconds() / 1000)
+			}
+
+			if b.Spd < 400 && b.Spd > stats.Max_speed {
+				stats.Max_speed = b.Spd
+				stats.Max_speed_time = uint64(ut.Sub(st).Nanoseconds() / 1000)
+			}
+
+			if b.Amps > stats.Max_current {
+				stats.Max_current = b.Amps
+				stats.Max_current_time = uint64(ut.Sub(st).Nanoseconds() / 1000)
+			}
+
+			if llat != b.Lat || llon != b.Lon {
+				_, d = geo.Csedist(llat, llon, b.Lat, b.Lon)
+				stats.Distance += d
+			}
+		}
+
+		b.Tdist = stats.Distance * 1852.0
+		if (rec.Cap & types.CAP_AMPS) == types.CAP_AMPS {
+			if d > 0 {
+				deltat := tdiff.Seconds()
+				aspd := d * 1852 / deltat              // m/s
+				b.Effic = b.Amps * 1000 / (3.6 * aspd) // efficiency
+				leffic = b.Effic
+				b.Whkm = b.Amps * b.Volts / (3.6 * aspd)
+				whacc += b.Amps * b.Volts * deltat / 3600
+				b.WhAcc = whacc
+				lwhkm = b.Whkm
+				if rec.Cap&types.CAP_ENERGYC == types.CAP_ENERGYC {
+					accEnergy += (b.Amps * deltat / 3.6)
+					b.Energy = accEnergy
+				}
+			} else {
+				b.Effic = leffic
+				b.Whkm = lwhkm
+			}
+		}
+
+		if b.Rssi > 0 {
+			rec.Cap |= types.CAP_RSSI_VALID
+		}
+		b.SetValid(fields, homes)
+		evs.Check(&b)
+
+		if ch != nil {
+			ch <- b
+		} else {
+			rec.Items = append(rec.Items, b)
+			rec.Valid |= b.Valid
+		}
+		llat = b.Lat
+		llon = b.Lon
+		lt = ut
+	}
+	srec := stats.Summary(uint64(lt.Sub(st).Nanoseconds() / 1000))
+	ls := types.LogSegment{}
+	if ch != nil {
+		ch <- srec
+		return ls, true
+	} else {
+		ok := homes.Flags != 0 && len(rec.Items) > 0
+		if ok {
+			ls.L = rec
+			ls.H = homes
+			ls.M = srec
+			ls.E = evs.Events
+		}
+		return ls, ok
+	}
+}
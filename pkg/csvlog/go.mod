@@ -0,0 +1,3 @@
+module csvlog
+
+go 1.19
@@ -0,0 +1,285 @@
+package csvlog
+
+import (
+	"embed"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+import (
+	"options"
+	"types"
+)
+
+// A profile maps the columns of a CSV log onto LogItem fields. Profiles are
+// JSON or TOML; those in profiles/ are built in, and may be overridden or
+// added to from the "csv" directory under the fl2x configuration directory.
+// options.Config.CsvProfile names a profile (or profile file) to use
+// regardless of the header match.
+
+//go:embed profiles
+var builtin embed.FS
+
+type csvfield struct {
+	Column string  `json:"column"`
+	Unit   string  `json:"unit"`   // overrides any unit given in the header
+	Scale  float64 `json:"scale"`  // applied before unit conversion, 0 => 1
+	Offset float64 `json:"offset"` // applied after scale
+	Split  string  `json:"split"`  // separator for a multi-value column (e.g. "lat lon")
+	Part   int     `json:"part"`   // 1 based element of a split column
+}
+
+type csvtime struct {
+	Columns []string `json:"columns"` // joined with a space before parsing
+	// Go time layout, or one of "rfc3339", "unix", "unix-ms", "unix-us",
+	// "elapsed", "elapsed-ms"
+	Format  string   `json:"format"`
+	Elapsed csvfield `json:"elapsed"` // optional elapsed time column, refining the above
+}
+
+type csvarmed struct {
+	Column   string   `json:"column"`
+	Values   []string `json:"values"`   // armed if the value is one of these
+	Disarmed []string `json:"disarmed"` // or, armed unless the value is one of these
+}
+
+type csvprofile struct {
+	Name      string              `json:"name"`
+	Desc      string              `json:"description"`
+	Match     []string            `json:"match"`     // columns identifying the log
+	Separator string              `json:"separator"` // default ","
+	Time      csvtime             `json:"time"`
+	Fields    map[string]csvfield `json:"fields"`
+	Modes     map[string]string   `json:"modes"` // column value => mode name
+	Armed     csvarmed            `json:"armed"`
+	file      string
+}
+
+// Field keys recognised in a profile
+var field_keys = []string{"lat", "lon", "alt", "galt", "spd", "cse", "cog", "pitch", "roll",
+	"numsat", "fix", "hdop", "volts", "amps", "energy", "rssi", "throttle", "fmode"}
+
+// Mode names used in a profile's "modes"
+var mode_names = map[string]uint8{
+	"acro":     types.FM_ACRO,
+	"manual":   types.FM_MANUAL,
+	"horizon":  types.FM_HORIZON,
+	"angle":    types.FM_ANGLE,
+	"launch":   types.FM_LAUNCH,
+	"rth":      types.FM_RTH,
+	"wp":       types.FM_WP,
+	"cruise3d": types.FM_CRUISE3D,
+	"cruise2d": types.FM_CRUISE2D,
+	"poshold":  types.FM_PH,
+	"althold":  types.FM_AH,
+	"emerg":    types.FM_EMERG,
+	"failsafe": types.FM_FS,
+	"land":     types.FM_LAND,
+}
+
+var profiles []*csvprofile
+
+func parse_profile(fn string, data []byte) (*csvprofile, error) {
+	p := &csvprofile{}
+	if strings.EqualFold(filepath.Ext(fn), ".toml") {
+		// re-encoded as JSON, for the one set of field tags
+		var m map[string]interface{}
+		_, err := toml.Decode(string(data), &m)
+		if err == nil {
+			data, err = json.Marshal(m)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	if p.Name == "" {
+		p.Name = strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn))
+	}
+	if p.Separator == "" {
+		p.Separator = ","
+	}
+	for k := range p.Fields {
+		found := false
+		for _, f := range field_keys {
+			if k == f {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown field \"%s\"", k)
+		}
+	}
+	for _, v := range p.Modes {
+		if _, ok := mode_names[strings.ToLower(v)]; !ok {
+			return nil, fmt.Errorf("unknown mode \"%s\"", v)
+		}
+	}
+	if len(p.Time.Columns) == 0 {
+		return nil, fmt.Errorf("no time columns")
+	}
+	p.file = fn
+	return p, nil
+}
+
+func add_profile(p *csvprofile) {
+	for j := range profiles {
+		if profiles[j].Name == p.Name {
+			profiles[j] = p
+			return
+		}
+	}
+	profiles = append(profiles, p)
+}
+
+func load_profiles() {
+	if profiles != nil {
+		return
+	}
+	profiles = []*csvprofile{}
+	ents, _ := builtin.ReadDir("profiles")
+	for _, e := range ents {
+		fn := "profiles/" + e.Name()
+		data, _ := builtin.ReadFile(fn)
+		if p, err := parse_profile(fn, data); err == nil {
+			add_profile(p)
+		} else {
+			fmt.Fprintf(os.Stderr, "csv profile %s: %s\n", fn, err)
+		}
+	}
+	dir := filepath.Join(types.GetConfigDir(), "csv")
+	fns, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	tfns, _ := filepath.Glob(filepath.Join(dir, "*.toml"))
+	fns = append(fns, tfns...)
+	sort.Strings(fns)
+	for _, fn := range fns {
+		if p, err := read_profile(fn); err == nil {
+			add_profile(p)
+		} else {
+			fmt.Fprintf(os.Stderr, "csv profile %s: %s\n", fn, err)
+		}
+	}
+}
+
+func read_profile(fn string) (*csvprofile, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return parse_profile(fn, data)
+}
+
+// The profile named by options.Config.CsvProfile, if any
+func forced_profile() *csvprofile {
+	name := options.Config.CsvProfile
+	if name == "" {
+		return nil
+	}
+	load_profiles()
+	for _, p := range profiles {
+		if p.Name == name {
+			return p
+		}
+	}
+	p, err := read_profile(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "csv profile %s: %s\n", name, err)
+		return nil
+	}
+	add_profile(p)
+	return p
+}
+
+type hdrrec struct {
+	i int
+	u string
+}
+
+var unitrx = regexp.MustCompile(`^(.+?)\s*[\(\[]([^\)\]]*)[\)\]]$`)
+
+// As otx, "Name(unit)" (or "Name [unit]") headers are split into name and unit;
+// columns may be referred to by either the bare name or the full header.
+func read_headers(r []string) map[string]hdrrec {
+	hdrs := make(map[string]hdrrec)
+	for i, s := range r {
+		s = strings.TrimSpace(strings.TrimPrefix(s, "\ufeff"))
+		if m := unitrx.FindStringSubmatch(s); m != nil {
+			if _, ok := hdrs[m[1]]; !ok {
+				hdrs[m[1]] = hdrrec{i, m[2]}
+			}
+		}
+		if _, ok := hdrs[s]; !ok {
+			hdrs[s] = hdrrec{i, ""}
+		}
+	}
+	return hdrs
+}
+
+func header_line(sig []byte, sep string) []string {
+	// A long header may exceed the probe size; use its complete columns
+	n := strings.IndexAny(string(sig), "\r\n")
+	if n == -1 {
+		if n = strings.LastIndex(string(sig), sep); n == -1 {
+			return nil
+		}
+	}
+	r := csv.NewReader(strings.NewReader(string(sig[:n])))
+	r.Comma = []rune(sep)[0]
+	r.TrimLeadingSpace = true
+	rec, err := r.Read()
+	if err != nil {
+		return nil
+	}
+	return rec
+}
+
+func (p *csvprofile) matches(hdrs map[string]hdrrec) bool {
+	for _, c := range p.Match {
+		if _, ok := hdrs[c]; !ok {
+			return false
+		}
+	}
+	for _, c := range p.Time.Columns {
+		if _, ok := hdrs[c]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the best matching profile (that with most matching columns) for a
+// header, and the probe confidence
+func find_profile(sig []byte) (*csvprofile, int) {
+	if p := forced_profile(); p != nil {
+		if r := header_line(sig, p.Separator); len(r) > 1 && p.matches(read_headers(r)) {
+			return p, types.PROBE_MAGIC
+		}
+		return nil, types.PROBE_NONE
+	}
+	load_profiles()
+	var best *csvprofile
+	for _, p := range profiles {
+		if len(p.Match) == 0 {
+			continue
+		}
+		if r := header_line(sig, p.Separator); len(r) > 1 && p.matches(read_headers(r)) {
+			if best == nil || len(p.Match) > len(best.Match) {
+				best = p
+			}
+		}
+	}
+	if best == nil {
+		return nil, types.PROBE_NONE
+	}
+	return best, types.PROBE_LIKELY
+}
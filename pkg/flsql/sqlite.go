@@ -30,13 +30,17 @@ CREATE TABLE IF NOT EXISTS logs(id integer, idx integer,
  ail  integer, ele  integer, rud  integer, thr integer,
  gyro_x integer, gyro_y integer, gyro_z integer, acc_x integer, acc_y integer, acc_z integer,
  fix  integer, numsat integer, fmode integer, rssi  integer, status integer, activewp integer,
- navmode integer, hwfail integer, windx integer, windy integer, windz integer);
+ navmode integer, hwfail integer, windx integer, windy integer, windz integer, valid integer);
+CREATE TABLE IF NOT EXISTS fields (mask integer, name text, unit text, description text);
+CREATE TABLE IF NOT EXISTS events (id integer, stamp integer, utc timestamp, lat double precision, lon double precision, alt double precision, kind integer, name text, detail text);
 create unique index if not exists logidx on logs (id,idx);`
 
 const IMETA = `insert into meta (id, dtg, duration, mname,firmware,fwdate, disarm, flags, motors, servos, sensors, acc1g, features, start, end) values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)`
 const ISERR = `insert into logerrs (id, errstr) values (?, ?)`
 const ISMISC = `insert into misc (id, type, content) values ($1,$2,$3)`
-const ILOG = `insert into logs (id, idx, stamp,lat,lon,alt,galt,spd,amps,volts,hlat,hlon,vrange,tdist,effic,energy,whkm,whAcc,qval,sval,aval,bval,fmtext,utc,throttle,cse,cog,bearing,roll,pitch,hdop,ail,ele,rud,thr,gyro_x,gyro_y,gyro_z,acc_x,acc_y,acc_z,fix,numsat,fmode,rssi,status,activewp,navmode,hwfail,windx,windy,windz) values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21,$22,$23,$24,$25,$26,$27,$28,$29,$30,$31,$32,$33,$34,$35,$36,$37,$38,$39,$40,$41,$42,$43,$44,$45,$46,$47,$48,$49,$50,$51,$52)`
+const ILOG = `insert into logs (id, idx, stamp,lat,lon,alt,galt,spd,amps,volts,hlat,hlon,vrange,tdist,effic,energy,whkm,whAcc,qval,sval,aval,bval,fmtext,utc,throttle,cse,cog,bearing,roll,pitch,hdop,ail,ele,rud,thr,gyro_x,gyro_y,gyro_z,acc_x,acc_y,acc_z,fix,numsat,fmode,rssi,status,activewp,navmode,hwfail,windx,windy,windz,valid) values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21,$22,$23,$24,$25,$26,$27,$28,$29,$30,$31,$32,$33,$34,$35,$36,$37,$38,$39,$40,$41,$42,$43,$44,$45,$46,$47,$48,$49,$50,$51,$52,$53)`
+const IEVENT = `insert into events (id, stamp, utc, lat, lon, alt, kind, name, detail) values ($1,$2,$3,$4,$5,$6,$7,$8,$9)`
+const IFIELD = `insert into fields (mask, name, unit, description) values ($1,$2,$3,$4)`
 
 type DBL struct {
 	db     *sqlx.DB
@@ -59,6 +63,10 @@ func NewSQLliteDB(fn string) DBL {
 	if _, err = d.db.Exec(SCHEMA); err != nil {
 		log.Fatalf("SQL Schema: %+v\n", err)
 	}
+	// the units of the logs table's columns, and the bits of "valid"
+	for _, f := range types.Fields {
+		d.db.MustExec(IFIELD, int64(f.Mask), f.Name, f.Unit, f.Desc)
+	}
 	return d
 }
 
@@ -78,6 +86,18 @@ func (d *DBL) Writemeta(m types.FlightMeta) {
 	d.tx.MustExec(IMETA, m.Index, m.Date, m.Duration.Seconds(), m.Craft, m.Firmware, m.Fwdate, m.Disarm, m.Flags, m.Motors, m.Servos, m.Sensors, m.Acc1G, m.Features, m.Start, m.End)
 }
 
+// WriteEvents writes a flight's events, after its log items (the time stamps
+// being relative to the first item's)
+func (d *DBL) WriteEvents(idx int, evs []types.LogEvent) {
+	for _, e := range evs {
+		stamp := int64(0)
+		if e.Stamp > d.stamp {
+			stamp = int64(e.Stamp - d.stamp)
+		}
+		d.tx.MustExec(IEVENT, idx, stamp, e.Utc, e.Lat, e.Lon, e.Alt, int(e.Kind), e.Kind.String(), e.Detail)
+	}
+}
+
 func (d *DBL) WriteErrStr(idx int, errstr string) {
 	//log.Printf("Errors: %d <%s>\n", idx, errstr)
 	d.tx.MustExec(ISERR, idx, errstr)
@@ -228,7 +248,8 @@ func (d *DBL) Writelog(idx int, nx int, b types.LogItem) {
 		b.HWfail,
 		b.Wind[0],
 		b.Wind[1],
-		b.Wind[2])
+		b.Wind[2],
+		int64(b.Valid))
 }
 
 func (d *DBL) Close() {
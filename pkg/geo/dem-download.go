@@ -21,7 +21,8 @@ func download(fname, dir string) {
 
 	file, err := os.Create(gzname)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("DEM: %v\n", err)
+		return
 	}
 	client := http.Client{
 		CheckRedirect: func(r *http.Request, via []*http.Request) error {
@@ -31,7 +32,11 @@ func download(fname, dir string) {
 	}
 	resp, err := client.Get(uri)
 	if err != nil {
-		log.Fatal(err)
+		// offline, the lookup reports no data
+		log.Printf("DEM: %v\n", err)
+		file.Close()
+		os.Remove(gzname)
+		return
 	}
 
 	_, err = io.Copy(file, resp.Body)
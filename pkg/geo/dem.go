@@ -28,7 +28,6 @@ func (d *DEMMgr) lookup_and_check(lat, lon float64) (float64, error) {
 				download(fname, d.dem.dir)
 			} else {
 				return e, fmt.Errorf("DEM: No data for %f %f", lat, lon)
-				break
 			}
 		} else {
 			break
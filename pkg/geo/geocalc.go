@@ -64,3 +64,44 @@ func Posit(lat1, lon1, cse, dist float64) (float64, float64) {
 	lon = to_degrees(lon)
 	return lat, lon
 }
+
+// Solve3 solves the 3x3 system m.x = v (Gaussian elimination, partial
+// pivoting), as for the least squares fits; false if m is singular
+// (relative to its largest element).
+func Solve3(m [3][3]float64, v [3]float64) ([3]float64, bool) {
+	var x [3]float64
+	mmax := 0.0
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			mmax = math.Max(mmax, math.Abs(m[r][c]))
+		}
+	}
+	for c := 0; c < 3; c++ {
+		p := c
+		for r := c + 1; r < 3; r++ {
+			if math.Abs(m[r][c]) > math.Abs(m[p][c]) {
+				p = r
+			}
+		}
+		if math.Abs(m[p][c]) <= 1e-12*mmax {
+			return x, false
+		}
+		m[c], m[p] = m[p], m[c]
+		v[c], v[p] = v[p], v[c]
+		for r := c + 1; r < 3; r++ {
+			f := m[r][c] / m[c][c]
+			for k := c; k < 3; k++ {
+				m[r][k] -= f * m[c][k]
+			}
+			v[r] -= f * v[c]
+		}
+	}
+	for r := 2; r >= 0; r-- {
+		s := v[r]
+		for k := r + 1; k < 3; k++ {
+			s -= m[r][k] * x[k]
+		}
+		x[r] = s / m[r][r]
+	}
+	return x, true
+}
@@ -0,0 +1,399 @@
+package geotag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Minimal JPEG / EXIF support: the photo's time from the EXIF, and adding
+// (or replacing) the GPS IFD.
+//
+// Updating the EXIF in place leaves the existing TIFF data where it is, so
+// that all its offsets (including those of maker notes) remain valid. A copy
+// of IFD0 with the GPS IFD pointer, and the GPS IFD, are appended, and the
+// TIFF header pointed at the new IFD0; the old IFD0 is then unreferenced.
+
+const (
+	tag_exififd  = 0x8769
+	tag_gpsifd   = 0x8825
+	tag_datetime = 0x0132
+	tag_dto      = 0x9003 // DateTimeOriginal
+	tag_offto    = 0x9011 // OffsetTimeOriginal
+	tag_subsecto = 0x9291 // SubSecTimeOriginal
+)
+
+const (
+	t_byte     = 1
+	t_ascii    = 2
+	t_short    = 3
+	t_long     = 4
+	t_rational = 5
+)
+
+var type_size = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+var exif_hdr = []byte("Exif\x00\x00")
+
+type ifdentry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte // the 4 byte value / offset field
+}
+
+type tiff struct {
+	b  []byte
+	bo binary.ByteOrder
+}
+
+// JPEG segments: returns the APP1 (EXIF) segment's start and end (including
+// the marker), or -1 if there is none
+func find_exif(jpg []byte) (int, int, error) {
+	if len(jpg) < 4 || jpg[0] != 0xff || jpg[1] != 0xd8 {
+		return -1, -1, fmt.Errorf("not a JPEG")
+	}
+	for p := 2; p+4 <= len(jpg); {
+		if jpg[p] != 0xff {
+			return -1, -1, fmt.Errorf("bad JPEG marker at %d", p)
+		}
+		m := jpg[p+1]
+		if m == 0xd8 || (m >= 0xd0 && m <= 0xd7) || m == 0x01 || m == 0xff {
+			p++
+			continue
+		}
+		if m == 0xda || m == 0xd9 { // start of scan, end of image
+			break
+		}
+		n := int(binary.BigEndian.Uint16(jpg[p+2:]))
+		end := p + 2 + n
+		if end > len(jpg) {
+			return -1, -1, fmt.Errorf("truncated JPEG")
+		}
+		if m == 0xe1 && bytes.HasPrefix(jpg[p+4:end], exif_hdr) {
+			return p, end, nil
+		}
+		p = end
+	}
+	return -1, -1, nil
+}
+
+func new_tiff(b []byte) (*tiff, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("short TIFF header")
+	}
+	t := &tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.bo = binary.LittleEndian
+	case "MM":
+		t.bo = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("bad TIFF byte order")
+	}
+	return t, nil
+}
+
+// Reads an IFD; returns its entries and the offset of the next IFD
+func (t *tiff) read_ifd(off uint32) ([]ifdentry, uint32, error) {
+	if int(off)+2 > len(t.b) {
+		return nil, 0, fmt.Errorf("bad IFD offset")
+	}
+	n := int(t.bo.Uint16(t.b[off:]))
+	p := int(off) + 2
+	if p+12*n+4 > len(t.b) {
+		return nil, 0, fmt.Errorf("truncated IFD")
+	}
+	var ents []ifdentry
+	for j := 0; j < n; j++ {
+		e := t.b[p+12*j:]
+		ents = append(ents, ifdentry{tag: t.bo.Uint16(e), typ: t.bo.Uint16(e[2:]),
+			count: t.bo.Uint32(e[4:]), value: append([]byte{}, e[8:12]...)})
+	}
+	return ents, t.bo.Uint32(t.b[p+12*n:]), nil
+}
+
+// The data of an entry, in place or at its offset
+func (t *tiff) data(e ifdentry) []byte {
+	n := type_size[e.typ] * e.count
+	if n <= 4 {
+		return e.value[:n]
+	}
+	off := t.bo.Uint32(e.value)
+	if uint64(off)+uint64(n) > uint64(len(t.b)) {
+		return nil
+	}
+	return t.b[off : off+n]
+}
+
+func (t *tiff) ascii(e ifdentry) string {
+	return strings.TrimSpace(strings.TrimRight(string(t.data(e)), "\x00"))
+}
+
+func find_tag(ents []ifdentry, tag uint16) (ifdentry, bool) {
+	for _, e := range ents {
+		if e.tag == tag {
+			return e, true
+		}
+	}
+	return ifdentry{}, false
+}
+
+// PhotoTime returns the time the photo was taken, from the EXIF
+// DateTimeOriginal (or DateTime), with any sub-seconds. The time is UTC if the
+// EXIF has an OffsetTimeOriginal; otherwise it is the camera's clock, which
+// is returned as UTC and flagged as such (utc == false).
+func PhotoTime(fn string) (ts time.Time, utc bool, err error) {
+	jpg, err := os.ReadFile(fn)
+	if err != nil {
+		return
+	}
+	start, end, err := find_exif(jpg)
+	if err != nil {
+		return
+	}
+	if start < 0 {
+		err = fmt.Errorf("no EXIF")
+		return
+	}
+	t, err := new_tiff(jpg[start+4+len(exif_hdr) : end])
+	if err != nil {
+		return
+	}
+	ifd0, _, err := t.read_ifd(t.bo.Uint32(t.b[4:]))
+	if err != nil {
+		return
+	}
+	var dt, subsec, offset string
+	if e, ok := find_tag(ifd0, tag_exififd); ok {
+		if eifd, _, xerr := t.read_ifd(t.bo.Uint32(e.value)); xerr == nil {
+			if e, ok := find_tag(eifd, tag_dto); ok {
+				dt = t.ascii(e)
+			}
+			if e, ok := find_tag(eifd, tag_subsecto); ok {
+				subsec = t.ascii(e)
+			}
+			if e, ok := find_tag(eifd, tag_offto); ok {
+				offset = t.ascii(e)
+			}
+		}
+	}
+	if dt == "" {
+		if e, ok := find_tag(ifd0, tag_datetime); ok {
+			dt = t.ascii(e)
+		}
+	}
+	if dt == "" {
+		err = fmt.Errorf("no EXIF date / time")
+		return
+	}
+	if subsec != "" {
+		dt += "." + subsec
+	}
+	if offset != "" {
+		ts, err = time.Parse("2006:01:02 15:04:05.999999999-07:00", dt+offset)
+		utc = err == nil
+		ts = ts.UTC()
+		if err == nil {
+			return
+		}
+	}
+	ts, err = time.Parse("2006:01:02 15:04:05.999999999", dt)
+	return
+}
+
+// Builds IFDs in the file's byte order
+type ifdbuilder struct {
+	bo   binary.ByteOrder
+	ents []ifdentry
+	data [][]byte // out of line data, by entry
+}
+
+func (b *ifdbuilder) add(tag, typ uint16, count uint32, data []byte) {
+	e := ifdentry{tag: tag, typ: typ, count: count, value: make([]byte, 4)}
+	var ext []byte
+	if len(data) <= 4 {
+		copy(e.value, data)
+	} else {
+		ext = data
+	}
+	b.ents = append(b.ents, e)
+	b.data = append(b.data, ext)
+}
+
+func (b *ifdbuilder) rationals(vals ...[2]uint32) []byte {
+	d := make([]byte, 8*len(vals))
+	for j, v := range vals {
+		b.bo.PutUint32(d[8*j:], v[0])
+		b.bo.PutUint32(d[8*j+4:], v[1])
+	}
+	return d
+}
+
+func (b *ifdbuilder) long(v uint32) []byte {
+	d := make([]byte, 4)
+	b.bo.PutUint32(d, v)
+	return d
+}
+
+// Serialises the IFD (sorted by tag) to be placed at off, with its out of
+// line data following
+func (b *ifdbuilder) bytes(off uint32, next uint32) []byte {
+	idx := make([]int, len(b.ents))
+	for j := range idx {
+		idx[j] = j
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return b.ents[idx[i]].tag < b.ents[idx[j]].tag })
+	n := len(b.ents)
+	dpos := off + uint32(2+12*n+4)
+	out := make([]byte, 2+12*n+4)
+	b.bo.PutUint16(out, uint16(n))
+	var ext []byte
+	for k, j := range idx {
+		e := b.ents[j]
+		p := out[2+12*k:]
+		b.bo.PutUint16(p, e.tag)
+		b.bo.PutUint16(p[2:], e.typ)
+		b.bo.PutUint32(p[4:], e.count)
+		if d := b.data[j]; d != nil {
+			b.bo.PutUint32(p[8:], dpos+uint32(len(ext)))
+			ext = append(ext, d...)
+			if len(ext)%2 == 1 {
+				ext = append(ext, 0)
+			}
+		} else {
+			copy(p[8:], e.value)
+		}
+	}
+	b.bo.PutUint32(out[2+12*n:], next)
+	return append(out, ext...)
+}
+
+func dms_rationals(v float64) [][2]uint32 {
+	v = math.Abs(v)
+	d := math.Floor(v)
+	m := math.Floor((v - d) * 60)
+	s := ((v-d)*60 - m) * 60
+	return [][2]uint32{{uint32(d), 1}, {uint32(m), 1}, {uint32(math.Round(s * 10000)), 10000}}
+}
+
+// The GPS IFD for a fix
+func gps_ifd(bo binary.ByteOrder, f Fix) *ifdbuilder {
+	b := &ifdbuilder{bo: bo}
+	b.add(0x0000, t_byte, 4, []byte{2, 3, 0, 0})
+	ns, ew := "N", "E"
+	if f.Lat < 0 {
+		ns = "S"
+	}
+	if f.Lon < 0 {
+		ew = "W"
+	}
+	b.add(0x0001, t_ascii, 2, []byte(ns+"\x00"))
+	b.add(0x0002, t_rational, 3, b.rationals(dms_rationals(f.Lat)...))
+	b.add(0x0003, t_ascii, 2, []byte(ew+"\x00"))
+	b.add(0x0004, t_rational, 3, b.rationals(dms_rationals(f.Lon)...))
+	aref := byte(0)
+	if f.Alt < 0 {
+		aref = 1
+	}
+	b.add(0x0005, t_byte, 1, []byte{aref})
+	b.add(0x0006, t_rational, 1, b.rationals([2]uint32{uint32(math.Round(math.Abs(f.Alt) * 100)), 100}))
+	u := f.Time.UTC()
+	ms := u.Nanosecond() / 1e6
+	b.add(0x0007, t_rational, 3, b.rationals([2]uint32{uint32(u.Hour()), 1}, [2]uint32{uint32(u.Minute()), 1},
+		[2]uint32{uint32(u.Second()*1000 + ms), 1000}))
+	if f.HasHdg {
+		b.add(0x0010, t_ascii, 2, []byte("T\x00"))
+		b.add(0x0011, t_rational, 1, b.rationals([2]uint32{uint32(math.Round(f.Hdg * 100)), 100}))
+	}
+	b.add(0x0012, t_ascii, 7, []byte("WGS-84\x00"))
+	b.add(0x001d, t_ascii, 11, []byte(u.Format("2006:01:02")+"\x00"))
+	return b
+}
+
+// WriteExif adds the fix to the photo's EXIF as the GPS IFD (replacing any
+// existing). The file is replaced atomically.
+func WriteExif(fn string, f Fix) error {
+	jpg, err := os.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	start, end, err := find_exif(jpg)
+	if err != nil {
+		return err
+	}
+	if start < 0 {
+		return fmt.Errorf("no EXIF")
+	}
+	hlen := 4 + len(exif_hdr)
+	t, err := new_tiff(append([]byte{}, jpg[start+hlen:end]...))
+	if err != nil {
+		return err
+	}
+	ifd0, next, err := t.read_ifd(t.bo.Uint32(t.b[4:]))
+	if err != nil {
+		return err
+	}
+
+	if len(t.b)%2 == 1 {
+		t.b = append(t.b, 0)
+	}
+	off0 := uint32(len(t.b))
+	nb := &ifdbuilder{bo: t.bo}
+	for _, e := range ifd0 {
+		if e.tag != tag_gpsifd {
+			// values are left where they are; copy the entry verbatim
+			nb.ents = append(nb.ents, e)
+			nb.data = append(nb.data, nil)
+		}
+	}
+	nb.add(tag_gpsifd, t_long, 1, nb.long(0))
+	goff := off0 + uint32(len(nb.bytes(off0, next)))
+	if goff%2 == 1 {
+		goff++
+	}
+	nb.ents[len(nb.ents)-1].value = nb.long(goff)
+	nifd0 := nb.bytes(off0, next)
+	t.b = append(t.b, nifd0...)
+	if len(t.b)%2 == 1 {
+		t.b = append(t.b, 0)
+	}
+	t.b = append(t.b, gps_ifd(t.bo, f).bytes(goff, 0)...)
+	t.bo.PutUint32(t.b[4:], off0)
+
+	seglen := len(exif_hdr) + len(t.b) + 2
+	if seglen > 0xffff {
+		return fmt.Errorf("EXIF too large")
+	}
+	var out bytes.Buffer
+	out.Write(jpg[:start])
+	out.Write([]byte{0xff, 0xe1, byte(seglen >> 8), byte(seglen)})
+	out.Write(exif_hdr)
+	out.Write(t.b)
+	out.Write(jpg[end:])
+
+	tmp, err := os.CreateTemp(filepath.Dir(fn), ".geotag")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(out.Bytes())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if st, serr := os.Stat(fn); serr == nil {
+			os.Chmod(tmp.Name(), st.Mode())
+		}
+		err = os.Rename(tmp.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package geotag
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+import (
+	"geo"
+	"types"
+)
+
+// Geotagging photos from flight logs; the position, altitude and heading at
+// a photo's time are interpolated from the logs' items.
+
+// Points further apart than this (e.g. between flights) are not interpolated
+const max_gap = 10 * time.Second
+
+type Fix struct {
+	Time   time.Time
+	Lat    float64
+	Lon    float64
+	Alt    float64 // AMSL, if known, else relative
+	Hdg    float64
+	HasHdg bool
+}
+
+type Track struct {
+	pts []Fix
+}
+
+// AddSegment adds a flight's items (with a position) to the track
+func (t *Track) AddSegment(ls types.LogSegment, meta types.FlightMeta) {
+	if len(ls.L.Items) == 0 {
+		return
+	}
+	st := ls.L.Items[0].Stamp
+	for _, b := range ls.L.Items {
+		if b.Lat == 0 && b.Lon == 0 {
+			continue
+		}
+		f := Fix{Lat: b.Lat, Lon: b.Lon, Alt: b.Alt, Time: meta.ItemTime(b, st)}
+		if b.Valid.Has(types.F_GALT) {
+			f.Alt = b.GAlt
+		} else if (ls.H.Flags & types.HOME_ALT) == types.HOME_ALT {
+			f.Alt += ls.H.HomeAlt
+		}
+		if b.Logged(types.F_CSE) && b.Cse != 0xffff {
+			f.Hdg, f.HasHdg = float64(b.Cse), true
+		} else if b.Logged(types.F_COG) {
+			f.Hdg, f.HasHdg = float64(b.Cog), true
+		}
+		t.pts = append(t.pts, f)
+	}
+	sort.SliceStable(t.pts, func(i, j int) bool { return t.pts[i].Time.Before(t.pts[j].Time) })
+}
+
+func (t *Track) Len() int {
+	return len(t.pts)
+}
+
+// Span returns the times of the first and last points
+func (t *Track) Span() (time.Time, time.Time) {
+	if len(t.pts) == 0 {
+		return time.Time{}, time.Time{}
+	}
+	return t.pts[0].Time, t.pts[len(t.pts)-1].Time
+}
+
+// Locate interpolates the fix at ts; false if ts is outside the track (or
+// in a gap)
+func (t *Track) Locate(ts time.Time) (Fix, bool) {
+	n := len(t.pts)
+	j := sort.Search(n, func(i int) bool { return !t.pts[i].Time.Before(ts) })
+	if j == n {
+		return Fix{}, false
+	}
+	p1 := t.pts[j]
+	if p1.Time.Equal(ts) {
+		return p1, true
+	}
+	if j == 0 {
+		return Fix{}, false
+	}
+	p0 := t.pts[j-1]
+	gap := p1.Time.Sub(p0.Time)
+	if gap > max_gap {
+		return Fix{}, false
+	}
+	r := float64(ts.Sub(p0.Time)) / float64(gap)
+	f := Fix{Time: ts, Alt: p0.Alt + r*(p1.Alt-p0.Alt)}
+	cse, dist := geo.Csedist(p0.Lat, p0.Lon, p1.Lat, p1.Lon)
+	f.Lat, f.Lon = geo.Posit(p0.Lat, p0.Lon, cse, dist*r)
+	if p0.HasHdg && p1.HasHdg {
+		d := math.Mod(p1.Hdg-p0.Hdg+540, 360) - 180
+		f.Hdg = math.Mod(p0.Hdg+r*d+360, 360)
+		f.HasHdg = true
+	} else if p0.HasHdg || p1.HasHdg {
+		f.Hdg, f.HasHdg = p0.Hdg, p0.HasHdg
+		if r >= 0.5 || !p0.HasHdg {
+			f.Hdg, f.HasHdg = p1.Hdg, p1.HasHdg
+		}
+	}
+	return f, true
+}
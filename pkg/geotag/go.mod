@@ -0,0 +1,3 @@
+module geotag
+
+go 1.19
@@ -0,0 +1,65 @@
+package geotag
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// XMP sidecars, named as the photo with the extension .xmp (as Adobe
+// applications, darktable and exiftool's default), with the EXIF GPS
+// properties
+
+const xmp_template = `<?xpacket begin="%s" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="%s">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    exif:GPSVersionID="2.3.0.0"
+    exif:GPSLatitude="%s"
+    exif:GPSLongitude="%s"
+    exif:GPSAltitudeRef="%d"
+    exif:GPSAltitude="%d/100"
+    exif:GPSMapDatum="WGS-84"
+    exif:GPSTimeStamp="%s"%s/>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`
+
+// XMP GPSCoordinate, "DDD,MM.mmmmmmK"
+func xmp_coord(v float64, ns string) string {
+	h := ns[0]
+	if v < 0 {
+		h = ns[1]
+		v = -v
+	}
+	d := math.Floor(v)
+	return fmt.Sprintf("%d,%.6f%c", int(d), (v-d)*60, h)
+}
+
+func SidecarName(fn string) string {
+	return strings.TrimSuffix(fn, filepath.Ext(fn)) + ".xmp"
+}
+
+// WriteXmp writes the fix to the photo's sidecar; an existing sidecar (which
+// may hold other metadata) is not overwritten.
+func WriteXmp(fn string, f Fix, generator string) error {
+	xfn := SidecarName(fn)
+	if _, err := os.Stat(xfn); err == nil {
+		return fmt.Errorf("%s exists", filepath.Base(xfn))
+	}
+	aref := 0
+	if f.Alt < 0 {
+		aref = 1
+	}
+	hdg := ""
+	if f.HasHdg {
+		hdg = fmt.Sprintf("\n    exif:GPSImgDirectionRef=\"T\"\n    exif:GPSImgDirection=\"%d/100\"", int(math.Round(f.Hdg*100)))
+	}
+	s := fmt.Sprintf(xmp_template, "\ufeff", generator, xmp_coord(f.Lat, "NS"), xmp_coord(f.Lon, "EW"),
+		aref, int(math.Round(math.Abs(f.Alt)*100)), f.Time.UTC().Format("2006-01-02T15:04:05.000Z"), hdg)
+	return os.WriteFile(xfn, []byte(s), 0644)
+}
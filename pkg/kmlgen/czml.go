@@ -0,0 +1,543 @@
+package kmlgen
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	kml "github.com/twpayne/go-kml"
+	"html"
+	"image/color"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+import (
+	"cli"
+	"geo"
+	"mission"
+	"options"
+	"types"
+)
+
+// Cesium CZML output, for 3D playback in a browser. The aircraft is a time
+// dynamic position and orientation (with the bundled model, as glTF); the
+// track is a set of polylines for each colour scheme (as the KML folders),
+// coloured by the flight mode or the gradient set. Missions are polylines
+// and geozones are volumes between their minimum and maximum altitudes.
+//
+// CZML heights are ellipsoidal; as the KML, altitudes are AMSL and relative
+// to the home's (or, failing that, the DEM's) elevation.
+
+type czpacket map[string]interface{}
+
+func cz_rgba(c color.Color) czpacket {
+	r, g, b, a := c.RGBA()
+	return czpacket{"rgba": []uint32{r >> 8, g >> 8, b >> 8, a >> 8}}
+}
+
+func cz_material(c color.Color) czpacket {
+	return czpacket{"solidColor": czpacket{"color": cz_rgba(c)}}
+}
+
+func cz_time(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// Orientation of the model (X forward, Y left, Z up) in the Earth fixed frame
+// as Cesium's headingPitchRollQuaternion; heading is clockwise from east,
+// pitch positive nose up and roll positive right wing down. Returns
+// [x, y, z, w].
+func cz_orientation(lat, lon float64, a kml.GxAngle) []float64 {
+	d2r := math.Pi / 180
+	h := (a.Heading - 90) * d2r
+	p := -a.Tilt * d2r
+	r := -a.Roll * d2r
+	phi := lat * d2r
+	lam := lon * d2r
+
+	// East, North, Up (columns) to ECEF
+	enu := [3][3]float64{
+		{-math.Sin(lam), -math.Sin(phi) * math.Cos(lam), math.Cos(phi) * math.Cos(lam)},
+		{math.Cos(lam), -math.Sin(phi) * math.Sin(lam), math.Cos(phi) * math.Sin(lam)},
+		{0, math.Cos(phi), math.Sin(phi)},
+	}
+	// Rz(-h) Ry(-p) Rx(r)
+	ch, sh := math.Cos(-h), math.Sin(-h)
+	cp, sp := math.Cos(-p), math.Sin(-p)
+	cr, sr := math.Cos(r), math.Sin(r)
+	hpr := [3][3]float64{
+		{ch * cp, ch*sp*sr - sh*cr, ch*sp*cr + sh*sr},
+		{sh * cp, sh*sp*sr + ch*cr, sh*sp*cr - ch*sr},
+		{-sp, cp * sr, cp * cr},
+	}
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += enu[i][k] * hpr[k][j]
+			}
+		}
+	}
+
+	var x, y, z, w float64
+	if tr := m[0][0] + m[1][1] + m[2][2]; tr > 0 {
+		s := 0.5 / math.Sqrt(tr+1)
+		w = 0.25 / s
+		x = (m[2][1] - m[1][2]) * s
+		y = (m[0][2] - m[2][0]) * s
+		z = (m[1][0] - m[0][1]) * s
+	} else if m[0][0] > m[1][1] && m[0][0] > m[2][2] {
+		s := 2 * math.Sqrt(1+m[0][0]-m[1][1]-m[2][2])
+		w = (m[2][1] - m[1][2]) / s
+		x = 0.25 * s
+		y = (m[0][1] + m[1][0]) / s
+		z = (m[0][2] + m[2][0]) / s
+	} else if m[1][1] > m[2][2] {
+		s := 2 * math.Sqrt(1+m[1][1]-m[0][0]-m[2][2])
+		w = (m[0][2] - m[2][0]) / s
+		x = (m[0][1] + m[1][0]) / s
+		y = 0.25 * s
+		z = (m[1][2] + m[2][1]) / s
+	} else {
+		s := 2 * math.Sqrt(1+m[2][2]-m[0][0]-m[1][1])
+		w = (m[1][0] - m[0][1]) / s
+		x = (m[0][2] + m[2][0]) / s
+		y = (m[1][2] + m[2][1]) / s
+		z = 0.25 * s
+	}
+	return []float64{x, y, z, w}
+}
+
+// The aircraft; sampled position and orientation, with a trailing path
+func cz_aircraft(rec types.LogRec, halt float64, meta types.FlightMeta, desc string) czpacket {
+	st := rec.Items[0].Stamp
+	t0 := meta.ItemTime(rec.Items[0], st)
+	var pos, orient []float64
+	for _, r := range rec.Items {
+		et := math.Round(float64(r.Stamp-st)/1e3) / 1e3
+		pos = append(pos, et, r.Lon, r.Lat, halt+r.Alt)
+		orient = append(orient, et)
+		orient = append(orient, cz_orientation(r.Lat, r.Lon, get_angles(r))...)
+	}
+	p := czpacket{
+		"id":          "aircraft",
+		"name":        "Aircraft",
+		"description": desc,
+		"availability": fmt.Sprintf("%s/%s", cz_time(t0),
+			cz_time(meta.ItemTime(rec.Items[len(rec.Items)-1], st))),
+		"position":    czpacket{"epoch": cz_time(t0), "cartographicDegrees": pos},
+		"orientation": czpacket{"epoch": cz_time(t0), "unitQuaternion": orient},
+		"path": czpacket{"material": cz_material(color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xc0}),
+			"width": 2, "leadTime": 0, "trailTime": 60, "resolution": 1},
+	}
+	mfile := "models/fixedwing.glb"
+	if is_multirotor(meta) {
+		mfile = "models/multirotor.glb"
+	}
+	if b, err := models.ReadFile(mfile); err == nil {
+		p["model"] = czpacket{"gltf": "data:model/gltf-binary;base64," + base64.StdEncoding.EncodeToString(b),
+			"minimumPixelSize": 48}
+	} else {
+		log.Printf("czml: %s %+v\n", mfile, err)
+		p["point"] = czpacket{"pixelSize": 10, "color": cz_rgba(getflightColour(types.FM_ACRO))}
+	}
+	return p
+}
+
+// The track as polylines of runs of the same colour, grouped under a parent
+// packet named for the colour scheme
+func cz_track(rec types.LogRec, halt float64, colmode uint8, name string, viz bool) []czpacket {
+	pid := "track-" + strings.ToLower(name)
+	pkts := []czpacket{{"id": pid, "name": name}}
+	qval0, qval1 := get_qrange(rec, colmode)
+	gcols := Get_gradset(gradset_index())
+	colour := func(r types.LogItem) color.Color {
+		set_qval(&r, colmode, qval0, qval1)
+		var v int
+		switch colmode {
+		case COL_STYLE_RSSI:
+			v = int(r.Rssi)
+		case COL_STYLE_EFFIC:
+			v = int(r.Qval)
+		case COL_STYLE_SPEED:
+			v = int(r.Sval)
+		case COL_STYLE_ALTITUDE:
+			v = int(r.Aval)
+		case COL_STYLE_BATTERY:
+			v = int(r.Bval)
+		default:
+			return getflightColour(r.Fmode)
+		}
+		if v < 0 {
+			v = 0
+		} else if v > 100 {
+			v = 100
+		}
+		g := gcols[v/5]
+		return color.RGBA{R: g.R, G: g.G, B: g.B, A: g.A}
+	}
+
+	var run []float64
+	var rc color.Color
+	flush := func() {
+		if len(run) > 3 {
+			pkts = append(pkts, czpacket{
+				"id":     fmt.Sprintf("%s-%d", pid, len(pkts)),
+				"parent": pid,
+				"polyline": czpacket{"positions": czpacket{"cartographicDegrees": run},
+					"material": cz_material(rc), "width": 4, "arcType": "NONE", "show": viz},
+			})
+		}
+	}
+	for _, r := range rec.Items {
+		c := colour(r)
+		pt := []float64{r.Lon, r.Lat, halt + r.Alt}
+		if rc != nil && c != rc {
+			run = append(run, pt...)
+			flush()
+			run = nil
+		}
+		rc = c
+		run = append(run, pt...)
+	}
+	flush()
+	return pkts
+}
+
+func cz_point(id, parent, name, desc string, lat, lon, alt float64, c color.Color) czpacket {
+	p := czpacket{"id": id, "name": name,
+		"position": czpacket{"cartographicDegrees": []float64{lon, lat, alt}},
+		"point": czpacket{"pixelSize": 10, "color": cz_rgba(c),
+			"outlineColor": cz_rgba(color.White), "outlineWidth": 1},
+		"label": czpacket{"text": name, "font": "12pt sans-serif", "pixelOffset": czpacket{"cartesian2": []int{0, -16}},
+			"showBackground": true, "distanceDisplayCondition": czpacket{"distanceDisplayCondition": []float64{0, 5000}}},
+	}
+	if parent != "" {
+		p["parent"] = parent
+	}
+	if desc != "" {
+		p["description"] = desc
+	}
+	return p
+}
+
+// The mission's path (from / to home as To_kml) and waypoints. Relative
+// altitudes are resolved against the home altitude; if that is not known,
+// such waypoints are placed relative to the ground and the path is clamped to
+// the ground.
+func cz_mission(ms *mission.Mission, hpos types.HomeRec, mmidx int, viz bool) []czpacket {
+	pid := fmt.Sprintf("mission-%d", mmidx)
+	pkts := []czpacket{{"id": pid, "name": fmt.Sprintf("Mission #%d", mmidx)}}
+	addalt, amsl := mission_home_alt(ms, hpos)
+	var path []float64
+	if (hpos.Flags & types.HOME_ARM) != 0 {
+		path = append(path, hpos.HomeLon, hpos.HomeLat, addalt)
+	}
+	rth := false
+	for _, mi := range ms.MissionItems {
+		if mi.Action == "RTH" {
+			rth = true
+		}
+		if !mi.Is_GeoPoint() {
+			continue
+		}
+		alt := float64(mi.Alt)
+		if mi.P3&1 == 0 {
+			alt += addalt
+		}
+		path = append(path, mi.Lon, mi.Lat, alt)
+		p := cz_point(fmt.Sprintf("%s-wp%d", pid, mi.No), pid, fmt.Sprintf("%s %d", mi.Action, mi.No),
+			fmt.Sprintf("Action: %s<br/>Position: %s<br/>Elevation: %dm<br/>GPS Altitude: %.0fm",
+				mi.Action, geo.PositionFormat(mi.Lat, mi.Lon, options.Config.Dms), mi.Alt, alt),
+			mi.Lat, mi.Lon, alt, color.RGBA{R: 0x63, G: 0xa0, B: 0xfc, A: 0xff})
+		p["point"].(czpacket)["show"] = viz
+		p["label"].(czpacket)["show"] = viz
+		if !amsl && mi.P3&1 == 0 {
+			p["point"].(czpacket)["heightReference"] = "RELATIVE_TO_GROUND"
+			p["label"].(czpacket)["heightReference"] = "RELATIVE_TO_GROUND"
+		}
+		pkts = append(pkts, p)
+	}
+	if rth && (hpos.Flags&types.HOME_ARM) != 0 {
+		path = append(path, hpos.HomeLon, hpos.HomeLat, addalt)
+	}
+	if len(path) > 3 {
+		line := czpacket{"positions": czpacket{"cartographicDegrees": path}, "width": 3,
+			"arcType": "NONE", "show": viz,
+			"material": czpacket{"polylineOutline": czpacket{
+				"color":        cz_rgba(color.RGBA{R: 0xff, G: 0, B: 0, A: 0xc0}),
+				"outlineColor": cz_rgba(color.RGBA{R: 0xc0, G: 0xc0, B: 0xc0, A: 0x80}), "outlineWidth": 1}}}
+		if !amsl {
+			line["arcType"] = "GEODESIC"
+			line["clampToGround"] = true
+		}
+		pkts = append(pkts, czpacket{"id": pid + "-path", "parent": pid, "name": "Mission path",
+			"polyline": line})
+	}
+	return pkts
+}
+
+// Safehomes and geozones; the zones are volumes (relative to the ground)
+// from their minimum to maximum altitudes
+func cz_cli(fn string, fb *geo.Frob) []czpacket {
+	pkts := []czpacket{}
+	sha, _, gzone := cli.Read_clifile(fn)
+	for i, sh := range sha {
+		if fb != nil {
+			sh.Lat, sh.Lon, _ = fb.Relocate(sh.Lat, sh.Lon, 0)
+		}
+		p := cz_point(fmt.Sprintf("safehome-%d", i), "", fmt.Sprintf("Safehome %d", i), "",
+			sh.Lat, sh.Lon, 0, color.RGBA{R: 0xfc, G: 0xfc, B: 0, A: 0xff})
+		p["point"].(czpacket)["heightReference"] = "CLAMP_TO_GROUND"
+		p["ellipse"] = czpacket{"semiMajorAxis": cli.Safehome_distance * 1852.0,
+			"semiMinorAxis": cli.Safehome_distance * 1852.0, "fill": false, "outline": true,
+			"outlineColor": cz_rgba(color.RGBA{R: 0xc0, G: 0xc0, B: 0, A: 0xc0})}
+		pkts = append(pkts, p)
+	}
+	if len(gzone) > 0 {
+		pkts = append(pkts, czpacket{"id": "geozones", "name": "Geozones"})
+	}
+	for _, g := range gzone {
+		if len(g.Points) == 0 {
+			continue
+		}
+		c := color.RGBA{R: 0xff, G: 0, B: 0, A: 0xff}
+		if g.Gtype == cli.TYPE_INC {
+			c = color.RGBA{R: 0, G: 0xff, B: 0, A: 0xff}
+		}
+		fill := c
+		fill.A = 0x40
+		vol := czpacket{"height": float64(g.Minalt) / 100.0, "extrudedHeight": float64(g.Maxalt) / 100.0,
+			"heightReference": "RELATIVE_TO_GROUND", "extrudedHeightReference": "RELATIVE_TO_GROUND",
+			"material": cz_material(fill), "outline": true, "outlineColor": cz_rgba(c)}
+		p := czpacket{"id": fmt.Sprintf("geozone-%d", g.Zid), "parent": "geozones",
+			"name": fmt.Sprintf("Geozone %d", g.Zid), "description": strings.ReplaceAll(html.EscapeString(g.To_string()), "\n", "<br/>")}
+		switch g.Shape {
+		case cli.SHAPE_CIRCLE:
+			if len(g.Points) < 2 {
+				continue
+			}
+			lat, lon := g.Points[0].Lat, g.Points[0].Lon
+			if fb != nil {
+				lat, lon, _ = fb.Relocate(lat, lon, 0)
+			}
+			p["position"] = czpacket{"cartographicDegrees": []float64{lon, lat, 0}}
+			vol["semiMajorAxis"] = g.Points[1].Lat
+			vol["semiMinorAxis"] = g.Points[1].Lat
+			p["ellipse"] = vol
+		case cli.SHAPE_POLY:
+			var pts []float64
+			for _, pt := range g.Points {
+				if fb != nil {
+					pt.Lat, pt.Lon, _ = fb.Relocate(pt.Lat, pt.Lon, 0)
+				}
+				pts = append(pts, pt.Lon, pt.Lat, 0)
+			}
+			vol["positions"] = czpacket{"cartographicDegrees": pts}
+			p["polygon"] = vol
+		default:
+			continue
+		}
+		pkts = append(pkts, p)
+	}
+	return pkts
+}
+
+// Missions (as options.Config.Mission, .MissionIndex) and the CLI file,
+// relocated if rebasing
+func cz_plan(hpos types.HomeRec, fb *geo.Frob) []czpacket {
+	var pkts []czpacket
+	if len(options.Config.Mission) > 0 {
+		_, mm, err := mission.Read_Mission_File(options.Config.Mission)
+		if err == nil {
+			isviz := true
+			for nm, _ := range mm.Segment {
+				nmx := nm + 1
+				if options.Config.MissionIndex == 0 || nmx == options.Config.MissionIndex {
+					ms := mm.To_mission(nmx)
+					if fb != nil {
+						if ms.Metadata.Homey != 0 && ms.Metadata.Homex != 0 {
+							fb.Set_origin(ms.Metadata.Homey, ms.Metadata.Homex, 0)
+							ms.Metadata.Homey, ms.Metadata.Homex, _ = fb.Get_rebase()
+						}
+						for k, mi := range ms.MissionItems {
+							if mi.Is_GeoPoint() {
+								ms.MissionItems[k].Lat, ms.MissionItems[k].Lon, _ = fb.Relocate(mi.Lat, mi.Lon, 0)
+							}
+						}
+					}
+					pkts = append(pkts, cz_mission(ms, hpos, nmx, isviz)...)
+					isviz = false
+				}
+			}
+		}
+	}
+	if len(options.Config.Cli) > 0 {
+		pkts = append(pkts, cz_cli(options.Config.Cli, fb)...)
+	}
+	return pkts
+}
+
+func cz_table(m map[string]string) string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString("<table>")
+	for _, k := range keys {
+		sb.WriteString(fmt.Sprintf("<tr><td><b>%s</b></td><td>%s</td></tr>", html.EscapeString(k), html.EscapeString(m[k])))
+	}
+	sb.WriteString("</table>")
+	return sb.String()
+}
+
+// GenerateCZML is the CZML analogue of GenerateKML. It also writes a
+// standalone CesiumJS page (outfn, with the extension .html) embedding the
+// CZML.
+func GenerateCZML(hpos types.HomeRec, rec types.LogRec, outfn string,
+	meta types.FlightMeta, smap types.MapRec, evs []types.LogEvent, gv func() string) {
+	if (hpos.Flags&types.HOME_ARM) != 0 && (hpos.Flags&types.HOME_ALT) == 0 {
+		d := geo.InitDem("")
+		if elev, err := d.Get_Elevation(hpos.HomeLat, hpos.HomeLon); err == nil {
+			hpos.HomeAlt = elev
+			hpos.Flags |= types.HOME_ALT
+		}
+	}
+	halt := 0.0
+	if (hpos.Flags & types.HOME_ALT) == types.HOME_ALT {
+		halt = hpos.HomeAlt
+	}
+
+	sm := map[string]string{"Log": meta.LogName(), "Generator": gv()}
+	for k, v := range meta.Summary() {
+		sm[k] = v
+	}
+	for k, v := range smap {
+		sm[k] = v
+	}
+	if s, ok := meta.ShowDisarm(); ok {
+		sm["Disarm"] = s
+	}
+	desc := cz_table(sm)
+
+	// logs without UTC are timed from the flight's date
+	st := rec.Items[0].Stamp
+	t0 := meta.ItemTime(rec.Items[0], st)
+	t1 := meta.ItemTime(rec.Items[len(rec.Items)-1], st)
+	pkts := []czpacket{{
+		"id": "document", "name": meta.LogName(), "version": "1.0",
+		"clock": czpacket{"interval": fmt.Sprintf("%s/%s", cz_time(t0), cz_time(t1)),
+			"currentTime": cz_time(t0), "multiplier": 1, "range": "LOOP_STOP",
+			"step": "SYSTEM_CLOCK_MULTIPLIER"},
+	}}
+	pkts = append(pkts, cz_aircraft(rec, halt, meta, desc))
+
+	defviz := !(options.Config.Rssi && rec.Items[0].Rssi > 0)
+	pkts = append(pkts, cz_track(rec, halt, COL_STYLE_MODE, "Flight modes", defviz)...)
+	if rec.Cap&types.CAP_RSSI_VALID != 0 {
+		pkts = append(pkts, cz_track(rec, halt, COL_STYLE_RSSI, "RSSI", !defviz)...)
+	}
+	for _, t := range []struct {
+		cap   uint16
+		aflag int
+		mode  uint8
+		name  string
+	}{
+		{types.CAP_ENERGY, types.AFlags_EFFIC, COL_STYLE_EFFIC, "Efficiency"},
+		{types.CAP_SPEED, types.AFlags_SPEED, COL_STYLE_SPEED, "Speed"},
+		{types.CAP_ALTITUDE, types.AFlags_ALTITUDE, COL_STYLE_ALTITUDE, "Altitude"},
+		{types.CAP_VOLTS, types.AFlags_BATTERY, COL_STYLE_BATTERY, "Battery"},
+	} {
+		if (rec.Cap&t.cap) == t.cap && (options.Config.Aflags&t.aflag) == t.aflag {
+			pkts = append(pkts, cz_track(rec, halt, t.mode, t.name, false)...)
+		}
+	}
+
+	if (hpos.Flags & types.HOME_ARM) != 0 {
+		pkts = append(pkts, cz_point("home", "", "Home", geo.PositionFormat(hpos.HomeLat, hpos.HomeLon, options.Config.Dms),
+			hpos.HomeLat, hpos.HomeLon, halt, color.RGBA{R: 0, G: 0xff, B: 0, A: 0xff}))
+	}
+	if len(evs) > 0 {
+		pkts = append(pkts, czpacket{"id": "events", "name": "Events"})
+	}
+	for j, e := range evs {
+		if e.Lat == 0 && e.Lon == 0 {
+			continue
+		}
+		name := e.Kind.String()
+		if e.Detail != "" {
+			name = fmt.Sprintf("%s: %s", name, e.Detail)
+		}
+		pkts = append(pkts, cz_point(fmt.Sprintf("event-%d", j), "events", name, "",
+			e.Lat, e.Lon, halt+e.Alt, color.RGBA{R: 0xff, G: 0xff, B: 0, A: 0xff}))
+	}
+	pkts = append(pkts, cz_plan(hpos, geo.Getfrobnication())...)
+	write_czml(outfn, meta.LogName(), pkts)
+}
+
+// GeneratePlanCZML writes the mission and / or CLI file without a log, as
+// GeneratePlanGeoJSON
+func GeneratePlanCZML(outfn string, gv func() string) {
+	name := filepath.Base(options.Config.Mission)
+	if len(options.Config.Mission) == 0 {
+		name = filepath.Base(options.Config.Cli)
+	}
+	pkts := []czpacket{{"id": "document", "name": name, "version": "1.0", "description": gv()}}
+	pkts = append(pkts, cz_plan(types.HomeRec{}, geo.Getfrobnication())...)
+	write_czml(outfn, name, pkts)
+}
+
+// Writes the CZML document and its viewer page
+func write_czml(outfn string, name string, pkts []czpacket) {
+	b, err := json.Marshal(pkts)
+	if err == nil {
+		err = os.WriteFile(outfn, b, 0644)
+	}
+	if err == nil {
+		hfn := strings.TrimSuffix(outfn, filepath.Ext(outfn)) + ".html"
+		err = os.WriteFile(hfn, []byte(fmt.Sprintf(czml_page, html.EscapeString(name), b)), 0644)
+	}
+	if err != nil {
+		log.Fatalf("czml: %+v\n", err)
+	}
+}
+
+// A CesiumJS viewer with OpenStreetMap imagery, which requires no Cesium ion
+// access token
+const czml_page = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<script src="https://cesium.com/downloads/cesiumjs/releases/1.114/Build/Cesium/Cesium.js"></script>
+<link href="https://cesium.com/downloads/cesiumjs/releases/1.114/Build/Cesium/Widgets/widgets.css" rel="stylesheet">
+<style>html, body, #cesium { width: 100%%; height: 100%%; margin: 0; padding: 0; overflow: hidden; }</style>
+</head>
+<body>
+<div id="cesium"></div>
+<script>
+const czml = %s;
+const viewer = new Cesium.Viewer("cesium", {
+  baseLayer: new Cesium.ImageryLayer(new Cesium.OpenStreetMapImageryProvider({url: "https://tile.openstreetmap.org/"})),
+  baseLayerPicker: false,
+  geocoder: false,
+  shouldAnimate: false,
+});
+Cesium.CzmlDataSource.load(czml).then(function (ds) {
+  viewer.dataSources.add(ds);
+  const ac = ds.entities.getById("aircraft");
+  if (ac) {
+    viewer.flyTo(ds).then(function () { viewer.trackedEntity = ac; });
+  }
+});
+</script>
+</body>
+</html>
+`
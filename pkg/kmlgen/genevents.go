@@ -0,0 +1,194 @@
+package kmlgen
+
+import (
+	"fmt"
+	kml "github.com/twpayne/go-kml"
+	"github.com/twpayne/go-kml/icon"
+	"sort"
+	"strings"
+	"time"
+)
+
+import (
+	"geo"
+	"options"
+	"types"
+)
+
+// A placemark of the Events folder; either a log event or a maximum from the
+// flight's statistics
+type evmark struct {
+	ev    types.LogEvent
+	name  string
+	style string
+}
+
+var event_styles = []struct {
+	kind   types.EventKind
+	id     string
+	paddle string
+}{
+	{types.EV_ARM, "evArm", "grn-circle"},
+	{types.EV_DISARM, "evDisarm", "red-square"},
+	{types.EV_MODE, "evMode", "blu-circle"},
+	{types.EV_FAILSAFE, "evFailsafe", "red-stars"},
+	{types.EV_FSCLEAR, "evFSClear", "grn-stars"},
+	{types.EV_HWFAIL, "evHWFail", "purple-stars"},
+	{types.EV_HWOK, "evHWOK", "purple-circle"},
+	{types.EV_WAYPOINT, "evWP", "ltblu-circle"},
+	{types.EV_GPSLOST, "evGPSLost", "ylw-square"},
+	{types.EV_GPSFIX, "evGPSFix", "ylw-circle"},
+	{types.EV_LOG, "evLog", "wht-diamond"},
+	{types.EV_LOGERR, "evLogErr", "pink-diamond"},
+}
+
+const stats_style = "evStats"
+
+func event_style(k types.EventKind) string {
+	for _, s := range event_styles {
+		if s.kind == k {
+			return s.id
+		}
+	}
+	return "evLog"
+}
+
+func generate_event_styles() []kml.Element {
+	var el []kml.Element
+	for _, s := range event_styles {
+		el = append(el, kml.SharedStyle(s.id, icon.PaddleIconStyle(s.paddle)).
+			Add(balloon_style(BS_NAME_DESC)))
+	}
+	el = append(el, kml.SharedStyle(stats_style, icon.PaddleIconStyle("blu-diamond")).
+		Add(balloon_style(BS_NAME_DESC)))
+	return el
+}
+
+// Returns the index of the item at the time t (relative to the first item, as
+// LogRec.Stats)
+func item_index(rec types.LogRec, t uint64) int {
+	st := rec.Items[0].Stamp
+	for j, r := range rec.Items {
+		if r.Stamp-st >= t {
+			return j
+		}
+	}
+	return len(rec.Items) - 1
+}
+
+func item_at(rec types.LogRec, t uint64) types.LogItem {
+	return rec.Items[item_index(rec, t)]
+}
+
+func item_event(r types.LogItem, detail string) types.LogEvent {
+	return types.LogEvent{Stamp: r.Stamp, Utc: r.Utc, Lat: r.Lat, Lon: r.Lon, Alt: r.Alt, Detail: detail}
+}
+
+// Collects the placemarks: the log's events, with the disarm reason added to
+// the final disarm, and the times of maximum altitude, range and speed
+func get_evmarks(rec types.LogRec, meta types.FlightMeta, evs []types.LogEvent) []evmark {
+	var marks []evmark
+	lastdis := -1
+	for _, e := range evs {
+		if e.Kind == types.EV_DISARM {
+			lastdis = len(marks)
+		}
+		marks = append(marks, evmark{ev: e, name: e.Kind.String(), style: event_style(e.Kind)})
+	}
+
+	if s, ok := meta.ShowDisarm(); ok {
+		if lastdis == -1 {
+			e := item_event(rec.Items[len(rec.Items)-1], "")
+			e.Kind = types.EV_DISARM
+			lastdis = len(marks)
+			marks = append(marks, evmark{ev: e, name: e.Kind.String(), style: event_style(e.Kind)})
+		}
+		d := &marks[lastdis].ev.Detail
+		if *d == "" {
+			*d = s
+		} else {
+			*d = *d + ", " + s
+		}
+	}
+
+	stats := rec.Stats()
+	if stats.Max_alt > 0 {
+		r := item_at(rec, stats.Max_alt_time)
+		marks = append(marks, evmark{ev: item_event(r, fmt.Sprintf("%.1f m", stats.Max_alt)),
+			name: "Max altitude", style: stats_style})
+	}
+	if stats.Max_range > 0 {
+		r := item_at(rec, stats.Max_range_time)
+		marks = append(marks, evmark{ev: item_event(r, fmt.Sprintf("%.0f m", stats.Max_range*1852.0)),
+			name: "Max range", style: stats_style})
+	}
+	if stats.Max_speed > 0 {
+		r := item_at(rec, stats.Max_speed_time)
+		marks = append(marks, evmark{ev: item_event(r, fmt.Sprintf("%.1f m/s", stats.Max_speed)),
+			name: "Max speed", style: stats_style})
+	}
+
+	sort.SliceStable(marks, func(i, j int) bool {
+		return marks[i].ev.Stamp < marks[j].ev.Stamp
+	})
+	return marks
+}
+
+// Generates the Events folder, with a placemark per event; events before the
+// first GPS fix are placed at home
+func add_events(rec types.LogRec, hpos types.HomeRec, meta types.FlightMeta, evs []types.LogEvent) kml.Element {
+	f := kml.Folder(kml.Name("Events")).Add(kml.Visibility(true)).
+		Add(generate_event_styles()...)
+
+	st := rec.Items[0].Stamp
+	for _, m := range get_evmarks(rec, meta, evs) {
+		e := m.ev
+		if e.Lat == 0 && e.Lon == 0 {
+			if hpos.Flags == 0 {
+				continue
+			}
+			e.Lat = hpos.HomeLat
+			e.Lon = hpos.HomeLon
+		}
+		var alt float64
+		var altmode kml.AltitudeModeEnum
+		if (hpos.Flags & types.HOME_ALT) == types.HOME_ALT {
+			alt = hpos.HomeAlt + e.Alt
+			altmode = kml.AltitudeModeAbsolute
+		} else {
+			alt = e.Alt
+			altmode = kml.AltitudeModeRelativeToGround
+		}
+		et := (time.Duration(e.Stamp) - time.Duration(st)) * time.Microsecond
+
+		name := m.name
+		if e.Detail != "" {
+			name = name + ": " + e.Detail
+		}
+
+		var sb strings.Builder
+		sb.Write([]byte(`<table style="border="1px" silver; border="1" silver; rules="all";;">`))
+		if !e.Utc.IsZero() {
+			sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%s</td></tr>", "Time", e.Utc.Format("2006‑01‑02T15:04:05.99MST"))))
+		}
+		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%.1fs</td></tr>", "Elapsed", et.Seconds())))
+		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%s</td></tr>", "Position", geo.PositionFormat(e.Lat, e.Lon, options.Config.Dms))))
+		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%.0f m</td></tr>", "Elevation", e.Alt)))
+		sb.Write([]byte("</table>"))
+
+		k := kml.Placemark(
+			kml.Name(name),
+			kml.Description(sb.String()),
+			kml.StyleURL("#"+m.style),
+			kml.Point(
+				kml.AltitudeMode(altmode),
+				kml.Coordinates(kml.Coordinate{Lon: e.Lon, Lat: e.Lat, Alt: alt}),
+			),
+		)
+		if !e.Utc.IsZero() {
+			k.Add(kml.TimeStamp(kml.When(e.Utc)))
+		}
+		f.Add(k)
+	}
+	return f
+}
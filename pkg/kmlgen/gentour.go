@@ -0,0 +1,145 @@
+package kmlgen
+
+import (
+	"fmt"
+	kml "github.com/twpayne/go-kml"
+	"math"
+	"strconv"
+	"strings"
+)
+
+import (
+	"types"
+)
+
+// A gx:Tour flying a camera along the track, behind the aircraft ("chase") or
+// circling it ("orbit"), pausing at the maxima of the flight's statistics.
+// The tour is specified (options.Config.Tour) as a mode, optionally followed
+// by comma separated terms:
+//   lag=m     horizontal distance of the camera from the aircraft (default 60)
+//   height=m  height of the camera above the aircraft (default 25)
+//   scale=n   time compression, n seconds of flight per tour second (default 4)
+//   pause=s   pause at each maximum (default 3)
+// e.g. "chase", "orbit,lag=100,scale=10".
+
+type TourSpec struct {
+	Mode   string // "chase", "orbit", or "" for none
+	Lag    float64
+	Height float64
+	Scale  float64
+	Pause  float64
+}
+
+var DefaultTour = TourSpec{Lag: 60, Height: 25, Scale: 4, Pause: 3}
+
+// Orbit rate, degrees per tour second
+const orbit_rate = 12.0
+
+func ParseTour(s string) (TourSpec, error) {
+	ts := DefaultTour
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		k, v, hasv := strings.Cut(p, "=")
+		var f float64
+		if hasv {
+			var err error
+			if f, err = strconv.ParseFloat(v, 64); err != nil || f < 0 {
+				return ts, fmt.Errorf("tour: bad value \"%s\"", p)
+			}
+		}
+		switch {
+		case k == "" || k == "none":
+		case (k == "chase" || k == "orbit") && !hasv:
+			ts.Mode = k
+		case k == "lag" && hasv:
+			ts.Lag = f
+		case k == "height" && hasv:
+			ts.Height = f
+		case k == "scale" && hasv && f > 0:
+			ts.Scale = f
+		case k == "pause" && hasv:
+			ts.Pause = f
+		default:
+			return ts, fmt.Errorf("tour: unknown term \"%s\"", p)
+		}
+	}
+	if ts.Mode == "" && s != "" && s != "none" {
+		ts.Mode = "chase"
+	}
+	return ts, nil
+}
+
+func (ts TourSpec) Enabled() bool {
+	return ts.Mode != ""
+}
+
+// Indices of the items at the times of maximum altitude, range, speed and
+// current (as LogStats.Summary)
+func key_items(rec types.LogRec) map[int]bool {
+	keys := make(map[int]bool)
+	stats := rec.Stats()
+	for _, k := range []struct {
+		v float64
+		t uint64
+	}{{stats.Max_alt, stats.Max_alt_time}, {stats.Max_range, stats.Max_range_time},
+		{stats.Max_speed, stats.Max_speed_time}, {stats.Max_current, stats.Max_current_time}} {
+		if k.v > 0 {
+			keys[item_index(rec, k.t)] = true
+		}
+	}
+	return keys
+}
+
+// Generates the tour; a FlyTo per track point, timed from the log, so the
+// time slider (and hence any gx:Track model) follows the camera
+func add_tour(rec types.LogRec, hpos types.HomeRec, meta types.FlightMeta, ts TourSpec) kml.Element {
+	var altmode kml.AltitudeModeEnum
+	var halt float64
+	if (hpos.Flags & types.HOME_ALT) == types.HOME_ALT {
+		halt = hpos.HomeAlt
+		altmode = kml.AltitudeModeAbsolute
+	} else {
+		altmode = kml.AltitudeModeRelativeToGround
+	}
+	tilt := math.Atan2(ts.Lag, ts.Height) * 180 / math.Pi
+	rng := math.Hypot(ts.Lag, ts.Height)
+	keys := key_items(rec)
+
+	pl := kml.GxPlaylist()
+	elapsed := 0.0
+	h0 := get_angles(rec.Items[0]).Heading
+	for j, r := range rec.Items {
+		dur := 2.0
+		if j > 0 {
+			if r.Stamp <= rec.Items[j-1].Stamp {
+				continue
+			}
+			dur = float64(r.Stamp-rec.Items[j-1].Stamp) / 1e6 / ts.Scale
+		}
+		elapsed += dur
+		var heading float64
+		if ts.Mode == "orbit" {
+			heading = math.Mod(h0+orbit_rate*elapsed, 360)
+		} else {
+			heading = get_angles(r).Heading
+		}
+		pl.Add(kml.GxFlyTo(
+			kml.GxDuration(dur),
+			kml.GxFlyToMode(kml.GxFlyToModeSmooth),
+			kml.LookAt(
+				kml.GxTimeStamp(kml.When(meta.ItemTime(r, rec.Items[0].Stamp))),
+				kml.Longitude(r.Lon),
+				kml.Latitude(r.Lat),
+				kml.Altitude(halt+r.Alt),
+				kml.Heading(heading),
+				kml.Tilt(tilt),
+				kml.Range(rng),
+				kml.AltitudeMode(altmode),
+			),
+		))
+		if keys[j] && ts.Pause > 0 {
+			pl.Add(kml.GxWait(kml.GxDuration(ts.Pause)))
+		}
+	}
+	return kml.GxTour(kml.Name(fmt.Sprintf("Flythrough (%s)", ts.Mode)), pl)
+}
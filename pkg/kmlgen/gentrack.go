@@ -0,0 +1,100 @@
+package kmlgen
+
+import (
+	"embed"
+	kml "github.com/twpayne/go-kml"
+	"log"
+)
+
+import (
+	"types"
+)
+
+// COLLADA models for the gx:Track, nose to +Y, Z up, in metres (drawn large
+// enough to be seen from a distance)
+//
+//go:embed models
+var models embed.FS
+
+const track_icon = "https://earth.google.com/images/kml-icons/track-directional/track-0.png"
+
+// Fixed wing have one or two motors; a tricopter's yaw servo means that the
+// servos alone do not identify a plane.
+func is_multirotor(meta types.FlightMeta) bool {
+	return meta.Motors > 2
+}
+
+// gx:angles from the item's heading and attitude. LogItem.Pitch is positive
+// nose down (INAV); KML tilt and roll are clockwise about the model's X
+// (right) and Y (forward) axes, seen from the positive end.
+func get_angles(r types.LogItem) kml.GxAngle {
+	var a kml.GxAngle
+	if r.Logged(types.F_CSE) && r.Cse != 0xffff {
+		a.Heading = float64(r.Cse)
+	} else if r.Logged(types.F_COG) {
+		a.Heading = float64(r.Cog)
+	}
+	if r.Logged(types.F_ATTITUDE) {
+		a.Tilt = float64(r.Pitch)
+		a.Roll = -float64(r.Roll)
+	}
+	return a
+}
+
+// Generates a single gx:Track of the flight, with the aircraft's attitude,
+// which Google Earth animates with the time slider. The model is only added
+// for KMZ, which bundles it; the returned files are those to add to the KMZ.
+func add_gx_track(rec types.LogRec, hpos types.HomeRec, meta types.FlightMeta, withmodel bool) (kml.Element, map[string][]byte) {
+	var altmode kml.AltitudeModeEnum
+	var halt float64
+	if (hpos.Flags & types.HOME_ALT) == types.HOME_ALT {
+		halt = hpos.HomeAlt
+		altmode = kml.AltitudeModeAbsolute
+	} else {
+		altmode = kml.AltitudeModeRelativeToGround
+	}
+
+	t := kml.GxTrack(kml.AltitudeMode(altmode))
+	st := rec.Items[0].Stamp
+	for _, r := range rec.Items {
+		t.Add(kml.When(meta.ItemTime(r, st)))
+	}
+	for _, r := range rec.Items {
+		t.Add(kml.GxCoord(kml.Coordinate{Lon: r.Lon, Lat: r.Lat, Alt: halt + r.Alt}))
+	}
+	for _, r := range rec.Items {
+		t.Add(kml.GxAngles(get_angles(r)))
+	}
+
+	var files map[string][]byte
+	if withmodel {
+		mfile := "models/fixedwing.dae"
+		if is_multirotor(meta) {
+			mfile = "models/multirotor.dae"
+		}
+		if b, err := models.ReadFile(mfile); err == nil {
+			files = map[string][]byte{mfile: b}
+			t.Add(kml.Model(kml.Link(kml.Href(mfile))))
+		} else {
+			log.Printf("kmlbuilder: %s %+v\n", mfile, err)
+		}
+	}
+
+	k := kml.Placemark(
+		kml.Name("Aircraft"),
+		kml.Style(
+			kml.IconStyle(
+				kml.Icon(
+					kml.Href(track_icon),
+				),
+			),
+			kml.LineStyle(
+				kml.Width(2),
+				kml.Color(getflightColour(types.FM_ACRO)),
+			),
+		),
+		t,
+	)
+	f := kml.Folder(kml.Name("Flight track")).Add(kml.Visibility(true)).Add(k)
+	return f, files
+}
@@ -0,0 +1,74 @@
+package kmlgen
+
+import (
+	"fmt"
+	kml "github.com/twpayne/go-kml"
+	"github.com/twpayne/go-kml/icon"
+	"image/color"
+	"math"
+	"strings"
+)
+
+import (
+	"geo"
+	"options"
+	"types"
+	"wind"
+)
+
+const wind_step = 30 * 1000000 // µs between wind arrows
+
+// Generates the Wind folder, an arrow (pointing downwind, scaled by the wind
+// speed) every wind_step along the track
+func add_wind(rec types.LogRec, hpos types.HomeRec) kml.Element {
+	f := kml.Folder(kml.Name("Wind")).Add(kml.Visibility(options.Config.Visibility == 1))
+	next := uint64(0)
+	for _, r := range rec.Items {
+		if r.Stamp < next || !r.Logged(types.F_WIND) || (r.Lat == 0 && r.Lon == 0) {
+			continue
+		}
+		next = r.Stamp + wind_step
+		dir, spd := wind.FromDir(r.Wind)
+		var alt float64
+		var altmode kml.AltitudeModeEnum
+		if (hpos.Flags & types.HOME_ALT) == types.HOME_ALT {
+			alt = hpos.HomeAlt + r.Alt
+			altmode = kml.AltitudeModeAbsolute
+		} else {
+			alt = r.Alt
+			altmode = kml.AltitudeModeRelativeToGround
+		}
+
+		var sb strings.Builder
+		sb.Write([]byte(`<table style="border="1px" silver; border="1" silver; rules="all";;">`))
+		if !r.Utc.IsZero() {
+			sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%s</td></tr>", "Time", r.Utc.Format("2006‑01‑02T15:04:05.99MST"))))
+		}
+		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%.1f m/s from %03.0f°</td></tr>", "Wind", spd, dir)))
+		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%s</td></tr>", "Position", geo.PositionFormat(r.Lat, r.Lon, options.Config.Dms))))
+		sb.Write([]byte("</table>"))
+
+		k := kml.Placemark(
+			kml.Name(fmt.Sprintf("%.1f m/s", spd)),
+			kml.Description(sb.String()),
+			kml.Style(
+				kml.IconStyle(
+					kml.Color(color.RGBA{R: 0x40, G: 0xc0, B: 0xff, A: 0xff}),
+					kml.Scale(math.Min(2.0, 0.6+spd/10)),
+					kml.Heading(math.Round(math.Mod(dir+180, 360))),
+					kml.Icon(kml.Href(icon.ShapeHref("arrow"))),
+				),
+				kml.LabelStyle(kml.Scale(0.6)),
+			).Add(balloon_style(BS_NAME_DESC)),
+			kml.Point(
+				kml.AltitudeMode(altmode),
+				kml.Coordinates(kml.Coordinate{Lon: r.Lon, Lat: r.Lat, Alt: alt}),
+			),
+		)
+		if !r.Utc.IsZero() {
+			k.Add(kml.TimeStamp(kml.When(r.Utc)))
+		}
+		f.Add(k)
+	}
+	return f
+}
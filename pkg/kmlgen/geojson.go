@@ -0,0 +1,321 @@
+package kmlgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+import (
+	"cli"
+	"geo"
+	"mission"
+	"options"
+	"types"
+)
+
+// GeoJSON (RFC 7946) output, as an alternative to KML for web maps. The
+// flight is a FeatureCollection of the track (a LineString, whose properties
+// are the flight's summary), a Point per track point with the LogItem fields
+// as properties, the homes, the events, and any mission and CLI (safehomes,
+// geozones) file. Every Feature has a "kind" property to distinguish them.
+
+type GeoGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type GeoFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoGeometry            `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geocollection struct {
+	Type     string       `json:"type"`
+	Name     string       `json:"name,omitempty"`
+	Features []GeoFeature `json:"features"`
+}
+
+func geo_feature(gtype string, coords interface{}, kind string, props map[string]interface{}) GeoFeature {
+	if props == nil {
+		props = make(map[string]interface{})
+	}
+	props["kind"] = kind
+	return GeoFeature{Type: "Feature", Geometry: GeoGeometry{Type: gtype, Coordinates: coords}, Properties: props}
+}
+
+// Properties of a track point; the fields of LogItem, less the KML colour
+// scaling. Non finite values (which JSON cannot represent) are null.
+func item_props(r types.LogItem) map[string]interface{} {
+	props := make(map[string]interface{})
+	v := reflect.ValueOf(r)
+	t := v.Type()
+	for j := 0; j < t.NumField(); j++ {
+		name := t.Field(j).Name
+		switch name {
+		case "Qval", "Sval", "Aval", "Bval":
+			continue
+		}
+		f := v.Field(j)
+		var p interface{}
+		switch f.Kind() {
+		case reflect.Float64:
+			if x := f.Float(); !math.IsNaN(x) && !math.IsInf(x, 0) {
+				p = x
+			}
+		default:
+			p = f.Interface()
+		}
+		props[strings.ToLower(name)] = p
+	}
+	if r.Valid != 0 {
+		props["fields"] = r.Valid.String()
+	}
+	if !r.Utc.IsZero() {
+		props["utc"] = r.Utc.Format(time.RFC3339Nano)
+	}
+	return props
+}
+
+func geo_homes(hpos types.HomeRec) []GeoFeature {
+	var feats []GeoFeature
+	if hpos.Flags == 0 {
+		return feats
+	}
+	props := make(map[string]interface{})
+	if (hpos.Flags & types.HOME_ALT) == types.HOME_ALT {
+		props["alt"] = hpos.HomeAlt
+	}
+	feats = append(feats, geo_feature("Point", []float64{hpos.HomeLon, hpos.HomeLat}, "home", props))
+	if (hpos.Flags & types.HOME_SAFE) == types.HOME_SAFE {
+		feats = append(feats, geo_feature("Point", []float64{hpos.SafeLon, hpos.SafeLat}, "safehome", nil))
+	}
+	return feats
+}
+
+func geo_circle(lat, lon, radius float64) [][][]float64 {
+	var ring [][]float64
+	for j := 0; j < 360; j += 5 {
+		plat, plon := geo.Posit(lat, lon, float64(j), radius/1852.0)
+		ring = append(ring, []float64{plon, plat})
+	}
+	ring = append(ring, ring[0])
+	return [][][]float64{ring}
+}
+
+// Mission_geojson returns the mission's path (from home, if known) and its
+// waypoints, with the mission items' attributes as properties. Positions are
+// 3D (AMSL), relative altitudes being resolved against the home altitude; if
+// that is not known, positions are 2D
+func Mission_geojson(ms *mission.Mission, hpos types.HomeRec, mmidx int) []GeoFeature {
+	var feats []GeoFeature
+	var path [][]float64
+	addalt, is3d := mission_home_alt(ms, hpos)
+	position := func(lon, lat, alt float64) []float64 {
+		if is3d {
+			return []float64{lon, lat, alt}
+		}
+		return []float64{lon, lat}
+	}
+	if (hpos.Flags & types.HOME_ARM) != 0 {
+		path = append(path, position(hpos.HomeLon, hpos.HomeLat, addalt))
+	}
+	rth := false
+	for _, mi := range ms.MissionItems {
+		if mi.Action == "RTH" {
+			rth = true
+		}
+		if !mi.Is_GeoPoint() {
+			continue
+		}
+		alt := float64(mi.Alt)
+		if mi.P3&1 == 0 {
+			alt += addalt
+		}
+		pt := position(mi.Lon, mi.Lat, alt)
+		path = append(path, pt)
+		feats = append(feats, geo_feature("Point", pt, "waypoint", map[string]interface{}{
+			"mission": mmidx, "no": mi.No, "action": mi.Action, "alt": mi.Alt,
+			"amsl": mi.P3&1 == 1, "p1": mi.P1, "p2": mi.P2, "p3": mi.P3}))
+	}
+	if rth && (hpos.Flags&types.HOME_ARM) != 0 {
+		path = append(path, position(hpos.HomeLon, hpos.HomeLat, addalt))
+	}
+	if len(path) > 1 {
+		feats = append([]GeoFeature{geo_feature("LineString", path, "mission",
+			map[string]interface{}{"mission": mmidx})}, feats...)
+	}
+	return feats
+}
+
+// Cli_geojson returns the safehomes and geozones of a CLI file; circular
+// zones are given as polygons, with the centre and radius as properties.
+// Altitudes are metres.
+func Cli_geojson(fn string, fb *geo.Frob) []GeoFeature {
+	var feats []GeoFeature
+	sha, _, gzone := cli.Read_clifile(fn)
+	for i, sh := range sha {
+		if fb != nil {
+			sh.Lat, sh.Lon, _ = fb.Relocate(sh.Lat, sh.Lon, 0)
+		}
+		feats = append(feats, geo_feature("Point", []float64{sh.Lon, sh.Lat}, "safehome",
+			map[string]interface{}{"index": i, "radius": cli.Safehome_distance * 1852.0}))
+	}
+	for _, g := range gzone {
+		if len(g.Points) == 0 {
+			continue
+		}
+		gtype := "exclusive"
+		if g.Gtype == cli.TYPE_INC {
+			gtype = "inclusive"
+		}
+		props := map[string]interface{}{"zid": g.Zid, "type": gtype, "action": g.Action,
+			"minalt": float64(g.Minalt) / 100.0, "maxalt": float64(g.Maxalt) / 100.0}
+		switch g.Shape {
+		case cli.SHAPE_CIRCLE:
+			if len(g.Points) < 2 {
+				continue
+			}
+			lat, lon := g.Points[0].Lat, g.Points[0].Lon
+			if fb != nil {
+				lat, lon, _ = fb.Relocate(lat, lon, 0)
+			}
+			props["shape"] = "circle"
+			props["centre"] = []float64{lon, lat}
+			props["radius"] = g.Points[1].Lat
+			feats = append(feats, geo_feature("Polygon", geo_circle(lat, lon, g.Points[1].Lat), "geozone", props))
+		case cli.SHAPE_POLY:
+			var ring [][]float64
+			for _, pt := range g.Points {
+				if fb != nil {
+					pt.Lat, pt.Lon, _ = fb.Relocate(pt.Lat, pt.Lon, 0)
+				}
+				ring = append(ring, []float64{pt.Lon, pt.Lat})
+			}
+			ring = append(ring, ring[0])
+			props["shape"] = "polygon"
+			feats = append(feats, geo_feature("Polygon", [][][]float64{ring}, "geozone", props))
+		}
+	}
+	return feats
+}
+
+// Missions (as options.Config.Mission, .MissionIndex), relocated if rebasing
+func plan_geojson(hpos types.HomeRec, fb *geo.Frob) []GeoFeature {
+	var feats []GeoFeature
+	if len(options.Config.Mission) > 0 {
+		_, mm, err := mission.Read_Mission_File(options.Config.Mission)
+		if err == nil {
+			for nm, _ := range mm.Segment {
+				nmx := nm + 1
+				if options.Config.MissionIndex == 0 || nmx == options.Config.MissionIndex {
+					ms := mm.To_mission(nmx)
+					mhpos := hpos
+					if fb != nil {
+						if ms.Metadata.Homey != 0 && ms.Metadata.Homex != 0 {
+							fb.Set_origin(ms.Metadata.Homey, ms.Metadata.Homex, 0)
+							ms.Metadata.Homey, ms.Metadata.Homex, _ = fb.Get_rebase()
+						}
+						for k, mi := range ms.MissionItems {
+							if mi.Is_GeoPoint() {
+								ms.MissionItems[k].Lat, ms.MissionItems[k].Lon, _ = fb.Relocate(mi.Lat, mi.Lon, 0)
+							}
+						}
+					}
+					if mhpos.Flags == 0 && ms.Metadata.Homey != 0 && ms.Metadata.Homex != 0 {
+						mhpos.HomeLat = ms.Metadata.Homey
+						mhpos.HomeLon = ms.Metadata.Homex
+						mhpos.Flags = types.HOME_ARM
+					}
+					feats = append(feats, Mission_geojson(ms, mhpos, nmx)...)
+				}
+			}
+		}
+	}
+	if len(options.Config.Cli) > 0 {
+		feats = append(feats, Cli_geojson(options.Config.Cli, fb)...)
+	}
+	return feats
+}
+
+// Write_geojson writes a FeatureCollection
+func Write_geojson(w io.Writer, name string, feats []GeoFeature) error {
+	if feats == nil {
+		feats = []GeoFeature{}
+	}
+	return json.NewEncoder(w).Encode(geocollection{Type: "FeatureCollection", Name: name, Features: feats})
+}
+
+func write_geojson(outfn string, name string, feats []GeoFeature) {
+	w, err := os.Create(outfn)
+	if err == nil {
+		err = Write_geojson(w, name, feats)
+		w.Close()
+	}
+	if err != nil {
+		log.Fatalf("geojson: %+v\n", err)
+	}
+}
+
+// GenerateGeoJSON is the GeoJSON analogue of GenerateKML
+func GenerateGeoJSON(hpos types.HomeRec, rec types.LogRec, outfn string,
+	meta types.FlightMeta, smap types.MapRec, evs []types.LogEvent, gv func() string) {
+	var track [][]float64
+	halt := 0.0
+	if (hpos.Flags & types.HOME_ALT) == types.HOME_ALT {
+		halt = hpos.HomeAlt
+	}
+	for _, r := range rec.Items {
+		track = append(track, []float64{r.Lon, r.Lat, halt + r.Alt})
+	}
+
+	props := map[string]interface{}{"log": meta.LogName(), "generator": gv()}
+	for k, v := range meta.Summary() {
+		props[strings.ToLower(k)] = v
+	}
+	for k, v := range smap {
+		props[strings.ToLower(k)] = v
+	}
+	if s, ok := meta.ShowDisarm(); ok {
+		props["disarm"] = s
+	}
+	if rec.Valid != 0 {
+		props["fields"] = rec.Valid.String()
+	}
+	feats := []GeoFeature{geo_feature("LineString", track, "track", props)}
+	feats = append(feats, geo_homes(hpos)...)
+	for _, e := range evs {
+		if e.Lat == 0 && e.Lon == 0 {
+			continue
+		}
+		ep := map[string]interface{}{"event": e.Kind.String(), "detail": e.Detail, "stamp": e.Stamp}
+		if !e.Utc.IsZero() {
+			ep["utc"] = e.Utc.Format(time.RFC3339Nano)
+		}
+		feats = append(feats, geo_feature("Point", []float64{e.Lon, e.Lat, halt + e.Alt}, "event", ep))
+	}
+	for _, r := range rec.Items {
+		feats = append(feats, geo_feature("Point", []float64{r.Lon, r.Lat, halt + r.Alt}, "point", item_props(r)))
+	}
+	feats = append(feats, plan_geojson(hpos, geo.Getfrobnication())...)
+	write_geojson(outfn, meta.LogName(), feats)
+}
+
+// GeneratePlanGeoJSON writes the mission and / or CLI file without a log, as
+// GenerateMissionOnly and GenerateCliOnly
+func GeneratePlanGeoJSON(outfn string, gv func() string) {
+	name := filepath.Base(options.Config.Mission)
+	if len(options.Config.Mission) == 0 {
+		name = filepath.Base(options.Config.Cli)
+	}
+	feats := plan_geojson(types.HomeRec{}, geo.Getfrobnication())
+	write_geojson(outfn, fmt.Sprintf("%s (%s)", name, gv()), feats)
+}
@@ -18,6 +18,7 @@ import (
 	"mission"
 	"options"
 	"types"
+	"wind"
 )
 
 const (
@@ -116,8 +117,8 @@ func makeqval(val, vmin, vmax float64, invert bool) float64 {
 	return rval
 }
 
-func getPoints(rec types.LogRec, hpos types.HomeRec, colmode uint8, viz bool) []kml.Element {
-	var pt []kml.Element
+// Returns the 5% and 95% quantiles of the values coloured by colmode
+func get_qrange(rec types.LogRec, colmode uint8) (float64, float64) {
 	var qval0, qval1 float64
 	if colmode == COL_STYLE_EFFIC {
 		q := quantile.NewTargeted(0.05, 0.95)
@@ -153,18 +154,47 @@ func getPoints(rec types.LogRec, hpos types.HomeRec, colmode uint8, viz bool) []
 		qval1 = q.Query(0.95)
 	}
 
-	tpts := len(rec.Items)
-	effic := 0.0
-
-	startt := rec.Items[0].Stamp
+	return qval0, qval1
+}
 
-	for np, r := range rec.Items {
+// Sets the item's colour scale value (0-100) for colmode
+func set_qval(r *types.LogItem, colmode uint8, qval0, qval1 float64) {
+	if colmode == COL_STYLE_EFFIC {
+		effic := r.Effic
 		if options.Config.Engunit == "wh" {
 			effic = r.Whkm
-		} else {
-			effic = r.Effic
 		}
+		r.Qval = makeqval(effic, qval0, qval1, true)
+	} else if colmode == COL_STYLE_SPEED {
+		r.Sval = makeqval(r.Spd, qval0, qval1, options.Config.RedIsFast)
+	} else if colmode == COL_STYLE_ALTITUDE {
+		r.Aval = makeqval(r.Alt, qval0, qval1, !options.Config.RedIsLow)
+	} else if colmode == COL_STYLE_BATTERY {
+		r.Bval = makeqval(r.Volts, qval0, qval1, false)
+	}
+}
 
+// The gradient set chosen by options.Config.Gradset
+func gradset_index() int {
+	switch options.Config.Gradset {
+	case "rdgn":
+		return GRAD_RGN
+	case "yor":
+		return GRAD_YOR
+	default:
+		return GRAD_RED
+	}
+}
+
+func getPoints(rec types.LogRec, hpos types.HomeRec, colmode uint8, viz bool) []kml.Element {
+	var pt []kml.Element
+	qval0, qval1 := get_qrange(rec, colmode)
+
+	tpts := len(rec.Items)
+
+	startt := rec.Items[0].Stamp
+
+	for np, r := range rec.Items {
 		tfmt := r.Utc.Format("2006‑01‑02T15:04:05.99MST")
 		fmtxt := r.Fmtext
 		if (r.Status & types.Is_FAIL) == types.Is_FAIL {
@@ -179,15 +209,7 @@ func getPoints(rec types.LogRec, hpos types.HomeRec, colmode uint8, viz bool) []
 			alt = r.Alt
 			altmode = kml.AltitudeModeRelativeToGround
 		}
-		if colmode == COL_STYLE_EFFIC {
-			r.Qval = makeqval(effic, qval0, qval1, true)
-		} else if colmode == COL_STYLE_SPEED {
-			r.Sval = makeqval(r.Spd, qval0, qval1, options.Config.RedIsFast)
-		} else if colmode == COL_STYLE_ALTITUDE {
-			r.Aval = makeqval(r.Alt, qval0, qval1, !options.Config.RedIsLow)
-		} else if colmode == COL_STYLE_BATTERY {
-			r.Bval = makeqval(r.Volts, qval0, qval1, false)
-		}
+		set_qval(&r, colmode, qval0, qval1)
 
 		et := float64(r.Stamp-startt) / 1e6
 
@@ -200,21 +222,36 @@ func getPoints(rec types.LogRec, hpos types.HomeRec, colmode uint8, viz bool) []
 		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%s</td></tr>", "Position", geo.PositionFormat(r.Lat, r.Lon, options.Config.Dms))))
 		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%.0f m</td></tr>", "Elevation", r.Alt)))
 		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%.0f m</td></tr>", "GPS Altitude", alt)))
-		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%d° / %d°</td></tr>", "Heading / CoG", r.Cse, r.Cog)))
-		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%.1f m/s</td></tr>", "Speed", r.Spd)))
-		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%d</td></tr>", "Satellites", r.Numsat)))
-
-		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%.0f m</td></tr>", "Range", r.Vrange)))
-		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%d°</td></tr>", "Bearing", r.Bearing)))
-		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%d %%</td></tr>", "RSSI", r.Rssi)))
-		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%s</td></tr>", "Mode", fmtxt)))
+		if r.Logged(types.F_CSE) || r.Logged(types.F_COG) {
+			sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%d° / %d°</td></tr>", "Heading / CoG", r.Cse, r.Cog)))
+		}
+		if r.Logged(types.F_SPD) {
+			sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%.1f m/s</td></tr>", "Speed", r.Spd)))
+		}
+		if rec.Cap&types.CAP_WIND != 0 && r.Logged(types.F_WIND) {
+			dir, spd := wind.FromDir(r.Wind)
+			sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%.1f m/s from %03.0f°</td></tr>", "Wind", spd, dir)))
+		}
+		if r.Logged(types.F_NUMSAT) {
+			sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%d</td></tr>", "Satellites", r.Numsat)))
+		}
+		if r.Logged(types.F_RANGE) {
+			sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%.0f m</td></tr>", "Range", r.Vrange)))
+			sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%d°</td></tr>", "Bearing", r.Bearing)))
+		}
+		if r.Logged(types.F_RSSI) {
+			sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%d %%</td></tr>", "RSSI", r.Rssi)))
+		}
+		if r.Logged(types.F_FMODE) {
+			sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%s</td></tr>", "Mode", fmtxt)))
+		}
 		sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%.0f m</td></tr>", "Cumulative Distance", r.Tdist)))
-		if r.Volts > 0 {
+		if (r.Valid == 0 && r.Volts > 0) || r.Valid.Has(types.F_VOLTS) {
 			sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%.1f V</br>", "Voltage", r.Volts)))
 		}
-		if (rec.Cap & types.CAP_AMPS) == types.CAP_AMPS {
+		if (rec.Cap&types.CAP_AMPS) == types.CAP_AMPS && r.Logged(types.F_AMPS) {
 			sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%.1f A</td></tr>", "Current", r.Amps)))
-			if (rec.Cap & types.CAP_ENERGY) == types.CAP_ENERGY {
+			if (rec.Cap&types.CAP_ENERGY) == types.CAP_ENERGY && r.Logged(types.F_ENERGY) {
 				sb.Write([]byte(fmt.Sprintf("<tr><td><b>%s</b></td><td>%.1f mah / %.2f Wh</td></tr>", "Total Energy", r.Energy, r.WhAcc)))
 				ceav := r.Energy * 1000 / r.Tdist
 				ceav1 := r.WhAcc * 1000 / r.Tdist
@@ -441,17 +478,7 @@ func generate_shared_styles(style uint8) []kml.Element {
 		}
 	case COL_STYLE_RSSI:
 		{
-			gidx := 0
-
-			switch options.Config.Gradset {
-			case "rdgn":
-				gidx = GRAD_RGN
-			case "yor":
-				gidx = GRAD_YOR
-			default:
-				gidx = GRAD_RED
-			}
-			gcols := Get_gradset(gidx)
+			gcols := Get_gradset(gradset_index())
 			icons := []kml.Element{}
 			for j, c := range gcols {
 				sname := fmt.Sprintf("styleGrad%03d", j*5)
@@ -554,16 +581,12 @@ func GenerateMissionOnly(outfn string, gv func() string) {
 }
 
 func GenerateKML(hpos types.HomeRec, rec types.LogRec, outfn string,
-	meta types.FlightMeta, smap types.MapRec, gv func() string) {
+	meta types.FlightMeta, smap types.MapRec, evs []types.LogEvent, gv func() string) {
 
 	defviz := !(options.Config.Rssi && rec.Items[0].Rssi > 0)
 	ts0 := rec.Items[0].Utc
 	ts1 := rec.Items[len(rec.Items)-1].Utc
 
-	f0 := kml.Folder(kml.Name("Flight modes")).Add(kml.Visibility(defviz)).
-		Add(generate_shared_styles(0)...).
-		Add(getPoints(rec, hpos, COL_STYLE_MODE, defviz)...)
-
 	desc := fmt.Sprintf("Generator: %s", gv())
 	d := kml.Folder(kml.Name(meta.LogName())).Add(kml.Description(desc)).Add(kml.Open(true))
 	d.Add(add_ground_track(rec))
@@ -618,10 +641,31 @@ func GenerateKML(hpos types.HomeRec, rec types.LogRec, outfn string,
 	if s, ok := meta.ShowDisarm(); ok {
 		e.Add(kml.Data(kml.Name("Disarm"), kml.Value(s)))
 	}
+	if rec.Valid != 0 {
+		e.Add(kml.Data(kml.Name("Fields"), kml.Value(rec.Valid.String())))
+	}
 	d.Add(e)
 
 	d.Add(kml.TimeSpan(kml.Begin(ts0), kml.End(ts1)))
 	d.Add(getHomes(hpos)...)
+	d.Add(add_events(rec, hpos, meta, evs))
+	if rec.Cap&types.CAP_WIND != 0 {
+		d.Add(add_wind(rec, hpos))
+	}
+	if ts, err := ParseTour(options.Config.Tour); err == nil && ts.Enabled() {
+		d.Add(add_tour(rec, hpos, meta, ts))
+	}
+
+	if options.Config.GxTrack {
+		t, files := add_gx_track(rec, hpos, meta, strings.HasSuffix(outfn, ".kmz"))
+		d.Add(t)
+		write_kmz(outfn, d, files)
+		return
+	}
+
+	f0 := kml.Folder(kml.Name("Flight modes")).Add(kml.Visibility(defviz)).
+		Add(generate_shared_styles(0)...).
+		Add(getPoints(rec, hpos, COL_STYLE_MODE, defviz)...)
 	d.Add(f0)
 	if rec.Cap&types.CAP_RSSI_VALID != 0 || options.Config.Aflags != 0 {
 		d.Add(generate_shared_styles(COL_STYLE_RSSI)...)
@@ -668,16 +712,24 @@ func GenerateKML(hpos types.HomeRec, rec types.LogRec, outfn string,
 }
 
 func write_kml(outfn string, d *kml.CompoundElement) {
+	write_kmz(outfn, d, nil)
+}
+
+// Writes KML, or KMZ with any additional files (e.g. models)
+func write_kmz(outfn string, d *kml.CompoundElement, files map[string][]byte) {
 	var err error
 	if strings.HasSuffix(outfn, ".kmz") {
 		z := kmz.NewKMZ(d)
+		for fn, b := range files {
+			z.AddFile(fn, b)
+		}
 		w, err0 := os.Create(outfn)
 		err = err0
 		if err == nil {
 			err = z.WriteIndent(w, "", "  ")
 		}
 	} else {
-		k := kml.KML(d)
+		k := kml.GxKML(d)
 		output, err0 := os.Create(outfn)
 		err = err0
 		if err == nil {
@@ -0,0 +1,449 @@
+package kmlgen
+
+import (
+	"fmt"
+	"html"
+	"image/color"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+import (
+	"geo"
+	"types"
+)
+
+// A self-contained HTML flight report; the summary tables, SVG charts of the
+// logged values against time (on a background coloured by flight mode) and
+// an SVG plan view of the track, home, missions and geozones. There are no
+// scripts or external resources, so the report may be viewed offline.
+
+const (
+	chart_w   = 800.0
+	chart_h   = 160.0
+	chart_l   = 55.0 // left margin (axis labels)
+	chart_r   = 10.0
+	chart_t   = 10.0
+	chart_b   = 22.0
+	plan_size = 800.0
+	plan_pad  = 30.0
+)
+
+type moderun struct {
+	t0, t1 float64
+	mode   uint8
+	name   string
+}
+
+type chartdef struct {
+	title string
+	unit  string
+	field types.FieldMask
+	value func(types.LogItem) float64
+}
+
+var report_charts = []chartdef{
+	{"Altitude", "m", types.F_ALT, func(r types.LogItem) float64 { return r.Alt }},
+	{"Speed", "m/s", types.F_SPD, func(r types.LogItem) float64 { return r.Spd }},
+	{"Current", "A", types.F_AMPS, func(r types.LogItem) float64 { return r.Amps }},
+	{"Voltage", "V", types.F_VOLTS, func(r types.LogItem) float64 { return r.Volts }},
+	{"RSSI", "%", types.F_RSSI, func(r types.LogItem) float64 { return float64(r.Rssi) }},
+	{"Satellites", "", types.F_NUMSAT, func(r types.LogItem) float64 { return float64(r.Numsat) }},
+	{"HDOP", "", types.F_HDOP, func(r types.LogItem) float64 { return float64(r.Hdop) / 100.0 }},
+}
+
+func svg_colour(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+// A "nice" (1, 2, 5 x 10^n) step giving about n intervals over span
+func nice_step(span float64, n int) float64 {
+	if span <= 0 {
+		return 1
+	}
+	raw := span / float64(n)
+	mag := math.Pow(10, math.Floor(math.Log10(raw)))
+	switch f := raw / mag; {
+	case f < 1.5:
+		return mag
+	case f < 3.5:
+		return 2 * mag
+	case f < 7.5:
+		return 5 * mag
+	default:
+		return 10 * mag
+	}
+}
+
+func show_secs(t float64) string {
+	s := int(t)
+	return fmt.Sprintf("%02d:%02d", s/60, s%60)
+}
+
+func item_secs(r types.LogItem, st uint64) float64 {
+	return float64(r.Stamp-st) / 1e6
+}
+
+// Time spans of each flight mode
+func mode_runs(rec types.LogRec) []moderun {
+	var runs []moderun
+	st := rec.Items[0].Stamp
+	for _, r := range rec.Items {
+		t := item_secs(r, st)
+		if n := len(runs); n > 0 {
+			runs[n-1].t1 = t
+			if runs[n-1].mode == r.Fmode {
+				continue
+			}
+		}
+		runs = append(runs, moderun{t0: t, t1: t, mode: r.Fmode, name: r.Fmtext})
+	}
+	return runs
+}
+
+func mode_legend(sb *strings.Builder, runs []moderun) {
+	seen := make(map[uint8]bool)
+	sb.WriteString(`<p class="legend">`)
+	for _, m := range runs {
+		if seen[m.mode] {
+			continue
+		}
+		seen[m.mode] = true
+		name := m.name
+		if name == "" {
+			name = fmt.Sprintf("Mode %d", m.mode)
+		}
+		fmt.Fprintf(sb, `<span><i style="background:%s"></i>%s</span> `,
+			svg_colour(getflightColour(m.mode)), html.EscapeString(name))
+	}
+	sb.WriteString("</p>\n")
+}
+
+// Writes a chart of a logged value, or nothing if the value is not logged
+func svg_chart(sb *strings.Builder, rec types.LogRec, runs []moderun, c chartdef) {
+	st := rec.Items[0].Stamp
+	dur := item_secs(rec.Items[len(rec.Items)-1], st)
+	if dur <= 0 {
+		return
+	}
+	vmin, vmax := math.Inf(1), math.Inf(-1)
+	for _, r := range rec.Items {
+		if r.Logged(c.field) {
+			v := c.value(r)
+			vmin = math.Min(vmin, v)
+			vmax = math.Max(vmax, v)
+		}
+	}
+	if math.IsInf(vmin, 1) || (vmin == 0 && vmax == 0 && c.field != types.F_ALT) {
+		return
+	}
+	step := nice_step(vmax-vmin, 4)
+	vmin = math.Floor(vmin/step) * step
+	vmax = math.Ceil(vmax/step) * step
+	if vmax <= vmin {
+		vmax = vmin + step
+	}
+
+	pw := chart_w - chart_l - chart_r
+	ph := chart_h - chart_t - chart_b
+	xp := func(t float64) float64 { return chart_l + pw*t/dur }
+	yp := func(v float64) float64 { return chart_t + ph*(vmax-v)/(vmax-vmin) }
+
+	title := c.title
+	if c.unit != "" {
+		title += " (" + c.unit + ")"
+	}
+	fmt.Fprintf(sb, "<h3>%s</h3>\n", html.EscapeString(title))
+	fmt.Fprintf(sb, `<svg class="chart" viewBox="0 0 %.0f %.0f" xmlns="http://www.w3.org/2000/svg">`+"\n", chart_w, chart_h)
+	for _, m := range runs {
+		fmt.Fprintf(sb, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s" fill-opacity="0.3"/>`+"\n",
+			xp(m.t0), chart_t, xp(m.t1)-xp(m.t0), ph, svg_colour(getflightColour(m.mode)))
+	}
+	for v := vmin; v <= vmax+step/2; v += step {
+		y := yp(v)
+		fmt.Fprintf(sb, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" class="grid"/>`, chart_l, y, chart_l+pw, y)
+		fmt.Fprintf(sb, `<text x="%.1f" y="%.1f" class="ylab">%s</text>`+"\n", chart_l-4, y+4,
+			strings.TrimSuffix(strings.TrimRight(fmt.Sprintf("%.2f", v), "0"), "."))
+	}
+	tstep := nice_step(dur, 8)
+	if tstep < 1 {
+		tstep = 1
+	}
+	for t := 0.0; t <= dur; t += tstep {
+		x := xp(t)
+		fmt.Fprintf(sb, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" class="grid"/>`, x, chart_t, x, chart_t+ph)
+		fmt.Fprintf(sb, `<text x="%.1f" y="%.1f" class="xlab">%s</text>`+"\n", x, chart_h-6, show_secs(t))
+	}
+
+	var pb strings.Builder
+	pen := "M"
+	for _, r := range rec.Items {
+		if !r.Logged(c.field) {
+			pen = "M"
+			continue
+		}
+		fmt.Fprintf(&pb, "%s%.1f,%.1f ", pen, xp(item_secs(r, st)), yp(c.value(r)))
+		pen = "L"
+	}
+	fmt.Fprintf(sb, `<path d="%s" class="line"/>`+"\n", strings.TrimSpace(pb.String()))
+	fmt.Fprintf(sb, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" class="frame"/>`+"\n", chart_l, chart_t, pw, ph)
+	sb.WriteString("</svg>\n")
+}
+
+// Plan view; a local equirectangular projection (north up) of the track and
+// the features of the mission and CLI files
+func svg_plan(sb *strings.Builder, rec types.LogRec, hpos types.HomeRec, runs []moderun, feats []GeoFeature) {
+	type xy struct{ x, y float64 }
+	var lat0, lon0 float64
+	for _, r := range rec.Items {
+		if r.Lat != 0 || r.Lon != 0 {
+			lat0, lon0 = r.Lat, r.Lon
+			break
+		}
+	}
+	if lat0 == 0 && lon0 == 0 {
+		return
+	}
+	k := math.Pi / 180 * 6371009.0
+	cl := math.Cos(lat0 * math.Pi / 180)
+	proj := func(lat, lon float64) xy { return xy{(lon - lon0) * k * cl, (lat0 - lat) * k} }
+
+	var pts []xy
+	add := func(p xy) xy { pts = append(pts, p); return p }
+	var track []xy
+	for _, r := range rec.Items {
+		if r.Lat == 0 && r.Lon == 0 {
+			track = append(track, xy{math.NaN(), 0})
+			continue
+		}
+		track = append(track, add(proj(r.Lat, r.Lon)))
+	}
+	if hpos.Flags != 0 {
+		add(proj(hpos.HomeLat, hpos.HomeLon))
+	}
+	fcoords := func(c interface{}) []xy {
+		var ps []xy
+		switch v := c.(type) {
+		case []float64:
+			ps = append(ps, proj(v[1], v[0]))
+		case [][]float64:
+			for _, p := range v {
+				ps = append(ps, proj(p[1], p[0]))
+			}
+		case [][][]float64:
+			for _, p := range v[0] {
+				ps = append(ps, proj(p[1], p[0]))
+			}
+		}
+		return ps
+	}
+	for _, f := range feats {
+		for _, p := range fcoords(f.Geometry.Coordinates) {
+			add(p)
+		}
+	}
+
+	minx, miny, maxx, maxy := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, p := range pts {
+		minx, maxx = math.Min(minx, p.x), math.Max(maxx, p.x)
+		miny, maxy = math.Min(miny, p.y), math.Max(maxy, p.y)
+	}
+	span := math.Max(math.Max(maxx-minx, maxy-miny), 50)
+	// no narrower than half the span, centred
+	if d := span/2 - (maxx - minx); d > 0 {
+		minx, maxx = minx-d/2, maxx+d/2
+	}
+	if d := span/2 - (maxy - miny); d > 0 {
+		miny, maxy = miny-d/2, maxy+d/2
+	}
+	scale := (plan_size - 2*plan_pad) / span
+	w := (maxx-minx)*scale + 2*plan_pad
+	h := (maxy-miny)*scale + 2*plan_pad
+	sp := func(p xy) (float64, float64) { return plan_pad + (p.x-minx)*scale, plan_pad + (p.y-miny)*scale }
+	ppath := func(ps []xy) string {
+		var pb strings.Builder
+		for j, p := range ps {
+			x, y := sp(p)
+			if j == 0 {
+				fmt.Fprintf(&pb, "M%.1f,%.1f", x, y)
+			} else {
+				fmt.Fprintf(&pb, " L%.1f,%.1f", x, y)
+			}
+		}
+		return pb.String()
+	}
+
+	fmt.Fprintf(sb, `<svg class="plan" viewBox="0 0 %.0f %.0f" width="%.0f" xmlns="http://www.w3.org/2000/svg">`+"\n", w, h, w)
+	fmt.Fprintf(sb, `<rect width="%.0f" height="%.0f" fill="#2b3340"/>`+"\n", w, h)
+	for _, f := range feats {
+		ps := fcoords(f.Geometry.Coordinates)
+		switch f.Properties["kind"] {
+		case "geozone":
+			c := "#ff0000"
+			if f.Properties["type"] == "inclusive" {
+				c = "#00ff00"
+			}
+			fmt.Fprintf(sb, `<path d="%s Z" fill="%s" fill-opacity="0.15" stroke="%s"><title>Geozone %v</title></path>`+"\n",
+				ppath(ps), c, c, f.Properties["zid"])
+		case "mission":
+			fmt.Fprintf(sb, `<path d="%s" fill="none" stroke="#ff4040" stroke-dasharray="6,4"/>`+"\n", ppath(ps))
+		}
+	}
+
+	// track, in runs of the mode colour
+	st := rec.Items[0].Stamp
+	ri := 0
+	var seg []xy
+	flush := func(mode uint8) {
+		if len(seg) > 1 {
+			fmt.Fprintf(sb, `<path d="%s" fill="none" stroke="%s" stroke-width="2"/>`+"\n",
+				ppath(seg), svg_colour(getflightColour(mode)))
+		}
+	}
+	for j, r := range rec.Items {
+		t := item_secs(r, st)
+		for ri < len(runs)-1 && t >= runs[ri+1].t0 {
+			if !math.IsNaN(track[j].x) {
+				seg = append(seg, track[j])
+			}
+			flush(runs[ri].mode)
+			seg = nil
+			ri++
+		}
+		if math.IsNaN(track[j].x) {
+			flush(runs[ri].mode)
+			seg = nil
+			continue
+		}
+		seg = append(seg, track[j])
+	}
+	flush(runs[ri].mode)
+
+	for _, f := range feats {
+		ps := fcoords(f.Geometry.Coordinates)
+		switch f.Properties["kind"] {
+		case "waypoint":
+			x, y := sp(ps[0])
+			fmt.Fprintf(sb, `<circle cx="%.1f" cy="%.1f" r="4" fill="#63a0fc"/><text x="%.1f" y="%.1f" class="plab">%v</text>`+"\n",
+				x, y, x+6, y-4, f.Properties["no"])
+		case "safehome":
+			x, y := sp(ps[0])
+			fmt.Fprintf(sb, `<rect x="%.1f" y="%.1f" width="8" height="8" fill="#fcfc00"><title>Safehome</title></rect>`+"\n", x-4, y-4)
+		}
+	}
+	if hpos.Flags != 0 {
+		x, y := sp(proj(hpos.HomeLat, hpos.HomeLon))
+		fmt.Fprintf(sb, `<circle cx="%.1f" cy="%.1f" r="6" fill="#00c000" stroke="#fff"/><text x="%.1f" y="%.1f" class="plab">Home</text>`+"\n",
+			x, y, x+8, y-6)
+	}
+
+	// scale bar and north
+	bar := nice_step(span, 5)
+	bx, by := plan_pad, h-plan_pad/2
+	fmt.Fprintf(sb, `<path d="M%.1f,%.1f h%.1f" stroke="#fff" stroke-width="3"/><text x="%.1f" y="%.1f" class="plab">%s</text>`+"\n",
+		bx, by, bar*scale, bx+bar*scale+6, by+4, show_dist(bar))
+	fmt.Fprintf(sb, `<text x="%.1f" y="%.1f" class="plab">N &#8593;</text>`+"\n", w-plan_pad, plan_pad/2+6)
+	sb.WriteString("</svg>\n")
+}
+
+func show_dist(m float64) string {
+	if m >= 1000 {
+		return fmt.Sprintf("%g km", m/1000)
+	}
+	return fmt.Sprintf("%g m", m)
+}
+
+func html_table(sb *strings.Builder, m map[string]string, first []string) {
+	var keys []string
+	done := make(map[string]bool)
+	for _, k := range first {
+		if _, ok := m[k]; ok {
+			keys = append(keys, k)
+			done[k] = true
+		}
+	}
+	var rest []string
+	for k := range m {
+		if !done[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	sb.WriteString("<table>\n")
+	for _, k := range append(keys, rest...) {
+		fmt.Fprintf(sb, "<tr><th>%s</th><td>%s</td></tr>\n", html.EscapeString(k), html.EscapeString(m[k]))
+	}
+	sb.WriteString("</table>\n")
+}
+
+const report_style = `body { font-family: sans-serif; margin: 1em 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+th { background: #f0f0f0; }
+svg.chart { width: 100%; max-width: 800px; display: block; }
+svg.plan { max-width: 100%; height: auto; display: block; }
+.grid { stroke: #999; stroke-width: 0.5; stroke-dasharray: 2,2; }
+.frame { fill: none; stroke: #666; }
+.line { fill: none; stroke: #1040c0; stroke-width: 1.5; }
+.xlab { font-size: 10px; text-anchor: middle; }
+.ylab { font-size: 10px; text-anchor: end; }
+.plab { font-size: 12px; fill: #fff; }
+.legend span { margin-right: 1em; white-space: nowrap; }
+.legend i { display: inline-block; width: 1em; height: 1em; margin-right: 0.3em; vertical-align: middle; border: 1px solid #888; }
+`
+
+// GenerateReport is the HTML report analogue of GenerateKML
+func GenerateReport(hpos types.HomeRec, rec types.LogRec, outfn string,
+	meta types.FlightMeta, smap types.MapRec, evs []types.LogEvent, gv func() string) {
+	var sb strings.Builder
+	name := html.EscapeString(meta.LogName())
+	fmt.Fprintf(&sb, "<!DOCTYPE html>\n<html lang=\"en\">\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n<style>\n%s</style>\n</head>\n<body>\n", name, report_style)
+	fmt.Fprintf(&sb, "<h1>%s</h1>\n<p>Generator: %s</p>\n", name, html.EscapeString(gv()))
+
+	fm := meta.Summary()
+	if s, ok := meta.ShowDisarm(); ok {
+		fm["Disarm"] = s
+	}
+	if rec.Valid != 0 {
+		fm["Fields"] = rec.Valid.String()
+	}
+	sb.WriteString("<h2>Flight</h2>\n")
+	html_table(&sb, fm, []string{"Log", "Flight", "Firmware", "Size"})
+	if len(smap) > 0 {
+		sb.WriteString("<h2>Statistics</h2>\n")
+		html_table(&sb, smap, []string{"Duration", "Distance", "Altitude", "Speed", "Range", "Current"})
+	}
+
+	runs := mode_runs(rec)
+	sb.WriteString("<h2>Plan view</h2>\n")
+	mode_legend(&sb, runs)
+	svg_plan(&sb, rec, hpos, runs, plan_geojson(hpos, geo.Getfrobnication()))
+
+	sb.WriteString("<h2>Charts</h2>\n")
+	for _, c := range report_charts {
+		svg_chart(&sb, rec, runs, c)
+	}
+
+	if len(evs) > 0 {
+		st := rec.Items[0].Stamp
+		sb.WriteString("<h2>Events</h2>\n<table>\n<tr><th>Time</th><th>Event</th><th>Detail</th></tr>\n")
+		for _, e := range evs {
+			t := 0.0
+			if e.Stamp > st {
+				t = float64(e.Stamp-st) / 1e6
+			}
+			fmt.Fprintf(&sb, "<tr><td>%s</td><td>%s</td><td>%s</td></tr>\n", show_secs(t),
+				html.EscapeString(e.Kind.String()), html.EscapeString(e.Detail))
+		}
+		sb.WriteString("</table>\n")
+	}
+	sb.WriteString("</body>\n</html>\n")
+
+	if err := os.WriteFile(outfn, []byte(sb.String()), 0644); err != nil {
+		log.Fatalf("report: %+v\n", err)
+	}
+}
@@ -7,7 +7,10 @@ import (
 )
 
 import (
+	"geo"
+	"mission"
 	"options"
+	"types"
 )
 
 func GenKmlName(inp string, idx int) string {
@@ -16,9 +19,12 @@ func GenKmlName(inp string, idx int) string {
 	if len(ext) < len(outfn) {
 		outfn = outfn[0 : len(outfn)-len(ext)]
 	}
-	if options.Config.Kml {
+	switch {
+	case options.Config.Format != "" && options.Config.Format != "kml":
+		ext = "." + options.Config.Format
+	case options.Config.Kml:
 		ext = ".kml"
-	} else {
+	default:
 		ext = ".kmz"
 	}
 	if idx > 0 {
@@ -34,3 +40,33 @@ func GenKmlName(inp string, idx int) string {
 	}
 	return outfn
 }
+
+// The home altitude (AMSL) against which a mission's relative altitudes are
+// resolved; the log's, else the DEM elevation at the home or, for a plan
+// without one, at the mission's home or first waypoint. False if unknown.
+func mission_home_alt(ms *mission.Mission, hpos types.HomeRec) (float64, bool) {
+	var lat, lon float64
+	if (hpos.Flags & types.HOME_ARM) != 0 {
+		if (hpos.Flags & types.HOME_ALT) == types.HOME_ALT {
+			return hpos.HomeAlt, true
+		}
+		lat, lon = hpos.HomeLat, hpos.HomeLon
+	} else if ms.Metadata.Homey != 0 || ms.Metadata.Homex != 0 {
+		lat, lon = ms.Metadata.Homey, ms.Metadata.Homex
+	} else {
+		for _, mi := range ms.MissionItems {
+			if mi.Is_GeoPoint() {
+				lat, lon = mi.Lat, mi.Lon
+				break
+			}
+		}
+	}
+	if lat == 0 && lon == 0 {
+		return 0, false
+	}
+	d := geo.InitDem("")
+	if elev, err := d.Get_Elevation(lat, lon); err == nil {
+		return elev, true
+	}
+	return 0, false
+}
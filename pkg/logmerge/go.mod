@@ -0,0 +1,3 @@
+module logmerge
+
+go 1.19
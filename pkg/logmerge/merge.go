@@ -0,0 +1,399 @@
+package logmerge
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+import (
+	"trackfilter"
+	"types"
+)
+
+// Merges a second log of the same flight (typically the radio's OTX / Ethos
+// log) into a primary log (typically Blackbox). The second log is aligned by
+// UTC; where both logs have GPS positions, the clock offset is found by
+// cross-correlating the tracks, so the logs' clocks need not agree, and a
+// log without UTC is aligned on its time stamps. Fields that are not logged
+// by the primary log are filled from the second, and the second's events are
+// added.
+
+type Result struct {
+	Offset   time.Duration // add to primary time to get the secondary's time
+	Error    float64       // mean position difference (m) at Offset, -1 if not correlated
+	Matched  int           // number of primary items filled
+	Filled   uint16        // CAP_ values added
+	Relative bool          // the primary has no UTC; Offset is from its time stamps
+}
+
+const (
+	max_corr_points = 300
+	max_gap         = 5.0 // seconds, for interpolating positions
+)
+
+type tpos struct {
+	t   float64
+	lat float64
+	lon float64
+}
+
+func secs(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+func from_secs(t float64) time.Time {
+	return time.Unix(0, int64(math.Round(t*1e9))).UTC()
+}
+
+// Item times (s); the UTC where logged, otherwise the item's Stamp relative
+// to the first item with UTC. For a log without UTC, the Stamp alone, with
+// abs false.
+func times(items []types.LogItem) ([]float64, bool) {
+	ts := make([]float64, len(items))
+	k := -1
+	for j := range items {
+		if !items[j].Utc.IsZero() {
+			k = j
+			break
+		}
+	}
+	for j, b := range items {
+		switch {
+		case !b.Utc.IsZero():
+			ts[j] = secs(b.Utc)
+		case k >= 0:
+			ts[j] = secs(items[k].Utc) + (float64(b.Stamp)-float64(items[k].Stamp))/1e6
+		default:
+			ts[j] = float64(b.Stamp) / 1e6
+		}
+	}
+	return ts, k >= 0
+}
+
+func positions(items []types.LogItem, ts []float64) []tpos {
+	var pos []tpos
+	for j, b := range items {
+		if b.Fix > 1 && (b.Lat != 0 || b.Lon != 0) {
+			pos = append(pos, tpos{ts[j], b.Lat, b.Lon})
+		}
+	}
+	return pos
+}
+
+// Interpolated position at time t
+func position_at(pos []tpos, t float64) (float64, float64, bool) {
+	n := sort.Search(len(pos), func(i int) bool { return pos[i].t >= t })
+	switch {
+	case n == len(pos):
+		return 0, 0, false
+	case pos[n].t == t:
+		return pos[n].lat, pos[n].lon, true
+	case n == 0:
+		return 0, 0, false
+	}
+	p0 := pos[n-1]
+	p1 := pos[n]
+	dt := p1.t - p0.t
+	if dt > max_gap {
+		return 0, 0, false
+	}
+	f := (t - p0.t) / dt
+	return p0.lat + f*(p1.lat-p0.lat), p0.lon + f*(p1.lon-p0.lon), true
+}
+
+// Flat earth distance (m), adequate for the small differences compared here
+func distance(lat0, lon0, lat1, lon1 float64) float64 {
+	x := (lon1 - lon0) * math.Cos((lat0+lat1)*math.Pi/360.0)
+	y := lat1 - lat0
+	return math.Sqrt(x*x+y*y) * 111319.5
+}
+
+// Mean distance between the tracks for an offset, and the number of points compared
+func track_error(pp, sp []tpos, off float64) (float64, int) {
+	sum := 0.0
+	n := 0
+	for _, p := range pp {
+		if lat, lon, ok := position_at(sp, p.t+off); ok {
+			sum += distance(p.lat, p.lon, lat, lon)
+			n++
+		}
+	}
+	if n == 0 {
+		return math.MaxFloat64, 0
+	}
+	return sum / float64(n), n
+}
+
+// Finds the clock offset minimising the mean distance between the tracks,
+// searching coarsely over every offset giving an overlap, then refining
+func correlate(pp, sp []tpos) (float64, float64, bool) {
+	if len(pp) < 2 || len(sp) < 2 {
+		return 0, 0, false
+	}
+	if len(pp) > max_corr_points {
+		sub := make([]tpos, 0, max_corr_points)
+		for j := 0; j < max_corr_points; j++ {
+			sub = append(sub, pp[j*len(pp)/max_corr_points])
+		}
+		pp = sub
+	}
+	minn := len(pp) / 4
+	if minn < 10 {
+		minn = 10
+		if minn > len(pp) {
+			minn = len(pp)
+		}
+	}
+
+	lo := sp[0].t - pp[len(pp)-1].t
+	hi := sp[len(sp)-1].t - pp[0].t
+	step := (hi - lo) / 1000
+	if step < 1 {
+		step = 1
+	}
+
+	best := 0.0
+	berr := math.MaxFloat64
+	search := func(lo, hi, step float64) {
+		for off := lo; off <= hi; off += step {
+			if e, n := track_error(pp, sp, off); n >= minn && e < berr {
+				berr = e
+				best = off
+			}
+		}
+	}
+	search(lo, hi, step)
+	if berr == math.MaxFloat64 {
+		return 0, 0, false
+	}
+	for step > 0.1 {
+		c := best
+		search(c-step, c+step, step/10)
+		step /= 10
+	}
+	return best, berr, true
+}
+
+// Index of the nearest item (of times ts) to time t, within tolerance
+func nearest(ts []float64, t float64, tol float64) (int, bool) {
+	n := sort.Search(len(ts), func(i int) bool { return ts[i] >= t })
+	best := -1
+	bdt := tol + 1
+	for _, j := range []int{n - 1, n} {
+		if j >= 0 && j < len(ts) {
+			if dt := math.Abs(ts[j] - t); dt < bdt {
+				bdt = dt
+				best = j
+			}
+		}
+	}
+	return best, best >= 0 && bdt <= tol
+}
+
+// Index of the item nearest in Stamp to st
+func nearest_stamp(items []types.LogItem, st uint64) int {
+	n := sort.Search(len(items), func(i int) bool { return items[i].Stamp >= st })
+	if n == len(items) || (n > 0 && st-items[n-1].Stamp < items[n].Stamp-st) {
+		n--
+	}
+	return n
+}
+
+// The secondary's events, in the primary's time, that lie within the
+// primary's span and are not already in the primary (the same kind within
+// tol)
+func merge_events(p, s types.LogSegment, pts, sts []float64, off, tol float64, pabs, sabs bool) []types.LogEvent {
+	evs := append([]types.LogEvent{}, p.E...)
+	for _, e := range s.E {
+		var st float64
+		if sabs && !e.Utc.IsZero() {
+			st = secs(e.Utc)
+		} else {
+			j := nearest_stamp(s.L.Items, e.Stamp)
+			st = sts[j] + (float64(e.Stamp)-float64(s.L.Items[j].Stamp))/1e6
+		}
+		pt := st - off
+		if pt < pts[0]-tol || pt > pts[len(pts)-1]+tol {
+			continue
+		}
+		k, _ := nearest(pts, pt, math.MaxFloat64)
+		ps := math.Max(float64(p.L.Items[k].Stamp)+(pt-pts[k])*1e6, 0)
+		dup := false
+		for _, pe := range p.E {
+			if pe.Kind == e.Kind && math.Abs(float64(pe.Stamp)-ps)/1e6 <= tol {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		e.Stamp = uint64(ps)
+		switch {
+		case pabs:
+			e.Utc = from_secs(pt)
+		case sabs:
+			e.Utc = from_secs(st)
+		default:
+			e.Utc = time.Time{}
+		}
+		evs = append(evs, e)
+	}
+	sort.SliceStable(evs, func(i, j int) bool { return evs[i].Stamp < evs[j].Stamp })
+	return evs
+}
+
+func all_zero(items []types.LogItem, f func(b *types.LogItem) bool) bool {
+	for j := range items {
+		if f(&items[j]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge fills fields not logged by p from s, returning the merged segment,
+// with recalculated statistics.
+func Merge(p, s types.LogSegment) (types.LogSegment, Result, error) {
+	var res Result
+	if len(p.L.Items) == 0 || len(s.L.Items) == 0 {
+		return p, res, errors.New("empty log")
+	}
+
+	pitems := p.L.Items
+	sitems := s.L.Items
+	pts, pabs := times(pitems)
+	sts, sabs := times(sitems)
+	res.Relative = !pabs
+
+	res.Error = -1
+	off := 0.0
+	if o, e, ok := correlate(positions(pitems, pts), positions(sitems, sts)); ok {
+		off = o
+		res.Offset = time.Duration(off * 1e9)
+		res.Error = e
+	} else if !pabs || !sabs {
+		return p, res, errors.New("logs have no common time base")
+	}
+
+	tol := 2.0
+	if n := len(sts); n > 1 {
+		if iv := (sts[n-1] - sts[0]) / float64(n-1); 2*iv > tol {
+			tol = 2 * iv
+		}
+	}
+
+	nopos := len(positions(pitems, pts)) == 0
+	fill := s.L.Cap &^ p.L.Cap & (types.CAP_AMPS | types.CAP_VOLTS | types.CAP_ENERGY |
+		types.CAP_ENERGYC | types.CAP_RSSI_VALID | types.CAP_SPEED | types.CAP_ALTITUDE)
+	attitude := all_zero(pitems, func(b *types.LogItem) bool { return b.Roll != 0 || b.Pitch != 0 }) &&
+		!all_zero(sitems, func(b *types.LogItem) bool { return b.Roll != 0 || b.Pitch != 0 })
+	heading := all_zero(pitems, func(b *types.LogItem) bool { return b.Cse != 0 }) &&
+		!all_zero(sitems, func(b *types.LogItem) bool { return b.Cse != 0 })
+	sticks := all_zero(pitems, func(b *types.LogItem) bool { return b.Ail != 0 || b.Ele != 0 || b.Thr != 0 }) &&
+		!all_zero(sitems, func(b *types.LogItem) bool { return b.Ail != 0 || b.Ele != 0 || b.Thr != 0 })
+	throttle := all_zero(pitems, func(b *types.LogItem) bool { return b.Throttle != 0 }) &&
+		!all_zero(sitems, func(b *types.LogItem) bool { return b.Throttle != 0 })
+
+	copied := types.CapFields(fill)
+	for _, c := range []struct {
+		ok bool
+		f  types.FieldMask
+	}{{attitude, types.F_ATTITUDE}, {heading, types.F_CSE}, {sticks, types.F_STICKS},
+		{throttle, types.F_THROTTLE}, {nopos, types.F_POS | types.F_GALT | types.F_FIX | types.F_NUMSAT | types.F_HDOP}} {
+		if c.ok {
+			copied |= c.f
+		}
+	}
+
+	items := make([]types.LogItem, len(pitems))
+	copy(items, pitems)
+	// A primary without UTC takes the secondary's
+	utc := !pabs && sabs
+	for j := range items {
+		b := &items[j]
+		if utc {
+			b.Utc = from_secs(pts[j] + off)
+			b.Valid |= types.F_UTC
+		}
+		k, ok := nearest(sts, pts[j]+off, tol)
+		if !ok {
+			continue
+		}
+		sb := &sitems[k]
+		res.Matched++
+		if fill&types.CAP_AMPS != 0 {
+			b.Amps = sb.Amps
+		}
+		if fill&types.CAP_VOLTS != 0 {
+			b.Volts = sb.Volts
+		}
+		if fill&types.CAP_ENERGY != 0 {
+			b.Energy = sb.Energy
+		}
+		if fill&types.CAP_RSSI_VALID != 0 {
+			b.Rssi = sb.Rssi
+		}
+		if fill&types.CAP_SPEED != 0 {
+			b.Spd = sb.Spd
+		}
+		if fill&types.CAP_ALTITUDE != 0 {
+			b.Alt = sb.Alt
+		}
+		if attitude {
+			b.Roll = sb.Roll
+			b.Pitch = sb.Pitch
+		}
+		if heading {
+			b.Cse = sb.Cse
+		}
+		if sticks {
+			b.Ail, b.Ele, b.Rud, b.Thr = sb.Ail, sb.Ele, sb.Rud, sb.Thr
+		}
+		if throttle {
+			b.Throttle = sb.Throttle
+		}
+		if nopos {
+			b.Lat, b.Lon, b.GAlt = sb.Lat, sb.Lon, sb.GAlt
+			b.Fix, b.Numsat, b.Hdop = sb.Fix, sb.Numsat, sb.Hdop
+		}
+		if sb.Valid != 0 {
+			b.Valid |= copied & sb.Valid
+		} else {
+			b.Valid |= copied
+		}
+	}
+	if res.Matched == 0 {
+		return p, res, errors.New("no overlap between logs")
+	}
+
+	ls := p
+	ls.L = types.LogRec{Cap: p.L.Cap | fill, Items: items}
+	res.Filled = fill
+	if nopos {
+		if ls.H.Flags == 0 {
+			ls.H = s.H
+		}
+		trackfilter.Relocate(&ls.L, ls.H)
+	}
+	if res.Filled&(types.CAP_AMPS|types.CAP_VOLTS) != 0 {
+		trackfilter.Energy(&ls.L)
+	}
+	for j := range ls.L.Items {
+		b := &ls.L.Items[j]
+		b.SetValid(b.Valid, ls.H)
+	}
+	ls.L.SetValid()
+	if s.S != "" {
+		if ls.S != "" {
+			ls.S += "\n"
+		}
+		ls.S += s.S
+	}
+	st := ls.L.Stats()
+	ls.M = st.Summary(st.Duration)
+	ls.E = merge_events(p, s, pts, sts, off, tol, pabs, sabs)
+	return ls, res, nil
+}
@@ -931,7 +931,8 @@ func read_inav_cli(dat []byte) *MultiMission {
 						} else {
 							dref = "right"
 						}
-						f := cli.FWApproach{int8(idx), int8(idx - 8), int32(appa), int32(lnda), int16(hdr1), int16(hdr2), dref, (absa == 1)}
+						f := cli.FWApproach{No: int8(idx), Index: int8(idx - 8), Appalt: int32(appa), Landalt: int32(lnda),
+							Dirn1: int16(hdr1), Dirn2: int16(hdr2), Dref: dref, Aref: (absa == 1)}
 						fwa = append(fwa, f)
 					}
 				}
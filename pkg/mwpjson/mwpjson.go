@@ -2,13 +2,13 @@ package mwpjson
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"geo"
 	"math"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 )
@@ -83,6 +83,18 @@ func NewMWPJSONReader(fn string) MWPJSON {
 	return l
 }
 
+func init() {
+	types.RegisterLogFormat(types.LogFormat{Name: "mwp JSON", Type: types.IS_MWP, Probe: probe_log,
+		Reader: func(fn string) types.FlightLog { l := NewMWPJSONReader(fn); return &l }})
+}
+
+func probe_log(sig []byte) int {
+	if bytes.HasPrefix(sig, []byte(`{"type":`)) {
+		return types.PROBE_STRONG
+	}
+	return types.PROBE_NONE
+}
+
 func (o *MWPJSON) LogType() byte {
 	return types.LOGMWP
 }
@@ -118,9 +130,9 @@ func metas(logfile string) ([]types.FlightMeta, error) {
 	var metas []types.FlightMeta
 	var mt types.FlightMeta
 
-	r, err := os.Open(logfile)
+	r, err := types.OpenLog(logfile)
 	if err == nil {
-		bp := filepath.Base(logfile)
+		bp := types.LogBase(logfile)
 		nl := 0
 		scanner := bufio.NewScanner(r)
 		for scanner.Scan() {
@@ -289,6 +301,36 @@ func fm_ltm(ltm uint8) uint8 {
 	return fm
 }
 
+// Fields logged by each message type; see types.FieldMask
+var json_fields = map[string]types.FieldMask{
+	"armed":                     types.F_STATUS,
+	"v0:armed":                  types.F_STATUS,
+	"v0:nav-status":             types.F_NAVMODE | types.F_WPNO,
+	"v0:origin":                 types.F_HOME,
+	"v0:mode-flags":             types.F_STATUS | types.F_FMODE,
+	"v0:attitude":               types.F_ATTITUDE | types.F_CSE,
+	"v0:altitude":               types.F_ALT,
+	"altitude":                  types.F_ALT,
+	"v0:power":                  types.F_VOLTS | types.F_AMPS | types.F_ENERGY | types.F_RSSI,
+	"v0:gps":                    gps_fields | types.F_COG | types.F_SPD | types.F_HDOP,
+	"v0:range-bearing":          types.F_RANGE,
+	"comp_gps":                  types.F_RANGE,
+	"v0:sensor-reason":          types.F_HWFAIL,
+	"ltm_xframe":                types.F_HWFAIL,
+	"analog2":                   types.F_VOLTS | types.F_AMPS | types.F_RSSI,
+	"status":                    types.F_NAVMODE | types.F_WPNO | types.F_FMODE,
+	"raw_gps":                   gps_fields | types.F_COG | types.F_SPD,
+	"attitude":                  types.F_ATTITUDE | types.F_CSE,
+	"ltm_raw_sframe":            types.F_VOLTS | types.F_ENERGY | types.F_RSSI | types.F_STATUS,
+	"mavlink_attitude":          types.F_ATTITUDE | types.F_CSE,
+	"mavlink_vfr_hud":           types.F_ALT,
+	"mavlink_gps_raw_int":       gps_fields | types.F_COG | types.F_SPD | types.F_HDOP | types.F_RANGE,
+	"mavlink_gps_global_origin": types.F_HOME,
+	"mavlink_heartbeat":         types.F_FMODE | types.F_STATUS,
+}
+
+const gps_fields = types.F_STAMP | types.F_UTC | types.F_POS | types.F_GALT | types.F_FIX | types.F_NUMSAT
+
 func parse_json(o map[string]interface{}, b *types.LogItem) (bool, uint16) {
 	cap := uint16(0)
 	done := false
@@ -553,12 +595,7 @@ func parse_json(o map[string]interface{}, b *types.LogItem) (bool, uint16) {
 			mavtype := int(o["mavtype"].(float64))
 			mavmode := int(o["custom_mode"].(float64))
 			var ltmflags uint8
-			if o["utime"].(float64) > 1607040000 {
-				ltmflags = mav2ltm(mavmode, (mavtype == 1))
-			} else {
-				ltmflags = xmav2ltm(mavmode, (mavtype == 1))
-			}
-			b.Fmode = fm_ltm(ltmflags)
+			ltmflags, b.Fmode = MavFmode(mavmode, mavtype, o["utime"].(float64))
 			b.Status |= (ltmflags << 2)
 
 		default:
@@ -567,6 +604,18 @@ func parse_json(o map[string]interface{}, b *types.LogItem) (bool, uint16) {
 	return done, cap
 }
 
+// MavFmode maps a MAVLink HEARTBEAT custom_mode to LTM mode and FM_ mode.
+// utime (Unix seconds) selects the mapping, older inav used its own modes.
+func MavFmode(mavmode int, mavtype int, utime float64) (uint8, uint8) {
+	var ltmflags uint8
+	if utime > 1607040000 {
+		ltmflags = mav2ltm(mavmode, (mavtype == 1))
+	} else {
+		ltmflags = xmav2ltm(mavmode, (mavtype == 1))
+	}
+	return ltmflags, fm_ltm(ltmflags)
+}
+
 func xmav2ltm(mavmode int, is_fw bool) uint8 {
 	ltmmode := uint8(0)
 	if is_fw {
@@ -697,11 +746,61 @@ func mav2ltm(mavmode int, is_fw bool) uint8 {
 	return ltmmode
 }
 
+// Series reads every message of the flight, as a table per message type
+// (e.g. "attitude", "analog"), the columns being the message's numeric (and
+// boolean, as 0 / 1) values
+func (lg *MWPJSON) Series(m types.FlightMeta, sel []string) (*types.Series, error) {
+	fh, err := types.OpenLog(lg.name)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	s := types.NewSeries(sel)
+	scanner := bufio.NewScanner(fh)
+	st := -1.0
+	for nl := 1; scanner.Scan() && nl <= m.End; nl++ {
+		if nl < m.Start {
+			continue
+		}
+		var o map[string]interface{}
+		if json.Unmarshal(scanner.Bytes(), &o) != nil {
+			continue
+		}
+		typ, ok := o["type"].(string)
+		utm, ok1 := o["utime"].(float64)
+		if !ok || !ok1 {
+			continue
+		}
+		if st < 0 {
+			st = utm
+		}
+		vals := make(map[string]float64)
+		for k, v := range o {
+			switch x := v.(type) {
+			case float64:
+				vals[k] = x
+			case bool:
+				if x {
+					vals[k] = 1
+				} else {
+					vals[k] = 0
+				}
+			}
+		}
+		delete(vals, "utime")
+		if utm >= st {
+			s.AppendMap(typ, uint64((utm-st)*1e6), vals)
+		}
+	}
+	return s, scanner.Err()
+}
+
 func (lg *MWPJSON) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegment, bool) {
 	stats := types.LogStats{}
 	ls := types.LogSegment{}
 
-	fh, err := os.Open(lg.name)
+	fh, err := types.OpenLog(lg.name)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "log file %s\n", err)
 		return ls, false
@@ -711,12 +810,14 @@ func (lg *MWPJSON) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSeg
 	rec := types.LogRec{}
 	b := types.LogItem{}
 
+	var evs types.EventDetector
 	leffic := 0.0
 	lwhkm := 0.0
 	whacc := 0.0
 	blt := 0.0
 	llat := -999.0
 	llon := 0.0
+	var fields types.FieldMask
 
 	var o map[string]interface{}
 	scanner := bufio.NewScanner(fh)
@@ -732,6 +833,9 @@ func (lg *MWPJSON) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSeg
 			json.Unmarshal([]byte(l), &o)
 			done, cap := parse_json(o, &b)
 			rec.Cap |= cap
+			if t, ok := o["type"].(string); ok {
+				fields |= json_fields[t]
+			}
 
 			if done && b.Fix != 0 {
 				if b.Vrange > stats.Max_range {
@@ -790,10 +894,13 @@ func (lg *MWPJSON) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSeg
 					stats.Max_current_time = uint64(lt-st) * 1000000
 				}
 
+				b.SetValid(fields, homes)
+				evs.Check(&b)
 				if ch != nil {
 					ch <- b
 				} else {
 					rec.Items = append(rec.Items, b)
+					rec.Valid |= b.Valid
 				}
 				stats.Distance = b.Tdist / 1852.0
 				b.Cse = 0xffff
@@ -814,6 +921,7 @@ func (lg *MWPJSON) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSeg
 			ls.L = rec
 			ls.H = homes
 			ls.M = srec
+			ls.E = evs.Events
 		}
 		return ls, ok
 	}
@@ -15,62 +15,78 @@ import (
 )
 
 type Configuration struct {
-	Dms             bool    `json:"dms"`
-	Dump            bool    `json:"-"`
-	Efficiency      bool    `json:"efficiency"`
-	Extrude         bool    `json:"extrude"`
-	Fast            bool    `json:"-"`
-	Kml             bool    `json:"kml"`
-	Metas           bool    `json:"-"`
-	Rssi            bool    `json:"rssi"`
-	Summary         bool    `json:"-"`
-	Bulletvers      int     `json:"blt-vers"`
-	Intvl           int     `json:"-"`
-	Idx             int     `json:"-"`
-	HomeAlt         int     `json:"home-alt"`
-	SplitTime       int     `json:"split-time"`
-	Type            int     `json:"type"`
-	Blackbox_decode string  `json:"blackbox-decode"`
-	Gradset         string  `json:"gradient"`
-	Engunit         string  `json:"energy-unit"`
-	LTMdev          string  `json:"-"`
-	Mission         string  `json:"-"`
-	Cli             string  `json:"-"`
-	MissionIndex    int     `json:"-"`
-	MaxWP           int     `json:"max-wp"`
-	Mqttopts        string  `json:"-"`
-	Outdir          string  `json:"outdir"`
-	Rebase          string  `json:"-"`
-	Visibility      int     `json:"visibility"`
-	Tmpdir          string  `json:"-"`
-	Epsilon         float64 `json:"-"`
-	StartOff        int     `json:"start-offset"`
-	EndOff          int     `json:"end-offset"`
-	Modefilter      string  `json:"-"`
-	UseTopo         bool    `json:"-"`
-	Attribs         string  `json:"attributes"`
-	Aflags          int     `json:"-"`
-	RedIsFast       bool    `json:"fast-is-red"`
-	RedIsLow        bool    `json:"low-is-red"`
-	SitlEEprom      string  `json:"-"`
-	SitlListen      string  `json:"-"`
-	SitlPort        int     `json:"-"`
-	SitlNoStart     bool    `json:"-"`
-	SitlAutoArm     bool    `json:"-"`
-	Verbose         int     `json:"-"`
-	SitlConfig      string  `json:"-"`
-	SitlMinimal     bool    `json:"-"`
-	SkipTime        int     `json:"-"`
-	Speed           int     `json:"-"`
-	Sql             string  `json:"-"`
-	Nocache         bool    `json:"-"`
+	Dms          bool    `json:"dms"`
+	Dump         bool    `json:"-"`
+	Efficiency   bool    `json:"efficiency"`
+	Extrude      bool    `json:"extrude"`
+	Fast         bool    `json:"-"`
+	Kml          bool    `json:"kml"`
+	Metas        bool    `json:"-"`
+	Rssi         bool    `json:"rssi"`
+	Summary      bool    `json:"-"`
+	Bulletvers   int     `json:"blt-vers"`
+	Intvl        int     `json:"-"`
+	Idx          int     `json:"-"`
+	HomeAlt      int     `json:"home-alt"`
+	SplitTime    int     `json:"split-time"`
+	Type         int     `json:"type"`
+	Gradset      string  `json:"gradient"`
+	Engunit      string  `json:"energy-unit"`
+	LTMdev       string  `json:"-"`
+	Mission      string  `json:"-"`
+	Cli          string  `json:"-"`
+	MissionIndex int     `json:"-"`
+	MaxWP        int     `json:"max-wp"`
+	Mqttopts     string  `json:"-"`
+	Outdir       string  `json:"outdir"`
+	Rebase       string  `json:"-"`
+	Visibility   int     `json:"visibility"`
+	Tmpdir       string  `json:"-"`
+	Epsilon      float64 `json:"-"`
+	StartOff     int     `json:"start-offset"`
+	EndOff       int     `json:"end-offset"`
+	Modefilter   string  `json:"-"`
+	UseTopo      bool    `json:"-"`
+	Attribs      string  `json:"attributes"`
+	Aflags       int     `json:"-"`
+	RedIsFast    bool    `json:"fast-is-red"`
+	RedIsLow     bool    `json:"low-is-red"`
+	SitlEEprom   string  `json:"-"`
+	SitlListen   string  `json:"-"`
+	SitlPort     int     `json:"-"`
+	SitlNoStart  bool    `json:"-"`
+	SitlAutoArm  bool    `json:"-"`
+	Verbose      int     `json:"-"`
+	SitlConfig   string  `json:"-"`
+	SitlMinimal  bool    `json:"-"`
+	SkipTime     int     `json:"-"`
+	Speed        int     `json:"-"`
+	Sql          string  `json:"-"`
+	Nocache      bool    `json:"-"`
+	CsvProfile   string  `json:"csv-profile"`
+	Merge        string  `json:"-"`
+	Filter       string  `json:"filter"`
+	GxTrack      bool    `json:"gx-track"`
+	Tour         string  `json:"tour"`
+	Format       string  `json:"format"`
+	IgcGrecord   bool    `json:"igc-grecord"`
+	SubOffset    float64 `json:"sub-offset"`
+	SubArm       bool    `json:"sub-arm"`
+	SubTemplate  string  `json:"sub-template"`
+	PhotoDir     string  `json:"-"`
+	PhotoOffset  float64 `json:"photo-offset"`
+	Xmp          bool    `json:"xmp"`
+	DryRun       bool    `json:"-"`
+	CellVolts    float64 `json:"cell-volts"`
+	PerfCsv      string  `json:"-"`
+	Series       string  `json:"-"`
 }
 
 var (
 	MwpMisc map[string]string
 )
 
-var Config Configuration = Configuration{Intvl: 1000, Blackbox_decode: "blackbox_decode", Bulletvers: 2, SplitTime: 120, Epsilon: 0.015, StartOff: 30, EndOff: -30, Engunit: "mah", MaxWP: 120}
+var Config Configuration = Configuration{Intvl: 1000, Bulletvers: 2, SplitTime: 120, Epsilon: 0.015, StartOff: 30, EndOff: -30, Engunit: "mah", MaxWP: 120, CellVolts: 3.3}
 
 func isFlagSet(name string) bool {
 	found := false
@@ -144,21 +160,26 @@ func ParseCLI(gv func() string) ([]string, string) {
 	}
 
 	err = parse_config_file(cfgfile)
-	Config.Blackbox_decode = types.SetBBLFallback(Config.Blackbox_decode)
 
 	showversion := false
 	flag.IntVar(&Config.Idx, "index", 0, "Log index")
 	if !strings.HasPrefix(app, "fl2sitl") {
 		flag.IntVar(&Config.SplitTime, "split-time", Config.SplitTime, "[OTX] Time(s) determining log split, 0 disables")
+		flag.StringVar(&Config.CsvProfile, "csv-profile", Config.CsvProfile, "[CSV] Column mapping profile (name or file)")
+		if !strings.HasPrefix(app, "fl2ltm") {
+			flag.StringVar(&Config.Filter, "filter", Config.Filter, "Track filter (speed=m/s,hdop=n,sats=n,clock[=s] or default)")
+		}
 	}
 	if !strings.HasPrefix(app, "log2mission") {
 		if !strings.HasPrefix(app, "fl2sitl") {
 			flag.IntVar(&Config.HomeAlt, "home-alt", Config.HomeAlt, "[OTX] home altitude")
 			flag.BoolVar(&Config.Dump, "dump", false, "Dump log headers and exit")
 		}
-		flag.StringVar(&Config.Mission, "mission", "", "Optional mission file name")
-		flag.StringVar(&Config.Cli, "cli", "", "Optional CLI file name")
-		flag.IntVar(&Config.MissionIndex, "mission-index", 0, "Optional mission file index")
+		if !strings.HasPrefix(app, "fl2geotag") && !strings.HasPrefix(app, "fl2perf") {
+			flag.StringVar(&Config.Mission, "mission", "", "Optional mission file name")
+			flag.StringVar(&Config.Cli, "cli", "", "Optional CLI file name")
+			flag.IntVar(&Config.MissionIndex, "mission-index", 0, "Optional mission file index")
+		}
 	}
 
 	if strings.HasPrefix(app, "fl2mqtt") {
@@ -190,18 +211,36 @@ func ParseCLI(gv func() string) ([]string, string) {
 		flag.BoolVar(&Config.SitlMinimal, "minimal", false, "Don't read a BBL")
 		flag.BoolVar(&Config.SitlAutoArm, "auto-arm", false, "Arm as soon as ready (vice manaully)")
 		flag.IntVar(&Config.Verbose, "verbose", 0, "Verbosity")
+	} else if strings.HasPrefix(app, "fl2geotag") {
+		Config.Intvl = 100
+		flag.StringVar(&Config.PhotoDir, "photos", "", "Directory of photos (JPEG) to geotag")
+		flag.Float64Var(&Config.PhotoOffset, "photo-offset", Config.PhotoOffset, "Camera clock offset (s), added to photo times to give UTC")
+		flag.BoolVar(&Config.Xmp, "xmp", Config.Xmp, "Write XMP sidecar files (vice updating the photos' EXIF)")
+		flag.BoolVar(&Config.DryRun, "dry-run", false, "Show photo positions, don't write")
+	} else if strings.HasPrefix(app, "fl2perf") {
+		flag.StringVar(&Config.PerfCsv, "csv", "", "Also write the speed bins to a CSV file")
 	} else {
 		flag.BoolVar(&Config.Kml, "kml", Config.Kml, "Generate KML (vice default KMZ)")
+		flag.StringVar(&Config.Format, "format", Config.Format, "Output format [kml, geojson, czml, gpx, igc, html, srt, ass] (kml includes KMZ, html is a report)")
+		flag.BoolVar(&Config.IgcGrecord, "igc-grecord", Config.IgcGrecord, "Add a placeholder G (security) record to IGC output")
+		flag.Float64Var(&Config.SubOffset, "sub-offset", Config.SubOffset, "Subtitle offset, video time (s) of the log start (or arming)")
+		flag.BoolVar(&Config.SubArm, "sub-arm", Config.SubArm, "Synchronise subtitles to arming (vice log start)")
+		flag.StringVar(&Config.SubTemplate, "sub-template", Config.SubTemplate, "Subtitle text template ({alt}, {spd}, {mode} etc., \\n for new line)")
 		flag.BoolVar(&Config.Rssi, "rssi", Config.Rssi, "Set RSSI view as default")
 		flag.BoolVar(&Config.Extrude, "extrude", Config.Extrude, "Extends track points to ground")
+		flag.BoolVar(&Config.GxTrack, "gx-track", Config.GxTrack, "Animated track with 3D model (vice track points)")
+		flag.StringVar(&Config.Tour, "tour", Config.Tour, "Camera tour (chase|orbit[,lag=m][,height=m][,scale=n][,pause=s])")
 		flag.BoolVar(&Config.Efficiency, "efficiency", Config.Efficiency, "Include efficiency layer in KML/Z")
 		flag.StringVar(&Config.Engunit, "energy-unit", Config.Engunit, "Energy unit [mah, wh]")
+		flag.Float64Var(&Config.CellVolts, "cell-volts", Config.CellVolts, "Rest cell voltage defining usable battery capacity")
 		flag.StringVar(&Config.Gradset, "gradient", Config.Gradset, "Specific colour gradient [red,rdgn,yor]")
 		flag.BoolVar(&Config.Dms, "dms", Config.Dms, "Show positions as DD:MM:SS.s (vice decimal degrees)")
 		flag.StringVar(&Config.Outdir, "outdir", Config.Outdir, "Output directory for generated KML")
 		flag.IntVar(&Config.Visibility, "visibility", Config.Visibility, "0=folder value,-1=don't set,1=all on")
 		flag.BoolVar(&Config.Summary, "summary", Config.Summary, "Just show summary")
 		flag.StringVar(&Config.Attribs, "attributes", Config.Attribs, "Attributes to plot (effic,speed,altitude)")
+		flag.StringVar(&Config.Merge, "merge", "", "Merge a second log of the same flight(s) (e.g. radio log)")
+		flag.StringVar(&Config.Series, "series", "", "Also write the selected fields (field or table.field, * wildcard, comma separated) at the log's rate to CSV")
 	}
 	flag.BoolVar(&Config.Nocache, "no-cache", Config.Nocache, "Ignore meta cache")
 	flag.StringVar(&Config.Rebase, "rebase", "", "rebase all positions on lat,lon[,alt]")
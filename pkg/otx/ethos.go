@@ -0,0 +1,177 @@
+package otx
+
+import (
+	"bytes"
+	"encoding/csv"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"types"
+)
+
+// FrSky Ethos logs are similar to OpenTX / EdgeTX logs, but use descriptive
+// sensor names ("GPS speed(km/h)" vice "GSpd(kmh)") and may have only a
+// "Time" column, the date being in the file name. Headers are mapped onto the
+// OpenTX names, so the rest of the OTX reader applies unchanged.
+
+// Ethos sensor name (lower case, without spaces) to OTX name
+var ethos_names = map[string]string{
+	"date": "Date",
+	"time": "Time",
+	// S.Port
+	"rssi":        "RSSI",
+	"rxbatt":      "RxBt",
+	"rxbattery":   "RxBt",
+	"vfas":        "VFAS",
+	"current":     "Curr",
+	"consumption": "Capa",
+	"capacity":    "Capa",
+	"fuel":        "Fuel",
+	"altitude":    "Alt",
+	"gps":         "GPS",
+	"gpsspeed":    "GSpd",
+	"gpscourse":   "Hdg",
+	"heading":     "Hdg",
+	"gpsaltitude": "GAlt",
+	"gpsalt":      "GAlt",
+	"temp1":       "Tmp1",
+	"temp2":       "Tmp2",
+	"accx":        "AccX",
+	"accy":        "AccY",
+	"accz":        "AccZ",
+	// CRSF
+	"rxrssi1":    "1RSS",
+	"rxrssi2":    "2RSS",
+	"rxquality":  "RQly",
+	"rxsnr":      "RSNR",
+	"txpower":    "TPWR",
+	"battery":    "RxBt",
+	"vbat":       "RxBt",
+	"flightmode": "FM",
+	"gpssats":    "Sats",
+	"satellites": "Sats",
+	"pitch":      "Ptch",
+	"roll":       "Roll",
+	"yaw":        "Yaw",
+	// Sticks
+	"aileron":  "Ail",
+	"elevator": "Ele",
+	"rudder":   "Rud",
+	"throttle": "Thr",
+}
+
+const LOGTIMEONLY = "15:04:05"
+
+// Date of the log, from an Ethos file name (Model-2023-05-12-103000.csv),
+// for logs with only a time of day
+var logdate time.Time
+
+func NewEthosReader(fn string) OTXLOG {
+	l := NewOTXReader(fn)
+	l.ethos = true
+	return l
+}
+
+func init() {
+	types.RegisterLogFormat(types.LogFormat{Name: "Ethos", Type: types.IS_ETHOS, Probe: probe_ethos,
+		Reader: func(fn string) types.FlightLog { l := NewEthosReader(fn); return &l }})
+}
+
+func ethos_key(s string) (string, string) {
+	s = strings.TrimSpace(strings.TrimPrefix(s, "\ufeff"))
+	u := ""
+	if n := strings.IndexByte(s, '('); n != -1 && strings.HasSuffix(s, ")") {
+		u = s[n+1 : len(s)-1]
+		s = strings.TrimSpace(s[:n])
+	}
+	return s, u
+}
+
+func ethos_name(s string) (string, bool) {
+	k := strings.ToLower(strings.NewReplacer(" ", "", "_", "", ".", "").Replace(s))
+	n, ok := ethos_names[k]
+	return n, ok
+}
+
+func probe_ethos(sig []byte) int {
+	n := bytes.IndexAny(sig, "\r\n")
+	if n == -1 {
+		n = bytes.LastIndexByte(sig, ',')
+		if n == -1 {
+			return types.PROBE_NONE
+		}
+	}
+	r := csv.NewReader(bytes.NewReader(sig[:n]))
+	r.TrimLeadingSpace = true
+	rec, err := r.Read()
+	if err != nil || len(rec) < 2 {
+		return types.PROBE_NONE
+	}
+	if k, _ := ethos_key(rec[0]); k != "Date" && k != "Time" {
+		return types.PROBE_NONE
+	}
+	known := 0
+	ethos := 0
+	for _, s := range rec {
+		k, _ := ethos_key(s)
+		if n, ok := ethos_name(k); ok {
+			known++
+			if n != k {
+				ethos++ // Ethos specific naming
+			}
+		}
+	}
+	switch {
+	case ethos > 1:
+		return types.PROBE_MAGIC
+	case ethos > 0 && known > 2:
+		return types.PROBE_STRONG
+	}
+	return types.PROBE_NONE
+}
+
+func read_ethos_headers(r []string) {
+	hdrs = make(map[string]hdrrec)
+	for i, s := range r {
+		k, u := ethos_key(s)
+		if n, ok := ethos_name(k); ok {
+			k = n
+		}
+		if _, ok := hdrs[k]; !ok {
+			hdrs[k] = hdrrec{i, u}
+		}
+	}
+}
+
+var daterx = regexp.MustCompile(`(\d{4})-(\d{2})-(\d{2})`)
+
+func date_from_name(fn string) time.Time {
+	m := daterx.FindStringSubmatch(filepath.Base(fn))
+	if m == nil {
+		return time.Time{}
+	}
+	y, _ := strconv.Atoi(m[1])
+	mo, _ := strconv.Atoi(m[2])
+	d, _ := strconv.Atoi(m[3])
+	return time.Date(y, time.Month(mo), d, 0, 0, 0, 0, time.UTC)
+}
+
+// Parses OTX and Ethos date/time formats; a fractional second is optional
+func parse_time(s string) (time.Time, error) {
+	var t time.Time
+	var err error
+	for _, layout := range []string{LOGTIMEPARSE, TIMEDATE, "2006/01/02 15:04:05"} {
+		if t, err = time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	if t, err = time.Parse(LOGTIMEONLY, s); err == nil {
+		t = logdate.Add(t.Sub(time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)))
+	}
+	return t, err
+}
@@ -1,13 +1,13 @@
 package otx
 
 import (
+	"bytes"
 	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
-	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
@@ -25,8 +25,9 @@ const LOGTIMEPARSE = "2006-01-02 15:04:05.000"
 const TIMEDATE = "2006-01-02 15:04:05"
 
 type OTXLOG struct {
-	name string
-	meta []types.FlightMeta
+	name  string
+	meta  []types.FlightMeta
+	ethos bool
 }
 
 func NewOTXReader(fn string) OTXLOG {
@@ -36,14 +37,29 @@ func NewOTXReader(fn string) OTXLOG {
 	return l
 }
 
+func init() {
+	types.RegisterLogFormat(types.LogFormat{Name: "OpenTX", Type: types.IS_OTX, Probe: probe_log,
+		Reader: func(fn string) types.FlightLog { l := NewOTXReader(fn); return &l }})
+}
+
+func probe_log(sig []byte) int {
+	if bytes.HasPrefix(sig, []byte("Date,Time,")) {
+		return types.PROBE_STRONG
+	}
+	return types.PROBE_NONE
+}
+
 func (o *OTXLOG) LogType() byte {
+	if o.ethos {
+		return types.LOGETHOS
+	}
 	return types.LOGOTX
 }
 
 func (o *OTXLOG) GetMetas() ([]types.FlightMeta, error) {
 	m, err := types.ReadMetaCache(o.name)
 	if err != nil || options.Config.Nocache {
-		m, err = metas(o.name)
+		m, err = o.metas()
 		types.WriteMetaCache(o.name, m)
 	}
 	o.meta = m
@@ -55,7 +71,7 @@ func (o *OTXLOG) GetDurations() {
 
 func (o *OTXLOG) Dump() {
 	if hdrs == nil || len(hdrs) == 0 {
-		fh, err := os.Open(o.name)
+		fh, err := types.OpenLog(o.name)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "log file %s\n", err)
 			return
@@ -64,7 +80,7 @@ func (o *OTXLOG) Dump() {
 		r := csv.NewReader(fh)
 		r.TrimLeadingSpace = true
 		record, err := r.Read()
-		read_headers(record) // for future usage
+		o.read_headers(record) // for future usage
 	}
 	dump_headers()
 }
@@ -94,23 +110,48 @@ func read_headers(r []string) {
 	}
 }
 
-func metas(otxfile string) ([]types.FlightMeta, error) {
+func (o *OTXLOG) read_headers(r []string) {
+	if o.ethos {
+		read_ethos_headers(r)
+	} else {
+		read_headers(r)
+	}
+	logdate = date_from_name(o.name)
+}
+
+// Log time from the Date and Time columns
+func get_rec_time(r []string) (time.Time, error) {
+	s, _, ok := get_rec_value(r, "Date")
+	s1, _, ok1 := get_rec_value(r, "Time")
+	if !ok1 {
+		return time.Time{}, errors.New("no time")
+	}
+	if !ok {
+		return parse_time(s1)
+	}
+	var sb strings.Builder
+	sb.WriteString(s)
+	sb.WriteByte(' ')
+	sb.WriteString(s1)
+	return parse_time(sb.String())
+}
+
+func (o *OTXLOG) metas() ([]types.FlightMeta, error) {
+	otxfile := o.name
 	var metas []types.FlightMeta
 
-	fh, err := os.Open(otxfile)
+	fh, err := types.OpenLog(otxfile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "log file %s\n", err)
 		return metas, err
 	}
 	defer fh.Close()
 
-	basefile := filepath.Base(otxfile)
+	basefile := types.LogBase(otxfile)
 	r := csv.NewReader(fh)
 	r.TrimLeadingSpace = true
 
 	var lasttm time.Time
-	dindex := -1
-	tindex := -1
 
 	idx := 0
 	for i := 1; ; i++ {
@@ -121,24 +162,9 @@ func metas(otxfile string) ([]types.FlightMeta, error) {
 			break
 		}
 		if i == 1 {
-			read_headers(record) // for future usage
-			for j, s := range record {
-				switch s {
-				case "Date":
-					dindex = j
-				case "Time":
-					tindex = j
-				}
-				if dindex != -1 && tindex != -1 {
-					break
-				}
-			}
+			o.read_headers(record)
 		} else {
-			var sb strings.Builder
-			sb.WriteString(record[dindex])
-			sb.WriteByte(' ')
-			sb.WriteString(record[tindex])
-			t_utc, _ := time.Parse(LOGTIMEPARSE, sb.String())
+			t_utc, _ := get_rec_time(record)
 			if i == 2 || (options.Config.SplitTime > 0 && t_utc.Sub(lasttm).Seconds() > (time.Duration(options.Config.SplitTime)*time.Second).Seconds()) {
 				if idx > 0 {
 					metas[idx-1].End = i - 1
@@ -238,9 +264,45 @@ func dataCapability() uint16 {
 	return ret
 }
 
+// Fields logged, from the headers; see types.FieldMask
+func dataFields() types.FieldMask {
+	ret := types.F_STAMP | types.F_UTC
+	for _, f := range []struct {
+		keys []string
+		mask types.FieldMask
+	}{
+		{[]string{"GPS"}, types.F_POS},
+		{[]string{"Tmp2", "Sats"}, types.F_NUMSAT | types.F_FIX | types.F_HDOP},
+		{[]string{"ARM"}, types.F_NUMSAT | types.F_FIX | types.F_FMODE | types.F_STATUS},
+		{[]string{"Tmp1", "FM"}, types.F_FMODE | types.F_STATUS},
+		{[]string{"Alt"}, types.F_ALT},
+		{[]string{"GAlt"}, types.F_GALT},
+		{[]string{"GSpd"}, types.F_SPD},
+		{[]string{"Hdg"}, types.F_CSE | types.F_COG},
+		{[]string{"Yaw"}, types.F_CSE},
+		{[]string{"AccZ", "Ptch"}, types.F_ATTITUDE},
+		{[]string{"Thr"}, types.F_THROTTLE},
+		{[]string{"Ail"}, types.F_STICKS},
+		{[]string{"RSSI", "1RSS"}, types.F_RSSI},
+		{[]string{"VFAS", "RxBt"}, types.F_VOLTS},
+		{[]string{"Curr"}, types.F_AMPS},
+	} {
+		for _, k := range f.keys {
+			if _, ok := hdrs[k]; ok {
+				ret |= f.mask
+				break
+			}
+		}
+	}
+	if dataCapability()&types.CAP_ENERGY != 0 {
+		ret |= types.F_ENERGY
+	}
+	return ret
+}
+
 func normalise_units(v float64, u string) float64 {
 	switch u {
-	case "kmh":
+	case "kmh", "km/h":
 		v /= 3.6
 	case "mph":
 		v *= 0.44704
@@ -278,15 +340,7 @@ func get_otx_line(r []string) types.LogItem {
 		}
 	}
 
-	if s, _, ok := get_rec_value(r, "Date"); ok {
-		if s1, _, ok := get_rec_value(r, "Time"); ok {
-			var sb strings.Builder
-			sb.WriteString(s)
-			sb.WriteByte(' ')
-			sb.WriteString(s1)
-			b.Utc, _ = time.Parse(LOGTIMEPARSE, sb.String())
-		}
-	}
+	b.Utc, _ = get_rec_time(r)
 
 	if s, u, ok := get_rec_value(r, "Alt"); ok {
 		b.Alt, _ = strconv.ParseFloat(s, 64)
@@ -581,6 +635,92 @@ func acc_to_ah(ax, ay, az float64) (pitch int16, roll int16) {
 	return pitch, roll
 }
 
+// Series reads every record of the flight as the table "log", columns being
+// named as the log's fields (less units); the GPS position is split into
+// "GPS[0]" (latitude) and "GPS[1]" (longitude). Non-numeric values are
+// stored as NaN.
+func (lg *OTXLOG) Series(m types.FlightMeta, sel []string) (*types.Series, error) {
+	fh, err := types.OpenLog(lg.name)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	r := csv.NewReader(fh)
+	r.TrimLeadingSpace = true
+
+	s := types.NewSeries(sel)
+	var t *types.Table
+	var keys []string
+	var vals []float64
+	var st time.Time
+	gpsi := -1
+	for i := 1; ; i++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return s, err
+		}
+		if i == 1 {
+			lg.read_headers(record)
+			keys = make([]string, len(record))
+			copy(keys, record)
+			for k, h := range hdrs {
+				keys[h.i] = k
+			}
+			var names []string
+			for j, k := range keys {
+				if k == "GPS" {
+					gpsi = j
+					names = append(names, "GPS[0]", "GPS[1]")
+				} else {
+					names = append(names, k)
+				}
+			}
+			t = s.AddTable("log", names)
+			if t == nil {
+				break
+			}
+			continue
+		}
+		if i < m.Start || i > m.End {
+			continue
+		}
+		ts, err := get_rec_time(record)
+		if err != nil {
+			continue
+		}
+		if st.IsZero() {
+			st = ts
+		}
+		vals = vals[:0]
+		for j := range keys {
+			var f string
+			if j < len(record) {
+				f = record[j]
+			}
+			if j == gpsi {
+				lat, lon := math.NaN(), math.NaN()
+				if parts := strings.Split(f, " "); len(parts) == 2 {
+					lat, _ = strconv.ParseFloat(parts[0], 64)
+					lon, _ = strconv.ParseFloat(parts[1], 64)
+				}
+				vals = append(vals, lat, lon)
+				continue
+			}
+			v, err := strconv.ParseFloat(f, 64)
+			if err != nil {
+				v = math.NaN()
+			}
+			vals = append(vals, v)
+		}
+		t.Append(uint64(ts.Sub(st).Microseconds()), vals)
+	}
+	return s, nil
+}
+
 func (lg *OTXLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegment, bool) {
 	var stats types.LogStats
 
@@ -593,7 +733,7 @@ func (lg *OTXLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegm
 
 	fb := geo.Getfrobnication()
 
-	fh, err := os.Open(lg.name)
+	fh, err := types.OpenLog(lg.name)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "log file %s\n", err)
 		os.Exit(-1)
@@ -606,7 +746,9 @@ func (lg *OTXLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegm
 	//split_sec := 30 // to be parameterised
 	//	var armtime time.Time
 	var lt, st time.Time
+	var fields types.FieldMask
 
+	var evs types.EventDetector
 	leffic := 0.0
 	lwhkm := 0.0
 	whacc := 0.0
@@ -617,8 +759,9 @@ func (lg *OTXLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegm
 			break
 		}
 		if i == 1 {
-			read_headers(record)
+			lg.read_headers(record)
 			rec.Cap = dataCapability()
+			fields = dataFields()
 			continue
 		}
 		if i >= m.Start && i <= m.End {
@@ -686,6 +829,7 @@ func (lg *OTXLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegm
 					if (b.Status & (types.Is_CRSF | types.Is_ARDU)) != 0 {
 						b.Spd = calc_speed(b, tdiff, llat, llon)
 						rec.Cap |= types.CAP_SPEED
+						fields |= types.F_SPD
 					}
 				}
 
@@ -750,15 +894,29 @@ func (lg *OTXLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegm
 				if b.Rssi > 0 {
 					rec.Cap |= types.CAP_RSSI_VALID
 				}
+				b.SetValid(fields, homes)
+				evs.Check(&b)
 
 				if ch != nil {
 					ch <- b
 				} else {
 					rec.Items = append(rec.Items, b)
+					rec.Valid |= b.Valid
 				}
 				llat = b.Lat
 				llon = b.Lon
 				lt = b.Utc
+			} else if !st.IsZero() && homes.Flags != 0 {
+				// Events are detected on every frame, the items decimated
+				b.Stamp = uint64(b.Utc.Sub(st).Microseconds())
+				if fb != nil {
+					b.Utc = b.Utc.Add(froboff)
+					b.Lat, b.Lon, _ = fb.Relocate(b.Lat, b.Lon, 0)
+				}
+				b.Hlat = homes.HomeLat
+				b.Hlon = homes.HomeLon
+				b.SetValid(fields, homes)
+				evs.Check(&b)
 			}
 		}
 		if err != nil {
@@ -777,6 +935,7 @@ func (lg *OTXLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegm
 			ls.L = rec
 			ls.H = homes
 			ls.M = srec
+			ls.E = evs.Events
 		}
 		return ls, ok
 	}
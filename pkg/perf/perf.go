@@ -0,0 +1,244 @@
+package perf
+
+import (
+	"math"
+	"sort"
+)
+
+import (
+	"geo"
+	"types"
+)
+
+// Efficiency against speed, per craft, from the level, wings (near) level
+// cruise (CRUISE and WP mode) samples of any number of logs. The samples are
+// binned by ground speed and, where the wind is known, by airspeed (the
+// ground velocity less the wind). A power required curve
+//     P = C + A.v³ + B/v
+// (the constant, parasitic and induced terms) is fitted to the bins' mean
+// electrical power, giving the best endurance (minimum power) and best range
+// (minimum power / speed) speeds.
+
+const (
+	min_speed = 3.0 // m/s
+	max_climb = 1.0 // m/s, level flight
+	max_roll  = 15  // deg, turns excluded
+	min_bin   = 5   // samples in a bin used by the fit
+	BinWidth  = 1.0 // m/s
+)
+
+type Bin struct {
+	Speed float64 // bin centre (m/s)
+	N     int
+	Power float64 // mean (W)
+}
+
+// Wh/km at the bin's speed
+func (b Bin) Whkm() float64 {
+	return b.Power / b.Speed / 3.6
+}
+
+type Fit struct {
+	C, A, B   float64
+	Ok        bool
+	Endurance float64 // best endurance speed (m/s)
+	Range     float64 // best range speed (m/s)
+}
+
+func (f Fit) Power(v float64) float64 {
+	return f.C + f.A*v*v*v + f.B/v
+}
+
+type accum struct {
+	n   int
+	sum float64
+}
+
+type Curve struct {
+	bins map[int]*accum
+}
+
+type Craft struct {
+	Name    string
+	Flights int
+	Samples int
+	Ground  Curve
+	Air     Curve
+}
+
+type Perf struct {
+	crafts map[string]*Craft
+}
+
+func NewPerf() *Perf {
+	return &Perf{crafts: make(map[string]*Craft)}
+}
+
+func (c *Curve) add(v, p float64) {
+	if c.bins == nil {
+		c.bins = make(map[int]*accum)
+	}
+	k := int(v/BinWidth + 0.5)
+	a, ok := c.bins[k]
+	if !ok {
+		a = &accum{}
+		c.bins[k] = a
+	}
+	a.n++
+	a.sum += p
+}
+
+func is_cruise(fm uint8) bool {
+	switch fm {
+	case types.FM_CRUISE2D, types.FM_CRUISE3D, types.FM_WP:
+		return true
+	}
+	return false
+}
+
+// Add adds a flight's cruise samples to its craft's curves, returning the
+// number of samples used
+func (p *Perf) Add(ls types.LogSegment, meta types.FlightMeta) int {
+	if ls.L.Cap&(types.CAP_AMPS|types.CAP_VOLTS) != types.CAP_AMPS|types.CAP_VOLTS {
+		return 0
+	}
+	name := "noname"
+	if meta.Flags&types.Has_Craft != 0 && meta.Craft != "" {
+		name = meta.Craft
+	}
+	c, ok := p.crafts[name]
+	if !ok {
+		c = &Craft{Name: name}
+		p.crafts[name] = c
+	}
+	haswind := ls.L.Cap&types.CAP_WIND != 0
+	n := 0
+	for j := 1; j < len(ls.L.Items); j++ {
+		b := ls.L.Items[j]
+		l := ls.L.Items[j-1]
+		if !is_cruise(b.Fmode) || !b.Logged(types.F_AMPS|types.F_VOLTS) || b.Spd < min_speed {
+			continue
+		}
+		if b.Logged(types.F_ATTITUDE) && (b.Roll > max_roll || b.Roll < -max_roll) {
+			continue
+		}
+		if dt := float64(b.Stamp-l.Stamp) / 1e6; dt <= 0 || math.Abs(b.Alt-l.Alt)/dt > max_climb {
+			continue
+		}
+		pwr := b.Volts * b.Amps
+		if pwr <= 0 {
+			continue
+		}
+		c.Ground.add(b.Spd, pwr)
+		if haswind && b.Logged(types.F_WIND|types.F_COG) {
+			// INAV's wind is the air's velocity (cm/s, north, east, up)
+			cog := float64(b.Cog) * math.Pi / 180
+			vn := b.Spd*math.Cos(cog) - float64(b.Wind[0])/100
+			ve := b.Spd*math.Sin(cog) - float64(b.Wind[1])/100
+			if as := math.Hypot(vn, ve); as >= min_speed {
+				c.Air.add(as, pwr)
+			}
+		}
+		n++
+	}
+	if n > 0 {
+		c.Flights++
+		c.Samples += n
+	}
+	return n
+}
+
+// Crafts returns the crafts with samples, by name
+func (p *Perf) Crafts() []*Craft {
+	var cs []*Craft
+	for _, c := range p.crafts {
+		if c.Samples > 0 {
+			cs = append(cs, c)
+		}
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Name < cs[j].Name })
+	return cs
+}
+
+// Bins returns the curve's bins, by speed
+func (c *Curve) Bins() []Bin {
+	var bs []Bin
+	for k, a := range c.bins {
+		bs = append(bs, Bin{Speed: float64(k) * BinWidth, N: a.n, Power: a.sum / float64(a.n)})
+	}
+	sort.Slice(bs, func(i, j int) bool { return bs[i].Speed < bs[j].Speed })
+	return bs
+}
+
+// Fit fits the power required curve to the bins with at least min_bin
+// samples, weighted by their counts. The fit is not Ok if there are too few
+// bins or the curve has no minimum (A or B not positive).
+func (c *Curve) Fit() Fit {
+	var f Fit
+	var m [3][3]float64
+	var v [3]float64
+	nb := 0
+	for _, b := range c.Bins() {
+		if b.N < min_bin {
+			continue
+		}
+		nb++
+		x := [3]float64{1, b.Speed * b.Speed * b.Speed, 1 / b.Speed}
+		w := float64(b.N)
+		for r := 0; r < 3; r++ {
+			for k := 0; k < 3; k++ {
+				m[r][k] += w * x[r] * x[k]
+			}
+			v[r] += w * x[r] * b.Power
+		}
+	}
+	if nb < 4 {
+		return f
+	}
+	x, ok := geo.Solve3(m, v)
+	if !ok {
+		return f
+	}
+	f.C, f.A, f.B = x[0], x[1], x[2]
+	if f.A <= 0 || f.B <= 0 {
+		return f
+	}
+	f.Ok = true
+	// dP/dv = 3Av² - B/v² = 0
+	f.Endurance = math.Pow(f.B/(3*f.A), 0.25)
+	// d(P/v)/dv = 0 => 2Av⁴ - Cv - 2B = 0, which (being convex and negative
+	// at 0) has a single positive root
+	g := func(v float64) float64 { return 2*f.A*v*v*v*v - f.C*v - 2*f.B }
+	lo, hi := 0.0, 1.0
+	for g(hi) < 0 {
+		lo, hi = hi, hi*2
+	}
+	for j := 0; j < 60; j++ {
+		if mid := (lo + hi) / 2; g(mid) < 0 {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	f.Range = (lo + hi) / 2
+	return f
+}
+
+// Best returns the speeds of the (populated) bins with the least power and
+// the least energy per distance
+func (c *Curve) Best() (float64, float64) {
+	var se, sr float64
+	pe, pr := math.Inf(1), math.Inf(1)
+	for _, b := range c.Bins() {
+		if b.N < min_bin {
+			continue
+		}
+		if b.Power < pe {
+			pe, se = b.Power, b.Speed
+		}
+		if b.Whkm() < pr {
+			pr, sr = b.Whkm(), b.Speed
+		}
+	}
+	return se, sr
+}
@@ -0,0 +1,15 @@
+// Package readers links in every log reader; each registers its format
+// with types.RegisterLogFormat. New formats need only be added here.
+package readers
+
+import (
+	_ "aplog"
+	_ "bbl"
+	_ "bltlog"
+	_ "csvlog"
+	_ "mwpjson"
+	_ "otx"
+	_ "sqlreader"
+	_ "tlog"
+	_ "ulog"
+)
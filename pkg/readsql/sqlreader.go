@@ -1,11 +1,12 @@
 package sqlreader
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	"log"
+	"math"
 	_ "modernc.org/sqlite"
-	"path/filepath"
 	"strings"
 	"time"
 )
@@ -25,10 +26,26 @@ func NewSQLReader(fn string) SQLREAD {
 	var l SQLREAD
 	l.name = fn
 	l.meta = nil
-	l.db, _ = sqlx.Open("sqlite", fn)
+	if dbfile, err := types.LogFilePath(fn, options.Config.Tmpdir); err == nil {
+		l.db, _ = sqlx.Open("sqlite", dbfile)
+	} else {
+		log.Fatalf("sqlite %s\n", err)
+	}
 	return l
 }
 
+func init() {
+	types.RegisterLogFormat(types.LogFormat{Name: "SQLite", Type: types.IS_SQL, Probe: probe_log,
+		Reader: func(fn string) types.FlightLog { l := NewSQLReader(fn); return &l }})
+}
+
+func probe_log(sig []byte) int {
+	if bytes.HasPrefix(sig, []byte("SQLite format 3")) {
+		return types.PROBE_LIKELY
+	}
+	return types.PROBE_NONE
+}
+
 func (o *SQLREAD) LogType() byte {
 	return types.LOGSQL
 }
@@ -98,7 +115,7 @@ func parse_time(tm string) (time.Time, error) {
 
 func (o *SQLREAD) metas(logfile string) ([]types.FlightMeta, error) {
 	var metas []types.FlightMeta
-	bp := filepath.Base(logfile)
+	bp := types.LogBase(logfile)
 
 	rows, err := o.db.Queryx("SELECT * FROM meta order by id")
 	if err == nil {
@@ -146,6 +163,82 @@ func (o *SQLREAD) metas(logfile string) ([]types.FlightMeta, error) {
 	return metas, err
 }
 
+// Series reads the flight's rows as the table "logs", the columns being the
+// numeric columns of the database's logs table. The rate is that at which
+// the database was written.
+func (lg *SQLREAD) Series(m types.FlightMeta, sel []string) (*types.Series, error) {
+	rows, err := lg.db.Query("SELECT * FROM logs where id=$1 order by idx", m.Index)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	var pick []int
+	stampi := -1
+	for j, c := range cols {
+		switch c {
+		case "stamp":
+			stampi = j
+		case "id", "idx", "fmtext", "utc":
+		default:
+			names = append(names, c)
+			pick = append(pick, j)
+		}
+	}
+	s := types.NewSeries(sel)
+	t := s.AddTable("logs", names)
+	if t == nil || stampi == -1 {
+		return s, nil
+	}
+	raw := make([]interface{}, len(cols))
+	dest := make([]interface{}, len(cols))
+	for j := range raw {
+		dest[j] = &raw[j]
+	}
+	vals := make([]float64, len(pick))
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return s, err
+		}
+		for j, k := range pick {
+			switch v := raw[k].(type) {
+			case int64:
+				vals[j] = float64(v)
+			case float64:
+				vals[j] = v
+			default:
+				vals[j] = math.NaN()
+			}
+		}
+		stamp, _ := raw[stampi].(int64)
+		t.Append(uint64(stamp), vals)
+	}
+	return s, rows.Err()
+}
+
+// Reads the events stored for a flight; false if the database has none
+// (from earlier versions)
+func (lg *SQLREAD) read_events(id int) ([]types.LogEvent, bool) {
+	rows, err := lg.db.Query("SELECT stamp, utc, lat, lon, alt, kind, detail FROM events where id=$1 order by stamp", id)
+	if err != nil {
+		return nil, false
+	}
+	defer rows.Close()
+	var evs []types.LogEvent
+	for rows.Next() {
+		var e types.LogEvent
+		if err := rows.Scan(&e.Stamp, &e.Utc, &e.Lat, &e.Lon, &e.Alt, &e.Kind, &e.Detail); err != nil {
+			return nil, false
+		}
+		evs = append(evs, e)
+	}
+	return evs, true
+}
+
 func (lg *SQLREAD) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegment, bool) {
 	stats := types.LogStats{}
 	ls := types.LogSegment{}
@@ -157,13 +250,20 @@ func (lg *SQLREAD) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSeg
 		ltmmode int
 	)
 
+	var evs types.EventDetector
 	rows, err := lg.db.Query("SELECT * FROM logs where id=$1 order by idx", m.Index)
 	if err != nil {
 		log.Fatalf("METASQL for %d +%v\n", m.Index, err)
 	}
+	// Databases from older versions have no validity column; assume the
+	// fields were logged
+	valid := types.F_ALL
+	cols, _ := rows.Columns()
+	hasvalid := len(cols) > 0 && cols[len(cols)-1] == "valid"
+
 	for rows.Next() {
 		b := types.LogItem{}
-		err := rows.Scan(&mid, &midx,
+		dest := []interface{}{&mid, &midx,
 			&b.Stamp,
 			&b.Lat,
 			&b.Lon,
@@ -213,7 +313,11 @@ func (lg *SQLREAD) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSeg
 			&b.HWfail,
 			&b.Wind[0],
 			&b.Wind[1],
-			&b.Wind[2])
+			&b.Wind[2]}
+		if hasvalid {
+			dest = append(dest, &valid)
+		}
+		err := rows.Scan(dest...)
 
 		if err != nil {
 			log.Printf("META SQL: %+v\n", err)
@@ -265,10 +369,13 @@ func (lg *SQLREAD) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSeg
 		}
 
 		stats.Distance = b.Tdist / 1852.0
+		b.SetValid(valid, homes)
+		evs.Check(&b)
 		if ch != nil {
 			ch <- b
 		} else {
 			rec.Items = append(rec.Items, b)
+			rec.Valid |= b.Valid
 		}
 	}
 
@@ -284,6 +391,11 @@ func (lg *SQLREAD) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSeg
 			ls.L = rec
 			ls.H = homes
 			ls.M = srec
+			if e, ok := lg.read_events(m.Index); ok {
+				ls.E = e
+			} else {
+				ls.E = evs.Events
+			}
 		}
 		return ls, ok
 	}
@@ -0,0 +1,762 @@
+package tlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+import (
+	"geo"
+	"mwpjson"
+	"options"
+	"types"
+)
+
+// MAVLink telemetry log (.tlog) reader
+// Each record is a big-endian uint64 Unix timestamp (us) followed by a
+// MAVLink v1 (0xfe) or v2 (0xfd) packet
+
+const (
+	msg_HEARTBEAT           = 0
+	msg_SYS_STATUS          = 1
+	msg_GPS_RAW_INT         = 24
+	msg_ATTITUDE            = 30
+	msg_GLOBAL_POSITION_INT = 33
+	msg_RC_CHANNELS         = 65
+	msg_VFR_HUD             = 74
+)
+
+const (
+	mav_TYPE_GCS      = 6
+	mav_AUTOPILOT_APM = 3
+	mav_AUTOPILOT_INV = 8
+	mav_AUTOPILOT_PX4 = 12
+	mav_MODE_ARMED    = 128
+)
+
+// Sensors that imply a hardware failure if present, enabled and unhealthy
+// (gyro, acc, baro, gps)
+const mav_SENSOR_CRIT = 0x01 | 0x02 | 0x08 | 0x20
+
+type mavdef struct {
+	name  string
+	len   int
+	extra byte
+}
+
+var mavdefs = map[uint32]mavdef{
+	msg_HEARTBEAT:           {"HEARTBEAT", 9, 50},
+	msg_SYS_STATUS:          {"SYS_STATUS", 31, 124},
+	msg_GPS_RAW_INT:         {"GPS_RAW_INT", 30, 24},
+	msg_ATTITUDE:            {"ATTITUDE", 28, 39},
+	msg_GLOBAL_POSITION_INT: {"GLOBAL_POSITION_INT", 28, 104},
+	msg_RC_CHANNELS:         {"RC_CHANNELS", 42, 118},
+	msg_VFR_HUD:             {"VFR_HUD", 20, 20},
+}
+
+// Payload fields of the messages above (in MAVLink wire order), for Series;
+// the types are as dataflash formats (B: uint8, h: int16, H: uint16, i:
+// int32, I: uint32, Q: uint64, f: float)
+type mavfield struct {
+	name string
+	off  int
+	typ  byte
+}
+
+var mavfields = map[uint32][]mavfield{
+	msg_HEARTBEAT: {{"custom_mode", 0, 'I'}, {"type", 4, 'B'}, {"autopilot", 5, 'B'},
+		{"base_mode", 6, 'B'}, {"system_status", 7, 'B'}},
+	msg_SYS_STATUS: {{"onboard_control_sensors_present", 0, 'I'}, {"onboard_control_sensors_enabled", 4, 'I'},
+		{"onboard_control_sensors_health", 8, 'I'}, {"load", 12, 'H'}, {"voltage_battery", 14, 'H'},
+		{"current_battery", 16, 'h'}, {"drop_rate_comm", 18, 'H'}, {"errors_comm", 20, 'H'},
+		{"battery_remaining", 30, 'b'}},
+	msg_GPS_RAW_INT: {{"time_usec", 0, 'Q'}, {"lat", 8, 'i'}, {"lon", 12, 'i'}, {"alt", 16, 'i'},
+		{"eph", 20, 'H'}, {"epv", 22, 'H'}, {"vel", 24, 'H'}, {"cog", 26, 'H'},
+		{"fix_type", 28, 'B'}, {"satellites_visible", 29, 'B'}},
+	msg_ATTITUDE: {{"time_boot_ms", 0, 'I'}, {"roll", 4, 'f'}, {"pitch", 8, 'f'}, {"yaw", 12, 'f'},
+		{"rollspeed", 16, 'f'}, {"pitchspeed", 20, 'f'}, {"yawspeed", 24, 'f'}},
+	msg_GLOBAL_POSITION_INT: {{"time_boot_ms", 0, 'I'}, {"lat", 4, 'i'}, {"lon", 8, 'i'}, {"alt", 12, 'i'},
+		{"relative_alt", 16, 'i'}, {"vx", 20, 'h'}, {"vy", 22, 'h'}, {"vz", 24, 'h'}, {"hdg", 26, 'H'}},
+	msg_RC_CHANNELS: {{"time_boot_ms", 0, 'I'},
+		{"chan1_raw", 4, 'H'}, {"chan2_raw", 6, 'H'}, {"chan3_raw", 8, 'H'}, {"chan4_raw", 10, 'H'},
+		{"chan5_raw", 12, 'H'}, {"chan6_raw", 14, 'H'}, {"chan7_raw", 16, 'H'}, {"chan8_raw", 18, 'H'},
+		{"chan9_raw", 20, 'H'}, {"chan10_raw", 22, 'H'}, {"chan11_raw", 24, 'H'}, {"chan12_raw", 26, 'H'},
+		{"chan13_raw", 28, 'H'}, {"chan14_raw", 30, 'H'}, {"chan15_raw", 32, 'H'}, {"chan16_raw", 34, 'H'},
+		{"chan17_raw", 36, 'H'}, {"chan18_raw", 38, 'H'}, {"chancount", 40, 'B'}, {"rssi", 41, 'B'}},
+	msg_VFR_HUD: {{"airspeed", 0, 'f'}, {"groundspeed", 4, 'f'}, {"alt", 8, 'f'}, {"climb", 12, 'f'},
+		{"heading", 16, 'h'}, {"throttle", 18, 'H'}},
+}
+
+// Plausible tlog timestamps, 2000-01-01 .. 2100-01-01
+const (
+	tlog_MIN_US = 946684800 * 1000000
+	tlog_MAX_US = 4102444800 * 1000000
+)
+
+type mavpkt struct {
+	stamp   uint64
+	sysid   uint8
+	compid  uint8
+	msgid   uint32
+	payload []byte
+}
+
+type mavreader struct {
+	data []byte
+	pos  int
+	nbad int
+}
+
+type TLOG struct {
+	name string
+	meta []types.FlightMeta
+}
+
+func NewTLOGReader(fn string) TLOG {
+	var l TLOG
+	l.name = fn
+	l.meta = nil
+	return l
+}
+
+func init() {
+	types.RegisterLogFormat(types.LogFormat{Name: "MAVLink tlog", Type: types.IS_TLOG, Probe: probe_log,
+		Reader: func(fn string) types.FlightLog { l := NewTLOGReader(fn); return &l }})
+}
+
+func probe_log(sig []byte) int {
+	if is_tlog(sig) {
+		return types.PROBE_LIKELY
+	}
+	return types.PROBE_NONE
+}
+
+func (o *TLOG) LogType() byte {
+	return types.LOGTLOG
+}
+
+func (o *TLOG) GetMetas() ([]types.FlightMeta, error) {
+	m, err := types.ReadMetaCache(o.name)
+	if err != nil || options.Config.Nocache {
+		m, err = metas(o.name)
+		types.WriteMetaCache(o.name, m)
+	}
+	o.meta = m
+	return m, err
+}
+
+func (o *TLOG) GetDurations() {
+}
+
+func (o *TLOG) Dump() {
+	data, err := types.ReadLog(o.name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "log file %s\n", err)
+		os.Exit(1)
+	}
+	counts := make(map[uint32]int)
+	r := mavreader{data: data}
+	for {
+		p, ok := r.next()
+		if !ok {
+			break
+		}
+		counts[p.msgid] += 1
+	}
+	var a []int
+	for k := range counts {
+		a = append(a, int(k))
+	}
+	sort.Ints(a)
+	for _, k := range a {
+		name := "unknown"
+		if md, ok := mavdefs[uint32(k)]; ok {
+			name = md.name
+		}
+		fmt.Printf("%d, %s, %d\n", k, name, counts[uint32(k)])
+	}
+	if r.nbad > 0 {
+		fmt.Printf("bad packets: %d\n", r.nbad)
+	}
+}
+
+// Checks the first two records look plausible
+func is_tlog(sig []byte) bool {
+	pos := 0
+	for n := 0; n < 2 && pos+10 <= len(sig); n++ {
+		plen, ok := check_header(sig[pos:])
+		if !ok {
+			return false
+		}
+		pos += plen
+	}
+	return pos > 0
+}
+
+func check_header(b []byte) (int, bool) {
+	stamp := binary.BigEndian.Uint64(b)
+	if stamp < tlog_MIN_US || stamp > tlog_MAX_US {
+		return 0, false
+	}
+	switch b[8] {
+	case 0xfe:
+		return 8 + 6 + int(b[9]) + 2, true
+	case 0xfd:
+		n := 8 + 10 + int(b[9]) + 2
+		if len(b) > 10 && b[10]&1 != 0 {
+			n += 13
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+func crc_accumulate(crc uint16, b []byte) uint16 {
+	for _, c := range b {
+		tmp := c ^ byte(crc&0xff)
+		tmp ^= (tmp << 4)
+		crc = (crc >> 8) ^ (uint16(tmp) << 8) ^ (uint16(tmp) << 3) ^ (uint16(tmp) >> 4)
+	}
+	return crc
+}
+
+func (r *mavreader) resync() {
+	r.nbad++
+	for r.pos++; r.pos < len(r.data)-10; r.pos++ {
+		if _, ok := check_header(r.data[r.pos:]); ok {
+			return
+		}
+	}
+	r.pos = len(r.data)
+}
+
+func (r *mavreader) next() (*mavpkt, bool) {
+	for r.pos < len(r.data)-10 {
+		b := r.data[r.pos:]
+		plen, ok := check_header(b)
+		if !ok {
+			r.resync()
+			continue
+		}
+		if plen > len(b) {
+			break
+		}
+		p := &mavpkt{stamp: binary.BigEndian.Uint64(b)}
+		n := int(b[9])
+		var hlen int
+		if b[8] == 0xfe {
+			hlen = 6
+			p.sysid = b[11]
+			p.compid = b[12]
+			p.msgid = uint32(b[13])
+		} else {
+			hlen = 10
+			p.sysid = b[13]
+			p.compid = b[14]
+			p.msgid = uint32(b[15]) | uint32(b[16])<<8 | uint32(b[17])<<16
+		}
+		if md, ok := mavdefs[p.msgid]; ok {
+			crc := crc_accumulate(0xffff, b[9:8+hlen+n])
+			crc = crc_accumulate(crc, []byte{md.extra})
+			if crc != binary.LittleEndian.Uint16(b[8+hlen+n:]) {
+				r.resync()
+				continue
+			}
+			// MAVLink v2 truncates trailing zero bytes
+			sz := md.len
+			if n > sz {
+				sz = n
+			}
+			p.payload = make([]byte, sz)
+			copy(p.payload, b[8+hlen:8+hlen+n])
+		} else {
+			p.payload = b[8+hlen : 8+hlen+n]
+		}
+		r.pos += plen
+		return p, true
+	}
+	return nil, false
+}
+
+func (p *mavpkt) u16(off int) uint16 {
+	return binary.LittleEndian.Uint16(p.payload[off:])
+}
+
+func (p *mavpkt) i16(off int) int16 {
+	return int16(p.u16(off))
+}
+
+func (p *mavpkt) u32(off int) uint32 {
+	return binary.LittleEndian.Uint32(p.payload[off:])
+}
+
+func (p *mavpkt) i32(off int) int32 {
+	return int32(p.u32(off))
+}
+
+func (p *mavpkt) f32(off int) float64 {
+	return float64(math.Float32frombits(p.u32(off)))
+}
+
+func (p *mavpkt) value(f mavfield) float64 {
+	switch f.typ {
+	case 'B':
+		return float64(p.payload[f.off])
+	case 'b':
+		return float64(int8(p.payload[f.off]))
+	case 'h':
+		return float64(p.i16(f.off))
+	case 'H':
+		return float64(p.u16(f.off))
+	case 'i':
+		return float64(p.i32(f.off))
+	case 'I':
+		return float64(p.u32(f.off))
+	case 'Q':
+		return float64(binary.LittleEndian.Uint64(p.payload[f.off:]))
+	case 'f':
+		return p.f32(f.off)
+	}
+	return 0
+}
+
+func (p *mavpkt) utc() time.Time {
+	return time.UnixMicro(int64(p.stamp))
+}
+
+func is_vehicle(p *mavpkt) bool {
+	return p.payload[4] != mav_TYPE_GCS && p.payload[5] != mav_AUTOPILOT_INV
+}
+
+func autopilot_name(ap uint8) string {
+	switch ap {
+	case mav_AUTOPILOT_APM:
+		return "ArduPilot"
+	case mav_AUTOPILOT_PX4:
+		return "PX4"
+	default:
+		return "MAVLink"
+	}
+}
+
+func metas(logfile string) ([]types.FlightMeta, error) {
+	var metas []types.FlightMeta
+	data, err := types.ReadLog(logfile)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(data))
+
+	base := types.LogBase(logfile)
+	r := mavreader{data: data}
+	sysid := -1
+	armed := false
+	npos := 0
+	nl := 0
+	var fw string
+	var mt types.FlightMeta
+	var lt uint64
+	var ft time.Time
+
+	add_meta := func(end int, et uint64) {
+		mt.End = end
+		mt.Duration = time.Duration(et-uint64(mt.Date.UnixMicro())) * time.Microsecond
+		mt.Firmware = fw
+		if npos > 0 {
+			mt.Flags |= types.Is_Valid
+		}
+		metas = append(metas, mt)
+	}
+
+	for {
+		p, ok := r.next()
+		if !ok {
+			break
+		}
+		nl += 1
+		lt = p.stamp
+		if sysid != -1 && int(p.sysid) != sysid {
+			continue
+		}
+		switch p.msgid {
+		case msg_HEARTBEAT:
+			if !is_vehicle(p) {
+				continue
+			}
+			if sysid == -1 {
+				sysid = int(p.sysid)
+				fw = autopilot_name(p.payload[5])
+			}
+			isarmed := (p.payload[6] & mav_MODE_ARMED) != 0
+			if isarmed && !armed {
+				mt = types.FlightMeta{Logname: base, Index: len(metas) + 1, Start: nl,
+					Date: p.utc(), Size: size, Flags: types.Has_Start | types.Has_Size}
+				npos = 0
+			} else if !isarmed && armed {
+				add_meta(nl, p.stamp)
+			}
+			armed = isarmed
+		case msg_GPS_RAW_INT, msg_GLOBAL_POSITION_INT:
+			npos += 1
+			if ft.IsZero() {
+				ft = p.utc()
+			}
+		}
+	}
+
+	if armed {
+		add_meta(nl, lt)
+	} else if len(metas) == 0 && npos > 0 {
+		// Never armed, treat the whole log as one flight
+		mt = types.FlightMeta{Logname: base, Index: 1, Start: 1, Date: ft, Size: size,
+			Flags: types.Has_Start | types.Has_Size}
+		add_meta(nl, lt)
+	}
+
+	if len(metas) == 0 {
+		err = errors.New("No usable records in tlog")
+	}
+	return metas, err
+}
+
+// Series reads the vehicle's messages (of the types decoded) at the logged
+// rate, as a table per message type, named as the MAVLink message (e.g.
+// "ATTITUDE") with its fields, as transmitted (unscaled). Time stamps are
+// relative to the first message.
+func (lg *TLOG) Series(m types.FlightMeta, sel []string) (*types.Series, error) {
+	data, err := types.ReadLog(lg.name)
+	if err != nil {
+		return nil, err
+	}
+	s := types.NewSeries(sel)
+	tbls := make(map[uint32]*types.Table)
+	var st uint64
+	var vals []float64
+	sysid := -1
+	r := mavreader{data: data}
+	for nl := 1; nl <= m.End; nl++ {
+		p, ok := r.next()
+		if !ok {
+			break
+		}
+		if st == 0 {
+			st = p.stamp
+		}
+		if p.msgid == msg_HEARTBEAT && sysid == -1 && is_vehicle(p) {
+			sysid = int(p.sysid)
+		}
+		if int(p.sysid) != sysid || p.stamp < st {
+			continue
+		}
+		flds, ok := mavfields[p.msgid]
+		if !ok {
+			continue
+		}
+		t, ok := tbls[p.msgid]
+		if !ok {
+			var names []string
+			for _, f := range flds {
+				names = append(names, f.name)
+			}
+			t = s.AddTable(mavdefs[p.msgid].name, names)
+			tbls[p.msgid] = t
+		}
+		if t != nil {
+			vals = vals[:0]
+			for _, f := range flds {
+				vals = append(vals, p.value(f))
+			}
+			t.Append(p.stamp-st, vals)
+		}
+	}
+	return s, nil
+}
+
+func (lg *TLOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegment, bool) {
+	data, err := types.ReadLog(lg.name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "log file %s\n", err)
+		os.Exit(1)
+	}
+
+	var homes types.HomeRec
+	var rec types.LogRec
+	rec.Cap = (types.CAP_ALTITUDE | types.CAP_SPEED)
+
+	ndelay := 1000 * uint64(options.Config.Intvl)
+	stats := types.LogStats{}
+
+	fb := geo.Getfrobnication()
+	var froboff time.Duration
+
+	b := types.LogItem{}
+	have_origin := false
+	have_gpi := false
+	have_att := false
+	var llat, llon float64
+	var dt, st, lt, et uint64
+	var sysid = -1
+	var mavtype int
+	// Fields logged, as their messages are seen; see types.FieldMask
+	fields := types.F_STAMP | types.F_UTC
+
+	var evs types.EventDetector
+	leffic := 0.0
+	lwhkm := 0.0
+	whacc := 0.0
+
+	r := mavreader{data: data}
+	for nl := 1; nl <= m.End; nl++ {
+		p, ok := r.next()
+		if !ok {
+			break
+		}
+		if sysid != -1 && int(p.sysid) != sysid {
+			continue
+		}
+		emit := false
+		switch p.msgid {
+		case msg_HEARTBEAT:
+			if !is_vehicle(p) {
+				continue
+			}
+			sysid = int(p.sysid)
+			mavtype = int(p.payload[4])
+			_, b.Fmode = mwpjson.MavFmode(int(p.u32(0)), mavtype, float64(p.stamp)/1e6)
+			b.Fmtext = types.Mnames[b.Fmode]
+			fields |= types.F_FMODE | types.F_STATUS
+			if p.payload[6]&mav_MODE_ARMED != 0 {
+				b.Status |= types.Is_ARMED
+			} else {
+				b.Status &= ^types.Is_ARMED
+			}
+
+		case msg_SYS_STATUS:
+			if v := p.u16(14); v != 0xffff {
+				b.Volts = float64(v) / 1000.0
+				rec.Cap |= types.CAP_VOLTS
+				fields |= types.F_VOLTS
+			}
+			if v := p.i16(16); v != -1 {
+				amps := float64(v) / 100.0
+				if et != 0 && p.stamp > et {
+					b.Energy += amps * float64(p.stamp-et) / 3600000.0
+				}
+				et = p.stamp
+				b.Amps = amps
+				rec.Cap |= (types.CAP_AMPS | types.CAP_ENERGY)
+				fields |= types.F_AMPS | types.F_ENERGY
+			}
+			present := p.u32(0) & p.u32(4)
+			b.HWfail = (present & ^p.u32(8) & mav_SENSOR_CRIT) != 0
+			fields |= types.F_HWFAIL
+
+		case msg_GPS_RAW_INT:
+			switch fix := p.payload[28]; fix {
+			case 0, 1:
+				b.Fix = 0
+			case 2:
+				b.Fix = 1
+			default:
+				b.Fix = 2
+			}
+			b.Numsat = p.payload[29]
+			fields |= types.F_FIX | types.F_NUMSAT | types.F_GALT | types.F_POS
+			if v := p.u16(20); v != 0xffff {
+				b.Hdop = v
+				fields |= types.F_HDOP
+			}
+			b.GAlt = float64(p.i32(16)) / 1000.0
+			if v := p.u16(24); v != 0xffff {
+				b.Spd = float64(v) / 100.0
+				fields |= types.F_SPD
+			}
+			if v := p.u16(26); v != 0xffff {
+				b.Cog = uint32(v) / 100
+				fields |= types.F_COG
+			}
+			if !have_gpi {
+				b.Lat = float64(p.i32(8)) / 1e7
+				b.Lon = float64(p.i32(12)) / 1e7
+				emit = true
+			}
+
+		case msg_GLOBAL_POSITION_INT:
+			have_gpi = true
+			b.Lat = float64(p.i32(4)) / 1e7
+			b.Lon = float64(p.i32(8)) / 1e7
+			b.Alt = float64(p.i32(16)) / 1000.0
+			fields |= types.F_POS | types.F_ALT
+			if v := p.u16(26); v != 0xffff && !have_att {
+				b.Cse = uint32(v) / 100
+				fields |= types.F_CSE
+			}
+			emit = true
+
+		case msg_ATTITUDE:
+			have_att = true
+			b.Roll = int16(p.f32(4) * 180 / math.Pi)
+			b.Pitch = int16(-p.f32(8) * 180 / math.Pi)
+			cse := int(p.f32(12) * 180 / math.Pi)
+			if cse < 0 {
+				cse += 360
+			}
+			b.Cse = uint32(cse)
+			fields |= types.F_ATTITUDE | types.F_CSE
+
+		case msg_VFR_HUD:
+			if !have_gpi {
+				b.Alt = p.f32(8)
+			}
+			b.Throttle = int(p.u16(18))
+			fields |= types.F_ALT | types.F_THROTTLE
+
+		case msg_RC_CHANNELS:
+			b.Ail = int16(p.u16(4))
+			b.Ele = int16(p.u16(6))
+			b.Thr = int16(p.u16(8))
+			b.Rud = int16(p.u16(10))
+			fields |= types.F_STICKS
+			if rssi := p.payload[41]; rssi != 255 {
+				b.Rssi = uint8(int(rssi) * 100 / 254)
+				fields |= types.F_RSSI
+			}
+		}
+
+		if !emit || nl < m.Start || b.Fix == 0 {
+			continue
+		}
+
+		b.Stamp = p.stamp
+		b.Utc = p.utc()
+		us := b.Stamp
+
+		if !have_origin {
+			if b.Fix > 1 && b.Numsat > 5 {
+				have_origin = true
+				if fb != nil {
+					fb.Set_origin(b.Lat, b.Lon, b.GAlt)
+					ttmp := time.Now().Add(time.Hour * 24 * 42)
+					froboff = ttmp.Sub(b.Utc)
+				}
+				st = us
+				dt = us
+				homes.HomeLat, homes.HomeLon, homes.HomeAlt = b.Lat, b.Lon, b.GAlt
+				if fb != nil {
+					homes.HomeLat, homes.HomeLon, homes.HomeAlt = fb.Relocate(b.Lat, b.Lon, b.GAlt)
+				}
+				homes.Flags = types.HOME_ARM | types.HOME_ALT
+				llat = homes.HomeLat
+				llon = homes.HomeLon
+				if ch != nil {
+					ch <- homes
+				}
+			}
+			continue
+		}
+
+		if us <= st {
+			continue
+		}
+
+		bx := b
+		if fb != nil {
+			bx.Utc = bx.Utc.Add(froboff)
+			bx.Lat, bx.Lon, bx.GAlt = fb.Relocate(bx.Lat, bx.Lon, bx.GAlt)
+		}
+		bx.Hlat = homes.HomeLat
+		bx.Hlon = homes.HomeLon
+
+		// Events are detected on every fix, the items decimated
+		bx.SetValid(fields, homes)
+		evs.Check(&bx)
+		if (us - dt) < ndelay {
+			continue
+		}
+
+		c, d := geo.Csedist(homes.HomeLat, homes.HomeLon, bx.Lat, bx.Lon)
+		bx.Bearing = int32(c)
+		bx.Vrange = d * 1852.0
+
+		if d > stats.Max_range {
+			stats.Max_range = d
+			stats.Max_range_time = us - st
+		}
+
+		if llat != bx.Lat || llon != bx.Lon {
+			_, d = geo.Csedist(llat, llon, bx.Lat, bx.Lon)
+			stats.Distance += d
+		}
+		bx.Tdist = (stats.Distance * 1852.0)
+		llat = bx.Lat
+		llon = bx.Lon
+
+		if bx.Rssi > 0 {
+			rec.Cap |= types.CAP_RSSI_VALID
+		}
+
+		if (rec.Cap & types.CAP_AMPS) == types.CAP_AMPS {
+			if d > 0 {
+				deltat := float64((us - dt)) / 1000000.0 // seconds
+				aspd := d * 1852 / deltat                // m/s
+				bx.Effic = bx.Amps * 1000 / (3.6 * aspd) // efficiency mAh/km
+				leffic = bx.Effic
+				bx.Whkm = bx.Amps * bx.Volts / (3.6 * aspd)
+				whacc += bx.Amps * bx.Volts * deltat / 3600
+				bx.WhAcc = whacc
+				lwhkm = bx.Whkm
+			} else {
+				bx.Effic = leffic
+				bx.Whkm = lwhkm
+			}
+		}
+
+		if bx.Alt > stats.Max_alt {
+			stats.Max_alt = bx.Alt
+			stats.Max_alt_time = us - st
+		}
+
+		if bx.Spd < 400 && bx.Spd > stats.Max_speed {
+			stats.Max_speed = bx.Spd
+			stats.Max_speed_time = us - st
+		}
+
+		if bx.Amps > stats.Max_current {
+			stats.Max_current = bx.Amps
+			stats.Max_current_time = us - st
+		}
+
+		if ch != nil {
+			ch <- bx
+		} else {
+			rec.Items = append(rec.Items, bx)
+			rec.Valid |= bx.Valid
+		}
+		dt = us
+		lt = us
+	}
+
+	srec := stats.Summary(lt - st)
+	ls := types.LogSegment{}
+	if r.nbad > 0 {
+		ls.S = fmt.Sprintf("%d bad MAVLink packets", r.nbad)
+	}
+	if ch != nil {
+		ch <- srec
+		return ls, true
+	} else {
+		ok := homes.Flags != 0 && len(rec.Items) > 0
+		if ok {
+			ls.L = rec
+			ls.H = homes
+			ls.M = srec
+			ls.E = evs.Events
+		}
+		return ls, ok
+	}
+}
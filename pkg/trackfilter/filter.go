@@ -0,0 +1,393 @@
+package trackfilter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"geo"
+	"types"
+)
+
+// Post-read cleaning of a flight's track, applied to the LogSegment returned
+// by any reader before it is passed to a generator:
+//   - clock jumps (time going backwards, or leaping forward) are removed
+//   - fixes with a poor HDOP or too few satellites are rejected
+//   - fixes implying an impossible speed from the previous good fix are rejected
+// The home relative values, distance, energy and statistics are then
+// recalculated.
+
+type Spec struct {
+	MaxSpeed float64 // m/s, 0 => no implied speed check
+	MaxHdop  float64 // 0 => no HDOP check
+	MinSats  int     // 0 => no satellite count check
+	Clock    float64 // step (s) treated as a clock jump, 0 => no repair
+}
+
+type Result struct {
+	Speed int // fixes rejected for implied speed
+	Hdop  int // fixes rejected for HDOP
+	Sats  int // fixes rejected for satellite count
+	Clock int // clock jumps repaired
+}
+
+// Used by "default"
+var DefaultSpec = Spec{MaxSpeed: 150, MaxHdop: 5, MinSats: 5, Clock: 10}
+
+const (
+	default_clock = 10.0
+	max_rejects   = 5 // consecutive rejections before restarting the speed check
+)
+
+// ParseSpec parses a filter specification, a comma separated list of
+// "speed=m/s", "hdop=value", "sats=count", "clock[=seconds]", or "default";
+// an empty string or "none" disables filtering.
+func ParseSpec(s string) (Spec, error) {
+	var sp Spec
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		k, v, hasv := strings.Cut(p, "=")
+		var f float64
+		if hasv {
+			var err error
+			if f, err = strconv.ParseFloat(v, 64); err != nil || f < 0 {
+				return sp, fmt.Errorf("filter: bad value \"%s\"", p)
+			}
+		}
+		switch {
+		case k == "" || k == "none":
+		case k == "default" && !hasv:
+			sp = DefaultSpec
+		case k == "speed" && hasv:
+			sp.MaxSpeed = f
+		case k == "hdop" && hasv:
+			sp.MaxHdop = f
+		case k == "sats" && hasv:
+			sp.MinSats = int(f)
+		case k == "clock":
+			if hasv {
+				sp.Clock = f
+			} else {
+				sp.Clock = default_clock
+			}
+		default:
+			return sp, fmt.Errorf("filter: unknown term \"%s\"", p)
+		}
+	}
+	return sp, nil
+}
+
+func (sp Spec) Enabled() bool {
+	return sp.MaxSpeed > 0 || sp.MaxHdop > 0 || sp.MinSats > 0 || sp.Clock > 0
+}
+
+func (r Result) Rejected() int {
+	return r.Speed + r.Hdop + r.Sats
+}
+
+func (r Result) String() string {
+	var parts []string
+	for _, p := range []struct {
+		n    int
+		name string
+	}{{r.Speed, "speed"}, {r.Hdop, "hdop"}, {r.Sats, "sats"}} {
+		if p.n > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", p.name, p.n))
+		}
+	}
+	s := fmt.Sprintf("%d fixes rejected", r.Rejected())
+	if len(parts) > 0 {
+		s += " (" + strings.Join(parts, ", ") + ")"
+	}
+	switch {
+	case r.Clock == 1:
+		s += ", 1 clock jump repaired"
+	case r.Clock > 1:
+		s += fmt.Sprintf(", %d clock jumps repaired", r.Clock)
+	}
+	return s
+}
+
+func has_position(b *types.LogItem) bool {
+	return b.Lat != 0 || b.Lon != 0
+}
+
+// Apply filters a segment, returning the cleaned segment; the result is
+// also reported in the segment's summary as "Filter".
+func Apply(ls types.LogSegment, sp Spec) (types.LogSegment, Result) {
+	var res Result
+	if !sp.Enabled() || len(ls.L.Items) == 0 {
+		return ls, res
+	}
+	items := make([]types.LogItem, len(ls.L.Items))
+	copy(items, ls.L.Items)
+
+	if sp.Clock > 0 {
+		orig := make([]types.LogItem, len(items))
+		copy(orig, items)
+		if res.Clock = repair_clock(items, sp.Clock); res.Clock > 0 {
+			ls.E = shift_events(ls.E, orig, items)
+		}
+	}
+
+	hassats := false
+	for j := range items {
+		if items[j].Numsat > 0 {
+			hassats = true
+			break
+		}
+	}
+
+	// A rejected fix keeps its other data, its position being replaced by
+	// the last good fix's (and marked as not logged)
+	rejected := make([]bool, len(items))
+	var last *types.LogItem
+	nrej := 0
+	for j := range items {
+		b := &items[j]
+		if !has_position(b) {
+			continue
+		}
+		reject := false
+		switch {
+		case sp.MaxHdop > 0 && b.Hdop > 0 && float64(b.Hdop)/100.0 > sp.MaxHdop:
+			res.Hdop++
+			reject = true
+		case sp.MinSats > 0 && hassats && int(b.Numsat) < sp.MinSats:
+			res.Sats++
+			reject = true
+		case sp.MaxSpeed > 0 && last != nil && nrej < max_rejects:
+			_, d := geo.Csedist(last.Lat, last.Lon, b.Lat, b.Lon)
+			dt := float64(b.Stamp-last.Stamp) / 1e6
+			if b.Stamp <= last.Stamp {
+				dt = 0
+			}
+			// allow a fix's worth of movement for coarse time stamps
+			if d*1852.0 > sp.MaxSpeed*(dt+0.1) {
+				res.Speed++
+				nrej++
+				reject = true
+			}
+		}
+		if reject {
+			rejected[j] = true
+			continue
+		}
+		// after max_rejects consecutive rejections, the previous good
+		// fix is more likely to have been the glitch; restart from here
+		nrej = 0
+		last = b
+	}
+	var llat, llon float64
+	for j := range items {
+		b := &items[j]
+		if rejected[j] {
+			b.Lat, b.Lon = llat, llon
+			b.Valid &^= types.F_POS
+		} else if has_position(b) {
+			llat, llon = b.Lat, b.Lon
+		}
+	}
+
+	if res.Rejected() == 0 && res.Clock == 0 {
+		ls.M = with_filter(ls.M, res)
+		return ls, res
+	}
+	if res.Rejected() > 0 {
+		ls.E = reject_events(ls.E, items, rejected)
+	}
+	ls.L = types.LogRec{Cap: ls.L.Cap, Items: items}
+	ls.L.SetValid()
+	Relocate(&ls.L, ls.H)
+	if ls.L.Cap&types.CAP_AMPS != 0 {
+		Energy(&ls.L)
+	}
+	st := ls.L.Stats()
+	m := st.Summary(st.Duration)
+	for k, v := range ls.M {
+		if _, ok := m[k]; !ok {
+			m[k] = v
+		}
+	}
+	ls.M = with_filter(m, res)
+	return ls, res
+}
+
+// Moves events at rejected fixes (the nearest item by time) to the
+// replacement position
+func reject_events(evs []types.LogEvent, items []types.LogItem, rejected []bool) []types.LogEvent {
+	out := make([]types.LogEvent, len(evs))
+	for k, e := range evs {
+		j := sort.Search(len(items), func(i int) bool { return items[i].Stamp >= e.Stamp })
+		if j == len(items) || (j > 0 && e.Stamp-items[j-1].Stamp < items[j].Stamp-e.Stamp) {
+			j--
+		}
+		if rejected[j] {
+			e.Lat, e.Lon = items[j].Lat, items[j].Lon
+		}
+		out[k] = e
+	}
+	return out
+}
+
+func with_filter(m types.MapRec, res Result) types.MapRec {
+	if m == nil {
+		m = make(types.MapRec)
+	}
+	m["Filter"] = res.String()
+	return m
+}
+
+// Removes clock jumps from the microsecond timestamps and (separately, as
+// some logs take these from GPS) the UTC times, replacing each jump by the
+// typical log interval. Returns the number of items at which a jump was
+// repaired.
+func repair_clock(items []types.LogItem, limit float64) int {
+	n := len(items)
+	if n < 3 {
+		return 0
+	}
+	stamps := make([]float64, n)
+	utcs := make([]float64, n)
+	hasutc := true
+	for j := range items {
+		stamps[j] = float64(items[j].Stamp)
+		if items[j].Utc.IsZero() {
+			hasutc = false
+		} else {
+			utcs[j] = float64(items[j].Utc.UnixNano()) / 1e3
+		}
+	}
+	jumped := make([]bool, n)
+	if remove_jumps(stamps, limit*1e6, jumped) {
+		for j := range items {
+			items[j].Stamp = uint64(stamps[j])
+		}
+	}
+	if hasutc && remove_jumps(utcs, limit*1e6, jumped) {
+		for j := range items {
+			items[j].Utc = time.UnixMicro(int64(utcs[j])).UTC()
+		}
+	}
+	njump := 0
+	for _, jmp := range jumped {
+		if jmp {
+			njump++
+		}
+	}
+	return njump
+}
+
+// Applies the clock repair to the events, each being shifted as the item
+// nearest to it (by the original time stamps)
+func shift_events(evs []types.LogEvent, orig, items []types.LogItem) []types.LogEvent {
+	out := make([]types.LogEvent, len(evs))
+	for k, e := range evs {
+		jb := 0
+		for j := range orig {
+			if math.Abs(float64(orig[j].Stamp)-float64(e.Stamp)) < math.Abs(float64(orig[jb].Stamp)-float64(e.Stamp)) {
+				jb = j
+			}
+		}
+		e.Stamp = uint64(int64(e.Stamp) + int64(items[jb].Stamp) - int64(orig[jb].Stamp))
+		if !e.Utc.IsZero() && !orig[jb].Utc.IsZero() {
+			e.Utc = e.Utc.Add(items[jb].Utc.Sub(orig[jb].Utc))
+		}
+		out[k] = e
+	}
+	return out
+}
+
+// Removes steps that are negative or exceed lim from ts, in place
+func remove_jumps(ts []float64, lim float64, jumped []bool) bool {
+	var steps []float64
+	for j := 1; j < len(ts); j++ {
+		if ts[j] > ts[j-1] {
+			steps = append(steps, ts[j]-ts[j-1])
+		}
+	}
+	if len(steps) == 0 {
+		return false
+	}
+	sort.Float64s(steps)
+	median := steps[len(steps)/2]
+	changed := false
+	shift := 0.0
+	prev := ts[0]
+	for j := 1; j < len(ts); j++ {
+		cur := ts[j]
+		if step := cur - prev; step < 0 || step > lim {
+			shift = ts[j-1] + median - cur
+			jumped[j] = true
+			changed = true
+		}
+		prev = cur
+		ts[j] = cur + shift
+	}
+	return changed
+}
+
+// Relocate recalculates the home relative values (bearing, range) and the
+// cumulative distance, for records whose positions have been modified after
+// reading.
+func Relocate(r *types.LogRec, h types.HomeRec) {
+	tdist := 0.0
+	llat := 0.0
+	llon := 0.0
+	for j := range r.Items {
+		b := &r.Items[j]
+		b.Hlat = h.HomeLat
+		b.Hlon = h.HomeLon
+		if b.Lat != 0 || b.Lon != 0 {
+			if h.Flags != 0 {
+				c, d := geo.Csedist(h.HomeLat, h.HomeLon, b.Lat, b.Lon)
+				b.Bearing = int32(c)
+				b.Vrange = d * 1852.0
+			}
+			if llat != 0 || llon != 0 {
+				_, d := geo.Csedist(llat, llon, b.Lat, b.Lon)
+				tdist += d * 1852.0
+			}
+			llat = b.Lat
+			llon = b.Lon
+		}
+		b.Tdist = tdist
+	}
+}
+
+// Energy recalculates the accumulated energy and efficiency values, after
+// Relocate, or where current / voltage have been added after reading.
+func Energy(r *types.LogRec) {
+	whacc := 0.0
+	accEnergy := 0.0
+	items := r.Items
+	for j := 1; j < len(items); j++ {
+		b := &items[j]
+		deltat := float64(b.Stamp-items[j-1].Stamp) / 1e6
+		if b.Stamp <= items[j-1].Stamp {
+			b.WhAcc = items[j-1].WhAcc
+			b.Effic = items[j-1].Effic
+			b.Whkm = items[j-1].Whkm
+			continue
+		}
+		whacc += b.Amps * b.Volts * deltat / 3600
+		b.WhAcc = whacc
+		if r.Cap&types.CAP_ENERGYC == types.CAP_ENERGYC {
+			accEnergy += (b.Amps * deltat / 3.6)
+			b.Energy = accEnergy
+		}
+		if d := b.Tdist - items[j-1].Tdist; d > 0 {
+			aspd := d / deltat
+			b.Effic = b.Amps * 1000 / (3.6 * aspd)
+			b.Whkm = b.Amps * b.Volts / (3.6 * aspd)
+		} else {
+			b.Effic = items[j-1].Effic
+			b.Whkm = items[j-1].Whkm
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module trackfilter
+
+go 1.19
@@ -0,0 +1,3 @@
+module trkgen
+
+go 1.19
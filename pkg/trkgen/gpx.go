@@ -0,0 +1,171 @@
+package trkgen
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+import (
+	"types"
+)
+
+// Track exports for tools that accept neither KML nor GeoJSON: GPX 1.1 (map
+// and trail applications) and IGC (soaring / competition scoring).
+
+type gpxext struct {
+	Speed  *float64 `xml:"gpxtpx:TrackPointExtension>gpxtpx:speed,omitempty"`
+	Course *float64 `xml:"gpxtpx:TrackPointExtension>gpxtpx:course,omitempty"`
+}
+
+type gpxpt struct {
+	Lat  float64  `xml:"lat,attr"`
+	Lon  float64  `xml:"lon,attr"`
+	Ele  float64  `xml:"ele"`
+	Time string   `xml:"time,omitempty"`
+	Name string   `xml:"name,omitempty"`
+	Desc string   `xml:"desc,omitempty"`
+	Sym  string   `xml:"sym,omitempty"`
+	Fix  string   `xml:"fix,omitempty"`
+	Sat  *uint8   `xml:"sat,omitempty"`
+	Hdop *float64 `xml:"hdop,omitempty"`
+	Ext  *gpxext  `xml:"extensions,omitempty"`
+}
+
+type gpxfile struct {
+	XMLName xml.Name `xml:"gpx"`
+	Version string   `xml:"version,attr"`
+	Creator string   `xml:"creator,attr"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Xsi     string   `xml:"xmlns:xsi,attr"`
+	Tpx     string   `xml:"xmlns:gpxtpx,attr"`
+	Schema  string   `xml:"xsi:schemaLocation,attr"`
+	Name    string   `xml:"metadata>name"`
+	Desc    string   `xml:"metadata>desc,omitempty"`
+	Time    string   `xml:"metadata>time,omitempty"`
+	Wpts    []gpxpt  `xml:"wpt"`
+	TrkName string   `xml:"trk>name"`
+	TrkPts  []gpxpt  `xml:"trk>trkseg>trkpt"`
+}
+
+// Returns the item's altitude AMSL; GPS if logged, else the (baro) relative
+// altitude plus the home's
+func item_amsl(b types.LogItem, h types.HomeRec) float64 {
+	if b.Valid.Has(types.F_GALT) {
+		return b.GAlt
+	}
+	if (h.Flags & types.HOME_ALT) == types.HOME_ALT {
+		return h.HomeAlt + b.Alt
+	}
+	return b.Alt
+}
+
+func has_position(b types.LogItem) bool {
+	return !(b.Lat == 0 && b.Lon == 0)
+}
+
+// WriteGPX writes the flight as a GPX 1.1 track, with speed (m/s) and course
+// as Garmin TrackPointExtension v2 extensions; the home and the flight's
+// events are waypoints.
+func WriteGPX(w io.Writer, ls types.LogSegment, meta types.FlightMeta, gv func() string) error {
+	g := gpxfile{Version: "1.1", Creator: gv(), Xmlns: "http://www.topografix.com/GPX/1/1",
+		Xsi: "http://www.w3.org/2001/XMLSchema-instance",
+		Tpx: "http://www.garmin.com/xmlschemas/TrackPointExtension/v2",
+		Schema: "http://www.topografix.com/GPX/1/1 http://www.topografix.com/GPX/1/1/gpx.xsd " +
+			"http://www.garmin.com/xmlschemas/TrackPointExtension/v2 https://www8.garmin.com/xmlschemas/TrackPointExtensionv2.xsd",
+		Name: meta.LogName(), TrkName: meta.LogName()}
+	if meta.Flags&types.Has_Craft != 0 {
+		g.Desc = meta.Craft
+	}
+	if len(ls.L.Items) == 0 {
+		return fmt.Errorf("gpx: no track points")
+	}
+	st := ls.L.Items[0].Stamp
+	g.Time = meta.ItemTime(ls.L.Items[0], st).Format(time.RFC3339)
+
+	if ls.H.Flags != 0 {
+		wp := gpxpt{Lat: ls.H.HomeLat, Lon: ls.H.HomeLon, Ele: ls.H.HomeAlt, Name: "Home", Sym: "Airport"}
+		g.Wpts = append(g.Wpts, wp)
+	}
+	for _, e := range ls.E {
+		if e.Lat == 0 && e.Lon == 0 {
+			continue
+		}
+		b := types.LogItem{Stamp: e.Stamp, Utc: e.Utc, Alt: e.Alt}
+		wp := gpxpt{Lat: e.Lat, Lon: e.Lon, Ele: item_amsl(b, ls.H), Name: e.Kind.String(), Desc: e.Detail,
+			Time: meta.ItemTime(b, st).Format(time.RFC3339Nano), Sym: "Flag"}
+		g.Wpts = append(g.Wpts, wp)
+	}
+
+	for _, b := range ls.L.Items {
+		if !has_position(b) {
+			continue
+		}
+		pt := gpxpt{Lat: b.Lat, Lon: b.Lon, Ele: item_amsl(b, ls.H),
+			Time: meta.ItemTime(b, st).Format(time.RFC3339Nano)}
+		if b.Logged(types.F_FIX) {
+			switch {
+			case b.Fix >= 2:
+				pt.Fix = "3d"
+			case b.Fix == 1:
+				pt.Fix = "2d"
+			default:
+				pt.Fix = "none"
+			}
+		}
+		if b.Logged(types.F_NUMSAT) {
+			n := b.Numsat
+			pt.Sat = &n
+		}
+		if b.Logged(types.F_HDOP) && b.Hdop != 0 {
+			h := float64(b.Hdop) / 100.0
+			pt.Hdop = &h
+		}
+		var ext gpxext
+		if b.Logged(types.F_SPD) {
+			s := b.Spd
+			ext.Speed = &s
+		}
+		if b.Logged(types.F_COG) {
+			c := float64(b.Cog)
+			ext.Course = &c
+		}
+		if ext.Speed != nil || ext.Course != nil {
+			pt.Ext = &ext
+		}
+		g.TrkPts = append(g.TrkPts, pt)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", " ")
+	if err := e.Encode(g); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func GenerateGPX(ls types.LogSegment, outfn string, meta types.FlightMeta, gv func() string) {
+	write_file(outfn, func(w io.Writer) error {
+		return WriteGPX(w, ls, meta, gv)
+	})
+}
+
+func write_file(outfn string, wfunc func(io.Writer) error) {
+	w, err := os.Create(outfn)
+	if err == nil {
+		err = wfunc(w)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Fatalf("trkgen: %+v\n", err)
+	}
+}
@@ -0,0 +1,125 @@
+package trkgen
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+import (
+	"options"
+	"types"
+)
+
+// IGC output. The logs hold no static pressure, so the pressure altitude of
+// the B records is the (baro derived) altitude relative to home plus the
+// home's, rather than ISA pressure altitude. As the file is not produced by
+// an approved logger, it is not signed; options.Config.IgcGrecord adds a
+// placeholder G record for tools that insist on one.
+
+// Formats a latitude (ns = "NS") or longitude (ns = "EW") as DDMMmmm[N|S] /
+// DDDMMmmm[E|W]
+func igc_coord(v float64, digits int, ns string) string {
+	h := ns[0]
+	if v < 0 {
+		h = ns[1]
+		v = -v
+	}
+	deg := math.Floor(v)
+	mins := int(math.Round((v - deg) * 60000))
+	if mins == 60000 {
+		deg += 1
+		mins = 0
+	}
+	return fmt.Sprintf("%0*d%05d%c", digits, int(deg), mins, h)
+}
+
+// Formats an altitude as the 5 character IGC field
+func igc_alt(a float64) string {
+	n := int(math.Round(a))
+	if n < 0 {
+		if n < -9999 {
+			n = -9999
+		}
+		return fmt.Sprintf("-%04d", -n)
+	}
+	if n > 99999 {
+		n = 99999
+	}
+	return fmt.Sprintf("%05d", n)
+}
+
+// IGC header text may not contain CR / LF
+func igc_text(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// WriteIGC writes the flight as an IGC file; a header and a B record per
+// second
+func WriteIGC(w io.Writer, ls types.LogSegment, meta types.FlightMeta, gv func() string) error {
+	if len(ls.L.Items) == 0 {
+		return fmt.Errorf("igc: no track points")
+	}
+	st := ls.L.Items[0].Stamp
+	t0 := meta.ItemTime(ls.L.Items[0], st)
+
+	bw := bufio.NewWriter(w)
+	line := func(s string) {
+		bw.WriteString(s)
+		bw.WriteString("\r\n")
+	}
+
+	craft := ""
+	if meta.Flags&types.Has_Craft != 0 {
+		craft = igc_text(meta.Craft)
+	}
+	fw, _ := meta.ShowFirmware()
+	line("AXXX001 " + igc_text(gv()))
+	line(fmt.Sprintf("HFDTEDATE:%s,%02d", t0.Format("020106"), meta.Index%100))
+	line("HFPLTPILOTINCHARGE:")
+	line("HFGTYGLIDERTYPE:" + craft)
+	line("HFGIDGLIDERID:")
+	line("HFDTMGPSDATUM:WGS84")
+	line("HFRFWFIRMWAREVERSION:" + igc_text(fw))
+	line("HFRHWHARDWAREVERSION:")
+	line("HFFTYFRTYPE:" + igc_text(meta.LogName()))
+	line("HFGPSRECEIVER:")
+	line("HFPRSPRESSALTSENSOR:")
+	line("HFALGALTGPS:GEO")
+	line("HFALPALTPRESSURE:ISA")
+
+	last := int64(-1)
+	for _, b := range ls.L.Items {
+		if !has_position(b) {
+			continue
+		}
+		t := meta.ItemTime(b, st)
+		if s := t.Unix(); s <= last {
+			continue
+		} else {
+			last = s
+		}
+		valid := byte('A')
+		if b.Logged(types.F_FIX) && b.Fix < 2 {
+			valid = 'V'
+		}
+		palt := b.Alt
+		if (ls.H.Flags & types.HOME_ALT) == types.HOME_ALT {
+			palt += ls.H.HomeAlt
+		}
+		line(fmt.Sprintf("B%s%s%s%c%s%s", t.Format("150405"), igc_coord(b.Lat, 2, "NS"),
+			igc_coord(b.Lon, 3, "EW"), valid, igc_alt(palt), igc_alt(item_amsl(b, ls.H))))
+	}
+	if options.Config.IgcGrecord {
+		line("GNOTSIGNED")
+	}
+	return bw.Flush()
+}
+
+func GenerateIGC(ls types.LogSegment, outfn string, meta types.FlightMeta, gv func() string) {
+	write_file(outfn, func(w io.Writer) error {
+		return WriteIGC(w, ls, meta, gv)
+	})
+}
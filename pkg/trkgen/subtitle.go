@@ -0,0 +1,167 @@
+package trkgen
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+import (
+	"options"
+	"types"
+)
+
+// Telemetry subtitles (SRT and ASS) for overlaying on DVR / HD video. Each
+// track point is a subtitle, shown until the next. Subtitle times are from
+// the log start, or the first arming (options.Config.SubArm), which is at
+// options.Config.SubOffset seconds into the video.
+//
+// The text is given by options.Config.SubTemplate, in which {name} is
+// replaced by a value and \n is a line break:
+//   {time}  elapsed time (from the sync point)
+//   {alt}   altitude (relative)    {spd}   speed
+//   {dist}  distance from home     {hdg}   heading
+//   {volts} battery voltage        {amps}  current
+//   {mah}   energy used            {sats}  satellites
+//   {rssi}  RSSI                   {mode}  flight mode
+// Values that are not logged are shown as "-".
+
+const DefaultSubTemplate = `{mode}  {time}\n{alt}  {spd}  {dist}\n{volts}  {amps}  {mah}\n{sats} sats  RSSI {rssi}`
+
+const nolog = "-"
+
+type subline struct {
+	start, end float64 // seconds
+	text       []string
+}
+
+// Subtitle text for an item
+func sub_text(b types.LogItem, t float64, tmpl string) []string {
+	val := func(f types.FieldMask, s string) string {
+		if b.Logged(f) {
+			return s
+		}
+		return nolog
+	}
+	hdg := nolog
+	if b.Logged(types.F_CSE) && b.Cse != 0xffff {
+		hdg = fmt.Sprintf("%d°", b.Cse)
+	} else if b.Logged(types.F_COG) {
+		hdg = fmt.Sprintf("%d°", b.Cog)
+	}
+	sign := ""
+	if t < 0 {
+		sign = "-"
+		t = -t
+	}
+	r := strings.NewReplacer(
+		"{time}", fmt.Sprintf("%s%02d:%02d", sign, int(t)/60, int(t)%60),
+		"{alt}", val(types.F_ALT, fmt.Sprintf("%.0fm", b.Alt)),
+		"{spd}", val(types.F_SPD, fmt.Sprintf("%.1fm/s", b.Spd)),
+		"{dist}", val(types.F_RANGE, fmt.Sprintf("%.0fm", b.Vrange)),
+		"{hdg}", hdg,
+		"{volts}", val(types.F_VOLTS, fmt.Sprintf("%.1fV", b.Volts)),
+		"{amps}", val(types.F_AMPS, fmt.Sprintf("%.1fA", b.Amps)),
+		"{mah}", val(types.F_ENERGY, fmt.Sprintf("%.0fmAh", b.Energy)),
+		"{sats}", val(types.F_NUMSAT, fmt.Sprintf("%d", b.Numsat)),
+		"{rssi}", val(types.F_RSSI, fmt.Sprintf("%d%%", b.Rssi)),
+		"{mode}", val(types.F_FMODE, b.Fmtext),
+		`\n`, "\n",
+	)
+	return strings.Split(r.Replace(tmpl), "\n")
+}
+
+// The subtitles; times are relative to the video, those before its start
+// are dropped
+func sub_lines(ls types.LogSegment) []subline {
+	var subs []subline
+	items := ls.L.Items
+	if len(items) == 0 {
+		return subs
+	}
+	sync := items[0].Stamp
+	if options.Config.SubArm {
+		for _, e := range ls.E {
+			if e.Kind == types.EV_ARM {
+				sync = e.Stamp
+				break
+			}
+		}
+	}
+	tmpl := options.Config.SubTemplate
+	if tmpl == "" {
+		tmpl = DefaultSubTemplate
+	}
+	secs := func(s uint64) float64 {
+		return (float64(s) - float64(sync)) / 1e6
+	}
+	for j, b := range items {
+		t := secs(b.Stamp)
+		start := t + options.Config.SubOffset
+		end := start + 1
+		if j < len(items)-1 {
+			end = secs(items[j+1].Stamp) + options.Config.SubOffset
+		}
+		if end <= 0 || end <= start {
+			continue
+		}
+		if start < 0 {
+			start = 0
+		}
+		subs = append(subs, subline{start, end, sub_text(b, t, tmpl)})
+	}
+	return subs
+}
+
+func srt_time(t float64) string {
+	ms := int64(t*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", ms/3600000, (ms/60000)%60, (ms/1000)%60, ms%1000)
+}
+
+func ass_time(t float64) string {
+	cs := int64(t*100 + 0.5)
+	return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, (cs/6000)%60, (cs/100)%60, cs%100)
+}
+
+// WriteSRT writes the telemetry as SubRip subtitles
+func WriteSRT(w io.Writer, ls types.LogSegment, meta types.FlightMeta, gv func() string) error {
+	bw := bufio.NewWriter(w)
+	for j, s := range sub_lines(ls) {
+		fmt.Fprintf(bw, "%d\r\n%s --> %s\r\n", j+1, srt_time(s.start), srt_time(s.end))
+		for _, l := range s.text {
+			fmt.Fprintf(bw, "%s\r\n", l)
+		}
+		bw.WriteString("\r\n")
+	}
+	return bw.Flush()
+}
+
+// WriteASS writes the telemetry as Advanced SubStation Alpha subtitles, in
+// a monospaced font at the bottom left of a 1080p frame
+func WriteASS(w io.Writer, ls types.LogSegment, meta types.FlightMeta, gv func() string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "[Script Info]\r\nTitle: %s\r\n; %s\r\nScriptType: v4.00+\r\nPlayResX: 1920\r\nPlayResY: 1080\r\nWrapStyle: 2\r\nScaledBorderAndShadow: yes\r\n\r\n",
+		meta.LogName(), gv())
+	bw.WriteString("[V4+ Styles]\r\n" +
+		"Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding\r\n" +
+		"Style: Default,Monospace,40,&H00FFFFFF,&H000000FF,&H00000000,&H80000000,-1,0,0,0,100,100,0,0,1,2,1,1,40,40,40,1\r\n\r\n")
+	bw.WriteString("[Events]\r\nFormat: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\r\n")
+	for _, s := range sub_lines(ls) {
+		text := strings.NewReplacer("{", "(", "}", ")").Replace(strings.Join(s.text, `\N`))
+		fmt.Fprintf(bw, "Dialogue: 0,%s,%s,Default,,0,0,0,,%s\r\n", ass_time(s.start), ass_time(s.end), text)
+	}
+	return bw.Flush()
+}
+
+func GenerateSRT(ls types.LogSegment, outfn string, meta types.FlightMeta, gv func() string) {
+	write_file(outfn, func(w io.Writer) error {
+		return WriteSRT(w, ls, meta, gv)
+	})
+}
+
+func GenerateASS(ls types.LogSegment, outfn string, meta types.FlightMeta, gv func() string) {
+	write_file(outfn, func(w io.Writer) error {
+		return WriteASS(w, ls, meta, gv)
+	})
+}
@@ -7,12 +7,16 @@ import (
 )
 
 const (
-	LOGARP = 'A'
-	LOGBBL = 'B'
-	LOGOTX = 'O'
-	LOGBLT = 'G'
-	LOGMWP = 'M'
-	LOGSQL = 'S'
+	LOGARP   = 'A'
+	LOGBBL   = 'B'
+	LOGOTX   = 'O'
+	LOGBLT   = 'G'
+	LOGMWP   = 'M'
+	LOGSQL   = 'S'
+	LOGTLOG  = 'T'
+	LOGULOG  = 'U'
+	LOGCSV   = 'C'
+	LOGETHOS = 'E'
 )
 
 const (
@@ -142,10 +146,12 @@ type LogItem struct {
 	Navextra byte
 	HWfail   bool
 	Wind     [3]int16
+	Valid    FieldMask // fields holding logged values
 }
 
 type LogRec struct {
 	Cap   uint16
+	Valid FieldMask // union of the items' Valid
 	Items []LogItem
 }
 
@@ -210,6 +216,40 @@ func (b *LogStats) Summary(t uint64) MapRec {
 	return m
 }
 
+// Stats recalculates the statistics from the items of a LogRec, for records
+// that have been modified after reading. Range and distance are in nm, as
+// accumulated by the readers.
+func (r *LogRec) Stats() LogStats {
+	var s LogStats
+	n := len(r.Items)
+	if n == 0 {
+		return s
+	}
+	st := r.Items[0].Stamp
+	for _, b := range r.Items {
+		t := b.Stamp - st
+		if b.Alt > s.Max_alt {
+			s.Max_alt = b.Alt
+			s.Max_alt_time = t
+		}
+		if d := b.Vrange / 1852.0; d > s.Max_range {
+			s.Max_range = d
+			s.Max_range_time = t
+		}
+		if b.Spd < 400 && b.Spd > s.Max_speed {
+			s.Max_speed = b.Spd
+			s.Max_speed_time = t
+		}
+		if b.Amps > s.Max_current {
+			s.Max_current = b.Amps
+			s.Max_current_time = t
+		}
+	}
+	s.Distance = r.Items[n-1].Tdist / 1852.0
+	s.Duration = r.Items[n-1].Stamp - st
+	return s
+}
+
 type MapRec map[string]string
 
 type LogSegment struct {
@@ -217,10 +257,12 @@ type LogSegment struct {
 	H HomeRec
 	M MapRec
 	S string
+	E []LogEvent
 }
 
 type FlightLog interface {
 	Reader(FlightMeta, chan interface{}) (LogSegment, bool)
+	Series(FlightMeta, []string) (*Series, error)
 	GetMetas() ([]FlightMeta, error)
 	GetDurations()
 	Dump()
@@ -331,6 +373,15 @@ func (b *FlightMeta) Flight() string {
 	return sb.String()
 }
 
+// ItemTime returns the time of item r; for logs without UTC, the flight's
+// date plus the item's time from st (the first item's Stamp)
+func (b *FlightMeta) ItemTime(r LogItem, st uint64) time.Time {
+	if !r.Utc.IsZero() {
+		return r.Utc.UTC()
+	}
+	return b.Date.UTC().Add(time.Duration(r.Stamp-st) * time.Microsecond)
+}
+
 func (b *FlightMeta) Summary() MapRec {
 	var m MapRec
 	m = make(MapRec)
@@ -344,3 +395,18 @@ func (b *FlightMeta) Summary() MapRec {
 	}
 	return m
 }
+
+// CellCount returns the LiPo cell count for a pack voltage, the smallest for
+// which the voltage is plausible (0 if none)
+func CellCount(vbat float64) int {
+	ncell := 0
+	for i := 1; i < 10; i++ {
+		vmin := 3.0 * float64(i)
+		vmax := 4.22 * float64(i)
+		if vbat < vmax && vbat > vmin {
+			ncell = i
+			break
+		}
+	}
+	return ncell
+}
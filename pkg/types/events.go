@@ -0,0 +1,137 @@
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// Flight events (mode changes, arm / disarm, failsafe, ...). Readers derive
+// the state changes from every decoded frame (not only the items output after
+// decimation to the -interval) with an EventDetector, and
+// add any events logged as such (e.g. Blackbox 'E' frames); the events are
+// returned in LogSegment.E.
+
+type EventKind uint8
+
+const (
+	EV_ARM      EventKind = iota // armed
+	EV_DISARM                    // disarmed
+	EV_MODE                      // flight mode (initial, or changed)
+	EV_FAILSAFE                  // failsafe entered
+	EV_FSCLEAR                   // failsafe cleared
+	EV_HWFAIL                    // hardware failure
+	EV_HWOK                      // hardware failure cleared
+	EV_WAYPOINT                  // next waypoint (the previous reached)
+	EV_GPSLOST                   // GPS fix lost
+	EV_GPSFIX                    // GPS fix (re)gained
+	EV_LOG                       // event recorded by the FC / log
+	EV_LOGERR                    // log error (corrupt data)
+)
+
+var event_names = []string{"Armed", "Disarmed", "Mode", "Failsafe", "Failsafe cleared",
+	"HW failure", "HW OK", "Waypoint", "GPS lost", "GPS fix", "Log event", "Log error"}
+
+func (k EventKind) String() string {
+	if int(k) < len(event_names) {
+		return event_names[k]
+	}
+	return fmt.Sprintf("Event %d", k)
+}
+
+type LogEvent struct {
+	Stamp  uint64 // as LogItem.Stamp
+	Utc    time.Time
+	Lat    float64
+	Lon    float64
+	Alt    float64
+	Kind   EventKind
+	Detail string
+}
+
+func (e LogEvent) String() string {
+	if e.Detail == "" {
+		return e.Kind.String()
+	}
+	return e.Kind.String() + ": " + e.Detail
+}
+
+// Derives events from the state changes between successive items
+type EventDetector struct {
+	Events []LogEvent
+	last   LogItem
+	have   bool
+}
+
+// Add adds an event at item b
+func (d *EventDetector) Add(b *LogItem, k EventKind, detail string) {
+	d.Events = append(d.Events, LogEvent{Stamp: b.Stamp, Utc: b.Utc, Lat: b.Lat, Lon: b.Lon,
+		Alt: b.Alt, Kind: k, Detail: detail})
+}
+
+// AddAt adds an event at an earlier time stamp than item b, at b's position
+func (d *EventDetector) AddAt(b *LogItem, stamp uint64, k EventKind, detail string) {
+	d.Add(b, k, detail)
+	e := &d.Events[len(d.Events)-1]
+	if stamp < b.Stamp {
+		e.Stamp = stamp
+		if !e.Utc.IsZero() {
+			e.Utc = e.Utc.Add(-time.Duration(b.Stamp-stamp) * time.Microsecond)
+		}
+	}
+}
+
+// Check adds the events implied by the changes since the previous item, for
+// the fields of b that are valid (see SetValid)
+func (d *EventDetector) Check(b *LogItem) {
+	p := &d.last
+	if !d.have {
+		if b.Logged(F_FMODE) {
+			d.Add(b, EV_MODE, b.Fmtext)
+		}
+		if b.Logged(F_STATUS) && b.Status&Is_FAIL != 0 {
+			d.Add(b, EV_FAILSAFE, "")
+		}
+		if b.Logged(F_HWFAIL) && b.HWfail {
+			d.Add(b, EV_HWFAIL, "")
+		}
+	} else {
+		if b.Logged(F_STATUS) {
+			if a, pa := b.Status&Is_ARMED != 0, p.Status&Is_ARMED != 0; a != pa {
+				if a {
+					d.Add(b, EV_ARM, "")
+				} else {
+					d.Add(b, EV_DISARM, "")
+				}
+			}
+			if f, pf := b.Status&Is_FAIL != 0, p.Status&Is_FAIL != 0; f != pf {
+				if f {
+					d.Add(b, EV_FAILSAFE, "")
+				} else {
+					d.Add(b, EV_FSCLEAR, "")
+				}
+			}
+		}
+		if b.Logged(F_FMODE) && b.Fmode != p.Fmode {
+			d.Add(b, EV_MODE, fmt.Sprintf("%s (from %s)", b.Fmtext, p.Fmtext))
+		}
+		if b.Logged(F_HWFAIL) && b.HWfail != p.HWfail {
+			if b.HWfail {
+				d.Add(b, EV_HWFAIL, "")
+			} else {
+				d.Add(b, EV_HWOK, "")
+			}
+		}
+		if b.Logged(F_WPNO) && b.ActiveWP != p.ActiveWP && b.ActiveWP != 0 {
+			d.Add(b, EV_WAYPOINT, fmt.Sprintf("WP %d", b.ActiveWP))
+		}
+		if b.Logged(F_FIX) {
+			if b.Fix < 2 && p.Fix >= 2 {
+				d.Add(b, EV_GPSLOST, fmt.Sprintf("%d satellites", b.Numsat))
+			} else if b.Fix >= 2 && p.Fix < 2 {
+				d.Add(b, EV_GPSFIX, fmt.Sprintf("%d satellites", b.Numsat))
+			}
+		}
+	}
+	d.last = *b
+	d.have = true
+}
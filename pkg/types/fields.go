@@ -0,0 +1,175 @@
+package types
+
+import (
+	"strings"
+)
+
+// Per-field validity for LogItem. The coarse LogRec.Cap says what a log may
+// contain; LogItem.Valid says which fields of an item hold logged (or derived)
+// values, so that a zero may be distinguished from "not logged". Readers set
+// the fields their log provides with LogItem.SetValid; LogRec.Valid is the
+// union over a flight's items.
+// The units of each field are given by the Fields registry; readers convert
+// to these units.
+
+type FieldMask uint64
+
+const (
+	F_STAMP    FieldMask = 1 << iota // Stamp
+	F_UTC                            // Utc
+	F_POS                            // Lat, Lon
+	F_ALT                            // Alt (relative)
+	F_GALT                           // GAlt (AMSL)
+	F_SPD                            // Spd
+	F_AMPS                           // Amps
+	F_VOLTS                          // Volts
+	F_ENERGY                         // Energy
+	F_HOME                           // Hlat, Hlon
+	F_RANGE                          // Vrange, Bearing (derived)
+	F_TDIST                          // Tdist (derived)
+	F_EFFIC                          // Effic, Whkm, WhAcc (derived)
+	F_FMODE                          // Fmode, Fmtext
+	F_THROTTLE                       // Throttle
+	F_CSE                            // Cse
+	F_COG                            // Cog
+	F_ATTITUDE                       // Roll, Pitch
+	F_HDOP                           // Hdop
+	F_STICKS                         // Ail, Ele, Rud, Thr
+	F_GYRO                           // Gyro_x, Gyro_y, Gyro_z
+	F_ACC                            // Acc_x, Acc_y, Acc_z
+	F_FIX                            // Fix
+	F_NUMSAT                         // Numsat
+	F_RSSI                           // Rssi
+	F_STATUS                         // Status
+	F_WPNO                           // ActiveWP
+	F_NAVMODE                        // Navmode, Navextra
+	F_HWFAIL                         // HWfail
+	F_WIND                           // Wind
+	F_ALL      = F_WIND<<1 - 1
+)
+
+// Fields derived by SetValid from those logged
+const F_DERIVED = F_RANGE | F_TDIST | F_EFFIC
+
+type FieldInfo struct {
+	Mask FieldMask
+	Name string // short name (SQL / JSON)
+	Unit string // "" for counts, enumerations and flags
+	Desc string
+}
+
+// The units registry
+var Fields = []FieldInfo{
+	{F_STAMP, "stamp", "us", "Log time"},
+	{F_UTC, "utc", "", "UTC time"},
+	{F_POS, "position", "deg", "Latitude, longitude"},
+	{F_ALT, "alt", "m", "Altitude, relative to home"},
+	{F_GALT, "galt", "m", "GPS altitude, AMSL"},
+	{F_SPD, "spd", "m/s", "Ground speed"},
+	{F_AMPS, "amps", "A", "Current"},
+	{F_VOLTS, "volts", "V", "Battery voltage"},
+	{F_ENERGY, "energy", "mAh", "Energy used"},
+	{F_HOME, "home", "deg", "Home latitude, longitude"},
+	{F_RANGE, "range", "m", "Range (m) and bearing (deg) from home"},
+	{F_TDIST, "tdist", "m", "Cumulative distance"},
+	{F_EFFIC, "effic", "mAh/km", "Efficiency (also Wh/km, Wh)"},
+	{F_FMODE, "fmode", "", "Flight mode"},
+	{F_THROTTLE, "throttle", "%", "Throttle"},
+	{F_CSE, "cse", "deg", "Heading"},
+	{F_COG, "cog", "deg", "Course over ground"},
+	{F_ATTITUDE, "attitude", "deg", "Roll, pitch"},
+	{F_HDOP, "hdop", "1/100", "HDOP"},
+	{F_STICKS, "sticks", "us", "Stick positions (Ail, Ele, Rud, Thr)"},
+	{F_GYRO, "gyro", "deg/s", "Gyro rates"},
+	{F_ACC, "acc", "", "Accelerometer (raw, see FlightMeta.Acc1G)"},
+	{F_FIX, "fix", "", "GPS fix type"},
+	{F_NUMSAT, "numsat", "", "Satellites"},
+	{F_RSSI, "rssi", "%", "RSSI"},
+	{F_STATUS, "status", "", "Armed / failsafe status"},
+	{F_WPNO, "activewp", "", "Active waypoint"},
+	{F_NAVMODE, "navmode", "", "Navigation state"},
+	{F_HWFAIL, "hwfail", "", "Hardware failure"},
+	{F_WIND, "wind", "cm/s", "Wind (x, y, z)"},
+}
+
+func (m FieldMask) Has(f FieldMask) bool {
+	return m&f == f
+}
+
+// Info returns the registry entry for a single field
+func (m FieldMask) Info() (FieldInfo, bool) {
+	for _, f := range Fields {
+		if f.Mask == m {
+			return f, true
+		}
+	}
+	return FieldInfo{}, false
+}
+
+func (m FieldMask) String() string {
+	var names []string
+	for _, f := range Fields {
+		if m&f.Mask != 0 {
+			names = append(names, f.Name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// CapFields maps LogRec.Cap capabilities to the corresponding fields
+func CapFields(cap uint16) FieldMask {
+	var m FieldMask
+	for _, c := range []struct {
+		cap uint16
+		f   FieldMask
+	}{{CAP_AMPS, F_AMPS}, {CAP_VOLTS, F_VOLTS}, {CAP_ENERGY, F_ENERGY}, {CAP_RSSI_VALID, F_RSSI},
+		{CAP_SPEED, F_SPD}, {CAP_ALTITUDE, F_ALT}, {CAP_WPNO, F_WPNO}, {CAP_WIND, F_WIND}} {
+		if cap&c.cap != 0 {
+			m |= c.f
+		}
+	}
+	return m
+}
+
+// SetValid sets the item's validity from the fields m provided by the log,
+// less any whose value in this item is missing or a sentinel, and adds the
+// derived fields that follow from those present and the home h.
+func (b *LogItem) SetValid(m FieldMask, h HomeRec) {
+	m &^= F_DERIVED
+	if b.Utc.IsZero() {
+		m &^= F_UTC
+	}
+	if b.Lat == 0 && b.Lon == 0 {
+		m &^= F_POS
+	}
+	if b.Hlat == 0 && b.Hlon == 0 {
+		m &^= F_HOME
+	}
+	if b.Cse == 0xffff {
+		m &^= F_CSE
+	}
+	if m&F_POS != 0 {
+		m |= F_TDIST
+		if h.Flags != 0 && b.Bearing >= 0 && b.Vrange >= 0 {
+			m |= F_RANGE
+		}
+		if m&F_AMPS != 0 {
+			m |= F_EFFIC
+		}
+	}
+	b.Valid = m
+}
+
+// Logged reports whether the fields f are logged for the item; items without
+// validity (e.g. from external callers) are assumed to have all fields
+func (b *LogItem) Logged(f FieldMask) bool {
+	return b.Valid == 0 || b.Valid.Has(f)
+}
+
+// SetValid recalculates the record's validity as the union of its items'
+func (r *LogRec) SetValid() {
+	r.Valid = 0
+	for j := range r.Items {
+		r.Valid |= r.Items[j].Valid
+	}
+}
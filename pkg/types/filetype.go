@@ -1,11 +1,10 @@
 package types
 
 import (
-	"bufio"
-	"bytes"
-	"log"
-	"os"
-	"strings"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
 )
 
 const (
@@ -16,32 +15,101 @@ const (
 	IS_MWP     = 4
 	IS_AP      = 5
 	IS_SQL     = 6
+	IS_TLOG    = 7
+	IS_ULOG    = 8
+	IS_CSV     = 9
+	IS_ETHOS   = 10
 )
 
-func EvinceFileType(fn string) int {
-	res := IS_UNKNOWN
-	file, err := os.Open(fn)
+// Number of leading bytes offered to a probe
+const PROBE_SIZE = 512
+
+// Confidence values returned by probes; 0 means "not mine"
+const (
+	PROBE_NONE   = 0
+	PROBE_WEAK   = 25
+	PROBE_LIKELY = 50
+	PROBE_STRONG = 75
+	PROBE_MAGIC  = 100
+)
+
+// A ProbeFunc inspects the start of a file (up to PROBE_SIZE bytes) and returns
+// a confidence that it is of its format.
+type ProbeFunc func(sig []byte) int
+
+// A ReaderFunc constructs the FlightLog reader for a file.
+type ReaderFunc func(fn string) FlightLog
+
+type LogFormat struct {
+	Name   string
+	Type   int
+	Probe  ProbeFunc
+	Reader ReaderFunc
+}
+
+var formats []LogFormat
+
+// RegisterLogFormat is called by each reader package (from init()) to
+// make its format known to EvinceFileType / NewFlightLog.
+func RegisterLogFormat(f LogFormat) {
+	formats = append(formats, f)
+	sort.SliceStable(formats, func(i, j int) bool { return formats[i].Type < formats[j].Type })
+}
+
+func LogFormats() []LogFormat {
+	return formats
+}
+
+func read_signature(fn string) ([]byte, error) {
+	file, err := OpenLog(fn)
 	if err != nil {
-		log.Fatalf("filetype: %+v\n", err)
+		return nil, err
 	}
 	defer file.Close()
-	fh := bufio.NewReader(file)
-	sig, err := fh.Peek(128) //read a few bytes without consuming
-	if err == nil {
-		switch {
-		case strings.Contains(string(sig), "H Product:Blackbox"):
-			res = IS_BBL
-		case strings.HasPrefix(string(sig), "Date,Time,"):
-			res = IS_OTX
-		case strings.Contains(string(sig), "|Connected to"):
-			res = IS_BLT
-		case strings.HasPrefix(string(sig), `{"type":`):
-			res = IS_MWP
-		case bytes.HasPrefix(sig, []byte{0xa3, 0x95, 0x80, 0x80, 0x59, 0x46, 0x4d, 0x54}):
-			res = IS_AP
-		case strings.HasPrefix(string(sig), "SQLite format 3"):
-			res = IS_SQL
+	sig := make([]byte, PROBE_SIZE)
+	n, err := io.ReadFull(file, sig)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return sig[:n], err
+}
+
+func probe(sig []byte) (*LogFormat, int) {
+	var best *LogFormat
+	bconf := PROBE_NONE
+	for j := range formats {
+		if c := formats[j].Probe(sig); c > bconf {
+			bconf = c
+			best = &formats[j]
 		}
 	}
-	return res
+	return best, bconf
+}
+
+// EvinceFileType returns the IS_ type of the best matching registered
+// format, or IS_UNKNOWN
+func EvinceFileType(fn string) int {
+	sig, err := read_signature(fn)
+	if err != nil {
+		return IS_UNKNOWN
+	}
+	if f, _ := probe(sig); f != nil {
+		return f.Type
+	}
+	return IS_UNKNOWN
+}
+
+// NewFlightLog returns a reader for the best matching registered format
+func NewFlightLog(fn string) (FlightLog, error) {
+	sig, err := read_signature(fn)
+	if err != nil {
+		return nil, err
+	}
+	if f, _ := probe(sig); f != nil {
+		return f.Reader(fn), nil
+	}
+	if len(formats) == 0 {
+		return nil, errors.New("no log formats registered")
+	}
+	return nil, fmt.Errorf("%s: unknown log format", fn)
 }
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"crypto/sha1"
 	b64 "encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -15,15 +16,24 @@ func Init() {
 }
 
 func get_cache_name(lname string) (string, error) {
-	fi, err := os.Stat(lname)
+	var fn string
+	data, err := load_source(lname)
 	if err != nil {
 		return "", err
 	}
-	sz := fi.Size()
-	mt := fi.ModTime().UTC().UnixNano() / 1000 // for Ubuntu 20.04 et al
-	base := filepath.Base(lname)
-	uenc := b64.URLEncoding.EncodeToString([]byte(base))
-	fn := fmt.Sprintf("%s.%x.%x", uenc, sz, mt)
+	uenc := b64.URLEncoding.EncodeToString([]byte(LogBase(lname)))
+	if data != nil {
+		// stdin, compressed or archived, key on the content
+		fn = fmt.Sprintf("%s.%x.%x", uenc, len(data), sha1.Sum(data))
+	} else {
+		fi, err := os.Stat(lname)
+		if err != nil {
+			return "", err
+		}
+		sz := fi.Size()
+		mt := fi.ModTime().UTC().UnixNano() / 1000 // for Ubuntu 20.04 et al
+		fn = fmt.Sprintf("%s.%x.%x", uenc, sz, mt)
+	}
 	dn := GetCacheDir()
 	return filepath.Join(dn, fn), nil
 }
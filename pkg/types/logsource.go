@@ -0,0 +1,267 @@
+package types
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"github.com/ulikunitz/xz"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A log name given to the readers may be
+//   - a plain file
+//   - "-", the log is read from stdin
+//   - a gzip or xz compressed file
+//   - a member of a zip archive, "archive.zip/path/in/archive"
+// Other than plain files, the (decompressed) content is held in memory, so
+// a log may be read as many times as the readers require.
+
+const STDIN_NAME = "-"
+
+var (
+	gz_magic  = []byte{0x1f, 0x8b}
+	xz_magic  = []byte{0xfd, '7', 'z', 'X', 'Z', 0}
+	zip_magic = []byte{'P', 'K', 3, 4}
+)
+
+type memlog struct {
+	*bytes.Reader
+}
+
+func (m memlog) Close() error {
+	return nil
+}
+
+var (
+	srcmu   sync.Mutex
+	sources = make(map[string][]byte)
+)
+
+func is_archive(fn string) bool {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return false
+	}
+	defer fh.Close()
+	sig := make([]byte, len(zip_magic))
+	_, err = io.ReadFull(fh, sig)
+	return err == nil && bytes.Equal(sig, zip_magic)
+}
+
+func is_regular(fn string) bool {
+	fi, err := os.Stat(fn)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// Splits "archive.zip/member" into its parts, the archive being the
+// shortest leading path that is a regular file
+func split_member(name string) (string, string, bool) {
+	for j := 1; j < len(name); j++ {
+		if name[j] == '/' || name[j] == os.PathSeparator {
+			if is_regular(name[:j]) {
+				if is_archive(name[:j]) {
+					return name[:j], filepath.ToSlash(name[j+1:]), true
+				}
+				return "", "", false
+			}
+		}
+	}
+	return "", "", false
+}
+
+func decompress(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, gz_magic):
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	case bytes.HasPrefix(data, xz_magic):
+		xr, err := xz.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("xz: %w", err)
+		}
+		out, err := io.ReadAll(xr)
+		if err != nil {
+			return nil, fmt.Errorf("xz: %w", err)
+		}
+		return out, nil
+	}
+	return data, nil
+}
+
+func read_member(archive, member string) ([]byte, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.Name == member {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return io.ReadAll(rc)
+		}
+	}
+	return nil, fmt.Errorf("%s: no member %s", archive, member)
+}
+
+// Returns the in-memory content for a log name, or nil for a plain file
+func load_source(name string) ([]byte, error) {
+	srcmu.Lock()
+	defer srcmu.Unlock()
+	if data, ok := sources[name]; ok {
+		return data, nil
+	}
+	var data []byte
+	var err error
+	if name == STDIN_NAME {
+		data, err = io.ReadAll(os.Stdin)
+	} else if is_regular(name) {
+		var fh *os.File
+		if fh, err = os.Open(name); err != nil {
+			return nil, err
+		}
+		sig := make([]byte, len(xz_magic))
+		n, _ := io.ReadFull(fh, sig)
+		fh.Close()
+		sig = sig[:n]
+		if !bytes.HasPrefix(sig, gz_magic) && !bytes.HasPrefix(sig, xz_magic) {
+			return nil, nil
+		}
+		data, err = os.ReadFile(name)
+	} else if archive, member, ok := split_member(name); ok {
+		data, err = read_member(archive, member)
+	} else {
+		_, err = os.Stat(name)
+		return nil, err
+	}
+	if err == nil {
+		data, err = decompress(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sources[name] = data
+	return data, nil
+}
+
+// OpenLog opens a log name for reading, decompressing as necessary
+func OpenLog(name string) (io.ReadSeekCloser, error) {
+	data, err := load_source(name)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return os.Open(name)
+	}
+	return memlog{bytes.NewReader(data)}, nil
+}
+
+// ReadLog returns the entire (decompressed) content of a log name
+func ReadLog(name string) ([]byte, error) {
+	data, err := load_source(name)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return os.ReadFile(name)
+	}
+	return data, nil
+}
+
+// LogFilePath returns a file system path for the log name, for consumers
+// that can only work with files. Logs that are not plain files are
+// materialised in dir, a temporary directory that the caller removes.
+func LogFilePath(name string, dir string) (string, error) {
+	data, err := load_source(name)
+	if err != nil || data == nil {
+		return name, err
+	}
+	fn := filepath.Join(dir, fmt.Sprintf("log.%x", sha1.Sum(data)))
+	if _, err := os.Stat(fn); err == nil {
+		return fn, nil
+	}
+	err = os.WriteFile(fn, data, 0644)
+	return fn, err
+}
+
+// LogBase returns the name of a log as shown in FlightMeta.Logname; the
+// base name for files, "archive.zip/member" for archive members, less any
+// compression suffix.
+func LogBase(name string) string {
+	if name == STDIN_NAME {
+		return "stdin"
+	}
+	var base string
+	if !is_regular(name) {
+		if archive, member, ok := split_member(name); ok {
+			base = filepath.Base(archive) + "/" + member
+		}
+	}
+	if base == "" {
+		base = filepath.Base(name)
+	}
+	switch strings.ToLower(filepath.Ext(base)) {
+	case ".gz", ".xz":
+		base = base[:len(base)-3]
+	}
+	return base
+}
+
+// ExpandLogs replaces any zip archive in the list of names by those of its
+// members that are recognised as logs.
+func ExpandLogs(names []string) []string {
+	var files []string
+	for _, fn := range names {
+		if fn == STDIN_NAME || !is_regular(fn) || !is_archive(fn) {
+			files = append(files, fn)
+			continue
+		}
+		members, err := archive_members(fn)
+		if err != nil || len(members) == 0 {
+			files = append(files, fn)
+			continue
+		}
+		files = append(files, members...)
+	}
+	return files
+}
+
+func archive_members(archive string) ([]string, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var members []string
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		name := archive + "/" + f.Name
+		sig, err := read_signature(name)
+		if err != nil {
+			continue
+		}
+		if lf, _ := probe(sig); lf != nil {
+			members = append(members, name)
+		}
+	}
+	if len(members) == 0 {
+		err = errors.New("no logs in archive")
+	}
+	return members, err
+}
@@ -0,0 +1,214 @@
+package types
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Full rate, columnar access to the fields of a log, for analysis of (for
+// example) gyro, accelerometer or motor data at the log's native rate. The
+// LogItem stream returned by FlightLog.Reader is decimated to the sampling
+// interval; FlightLog.Series instead stores every value of every frame of
+// the selected fields.
+//
+// A log's fields are grouped into tables, each of which has its own time
+// stamps; a Blackbox or CSV log has a single table, while message based logs
+// (ArduPilot, MAVLink, ULog, ...) have a table per message type. Columns are
+// named as in the log and may be addressed as "field" or "table.field".
+
+type Table struct {
+	Name  string
+	Names []string    // column names
+	Stamp []uint64    // frame time stamps (us)
+	Cols  [][]float64 // Cols[i][n] is the value of Names[i] in frame n
+	pick  []int       // indices of the selected columns in the source frame
+}
+
+type Series struct {
+	Tables []*Table
+	sel    []string
+}
+
+// NewSeries returns an empty store, which will hold the fields selected by
+// sel. Each selection is a field name or "table.field", case insensitive; a
+// trailing "*" matches any suffix (so "gyro*" or "ATT.*"). An empty selection
+// selects all fields.
+func NewSeries(sel []string) *Series {
+	var s Series
+	for _, p := range sel {
+		if p = strings.TrimSpace(p); p != "" {
+			s.sel = append(s.sel, strings.ToLower(p))
+		}
+	}
+	return &s
+}
+
+func match(pat, name string) bool {
+	if strings.HasSuffix(pat, "*") {
+		return strings.HasPrefix(name, pat[:len(pat)-1])
+	}
+	return pat == name
+}
+
+// Selected reports whether a table's field is selected
+func (s *Series) Selected(table, field string) bool {
+	if len(s.sel) == 0 {
+		return true
+	}
+	f := strings.ToLower(field)
+	tf := strings.ToLower(table) + "." + f
+	for _, p := range s.sel {
+		if match(p, f) || match(p, tf) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddTable adds (or returns the existing) table whose frames comprise the
+// fields names; the selected fields are stored. Returns nil if none of the
+// fields is selected, which Append accepts.
+func (s *Series) AddTable(name string, names []string) *Table {
+	if t := s.Table(name); t != nil {
+		return t
+	}
+	t := &Table{Name: name}
+	for j, n := range names {
+		if s.Selected(name, n) {
+			t.Names = append(t.Names, n)
+			t.pick = append(t.pick, j)
+		}
+	}
+	if len(t.pick) == 0 {
+		return nil
+	}
+	t.Cols = make([][]float64, len(t.pick))
+	s.Tables = append(s.Tables, t)
+	return t
+}
+
+// Append stores a frame, vals being the values of all the fields given to
+// AddTable
+func (t *Table) Append(stamp uint64, vals []float64) {
+	if t == nil {
+		return
+	}
+	t.Stamp = append(t.Stamp, stamp)
+	for j, k := range t.pick {
+		t.Cols[j] = append(t.Cols[j], vals[k])
+	}
+}
+
+// AppendMap stores a frame of named values in a table, for logs whose
+// records are self describing (JSON, key:value); the first selected value of
+// a name adds its column (earlier frames being NaN), and columns missing
+// from a frame are NaN. Such tables are only added to by AppendMap.
+func (s *Series) AppendMap(table string, stamp uint64, vals map[string]float64) {
+	t := s.Table(table)
+	var names []string
+	for k := range vals {
+		if s.Selected(table, k) && (t == nil || t.Column(k) == nil) {
+			names = append(names, k)
+		}
+	}
+	if t == nil {
+		if len(names) == 0 {
+			return
+		}
+		t = &Table{Name: table}
+		s.Tables = append(s.Tables, t)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		c := make([]float64, t.Len(), t.Len()+1)
+		for j := range c {
+			c[j] = math.NaN()
+		}
+		t.Names = append(t.Names, k)
+		t.Cols = append(t.Cols, c)
+	}
+	t.Stamp = append(t.Stamp, stamp)
+	for j, k := range t.Names {
+		v, ok := vals[k]
+		if !ok {
+			v = math.NaN()
+		}
+		t.Cols[j] = append(t.Cols[j], v)
+	}
+}
+
+func (t *Table) Len() int {
+	return len(t.Stamp)
+}
+
+// Column returns the values of the named column, or nil
+func (t *Table) Column(name string) []float64 {
+	for j, n := range t.Names {
+		if strings.EqualFold(n, name) {
+			return t.Cols[j]
+		}
+	}
+	return nil
+}
+
+func (s *Series) Table(name string) *Table {
+	for _, t := range s.Tables {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// Column returns the time stamps and values of a column, named as "field"
+// (the first table having the field) or "table.field"
+func (s *Series) Column(name string) ([]uint64, []float64, bool) {
+	for _, t := range s.Tables {
+		c := t.Column(name)
+		if c == nil {
+			if tn, fn, ok := strings.Cut(name, "."); ok && strings.EqualFold(tn, t.Name) {
+				c = t.Column(fn)
+			}
+		}
+		if c != nil {
+			return t.Stamp, c, true
+		}
+	}
+	return nil, nil, false
+}
+
+// Len returns the total number of frames stored
+func (s *Series) Len() int {
+	n := 0
+	for _, t := range s.Tables {
+		n += t.Len()
+	}
+	return n
+}
+
+// WriteCSV writes a table as CSV, a row per frame, the first column being the
+// time stamp (us); missing (NaN) values are empty
+func (t *Table) WriteCSV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("stamp")
+	for _, n := range t.Names {
+		bw.WriteByte(',')
+		bw.WriteString(n)
+	}
+	bw.WriteByte('\n')
+	for i, st := range t.Stamp {
+		bw.WriteString(strconv.FormatUint(st, 10))
+		for _, c := range t.Cols {
+			bw.WriteByte(',')
+			if !math.IsNaN(c[i]) {
+				bw.WriteString(strconv.FormatFloat(c[i], 'g', -1, 64))
+			}
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
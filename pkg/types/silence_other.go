@@ -34,7 +34,3 @@ func GetCacheDir() string {
 	os.MkdirAll(dir, 0755)
 	return dir
 }
-
-func SetBBLFallback(bblname string) string {
-	return bblname
-}
@@ -88,18 +88,3 @@ func GetCacheDir() string {
 	checkdirs("fl2x")
 	return checkdirs(filepath.Join("fl2x", ".cache"))
 }
-
-func SetBBLFallback(bblname string) string {
-	if bblname == "blackbox_decode" {
-		ex, err := os.Executable()
-		if err != nil {
-			panic(err)
-		}
-		exPath := filepath.Dir(ex)
-		bblpath := filepath.Join(exPath, "blackbox_decode.exe")
-		if _, err := os.Stat(bblpath); err == nil {
-			return bblpath
-		}
-	}
-	return bblname
-}
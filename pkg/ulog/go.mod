@@ -0,0 +1,3 @@
+module ulog
+
+go 1.19
@@ -0,0 +1,926 @@
+package ulog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"geo"
+	"options"
+	"types"
+)
+
+// PX4 ULog reader
+// https://docs.px4.io/main/en/dev_log/ulog_file_format.html
+
+var ulog_magic = []byte{'U', 'L', 'o', 'g', 0x01, 0x12, 0x35}
+var sync_magic = []byte{0x2f, 0x73, 0x13, 0x20, 0x25, 0x0c, 0xbb, 0x12}
+
+const (
+	ulog_HDR_SIZE  = 16
+	ulog_MSG_HDR   = 3
+	ulog_INCOMPAT  = 1 // Data appended
+	ulog_FLAG_SIZE = 40
+)
+
+// PX4 vehicle_status nav_state
+const (
+	nav_MANUAL            = 0
+	nav_ALTCTL            = 1
+	nav_POSCTL            = 2
+	nav_AUTO_MISSION      = 3
+	nav_AUTO_LOITER       = 4
+	nav_AUTO_RTL          = 5
+	nav_AUTO_LANDENGFAIL  = 8
+	nav_AUTO_LANDGPSFAIL  = 9
+	nav_ACRO              = 10
+	nav_DESCEND           = 12
+	nav_TERMINATION       = 13
+	nav_OFFBOARD          = 14
+	nav_STAB              = 15
+	nav_RATTITUDE         = 16
+	nav_AUTO_TAKEOFF      = 17
+	nav_AUTO_LAND         = 18
+	nav_AUTO_FOLLOW       = 19
+	nav_AUTO_PRECLAND     = 20
+	nav_ORBIT             = 21
+	nav_AUTO_VTOL_TAKEOFF = 22
+)
+
+const arming_STATE_ARMED = 2
+
+var type_sizes = map[string]int{
+	"int8_t": 1, "uint8_t": 1, "bool": 1, "char": 1,
+	"int16_t": 2, "uint16_t": 2,
+	"int32_t": 4, "uint32_t": 4, "float": 4,
+	"int64_t": 8, "uint64_t": 8, "double": 8,
+}
+
+type ufield struct {
+	name  string
+	typ   string
+	off   int
+	size  int
+	count int
+}
+
+type uformat struct {
+	name   string
+	defs   []string
+	size   int
+	fields []ufield
+	idx    map[string]int
+}
+
+type usub struct {
+	name  string
+	multi uint8
+	fmt   *uformat
+}
+
+type ulreader struct {
+	data     []byte
+	pos      int
+	limit    int
+	appended int
+	tstamp   uint64
+	formats  map[string]*uformat
+	subs     map[uint16]*usub
+	info     map[string]string
+	ndrop    int
+	dropms   int
+	nbad     int
+}
+
+type ULOG struct {
+	name string
+	meta []types.FlightMeta
+}
+
+func NewULOGReader(fn string) ULOG {
+	var l ULOG
+	l.name = fn
+	l.meta = nil
+	return l
+}
+
+func init() {
+	types.RegisterLogFormat(types.LogFormat{Name: "PX4 ULog", Type: types.IS_ULOG, Probe: probe_log,
+		Reader: func(fn string) types.FlightLog { l := NewULOGReader(fn); return &l }})
+}
+
+func probe_log(sig []byte) int {
+	if bytes.HasPrefix(sig, ulog_magic) {
+		return types.PROBE_MAGIC
+	}
+	return types.PROBE_NONE
+}
+
+func (o *ULOG) LogType() byte {
+	return types.LOGULOG
+}
+
+func (o *ULOG) GetMetas() ([]types.FlightMeta, error) {
+	m, err := types.ReadMetaCache(o.name)
+	if err != nil || options.Config.Nocache {
+		m, err = metas(o.name)
+		types.WriteMetaCache(o.name, m)
+	}
+	o.meta = m
+	return m, err
+}
+
+func (o *ULOG) GetDurations() {
+}
+
+func (o *ULOG) Dump() {
+	u, err := open_ulog(o.name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ulog: %s\n", err)
+		os.Exit(1)
+	}
+	counts := make(map[string]int)
+	for {
+		typ, body, ok := u.next()
+		if !ok {
+			break
+		}
+		if typ == 'D' && len(body) > 2 {
+			if s, ok := u.subs[binary.LittleEndian.Uint16(body)]; ok {
+				counts[fmt.Sprintf("%s.%d", s.name, s.multi)] += 1
+			}
+		}
+	}
+	var ks []string
+	for k := range u.info {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		fmt.Printf("%s: %s\n", k, u.info[k])
+	}
+	ks = ks[:0]
+	for k := range counts {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		fmt.Printf("%s, %d\n", k, counts[k])
+	}
+	if u.ndrop > 0 {
+		fmt.Printf("dropouts: %d (%dms)\n", u.ndrop, u.dropms)
+	}
+}
+
+func open_ulog(fn string) (*ulreader, error) {
+	data, err := types.ReadLog(fn)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < ulog_HDR_SIZE || !bytes.HasPrefix(data, ulog_magic) {
+		return nil, errors.New("Not a ULog file")
+	}
+	u := &ulreader{data: data}
+	u.rewind()
+	return u, nil
+}
+
+// Restarts reading from the first message
+func (u *ulreader) rewind() {
+	*u = ulreader{data: u.data, pos: ulog_HDR_SIZE, limit: len(u.data)}
+	u.tstamp = binary.LittleEndian.Uint64(u.data[8:])
+	u.formats = make(map[string]*uformat)
+	u.subs = make(map[uint16]*usub)
+	u.info = make(map[string]string)
+}
+
+func (u *ulreader) resync() {
+	u.nbad++
+	n := bytes.Index(u.data[u.pos+1:u.limit], sync_magic)
+	if n == -1 {
+		u.pos = u.limit
+	} else {
+		u.pos += 1 + n + len(sync_magic)
+	}
+}
+
+// Returns the next message type and body, with definitions, info and
+// dropouts handled internally
+func (u *ulreader) next() (byte, []byte, bool) {
+	for {
+		if u.pos+ulog_MSG_HDR > u.limit {
+			if u.appended > u.pos && u.appended < len(u.data) {
+				u.pos = u.appended
+				u.limit = len(u.data)
+				u.appended = 0
+				continue
+			}
+			return 0, nil, false
+		}
+		size := int(binary.LittleEndian.Uint16(u.data[u.pos:]))
+		typ := u.data[u.pos+2]
+		if u.pos+ulog_MSG_HDR+size > u.limit {
+			// truncated message (e.g. before appended data)
+			u.pos = u.limit
+			continue
+		}
+		body := u.data[u.pos+ulog_MSG_HDR : u.pos+ulog_MSG_HDR+size]
+		switch typ {
+		case 'B':
+			if size >= ulog_FLAG_SIZE && body[8]&ulog_INCOMPAT != 0 {
+				off := int(binary.LittleEndian.Uint64(body[16:]))
+				if off > u.pos && off < len(u.data) {
+					u.appended = off
+					u.limit = off
+				}
+			}
+		case 'F':
+			u.add_format(string(body))
+		case 'I':
+			u.add_info(body)
+		case 'A':
+			if size > 3 {
+				id := binary.LittleEndian.Uint16(body[1:])
+				name := string(body[3:])
+				if f := u.get_format(name); f != nil {
+					u.subs[id] = &usub{name: name, multi: body[0], fmt: f}
+				}
+			}
+		case 'R':
+			if size >= 2 {
+				delete(u.subs, binary.LittleEndian.Uint16(body))
+			}
+		case 'O':
+			if size >= 2 {
+				u.ndrop += 1
+				u.dropms += int(binary.LittleEndian.Uint16(body))
+			}
+		case 'D', 'L', 'C', 'M', 'P', 'Q', 'S':
+		default:
+			// unknown (newer) message types are skipped, as the spec
+			// requires; message types are letters, so anything else is
+			// corrupt
+			if (typ >= 'A' && typ <= 'Z') || (typ >= 'a' && typ <= 'z') {
+				u.pos += ulog_MSG_HDR + size
+			} else {
+				u.resync()
+			}
+			continue
+		}
+		u.pos += ulog_MSG_HDR + size
+		return typ, body, true
+	}
+}
+
+func (u *ulreader) add_format(s string) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return
+	}
+	f := &uformat{name: parts[0], size: -1}
+	for _, d := range strings.Split(parts[1], ";") {
+		if d != "" {
+			f.defs = append(f.defs, d)
+		}
+	}
+	u.formats[f.name] = f
+}
+
+// Resolves field offsets (and nested types) on first use
+func (u *ulreader) get_format(name string) *uformat {
+	f, ok := u.formats[name]
+	if !ok {
+		return nil
+	}
+	if f.size != -1 {
+		return f
+	}
+	f.size = 0
+	f.idx = make(map[string]int)
+	for _, d := range f.defs {
+		tn := strings.Fields(d)
+		if len(tn) != 2 {
+			continue
+		}
+		fl := ufield{typ: tn[0], name: tn[1], off: f.size, count: 1}
+		if n := strings.Index(fl.typ, "["); n != -1 {
+			fl.count, _ = strconv.Atoi(strings.TrimSuffix(fl.typ[n+1:], "]"))
+			fl.typ = fl.typ[:n]
+		}
+		if sz, ok := type_sizes[fl.typ]; ok {
+			fl.size = sz
+		} else if nf := u.get_format(fl.typ); nf != nil && nf != f {
+			fl.size = nf.size
+		} else {
+			return nil
+		}
+		f.size += fl.size * fl.count
+		if !strings.HasPrefix(fl.name, "_padding") {
+			f.idx[fl.name] = len(f.fields)
+			f.fields = append(f.fields, fl)
+		}
+	}
+	return f
+}
+
+func (u *ulreader) add_info(b []byte) {
+	if len(b) < 1 || int(b[0])+1 > len(b) {
+		return
+	}
+	key := string(b[1 : 1+b[0]])
+	val := b[1+b[0]:]
+	tn := strings.Fields(key)
+	if len(tn) != 2 {
+		return
+	}
+	if strings.HasPrefix(tn[0], "char[") {
+		u.info[tn[1]] = strings.TrimRight(string(val), "\x00")
+	} else if v, ok := value_of(tn[0], val); ok {
+		u.info[tn[1]] = strconv.FormatInt(int64(v), 10)
+	}
+}
+
+func value_of(typ string, p []byte) (float64, bool) {
+	if sz, ok := type_sizes[typ]; !ok || sz > len(p) {
+		return 0, false
+	}
+	switch typ {
+	case "int8_t":
+		return float64(int8(p[0])), true
+	case "uint8_t", "bool", "char":
+		return float64(p[0]), true
+	case "int16_t":
+		return float64(int16(binary.LittleEndian.Uint16(p))), true
+	case "uint16_t":
+		return float64(binary.LittleEndian.Uint16(p)), true
+	case "int32_t":
+		return float64(int32(binary.LittleEndian.Uint32(p))), true
+	case "uint32_t":
+		return float64(binary.LittleEndian.Uint32(p)), true
+	case "int64_t":
+		return float64(int64(binary.LittleEndian.Uint64(p))), true
+	case "uint64_t":
+		return float64(binary.LittleEndian.Uint64(p)), true
+	case "float":
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(p))), true
+	case "double":
+		return math.Float64frombits(binary.LittleEndian.Uint64(p)), true
+	}
+	return 0, false
+}
+
+// Value of (element n of) a named field from a data message payload
+func (f *uformat) get(data []byte, name string, n int) (float64, bool) {
+	i, ok := f.idx[name]
+	if !ok {
+		return 0, false
+	}
+	fl := f.fields[i]
+	if n >= fl.count {
+		return 0, false
+	}
+	off := fl.off + n*fl.size
+	if off+fl.size > len(data) {
+		return 0, false
+	}
+	v, ok := value_of(fl.typ, data[off:])
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
+	return v, ok
+}
+
+func (f *uformat) value(data []byte, name string) float64 {
+	v, _ := f.get(data, name, 0)
+	return v
+}
+
+func (u *ulreader) firmware() string {
+	var sb strings.Builder
+	sysname := u.info["sys_name"]
+	if sysname == "" {
+		sysname = "PX4"
+	}
+	sb.WriteString(sysname)
+	if s, ok := u.info["ver_sw_release"]; ok {
+		v, _ := strconv.ParseInt(s, 10, 64)
+		fmt.Fprintf(&sb, " %d.%d.%d", (v>>24)&0xff, (v>>16)&0xff, (v>>8)&0xff)
+	}
+	if s, ok := u.info["ver_sw"]; ok {
+		if len(s) > 7 {
+			s = s[:7]
+		}
+		fmt.Fprintf(&sb, " (%s)", s)
+	}
+	if s, ok := u.info["ver_hw"]; ok {
+		sb.WriteString(" ")
+		sb.WriteString(s)
+	}
+	return sb.String()
+}
+
+func navstate_to_fmode(nav int) uint8 {
+	switch nav {
+	case nav_MANUAL:
+		return types.FM_MANUAL
+	case nav_ALTCTL:
+		return types.FM_AH
+	case nav_POSCTL, nav_AUTO_LOITER, nav_AUTO_FOLLOW, nav_ORBIT:
+		return types.FM_PH
+	case nav_AUTO_MISSION, nav_OFFBOARD:
+		return types.FM_WP
+	case nav_AUTO_RTL:
+		return types.FM_RTH
+	case nav_AUTO_LANDENGFAIL, nav_AUTO_LANDGPSFAIL, nav_DESCEND, nav_TERMINATION:
+		return types.FM_EMERG
+	case nav_ACRO:
+		return types.FM_ACRO
+	case nav_STAB:
+		return types.FM_ANGLE
+	case nav_RATTITUDE:
+		return types.FM_HORIZON
+	case nav_AUTO_TAKEOFF, nav_AUTO_VTOL_TAKEOFF:
+		return types.FM_LAUNCH
+	case nav_AUTO_LAND, nav_AUTO_PRECLAND:
+		return types.FM_LAND
+	default:
+		return types.FM_ACRO
+	}
+}
+
+// Position from either the older (int, 1e-7 deg, mm) or newer (double) fields
+func gps_position(f *uformat, d []byte) (float64, float64, float64) {
+	var lat, lon, alt float64
+	if v, ok := f.get(d, "latitude_deg", 0); ok {
+		lat = v
+		lon = f.value(d, "longitude_deg")
+		alt = f.value(d, "altitude_msl_m")
+	} else {
+		lat = f.value(d, "lat") / 1e7
+		lon = f.value(d, "lon") / 1e7
+		alt = f.value(d, "alt") / 1000.0
+	}
+	return lat, lon, alt
+}
+
+func metas(logfile string) ([]types.FlightMeta, error) {
+	var metas []types.FlightMeta
+	u, err := open_ulog(logfile)
+	if err != nil {
+		return nil, err
+	}
+
+	mt := types.FlightMeta{Logname: types.LogBase(logfile), Index: 1, Size: int64(len(u.data)),
+		Start: 1, Flags: types.Has_Size | types.Has_Start}
+	var st, lt uint64
+	var utcoff int64
+	ngps := 0
+	gpsinst := 256 // GPS instance counted, the lowest publishing
+	nl := 0
+	for {
+		typ, body, ok := u.next()
+		if !ok {
+			break
+		}
+		nl += 1
+		if typ != 'D' || len(body) < 10 {
+			continue
+		}
+		s, ok := u.subs[binary.LittleEndian.Uint16(body)]
+		if !ok {
+			continue
+		}
+		d := body[2:]
+		ts := uint64(s.fmt.value(d, "timestamp"))
+		if st == 0 || (ts != 0 && ts < st) {
+			st = ts
+		}
+		if ts > lt {
+			lt = ts
+		}
+		if s.name == "vehicle_gps_position" && int(s.multi) <= gpsinst {
+			if int(s.multi) < gpsinst {
+				gpsinst = int(s.multi)
+				ngps = 0
+				utcoff = 0
+			}
+			ngps += 1
+			if utc := int64(s.fmt.value(d, "time_utc_usec")); utcoff == 0 && utc > 0 {
+				utcoff = utc - int64(ts)
+			}
+		}
+	}
+
+	mt.End = nl
+	mt.Firmware = u.firmware()
+	mt.Fwdate = "unknown"
+	mt.Flags |= types.Has_Firmware
+	if s, ok := u.info["sys_uuid"]; ok {
+		mt.Craft = s
+		mt.Flags |= types.Has_Craft
+	}
+	mt.Sensors = types.Has_Acc | types.Has_Baro
+	if ngps > 0 {
+		mt.Sensors |= types.Has_GPS
+		mt.Flags |= types.Is_Valid
+	}
+	if utcoff != 0 {
+		mt.Date = time.UnixMicro(int64(st) + utcoff)
+	} else {
+		mt.Date = time.UnixMicro(int64(u.tstamp))
+	}
+	mt.Duration = time.Duration(lt-st) * time.Microsecond
+	metas = append(metas, mt)
+	if ngps == 0 {
+		err = errors.New("No GPS data in ULog")
+	}
+	return metas, err
+}
+
+// Whether a field is numeric, for Series (nested types and strings are not)
+func is_numeric(fl ufield) bool {
+	_, ok := type_sizes[fl.typ]
+	return ok && !(fl.typ == "char" && fl.count > 1)
+}
+
+// Column names of the numeric fields of a format; array elements are named
+// as "field[n]"
+func (f *uformat) columns() []string {
+	var names []string
+	for _, fl := range f.fields {
+		if !is_numeric(fl) {
+			continue
+		}
+		if fl.count == 1 {
+			names = append(names, fl.name)
+		} else {
+			for n := 0; n < fl.count; n++ {
+				names = append(names, fmt.Sprintf("%s[%d]", fl.name, n))
+			}
+		}
+	}
+	return names
+}
+
+func (f *uformat) values(data []byte, vals []float64) []float64 {
+	vals = vals[:0]
+	for _, fl := range f.fields {
+		if !is_numeric(fl) {
+			continue
+		}
+		for n := 0; n < fl.count; n++ {
+			v, ok := f.get(data, fl.name, n)
+			if !ok {
+				v = math.NaN()
+			}
+			vals = append(vals, v)
+		}
+	}
+	return vals
+}
+
+// Series reads every data message of the log, as a table per topic, named
+// as the topic (with "_n" appended for multi-instance topics, n > 0)
+func (lg *ULOG) Series(m types.FlightMeta, sel []string) (*types.Series, error) {
+	u, err := open_ulog(lg.name)
+	if err != nil {
+		return nil, err
+	}
+	s := types.NewSeries(sel)
+	tbls := make(map[*usub]*types.Table)
+	var vals []float64
+	for {
+		typ, body, ok := u.next()
+		if !ok {
+			break
+		}
+		if typ != 'D' || len(body) < 10 {
+			continue
+		}
+		sub, ok := u.subs[binary.LittleEndian.Uint16(body)]
+		if !ok {
+			continue
+		}
+		t, ok := tbls[sub]
+		if !ok {
+			name := sub.name
+			if sub.multi != 0 {
+				name = fmt.Sprintf("%s_%d", name, sub.multi)
+			}
+			t = s.AddTable(name, sub.fmt.columns())
+			tbls[sub] = t
+		}
+		if t != nil {
+			d := body[2:]
+			vals = sub.fmt.values(d, vals)
+			t.Append(uint64(sub.fmt.value(d, "timestamp")), vals)
+		}
+	}
+	return s, nil
+}
+
+// The instance of each topic that is read; of multi-instance topics (e.g.
+// a second GPS or battery), the lowest that publishes data
+func topic_instances(u *ulreader) map[string]uint8 {
+	inst := make(map[string]uint8)
+	for {
+		typ, body, ok := u.next()
+		if !ok {
+			break
+		}
+		if typ == 'D' && len(body) > 2 {
+			if s, ok := u.subs[binary.LittleEndian.Uint16(body)]; ok {
+				if n, ok := inst[s.name]; !ok || s.multi < n {
+					inst[s.name] = s.multi
+				}
+			}
+		}
+	}
+	return inst
+}
+
+func (lg *ULOG) Reader(m types.FlightMeta, ch chan interface{}) (types.LogSegment, bool) {
+	u, err := open_ulog(lg.name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ulog: %s\n", err)
+		os.Exit(1)
+	}
+	inst := topic_instances(u)
+	u.rewind()
+
+	var homes types.HomeRec
+	var rec types.LogRec
+	rec.Cap = (types.CAP_ALTITUDE | types.CAP_SPEED)
+
+	ndelay := 1000 * uint64(options.Config.Intvl)
+	stats := types.LogStats{}
+
+	fb := geo.Getfrobnication()
+	var froboff time.Duration
+
+	b := types.LogItem{}
+	have_origin := false
+	var llat, llon float64
+	var dt, st, lt uint64
+	var utcoff int64
+	// Fields logged, as their topics are seen; see types.FieldMask. Alt is
+	// derived from the GPS altitude.
+	fields := types.F_STAMP | types.F_UTC | types.F_POS | types.F_GALT | types.F_ALT |
+		types.F_FIX | types.F_NUMSAT | types.F_HDOP | types.F_SPD | types.F_COG
+
+	var evs types.EventDetector
+	leffic := 0.0
+	lwhkm := 0.0
+	whacc := 0.0
+
+	for {
+		typ, body, ok := u.next()
+		if !ok {
+			break
+		}
+		if typ != 'D' || len(body) < 10 {
+			continue
+		}
+		s, ok := u.subs[binary.LittleEndian.Uint16(body)]
+		if !ok || s.multi != inst[s.name] {
+			continue
+		}
+		f := s.fmt
+		d := body[2:]
+		emit := false
+
+		switch s.name {
+		case "vehicle_gps_position":
+			us := uint64(f.value(d, "timestamp"))
+			if utc := int64(f.value(d, "time_utc_usec")); utcoff == 0 && utc > 0 {
+				utcoff = utc - int64(us)
+			}
+			b.Lat, b.Lon, b.GAlt = gps_position(f, d)
+			switch fix := int(f.value(d, "fix_type")); {
+			case fix < 2:
+				b.Fix = 0
+			case fix == 2:
+				b.Fix = 1
+			default:
+				b.Fix = 2
+			}
+			b.Numsat = uint8(f.value(d, "satellites_used"))
+			b.Hdop = uint16(f.value(d, "hdop") * 100)
+			b.Spd = f.value(d, "vel_m_s")
+			cog := int(f.value(d, "cog_rad") * 180 / math.Pi)
+			if cog < 0 {
+				cog += 360
+			}
+			b.Cog = uint32(cog)
+			b.Stamp = us
+			if utcoff != 0 {
+				b.Utc = time.UnixMicro(int64(us) + utcoff)
+			}
+			emit = true
+
+		case "vehicle_attitude":
+			q0 := f.value(d, "q")
+			q1, _ := f.get(d, "q", 1)
+			q2, _ := f.get(d, "q", 2)
+			q3, _ := f.get(d, "q", 3)
+			roll := math.Atan2(2*(q0*q1+q2*q3), 1-2*(q1*q1+q2*q2))
+			pitch := math.Asin(math.Max(-1, math.Min(1, 2*(q0*q2-q3*q1))))
+			yaw := math.Atan2(2*(q0*q3+q1*q2), 1-2*(q2*q2+q3*q3))
+			b.Roll = int16(roll * 180 / math.Pi)
+			// PX4 pitch is nose up positive, INAV's (and LogItem's) nose down
+			b.Pitch = int16(-pitch * 180 / math.Pi)
+			cse := int(yaw * 180 / math.Pi)
+			if cse < 0 {
+				cse += 360
+			}
+			b.Cse = uint32(cse)
+			fields |= types.F_ATTITUDE | types.F_CSE
+
+		case "battery_status":
+			if v, ok := f.get(d, "voltage_filtered_v", 0); ok && v > 0 {
+				b.Volts = v
+			} else {
+				b.Volts = f.value(d, "voltage_v")
+			}
+			if b.Volts > 0 {
+				rec.Cap |= types.CAP_VOLTS
+				fields |= types.F_VOLTS
+			}
+			if v, ok := f.get(d, "current_a", 0); ok && v >= 0 {
+				b.Amps = v
+				rec.Cap |= types.CAP_AMPS
+				fields |= types.F_AMPS
+			}
+			if v, ok := f.get(d, "discharged_mah", 0); ok && v >= 0 {
+				b.Energy = v
+				rec.Cap |= types.CAP_ENERGY
+				fields |= types.F_ENERGY
+			}
+
+		case "vehicle_status":
+			b.Fmode = navstate_to_fmode(int(f.value(d, "nav_state")))
+			b.Fmtext = types.Mnames[b.Fmode]
+			b.Status = 0
+			if f.value(d, "arming_state") == arming_STATE_ARMED {
+				b.Status |= types.Is_ARMED
+			}
+			if f.value(d, "failsafe") != 0 {
+				b.Status |= types.Is_FAIL
+			}
+			fields |= types.F_FMODE | types.F_STATUS
+
+		case "input_rc":
+			b.Ail = int16(f.value(d, "values"))
+			v, _ := f.get(d, "values", 1)
+			b.Ele = int16(v)
+			v, _ = f.get(d, "values", 2)
+			b.Thr = int16(v)
+			v, _ = f.get(d, "values", 3)
+			b.Rud = int16(v)
+			b.Throttle = (int(b.Thr) - 1000) / 10
+			fields |= types.F_STICKS | types.F_THROTTLE
+			if v, ok := f.get(d, "rssi", 0); ok && v > 0 && v <= 100 {
+				b.Rssi = uint8(v)
+				fields |= types.F_RSSI
+			}
+		}
+
+		if !emit || b.Fix == 0 {
+			continue
+		}
+
+		us := b.Stamp
+		if !have_origin {
+			if b.Fix > 1 && b.Numsat > 5 {
+				have_origin = true
+				if fb != nil {
+					fb.Set_origin(b.Lat, b.Lon, b.GAlt)
+					ttmp := time.Now().Add(time.Hour * 24 * 42)
+					froboff = ttmp.Sub(b.Utc)
+				}
+				st = us
+				dt = us
+				homes.HomeLat, homes.HomeLon, homes.HomeAlt = b.Lat, b.Lon, b.GAlt
+				if fb != nil {
+					homes.HomeLat, homes.HomeLon, homes.HomeAlt = fb.Relocate(b.Lat, b.Lon, b.GAlt)
+				}
+				homes.Flags = types.HOME_ARM | types.HOME_ALT
+				llat = homes.HomeLat
+				llon = homes.HomeLon
+				if ch != nil {
+					ch <- homes
+				}
+			}
+			continue
+		}
+
+		if us <= st {
+			continue
+		}
+
+		bx := b
+		bx.Alt = b.GAlt - homes.HomeAlt
+		if fb != nil {
+			bx.Utc = bx.Utc.Add(froboff)
+			bx.Lat, bx.Lon, bx.GAlt = fb.Relocate(bx.Lat, bx.Lon, bx.GAlt)
+		}
+		bx.Hlat = homes.HomeLat
+		bx.Hlon = homes.HomeLon
+
+		// Events are detected on every fix, the items decimated
+		bx.SetValid(fields, homes)
+		evs.Check(&bx)
+		if (us - dt) < ndelay {
+			continue
+		}
+
+		c, dx := geo.Csedist(homes.HomeLat, homes.HomeLon, bx.Lat, bx.Lon)
+		bx.Bearing = int32(c)
+		bx.Vrange = dx * 1852.0
+
+		if dx > stats.Max_range {
+			stats.Max_range = dx
+			stats.Max_range_time = us - st
+		}
+
+		if llat != bx.Lat || llon != bx.Lon {
+			_, dx = geo.Csedist(llat, llon, bx.Lat, bx.Lon)
+			stats.Distance += dx
+		}
+		bx.Tdist = (stats.Distance * 1852.0)
+		llat = bx.Lat
+		llon = bx.Lon
+
+		if bx.Rssi > 0 {
+			rec.Cap |= types.CAP_RSSI_VALID
+		}
+
+		if (rec.Cap & types.CAP_AMPS) == types.CAP_AMPS {
+			if dx > 0 {
+				deltat := float64((us - dt)) / 1000000.0 // seconds
+				aspd := dx * 1852 / deltat               // m/s
+				bx.Effic = bx.Amps * 1000 / (3.6 * aspd) // efficiency mAh/km
+				leffic = bx.Effic
+				bx.Whkm = bx.Amps * bx.Volts / (3.6 * aspd)
+				whacc += bx.Amps * bx.Volts * deltat / 3600
+				bx.WhAcc = whacc
+				lwhkm = bx.Whkm
+			} else {
+				bx.Effic = leffic
+				bx.Whkm = lwhkm
+			}
+		}
+
+		if bx.Alt > stats.Max_alt {
+			stats.Max_alt = bx.Alt
+			stats.Max_alt_time = us - st
+		}
+
+		if bx.Spd < 400 && bx.Spd > stats.Max_speed {
+			stats.Max_speed = bx.Spd
+			stats.Max_speed_time = us - st
+		}
+
+		if bx.Amps > stats.Max_current {
+			stats.Max_current = bx.Amps
+			stats.Max_current_time = us - st
+		}
+
+		if ch != nil {
+			ch <- bx
+		} else {
+			rec.Items = append(rec.Items, bx)
+			rec.Valid |= bx.Valid
+		}
+		dt = us
+		lt = us
+	}
+
+	srec := stats.Summary(lt - st)
+	ls := types.LogSegment{}
+	if u.ndrop > 0 || u.nbad > 0 {
+		ls.S = fmt.Sprintf("%d dropouts (%dms), %d corrupt", u.ndrop, u.dropms, u.nbad)
+	}
+	if ch != nil {
+		ch <- srec
+		return ls, true
+	} else {
+		ok := homes.Flags != 0 && len(rec.Items) > 0
+		if ok {
+			ls.L = rec
+			ls.H = homes
+			ls.M = srec
+			ls.E = evs.Events
+		}
+		return ls, ok
+	}
+}
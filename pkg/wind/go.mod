@@ -0,0 +1,3 @@
+module wind
+
+go 1.19
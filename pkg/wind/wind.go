@@ -0,0 +1,219 @@
+package wind
+
+import (
+	"fmt"
+	"math"
+)
+
+import (
+	"geo"
+	"types"
+)
+
+// Wind estimation, for logs without the FC's wind estimate, from the ground
+// velocity (Spd, Cog) as the course changes in turns and loiters. Over a
+// short window the airspeed and wind are assumed constant, so:
+//   - with the heading (Cse), the ground velocity is the wind plus the
+//     airspeed along the heading; the wind and airspeed are fitted by least
+//     squares
+//   - without it (or where it does not fit), the ground velocity vectors lie
+//     on a circle, centred on the wind with the airspeed as radius, which
+//     is fitted
+// The estimates are interpolated to fill LogItem.Wind; as INAV, the wind is
+// the air's velocity (cm/s, north, east, up (unknown, 0)).
+
+const (
+	window     = 60 * 1000000 // µs
+	step       = 10 * 1000000 // µs
+	min_speed  = 3.0          // m/s
+	min_points = 10
+	max_spread = 0.75 // mean resultant length of the courses (0 => all round)
+	max_rms    = 2.0  // m/s, fit residual
+	same_cse   = 0.9  // fraction of Cse == Cog for Cse not to be a heading
+)
+
+type sample struct {
+	t   uint64
+	vn  float64
+	ve  float64
+	hdg float64 // radians
+}
+
+type estimate struct {
+	t  uint64
+	wn float64
+	we float64
+}
+
+func normal_add(m *[3][3]float64, v *[3]float64, x [3]float64, y float64) {
+	for r := 0; r < 3; r++ {
+		for k := 0; k < 3; k++ {
+			m[r][k] += x[r] * x[k]
+		}
+		v[r] += x[r] * y
+	}
+}
+
+// Mean resultant length of the directions (1 => all the same)
+func spread(ss []sample, hdg bool) float64 {
+	var sn, se float64
+	for _, s := range ss {
+		a := math.Atan2(s.ve, s.vn)
+		if hdg {
+			a = s.hdg
+		}
+		sn += math.Cos(a)
+		se += math.Sin(a)
+	}
+	return math.Hypot(sn, se) / float64(len(ss))
+}
+
+// Fits the wind and airspeed with the heading
+func fit_heading(ss []sample) (float64, float64, float64, bool) {
+	var m [3][3]float64
+	var v [3]float64
+	for _, s := range ss {
+		normal_add(&m, &v, [3]float64{1, 0, math.Cos(s.hdg)}, s.vn)
+		normal_add(&m, &v, [3]float64{0, 1, math.Sin(s.hdg)}, s.ve)
+	}
+	x, ok := geo.Solve3(m, v)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	var rs float64
+	for _, s := range ss {
+		dn := s.vn - x[0] - x[2]*math.Cos(s.hdg)
+		de := s.ve - x[1] - x[2]*math.Sin(s.hdg)
+		rs += dn*dn + de*de
+	}
+	return x[0], x[1], x[2], math.Sqrt(rs/float64(len(ss))) < max_rms
+}
+
+// Fits the circle vn² + ve² = 2.wn.vn + 2.we.ve + c (c = Va² - |w|²)
+func fit_circle(ss []sample) (float64, float64, float64, bool) {
+	var m [3][3]float64
+	var v [3]float64
+	for _, s := range ss {
+		normal_add(&m, &v, [3]float64{2 * s.vn, 2 * s.ve, 1}, s.vn*s.vn+s.ve*s.ve)
+	}
+	x, ok := geo.Solve3(m, v)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	va2 := x[2] + x[0]*x[0] + x[1]*x[1]
+	if va2 <= 0 {
+		return 0, 0, 0, false
+	}
+	va := math.Sqrt(va2)
+	var rs float64
+	for _, s := range ss {
+		d := math.Hypot(s.vn-x[0], s.ve-x[1]) - va
+		rs += d * d
+	}
+	return x[0], x[1], va, math.Sqrt(rs/float64(len(ss))) < max_rms
+}
+
+func samples(rec types.LogRec) ([]sample, bool) {
+	var ss []sample
+	nhdg, nsame := 0, 0
+	for _, b := range rec.Items {
+		if !b.Logged(types.F_SPD|types.F_COG) || b.Spd < min_speed || b.Spd > 200 {
+			continue
+		}
+		c := float64(b.Cog) * math.Pi / 180
+		s := sample{t: b.Stamp, vn: b.Spd * math.Cos(c), ve: b.Spd * math.Sin(c), hdg: math.NaN()}
+		if b.Logged(types.F_CSE) && b.Cse != 0xffff {
+			s.hdg = float64(b.Cse%360) * math.Pi / 180
+			nhdg++
+			if d := (b.Cse%360 + 360 - b.Cog%360) % 360; d <= 1 || d >= 359 {
+				nsame++
+			}
+		}
+		ss = append(ss, s)
+	}
+	// a heading must be logged throughout, and not be a copy of the course
+	usehdg := len(ss) > 0 && nhdg == len(ss) && float64(nsame) < same_cse*float64(nhdg)
+	return ss, usehdg
+}
+
+// Estimate estimates the wind of a log without it (no CAP_WIND), filling
+// the items' Wind and setting CAP_WIND and F_WIND; false if there is no
+// estimate (e.g. the flight was too straight).
+func Estimate(rec *types.LogRec) bool {
+	if rec.Cap&types.CAP_WIND != 0 || len(rec.Items) == 0 {
+		return false
+	}
+	ss, usehdg := samples(*rec)
+	var ests []estimate
+	j0, j1 := 0, 0
+	for t := rec.Items[0].Stamp; len(ss) > 0 && t <= ss[len(ss)-1].t; t += step {
+		for j0 < len(ss) && ss[j0].t < t {
+			j0++
+		}
+		for j1 < len(ss) && ss[j1].t < t+window {
+			j1++
+		}
+		w := ss[j0:j1]
+		if len(w) < min_points {
+			continue
+		}
+		var wn, we, va float64
+		ok := false
+		if usehdg && spread(w, true) <= max_spread {
+			wn, we, va, ok = fit_heading(w)
+		}
+		// falling back to the course (a poor heading may not fit)
+		if !ok && spread(w, false) <= max_spread {
+			wn, we, va, ok = fit_circle(w)
+		}
+		if ok && va > min_speed && math.Hypot(wn, we) < va {
+			ests = append(ests, estimate{t + window/2, wn, we})
+		}
+	}
+	if len(ests) == 0 {
+		return false
+	}
+	k := 0
+	for j := range rec.Items {
+		b := &rec.Items[j]
+		for k < len(ests)-1 && ests[k+1].t <= b.Stamp {
+			k++
+		}
+		e := ests[k]
+		if k < len(ests)-1 && b.Stamp > e.t {
+			e1 := ests[k+1]
+			r := float64(b.Stamp-e.t) / float64(e1.t-e.t)
+			e.wn += r * (e1.wn - e.wn)
+			e.we += r * (e1.we - e.we)
+		}
+		b.Wind = [3]int16{int16(math.Round(e.wn * 100)), int16(math.Round(e.we * 100)), 0}
+		if b.Valid != 0 {
+			b.Valid |= types.F_WIND
+		}
+	}
+	rec.Cap |= types.CAP_WIND
+	if rec.Valid != 0 {
+		rec.Valid |= types.F_WIND
+	}
+	return true
+}
+
+// Direction the wind is from (degrees) and its speed (m/s)
+func FromDir(w [3]int16) (float64, float64) {
+	n := float64(w[0]) / 100
+	e := float64(w[1]) / 100
+	dir := math.Mod(math.Atan2(-e, -n)*180/math.Pi+360, 360)
+	return dir, math.Hypot(n, e)
+}
+
+// Summary returns the mean wind, as "speed from direction"
+func Summary(rec types.LogRec) string {
+	var n, e float64
+	for _, b := range rec.Items {
+		n += float64(b.Wind[0])
+		e += float64(b.Wind[1])
+	}
+	k := float64(len(rec.Items))
+	dir, spd := FromDir([3]int16{int16(n / k), int16(e / k), 0})
+	return fmt.Sprintf("%.1f m/s from %03.0f°", spd, dir)
+}